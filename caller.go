@@ -0,0 +1,55 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "golang.org/x/net/context"
+
+// Caller describes the process on whose behalf the kernel sent an op.
+type Caller struct {
+	// The caller's effective (file system) user and group IDs.
+	Uid uint32
+	Gid uint32
+
+	// The caller's process ID. On Linux this is the ID of the calling thread.
+	Pid uint32
+}
+
+// CallerFromContext returns the credentials of the caller for the op
+// associated with the supplied context, which must have been returned by
+// Connection.ReadOp (as are the contexts handed to fuseutil.FileSystem
+// methods). ok is false if the context isn't associated with an op.
+//
+// The credentials are zero for ops that the kernel issues on its own behalf,
+// e.g. writeback and forgets. They are only meaningful to file systems that
+// do their own permission checking; by default the kernel has already checked
+// them against the attributes of the inodes involved before sending the op.
+// See MountConfig.AllowOther.
+//
+// This must not be called after the op has been replied to.
+func CallerFromContext(ctx context.Context) (c Caller, ok bool) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return
+	}
+
+	h := state.inMsg.Header()
+	c = Caller{
+		Uid: h.Uid,
+		Gid: h.Gid,
+		Pid: h.Pid,
+	}
+
+	return
+}
@@ -21,8 +21,10 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -52,8 +54,13 @@ var contextKey interface{} = contextKeyType(0)
 //
 //  *  (http://goo.gl/JnhbdL) Don't read ahead at all if that field is zero.
 //
-// Reading a page at a time is a drag. Ask for a larger size.
-const maxReadahead = 1 << 20
+// Reading a page at a time is a drag. Ask for a larger size, unless
+// MountConfig.MaxReadahead says otherwise.
+const defaultMaxReadahead = 1 << 20
+
+// The smallest max_write that the kernel accepts; it raises anything smaller
+// to this.
+const minMaxWrite = 4096
 
 // Connection represents a connection to the fuse kernel process. It is used to
 // receive and reply to requests from the kernel.
@@ -67,6 +74,60 @@ type Connection struct {
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// The max_readahead and max_write sent to the kernel. Set by Init.
+	maxReadahead uint32
+	maxWrite     uint32
+
+	// The largest ReadFileOp the kernel will send. Set by Init.
+	maxReadSize int
+
+	// What the kernel offered in the init op. Set by Init.
+	kernelFeatures KernelFeatures
+
+	// What was agreed in the init exchange. Set by Init.
+	capabilities Capabilities
+
+	// Non-nil if MountConfig.DetectStaleHandles is set.
+	staleHandles *staleHandleDetector
+
+	// Non-nil if MountConfig.CheckLookupCounts is set.
+	lookupCounts *lookupCountChecker
+
+	// Non-nil if MountConfig.CheckDirCookies is set.
+	dirCookies *dirCookieChecker
+
+	// If MountConfig.MaxOpsInFlight is positive, a semaphore with that many
+	// slots, one of which is held from when ReadOp returns each op other than
+	// a forget until the op is replied to.
+	opSlots chan struct{}
+
+	// Ops that have been read and set up, waiting in order for a slot in
+	// opSlots before ReadOp returns them. Touched only by ReadOp.
+	waiting []waitingOp
+
+	// Non-nil if MountConfig.TraceRingSize is positive.
+	trace *opTraceRing
+
+	// Non-nil if MountConfig.CollectStats is set.
+	stats *opStatsCollector
+
+	// If MountConfig.ReadBufferDepth or MountConfig.MaxOpsInFlight is
+	// positive, messages read from the device by readLoop, to be consumed by
+	// ReadOp. Closed when readLoop returns. Otherwise nil, and ReadOp reads
+	// from the device itself.
+	rawMessages chan rawMessage
+
+	// The error with which ReadOp is to stop once it has returned the ops in
+	// waiting. Set only by ReadOp.
+	readErr error
+
+	// Closed by close, telling readLoop to stop waiting for ReadOp.
+	closed chan struct{}
+
+	// Why ReadOp stopped delivering ops, if not because of a clean unmount.
+	// Set only by ReadOp, and reported by close.
+	endErr *ErrConnectionClosed
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
@@ -80,12 +141,27 @@ type Connection struct {
 	outMessages freelist.Freelist // GUARDED_BY(mu)
 }
 
+// The result of a read from the device by readLoop.
+type rawMessage struct {
+	m   *buffer.InMessage
+	err error
+}
+
+// An op that has been read, waiting for room among MountConfig.MaxOpsInFlight.
+type waitingOp struct {
+	ctx context.Context
+	op  interface{}
+}
+
 // State that is maintained for each in-flight op. This is stuffed into the
 // context that the user uses to reply to the op.
 type opState struct {
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// When the op was read, if it is to be traced, counted, or observed.
+	start time.Time
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
@@ -103,6 +179,31 @@ func newConnection(
 		errorLogger: errorLogger,
 		dev:         dev,
 		cancelFuncs: make(map[uint64]func()),
+		closed:      make(chan struct{}),
+	}
+
+	if cfg.DetectStaleHandles {
+		c.staleHandles = newStaleHandleDetector()
+	}
+
+	if cfg.CheckLookupCounts {
+		c.lookupCounts = newLookupCountChecker()
+	}
+
+	if cfg.CheckDirCookies {
+		c.dirCookies = newDirCookieChecker()
+	}
+
+	if cfg.MaxOpsInFlight > 0 {
+		c.opSlots = make(chan struct{}, cfg.MaxOpsInFlight)
+	}
+
+	if cfg.TraceRingSize > 0 {
+		c.trace = newOpTraceRing(cfg.TraceRingSize)
+	}
+
+	if cfg.CollectStats {
+		c.stats = newOpStatsCollector()
 	}
 
 	// Initialize.
@@ -113,6 +214,14 @@ func newConnection(
 		return
 	}
 
+	// Read ahead from the device if asked to, or if there is a limit on ops in
+	// flight, so that ReadOp can carry on reading interrupts while waiting for
+	// room.
+	if cfg.ReadBufferDepth > 0 || c.opSlots != nil {
+		c.rawMessages = make(chan rawMessage, cfg.ReadBufferDepth)
+		go c.readLoop()
+	}
+
 	return
 }
 
@@ -133,22 +242,16 @@ func (c *Connection) Init() (err error) {
 	}
 
 	// Make sure the protocol version spoken by the kernel is new enough.
-	min := fusekernel.Protocol{
-		fusekernel.ProtoVersionMinMajor,
-		fusekernel.ProtoVersionMinMinor,
-	}
-
-	if initOp.Kernel.LT(min) {
+	if initOp.Kernel.LT(fusekernel.Protocol(MinProtocolVersion)) {
 		c.Reply(ctx, syscall.EPROTO)
 		err = fmt.Errorf("Version too old: %v", initOp.Kernel)
 		return
 	}
 
+	c.kernelFeatures = kernelFeatures(initOp)
+
 	// Downgrade our protocol if necessary.
-	c.protocol = fusekernel.Protocol{
-		fusekernel.ProtoVersionMaxMajor,
-		fusekernel.ProtoVersionMaxMinor,
-	}
+	c.protocol = fusekernel.Protocol(MaxProtocolVersion)
 
 	if initOp.Kernel.LT(c.protocol) {
 		c.protocol = initOp.Kernel
@@ -156,23 +259,205 @@ func (c *Connection) Init() (err error) {
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
-	initOp.MaxReadahead = maxReadahead
-	initOp.MaxWrite = buffer.MaxWriteSize
+	c.maxReadahead, c.maxWrite = ioSizes(&c.cfg, initOp.MaxReadahead)
+	initOp.MaxReadahead = c.maxReadahead
+	initOp.MaxWrite = c.maxWrite
+	c.maxReadSize = maxReadSize(&c.cfg)
 
-	initOp.Flags = 0
+	var wanted fusekernel.InitFlags
 
 	// Tell the kernel not to use pitifully small 4 KiB writes.
-	initOp.Flags |= fusekernel.InitBigWrites
+	wanted |= fusekernel.InitBigWrites
+
+	// Ask to be told when the connection is aborted, rather than seeing it as
+	// an unmount.
+	wanted |= fusekernel.InitAbortError
 
 	// Enable writeback caching if the user hasn't asked us not to.
 	if !c.cfg.DisableWritebackCaching {
-		initOp.Flags |= fusekernel.InitWritebackCache
+		wanted |= fusekernel.InitWritebackCache
 	}
 
+	// Ask for unmasked modes if the library or the file system is to apply the
+	// umask.
+	if c.cfg.ApplyUmask || c.cfg.DontMask {
+		wanted |= fusekernel.InitDontMask
+	}
+
+	// Take over clearing set-user-ID and set-group-ID bits, if asked to.
+	if c.cfg.HandleKillPrivileges {
+		wanted |= fusekernel.InitKillPrivV2
+	}
+
+	// Hand locking over to the file system, if asked to.
+	if c.cfg.HandleLocks {
+		wanted |= fusekernel.InitPosixLocks | fusekernel.InitFlockLocks
+	}
+
+	// Let the kernel decide when to read directories with attributes, if
+	// asked to.
+	if c.cfg.EnableReadDirPlus {
+		wanted |= fusekernel.InitDoReaddirplus | fusekernel.InitReaddirplusAuto
+	}
+
+	// Let the kernel send the pieces of a direct I/O request in parallel, if
+	// asked to.
+	if c.cfg.EnableAsyncDirectIO {
+		wanted |= fusekernel.InitAsyncDIO
+	}
+
+	// Don't ask for anything the kernel is too old to understand.
+	offered := initOp.Flags
+
+	var disabled fusekernel.InitFlags
+	initOp.Flags, disabled = gateInitFlags(initOp.Kernel, wanted)
+	if disabled != 0 && c.debugLogger != nil {
+		c.debugLog(
+			opFuseID(ctx),
+			1,
+			"Init: disabled %v; kernel protocol %v is too old",
+			disabled,
+			initOp.Kernel)
+	}
+
+	// Summarize the outcome, so that it's easy to tell why a feature isn't in
+	// effect.
+	if c.debugLogger != nil {
+		c.debugLog(opFuseID(ctx), 1, "Init: %s", describeInit(initOp, offered, wanted))
+	}
+
+	c.capabilities = capabilities(initOp.Flags & offered)
+
 	c.Reply(ctx, nil)
 	return
 }
 
+// Protocol returns the version of the kernel protocol in use, which is the
+// older of the versions spoken by the kernel and the library. It is valid
+// once Init has returned, as it has for a connection passed to
+// Server.ServeOps.
+func (c *Connection) Protocol() ProtocolVersion {
+	return ProtocolVersion(c.protocol)
+}
+
+// Capabilities returns the optional features agreed with the kernel by Init,
+// so that a server can adapt to what is in effect. It is valid once Init has
+// returned, as it has for a connection passed to Server.ServeOps.
+func (c *Connection) Capabilities() Capabilities {
+	return c.capabilities
+}
+
+// Describe the result of negotiating with the kernel on a single line, given
+// the init op as we're about to reply to it, the flags the kernel offered, and
+// those we wanted. A flag is in effect only if it is both offered and
+// requested.
+func describeInit(
+	op *initOp,
+	offered fusekernel.InitFlags,
+	wanted fusekernel.InitFlags) string {
+	// We never set max_background, so the kernel uses its default.
+	return fmt.Sprintf(
+		"protocol %v (kernel %v); flags offered %v, requested %v, granted %v; "+
+			"max_write %d, max_readahead %d, max_background 0 (kernel default)",
+		op.Library,
+		op.Kernel,
+		offered,
+		wanted,
+		op.Flags&offered,
+		op.MaxWrite,
+		op.MaxReadahead)
+}
+
+// Choose the max_readahead and max_write to reply to the init op with, given
+// the supplied config and the max_readahead that the kernel offered. The
+// kernel never reads ahead further than it offered, and we can't receive
+// writes larger than our buffers, so the config is clamped to both.
+func ioSizes(
+	cfg *MountConfig,
+	kernelReadahead uint32) (readahead uint32, write uint32) {
+	readahead = cfg.MaxReadahead
+	if readahead == 0 {
+		readahead = defaultMaxReadahead
+	}
+
+	// OS X doesn't tell us its limit.
+	if kernelReadahead != 0 && readahead > kernelReadahead {
+		readahead = kernelReadahead
+	}
+
+	write = cfg.MaxWrite
+	if write == 0 || write > buffer.MaxWriteSize {
+		write = buffer.MaxWriteSize
+	}
+
+	if write < minMaxWrite {
+		write = minMaxWrite
+	}
+
+	return
+}
+
+// Return the largest ReadFileOp that the kernel will send to a file system
+// mounted with the supplied config.
+//
+// Linux splits reads into requests of at most max_pages pages, which is 32
+// unless negotiated otherwise (we don't), and of at most the max_read mount
+// option if it is set (though never less than 4 KiB). OS X limits them to the
+// iosize given to the mount helper, which is the size of our buffers.
+func maxReadSize(cfg *MountConfig) (n int) {
+	n = buffer.MaxReadSize
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	if pages := 32 * os.Getpagesize(); pages < n {
+		n = pages
+	}
+
+	if v, err := strconv.Atoi(cfg.Options["max_read"]); err == nil {
+		if v < 4096 {
+			v = 4096
+		}
+
+		if v < n {
+			n = v
+		}
+	}
+
+	return
+}
+
+// Split the supplied init flags into those that a kernel speaking the given
+// protocol version understands, and those that it doesn't.
+//
+// Note that it is the kernel's version that matters here, not the version we
+// negotiate with it: the kernel honours flags regardless of the minor version
+// we reply with, which affects only the layout of messages.
+func gateInitFlags(
+	kernel fusekernel.Protocol,
+	wanted fusekernel.InitFlags) (granted, disabled fusekernel.InitFlags) {
+	for bit := fusekernel.InitFlags(1); bit != 0; bit <<= 1 {
+		if wanted&bit == 0 {
+			continue
+		}
+
+		if min, ok := bit.MinProtocol(); ok && kernel.LT(min) {
+			disabled |= bit
+			continue
+		}
+
+		granted |= bit
+	}
+
+	return
+}
+
+// Return the fuse "unique" request ID for the op associated with the supplied
+// context, which must have been returned by ReadOp.
+func opFuseID(ctx context.Context) uint64 {
+	return ctx.Value(contextKey).(opState).inMsg.Header().Unique
+}
+
 // Log information for an operation with the given ID. calldepth is the depth
 // to use when recovering file:line information with runtime.Caller.
 func (c *Connection) debugLog(
@@ -241,7 +526,7 @@ func (c *Connection) beginOp(
 	// should not record any state keyed on their ID.
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
-	if opCode != fusekernel.OpForget {
+	if !isForget(opCode) {
 		var cancel func()
 		ctx, cancel = context.WithCancel(ctx)
 		c.recordCancelFunc(fuseID, cancel)
@@ -250,6 +535,12 @@ func (c *Connection) beginOp(
 	return
 }
 
+// Return whether the supplied opcode is for a forget request, to which the
+// kernel expects no reply.
+func isForget(opCode uint32) bool {
+	return opCode == fusekernel.OpForget || opCode == fusekernel.OpBatchForget
+}
+
 // Clean up all state associated with an op to which the user has responded,
 // given its underlying fuse opcode and request ID. This must be called before
 // a response is sent to the kernel, to avoid a race where the request's ID
@@ -268,7 +559,7 @@ func (c *Connection) finishOp(
 	//
 	// Special case: we don't do this for Forget requests. See the note in
 	// beginOp above.
-	if opCode != fusekernel.OpForget {
+	if !isForget(opCode) {
 		cancel, ok := c.cancelFuncs[fuseID]
 		if !ok {
 			panic(fmt.Sprintf("Unknown request ID in finishOp: %v", fuseID))
@@ -321,6 +612,10 @@ func (c *Connection) readMessage() (m *buffer.InMessage, err error) {
 		//
 		//  *  ENODEV means fuse has hung up.
 		//
+		//  *  ECONNABORTED means the connection was aborted, e.g. through
+		//     /sys/fs/fuse/connections. The kernel returns ENODEV instead unless
+		//     we asked for InitAbortError, which requires Linux 4.17.
+		//
 		//  *  EINTR means we should try again. (This seems to happen often on
 		//     OS X, cf. http://golang.org/issue/11180)
 		//
@@ -329,6 +624,9 @@ func (c *Connection) readMessage() (m *buffer.InMessage, err error) {
 			case syscall.ENODEV:
 				err = io.EOF
 
+			case syscall.ECONNABORTED:
+				err = errConnectionAborted
+
 			case syscall.EINTR:
 				err = nil
 				continue
@@ -345,50 +643,234 @@ func (c *Connection) readMessage() (m *buffer.InMessage, err error) {
 	}
 }
 
-// Write the supplied message to the kernel.
-func (c *Connection) writeMessage(msg []byte) (err error) {
-	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
-	if err != nil {
+// Read messages from the device into c.rawMessages until an error occurs or
+// the connection is closed.
+func (c *Connection) readLoop() {
+	defer close(c.rawMessages)
+
+	for {
+		m, err := c.readMessage()
+
+		select {
+		case c.rawMessages <- rawMessage{m, err}:
+
+		case <-c.closed:
+			if m != nil {
+				c.putInMessage(m)
+			}
+
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Return the next message from the kernel, either directly from the device or
+// from readLoop.
+func (c *Connection) nextMessage() (m *buffer.InMessage, err error) {
+	if c.rawMessages == nil {
+		m, err = c.readMessage()
 		return
 	}
 
-	if n != len(msg) {
-		err = fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
+	raw, ok := <-c.rawMessages
+	if !ok {
+		err = io.EOF
 		return
 	}
 
+	m, err = raw.m, raw.err
+	return
+}
+
+// Write the supplied message to the kernel.
+func (c *Connection) writeMessage(msg []byte) (err error) {
+	// Avoid the retry loop in os.File.Write, which would try to write the rest
+	// of a short write.
+	err = writeDeviceMessage(int(c.dev.Fd()), msg, syscall.Write)
 	return
 }
 
+// Write the supplied message to the fuse device using the supplied write
+// function, which is syscall.Write other than in tests.
+//
+// The kernel parses each write to the device as a whole message, and either
+// consumes all of it or fails with nothing consumed. So a write interrupted
+// by a signal is simply retried. A short write would mean that the kernel had
+// taken part of a message, and writing the rest would only be parsed as a
+// malformed message of its own, so it is reported as an error instead.
+func writeDeviceMessage(
+	fd int,
+	msg []byte,
+	write func(int, []byte) (int, error)) (err error) {
+	for {
+		var n int
+		n, err = write(fd, msg)
+
+		switch {
+		case err == syscall.EINTR:
+			continue
+
+		case err != nil:
+
+		case n != len(msg):
+			err = fmt.Errorf("Short write to device: wrote %d of %d bytes", n, len(msg))
+		}
+
+		return
+	}
+}
+
 // ReadOp consumes the next op from the kernel process, returning the op and a
 // context that should be used for work related to the op. It returns io.EOF if
-// the kernel has closed the connection.
+// the kernel has closed the connection, including when the connection was
+// aborted. Any other error means that the connection is unusable. In either
+// case the reason is reported by MountedFileSystem.Join.
 //
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
 //
+// The context is cancelled if the kernel interrupts the op (FUSE_INTERRUPT),
+// which it does when the process waiting on it receives a signal. A file
+// system doing slow work can watch ctx.Done() and return ctx.Err(), which the
+// kernel receives as EINTR. Either way the op must still be replied to.
+// Replying after an interrupt, whether with an error or with a result that was
+// ready anyway, is harmless: a kernel that has given up on the op discards the
+// reply.
+//
 // This function delivers ops in exactly the order they are received from
-// /dev/fuse. It must not be called multiple times concurrently.
+// /dev/fuse, except that forgets overtake ops waiting for room among
+// MountConfig.MaxOpsInFlight. It must not be called multiple times
+// concurrently.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) ReadOp() (ctx context.Context, op interface{}, err error) {
-	// Keep going until we find a request we know how to convert.
+	// Keep going until we find an op for the user.
 	for {
-		// Read the next message from the kernel.
-		var inMsg *buffer.InMessage
-		inMsg, err = c.readMessage()
+		ctx, op, err = c.nextOp()
 		if err != nil {
 			return
 		}
 
+		// Special case: if asked to, refuse reads and writes on stale handles
+		// rather than letting them reach the file system.
+		if problem := c.checkStaleHandle(op); problem != "" {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf("%T: stale handle: %s", op, problem)
+			}
+
+			c.Reply(ctx, syscall.ESTALE)
+			continue
+		}
+
+		// Special case: if asked to, refuse directory reads at offsets that the
+		// file system never issued.
+		if problem := c.checkDirCookie(op); problem != "" {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf("%T: invalid cookie: %s", op, problem)
+			}
+
+			c.Reply(ctx, syscall.EINVAL)
+			continue
+		}
+
+		// Special case: zero-length reads and writes are no-ops, so there's no
+		// need to bother the file system with them.
+		if isEmptyIO(op) {
+			c.Reply(ctx, nil)
+			continue
+		}
+
+		// Special case: refuse to let files grow beyond the configured maximum
+		// size.
+		if err := c.checkFileSize(op); err != nil {
+			c.Reply(ctx, err)
+			continue
+		}
+
+		// Special case: acknowledge destroy requests ourselves. Nothing follows
+		// but EOF, at which point the server cleans up.
+		if _, ok := op.(*destroyOp); ok {
+			c.Reply(ctx, nil)
+			continue
+		}
+
+		// Return the op to the user.
+		return
+	}
+}
+
+// Read the next op from the kernel and set it up, handling interrupts along
+// the way, then take a slot in c.opSlots for it if there is a limit on ops in
+// flight. Forgets, which are never replied to, don't need a slot.
+//
+// Ops that find no room wait in c.waiting. Meanwhile messages continue to be
+// read, so that an interrupt for an op that is holding a slot is seen even if
+// every slot is held.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) nextOp() (ctx context.Context, op interface{}, err error) {
+	for {
+		// Hand over the op that has waited longest as soon as there is room,
+		// reading more messages in the meantime if we can.
+		var inMsg *buffer.InMessage
+		if len(c.waiting) > 0 {
+			var rawMessages chan rawMessage
+			if c.readErr == nil {
+				rawMessages = c.rawMessages
+			}
+
+			select {
+			case c.opSlots <- struct{}{}:
+				ctx, op = c.waiting[0].ctx, c.waiting[0].op
+				c.waiting = c.waiting[1:]
+				return
+
+			case raw, ok := <-rawMessages:
+				inMsg, err = raw.m, raw.err
+				if !ok {
+					err = io.EOF
+				}
+			}
+		} else {
+			if c.readErr != nil {
+				err = c.readErr
+				return
+			}
+
+			inMsg, err = c.nextMessage()
+		}
+
+		switch err {
+		case nil:
+
+		case io.EOF:
+
+		case errConnectionAborted:
+			c.endErr = &ErrConnectionClosed{Reason: ConnectionAborted}
+			err = io.EOF
+
+		default:
+			c.endErr = &ErrConnectionClosed{Reason: ConnectionDeviceError, Err: err}
+		}
+
+		if err != nil {
+			c.readErr = err
+			continue
+		}
+
 		// Convert the message to an op.
 		outMsg := c.getOutMessage()
-		op, err = convertInMessage(inMsg, outMsg, c.protocol)
+		op, err = convertInMessage(inMsg, outMsg, c.protocol, c.maskMode)
 		if err != nil {
 			c.putOutMessage(outMsg)
 			err = fmt.Errorf("convertInMessage: %v", err)
-			return
+			c.endErr = &ErrConnectionClosed{Reason: ConnectionDeviceError, Err: err}
+			c.readErr = err
+			continue
 		}
 
 		// Choose an ID for this operation for the purposes of logging, and log it.
@@ -396,19 +878,181 @@ func (c *Connection) ReadOp() (ctx context.Context, op interface{}, err error) {
 			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
 		}
 
-		// Special case: handle interrupt requests inline.
+		// Special case: handle interrupt requests inline. They are never
+		// replied to, so don't occupy a slot.
 		if interruptOp, ok := op.(*interruptOp); ok {
 			c.handleInterrupt(interruptOp.FuseID)
 			continue
 		}
 
+		// Check that forgets balance lookups, if asked to.
+		if c.lookupCounts != nil {
+			if problem := c.lookupCounts.observeRequest(op); problem != "" {
+				panic(fmt.Sprintf("CheckLookupCounts: %s", problem))
+			}
+		}
+
 		// Set up a context that remembers information about this op.
 		ctx = c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		state := opState{inMsg: inMsg, outMsg: outMsg, op: op}
+		if c.trace != nil || c.stats != nil || c.cfg.OpObserver != nil {
+			state.start = time.Now()
+		}
 
-		// Return the op to the user.
+		if c.stats != nil {
+			c.stats.begin()
+		}
+
+		ctx = context.WithValue(ctx, contextKey, state)
+
+		// Take a slot if there is a limit, queueing behind any ops already
+		// waiting for one.
+		if c.opSlots == nil || isForget(inMsg.Header().Opcode) {
+			return
+		}
+
+		if len(c.waiting) == 0 {
+			select {
+			case c.opSlots <- struct{}{}:
+				return
+
+			default:
+			}
+		}
+
+		c.waiting = append(c.waiting, waitingOp{ctx, op})
+	}
+}
+
+// Release a slot taken by nextOp.
+func (c *Connection) releaseOpSlot() {
+	if c.opSlots != nil {
+		<-c.opSlots
+	}
+}
+
+// Is the supplied op a read or write of zero bytes?
+func isEmptyIO(op interface{}) bool {
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		return len(typed.Dst) == 0
+
+	case *fuseops.WriteFileOp:
+		return len(typed.Data) == 0
+	}
+
+	return false
+}
+
+// If MountConfig.MaxFileSize is set, return EFBIG for ops that would take a
+// file beyond it. Writes that straddle the limit are shortened in place.
+func (c *Connection) checkFileSize(op interface{}) (err error) {
+	max := c.cfg.MaxFileSize
+	if max == 0 {
+		return
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.WriteFileOp:
+		if typed.Offset < 0 || uint64(typed.Offset) >= max {
+			err = syscall.EFBIG
+			return
+		}
+
+		if room := max - uint64(typed.Offset); uint64(len(typed.Data)) > room {
+			typed.Data = typed.Data[:room]
+		}
+
+	case *fuseops.SetInodeAttributesOp:
+		if typed.Size != nil && *typed.Size > max {
+			err = syscall.EFBIG
+			return
+		}
+
+	case *fuseops.FallocateOp:
+		if typed.Mode&fuseops.FallocKeepSize == 0 && typed.Offset+typed.Length > max {
+			err = syscall.EFBIG
+			return
+		}
+
+	case *fuseops.CopyFileRangeOp:
+		if typed.DstOffset >= max {
+			err = syscall.EFBIG
+			return
+		}
+
+		if room := max - typed.DstOffset; typed.Length > room {
+			typed.Length = room
+		}
+	}
+
+	return
+}
+
+// If stale handle detection is enabled and the supplied op is a read or write
+// on a handle whose inode has since been reallocated, return a description of
+// the problem.
+func (c *Connection) checkStaleHandle(op interface{}) (problem string) {
+	if c.staleHandles == nil {
+		return
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		problem = c.staleHandles.check(typed.Inode, typed.Handle)
+
+	case *fuseops.WriteFileOp:
+		problem = c.staleHandles.check(typed.Inode, typed.Handle)
+	}
+
+	return
+}
+
+// If directory cookie checking is enabled and the supplied op is a directory
+// read at an offset that the file system never issued on its handle, return a
+// description of the problem.
+func (c *Connection) checkDirCookie(op interface{}) (problem string) {
+	if c.dirCookies == nil {
 		return
 	}
+
+	switch typed := op.(type) {
+	case *fuseops.ReadDirOp:
+		problem = c.dirCookies.check(typed.Handle, typed.Offset)
+
+	case *fuseops.ReadDirPlusOp:
+		problem = c.dirCookies.check(typed.Handle, typed.Offset)
+	}
+
+	return
+}
+
+// Apply the configured umask to the mode for a create-style op, given the
+// umask that the kernel reported for the caller (zero if the protocol doesn't
+// carry one). Also return the umask that the file system should apply itself,
+// which is non-zero only with DontMask. See MountConfig.ApplyUmask and
+// MountConfig.DontMask.
+func (c *Connection) maskMode(
+	mode os.FileMode,
+	callerUmask os.FileMode) (masked os.FileMode, fsUmask os.FileMode) {
+	switch {
+	case c.cfg.DontMask:
+		masked = mode
+		fsUmask = callerUmask & os.ModePerm
+
+	case c.cfg.ApplyUmask:
+		umask := callerUmask
+		if c.cfg.Umask != nil {
+			umask = *c.cfg.Umask
+		}
+
+		masked = mode &^ (umask & os.ModePerm)
+
+	default:
+		masked = mode
+	}
+
+	return
 }
 
 // Skip errors that happen as a matter of course, since they spook users.
@@ -443,14 +1087,76 @@ func (c *Connection) shouldLogError(
 		if err == syscall.ENOSYS {
 			return false
 		}
+
+	case *fuseops.FallocateOp:
+		// Likewise for optional methods that the file system doesn't support.
+		if err == syscall.ENOSYS {
+			return false
+		}
+
+	case *fuseops.IoctlOp:
+		if err == syscall.ENOSYS {
+			return false
+		}
+
+	case *fuseops.PollOp:
+		if err == syscall.ENOSYS {
+			return false
+		}
+
+	case *fuseops.ReleaseFileHandleOp:
+		// The kernel ignores the result, and has forgotten the handle either
+		// way. File systems return EBADF for handles they don't know (see
+		// fuseutil.HandleMap.Release); that indicates a bug in their
+		// accounting, but one that the debug log is enough to track down.
+		if err == syscall.EBADF {
+			return false
+		}
+
+	case *fuseops.ReleaseDirHandleOp:
+		if err == syscall.EBADF {
+			return false
+		}
+
+	case *fuseops.CopyFileRangeOp:
+		if err == syscall.ENOSYS {
+			return false
+		}
 	}
 
 	return true
 }
 
+// Return the errno that the kernel should receive for the supplied non-nil
+// error returned by the file system.
+func (c *Connection) errno(err error) syscall.Errno {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+
+	// Short of MountConfig.OpContext being cancelled, an op's context is
+	// cancelled only when the kernel interrupts it, so a file system returning
+	// the context's error has given up because of the interrupt.
+	if err == context.Canceled {
+		return syscall.EINTR
+	}
+
+	if c.cfg.DefaultErrno != 0 {
+		return c.cfg.DefaultErrno
+	}
+
+	return syscall.EIO
+}
+
 // Reply replies to an op previously read using ReadOp, with the supplied error
 // (or nil if successful). The context must be the context returned by ReadOp.
 //
+// The kernel protocol has no room for anything but the errno in an error
+// reply, so the op's outputs, including any attributes, are dropped and the
+// kernel keeps what it had cached. An op that changed the inode before
+// failing should either report the part that succeeded instead of the error
+// (see fuseops.WriteFileOp.Data) or, having replied, call InvalidateInode.
+//
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) Reply(ctx context.Context, opErr error) {
 	// Extract the state we stuffed in earlier.
@@ -466,13 +1172,47 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 	outMsg := state.outMsg
 	fuseID := inMsg.Header().Unique
 
-	// Make sure we destroy the messages when we're done.
+	// Make sure we destroy the messages when we're done, and make room for
+	// another op to be handed over.
+	if !isForget(inMsg.Header().Opcode) {
+		defer c.releaseOpSlot()
+	}
+
 	defer c.putInMessage(inMsg)
 	defer c.putOutMessage(outMsg)
 
 	// Clean up state for this op.
 	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
 
+	// Keep track of generations and handles, if asked to.
+	if c.staleHandles != nil && opErr == nil {
+		problem := c.staleHandles.observeReply(op)
+		if problem != "" && c.errorLogger != nil {
+			c.errorLogger.Printf("%T: %s", op, problem)
+		}
+	}
+
+	// Keep track of the directory cookies issued, if asked to.
+	if c.dirCookies != nil {
+		problem := c.dirCookies.observeReply(op, opErr)
+		if problem != "" && c.errorLogger != nil {
+			c.errorLogger.Printf("%T: %s", op, problem)
+		}
+	}
+
+	// Count the lookups the kernel will hold, if asked to.
+	if c.lookupCounts != nil && opErr == nil {
+		c.lookupCounts.observeReply(op)
+	}
+
+	// Reads at or past EOF are indicated to the kernel with a short read, not
+	// an error. File systems that pass through the result of an io.ReaderAt
+	// commonly return io.EOF along with the bytes that were available, which
+	// would otherwise become EIO and cause e.g. cat(1) to fail.
+	if _, ok := op.(*fuseops.ReadFileOp); ok && opErr == io.EOF {
+		opErr = nil
+	}
+
 	// Debug logging
 	if c.debugLogger != nil {
 		if opErr == nil {
@@ -482,9 +1222,19 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 		}
 	}
 
-	// Error logging
+	// Error logging. Include the type of errors that aren't errnos, which
+	// otherwise reach the kernel as a mysterious DefaultErrno.
 	if c.shouldLogError(op, opErr) {
-		c.errorLogger.Printf("%T error: %v", op, opErr)
+		if _, ok := opErr.(syscall.Errno); ok {
+			c.errorLogger.Printf("%T error: %v", op, opErr)
+		} else {
+			c.errorLogger.Printf(
+				"%T error: %v (%T, replying with errno %d)",
+				op,
+				opErr,
+				opErr,
+				c.errno(opErr))
+		}
 	}
 
 	// Send the reply to the kernel, if one is required.
@@ -492,18 +1242,61 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 
 	if !noResponse {
 		err := c.writeMessage(outMsg.Bytes())
-		if err != nil && c.errorLogger != nil {
-			c.errorLogger.Printf("writeMessage: %v %v", err, outMsg.Bytes())
+
+		switch {
+		case err == syscall.ENOENT:
+			// The kernel is no longer waiting for the reply, e.g. because the
+			// process that was waiting for it was killed.
+			if c.debugLogger != nil {
+				c.debugLog(fuseID, 1, "Reply discarded by the kernel")
+			}
+
+		case err != nil && c.errorLogger != nil:
+			c.errorLogger.Printf("%T: writing reply: %v %v", op, err, outMsg.Bytes())
 		}
 	}
+
+	// Tell the user about the error, if they've asked.
+	if c.cfg.OnOpError != nil && opErr != nil && !isSizeProbeResult(op, opErr) {
+		c.cfg.OnOpError(newOpErrorInfo(op, inMsg.Header(), opErr, c.errno(opErr)))
+	}
+
+	// Tell the user how the op went, if they've asked.
+	if c.cfg.OpObserver != nil {
+		c.cfg.OpObserver(opTypeName(op), time.Since(state.start), opErr)
+	}
+
+	// Remember the op, if asked to.
+	if c.trace != nil {
+		inode, _ := opTarget(op)
+		c.trace.add(OpRecord{
+			Op:       opTypeName(op),
+			Inode:    inode,
+			Start:    state.start,
+			Duration: time.Since(state.start),
+			Err:      opErr,
+		})
+	}
+
+	// Count the op, if asked to.
+	if c.stats != nil {
+		c.stats.end(op, time.Since(state.start), opErr)
+	}
 }
 
 // Close the connection. Must not be called until operations that were read
-// from the connection have been responded to.
+// from the connection have been responded to. Returns an *ErrConnectionClosed
+// if ReadOp stopped for some reason other than a clean unmount.
 func (c *Connection) close() (err error) {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
 	// user to respond to all ops first.
+	close(c.closed)
 	err = c.dev.Close()
+
+	if c.endErr != nil {
+		err = c.endErr
+	}
+
 	return
 }
@@ -0,0 +1,467 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/buffer"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+func TestGateInitFlags(t *testing.T) {
+	const wanted = fusekernel.InitBigWrites |
+		fusekernel.InitWritebackCache |
+		fusekernel.InitCaseSensitive
+
+	testCases := []struct {
+		kernel   fusekernel.Protocol
+		granted  fusekernel.InitFlags
+		disabled fusekernel.InitFlags
+	}{
+		// An old kernel, which understands big writes but not writeback caching.
+		{
+			kernel:   fusekernel.Protocol{Major: 7, Minor: 12},
+			granted:  fusekernel.InitBigWrites | fusekernel.InitCaseSensitive,
+			disabled: fusekernel.InitWritebackCache,
+		},
+
+		// A kernel that understands neither.
+		{
+			kernel:   fusekernel.Protocol{Major: 7, Minor: 8},
+			granted:  fusekernel.InitCaseSensitive,
+			disabled: fusekernel.InitBigWrites | fusekernel.InitWritebackCache,
+		},
+
+		// The first kernel with writeback caching, and one newer than that.
+		{
+			kernel:  fusekernel.Protocol{Major: 7, Minor: 23},
+			granted: wanted,
+		},
+
+		{
+			kernel:  fusekernel.Protocol{Major: 7, Minor: 31},
+			granted: wanted,
+		},
+	}
+
+	for _, tc := range testCases {
+		granted, disabled := gateInitFlags(tc.kernel, wanted)
+		if granted != tc.granted || disabled != tc.disabled {
+			t.Errorf(
+				"Kernel %v: got (%v, %v), want (%v, %v)",
+				tc.kernel,
+				granted,
+				disabled,
+				tc.granted,
+				tc.disabled)
+		}
+	}
+}
+
+func TestIOSizes(t *testing.T) {
+	const kernelReadahead = 128 << 10
+
+	testCases := []struct {
+		cfg       MountConfig
+		readahead uint32
+		write     uint32
+	}{
+		// Defaults, with readahead limited by the kernel.
+		{
+			cfg:       MountConfig{},
+			readahead: kernelReadahead,
+			write:     buffer.MaxWriteSize,
+		},
+
+		// Within the limits.
+		{
+			cfg:       MountConfig{MaxReadahead: 16 << 10, MaxWrite: 8 << 10},
+			readahead: 16 << 10,
+			write:     8 << 10,
+		},
+
+		// Beyond them.
+		{
+			cfg:       MountConfig{MaxReadahead: 4 << 20, MaxWrite: 4 << 20},
+			readahead: kernelReadahead,
+			write:     buffer.MaxWriteSize,
+		},
+
+		// Below the smallest max_write the kernel accepts.
+		{
+			cfg:       MountConfig{MaxWrite: 1},
+			readahead: kernelReadahead,
+			write:     4096,
+		},
+	}
+
+	for i, tc := range testCases {
+		readahead, write := ioSizes(&tc.cfg, kernelReadahead)
+		if readahead != tc.readahead || write != tc.write {
+			t.Errorf(
+				"Test case %d: got (%d, %d), want (%d, %d)",
+				i,
+				readahead,
+				write,
+				tc.readahead,
+				tc.write)
+		}
+	}
+}
+
+func TestMaskMode(t *testing.T) {
+	fixed := os.FileMode(0027)
+
+	testCases := []struct {
+		cfg         MountConfig
+		mode        os.FileMode
+		callerUmask os.FileMode
+		expected    os.FileMode
+	}{
+		// Not enabled; the kernel has already dealt with it.
+		{MountConfig{}, 0666, 0022, 0666},
+		{MountConfig{Umask: &fixed}, 0666, 0022, 0666},
+
+		// The caller's umask.
+		{MountConfig{ApplyUmask: true}, 0666, 0022, 0644},
+		{MountConfig{ApplyUmask: true}, os.ModeDir | 0777, 0077, os.ModeDir | 0700},
+
+		// A fixed umask.
+		{MountConfig{ApplyUmask: true, Umask: &fixed}, 0666, 0, 0640},
+		{MountConfig{ApplyUmask: true, Umask: &fixed}, 0666, 0077, 0640},
+		{MountConfig{ApplyUmask: true, Umask: &fixed}, os.ModeDir | 0777, 0, os.ModeDir | 0750},
+	}
+
+	for i, tc := range testCases {
+		c := &Connection{cfg: tc.cfg}
+		got, fsUmask := c.maskMode(tc.mode, tc.callerUmask)
+		if got != tc.expected {
+			t.Errorf("Test case %d: got %v, want %v", i, got, tc.expected)
+		}
+
+		if fsUmask != 0 {
+			t.Errorf("Test case %d: got file system umask %v", i, fsUmask)
+		}
+	}
+
+	// With DontMask, the mode is passed through along with the caller's umask.
+	c := &Connection{cfg: MountConfig{DontMask: true}}
+	got, fsUmask := c.maskMode(os.ModeDir|0777, 0022)
+	if got != os.ModeDir|0777 || fsUmask != 0022 {
+		t.Errorf("DontMask: got %v and umask %v", got, fsUmask)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background()},
+		cancelFuncs: make(map[uint64]func()),
+	}
+
+	ctx := c.beginOp(uint32(fusekernel.OpRead), 17)
+
+	// An interrupt for another request has no effect.
+	c.handleInterrupt(19)
+	select {
+	case <-ctx.Done():
+		t.Fatalf("Context cancelled by interrupt for another request")
+	default:
+	}
+
+	// An interrupt for this one cancels its context, and a file system
+	// returning the context's error gives the kernel EINTR.
+	c.handleInterrupt(17)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatalf("Context not cancelled by interrupt")
+	}
+
+	if errno := c.errno(ctx.Err()); errno != syscall.EINTR {
+		t.Errorf("Got errno %v, want EINTR", errno)
+	}
+
+	// An interrupt arriving after the reply is ignored.
+	c.finishOp(uint32(fusekernel.OpRead), 17)
+	c.handleInterrupt(17)
+
+	if len(c.cancelFuncs) != 0 {
+		t.Errorf("Cancel funcs remain: %v", c.cancelFuncs)
+	}
+}
+
+// Send a request with the supplied fixed-size arguments to the connection
+// from the kernel's side of a socket pair.
+func sendRequest(
+	t *testing.T,
+	kernelSide *os.File,
+	opcode uint32,
+	unique uint64,
+	in []byte) {
+	var header fusekernel.InHeader
+	const headerSize = unsafe.Sizeof(header)
+
+	header.Len = uint32(headerSize) + uint32(len(in))
+	header.Opcode = opcode
+	header.Unique = unique
+	header.Nodeid = 1
+
+	msg := append((*[headerSize]byte)(unsafe.Pointer(&header))[:], in...)
+	if _, err := kernelSide.Write(msg); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// Read the header of the next reply on the kernel's side of a socket pair.
+func readReply(t *testing.T, kernelSide *os.File) (out fusekernel.OutHeader) {
+	buf := make([]byte, 4096)
+	if _, err := kernelSide.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	out = *(*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	return
+}
+
+func TestMaxOpsInFlight_Interrupt(t *testing.T) {
+	const limit = 2
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernelSide := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernelSide.Close()
+
+	// Mount.
+	initIn := fusekernel.InitIn{Major: 7, Minor: 12}
+	sendRequest(
+		t,
+		kernelSide,
+		fusekernel.OpInit,
+		1,
+		(*[unsafe.Sizeof(initIn)]byte)(unsafe.Pointer(&initIn))[:])
+
+	cfg := MountConfig{
+		OpContext:      context.Background(),
+		MaxOpsInFlight: limit,
+	}
+
+	c, err := newConnection(cfg, nil, nil, dev)
+	if err != nil {
+		t.Fatalf("newConnection: %v", err)
+	}
+
+	defer c.close()
+
+	if out := readReply(t, kernelSide); out.Error != 0 {
+		t.Fatalf("Init: error %d", out.Error)
+	}
+
+	// Serve ops that block until interrupted, passing on those read.
+	ops := make(chan interface{}, 10)
+	served := make(chan error, 1)
+	go func() {
+		for {
+			ctx, op, err := c.ReadOp()
+			if err != nil {
+				served <- err
+				return
+			}
+
+			ops <- op
+			go func() {
+				<-ctx.Done()
+				c.Reply(ctx, ctx.Err())
+			}()
+		}
+	}()
+
+	nextOp := func() (op interface{}) {
+		select {
+		case op = <-ops:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for an op")
+		}
+
+		return
+	}
+
+	// Fill every slot, then send one more op, which has to wait.
+	for unique := uint64(2); unique < 2+limit+1; unique++ {
+		sendRequest(t, kernelSide, fusekernel.OpStatfs, unique, nil)
+	}
+
+	for i := 0; i < limit; i++ {
+		if op, ok := nextOp().(*fuseops.StatFSOp); !ok {
+			t.Fatalf("Unexpected op: %#v", op)
+		}
+	}
+
+	// A forget is handed over regardless.
+	forget := fusekernel.ForgetIn{Nlookup: 1}
+	sendRequest(
+		t,
+		kernelSide,
+		fusekernel.OpForget,
+		10,
+		(*[unsafe.Sizeof(forget)]byte)(unsafe.Pointer(&forget))[:])
+
+	if op, ok := nextOp().(*fuseops.ForgetInodeOp); !ok {
+		t.Fatalf("Unexpected op: %#v", op)
+	}
+
+	// Interrupting the ops holding the slots cancels them, making room for the
+	// one that was waiting, which can in turn be interrupted.
+	for unique := uint64(2); unique < 2+limit+1; unique++ {
+		interrupt := fusekernel.InterruptIn{Unique: unique}
+		sendRequest(
+			t,
+			kernelSide,
+			fusekernel.OpInterrupt,
+			20+unique,
+			(*[unsafe.Sizeof(interrupt)]byte)(unsafe.Pointer(&interrupt))[:])
+
+		out := readReply(t, kernelSide)
+		if out.Unique != unique || out.Error != -int32(syscall.EINTR) {
+			t.Fatalf("Reply for %d: got %+v", unique, out)
+		}
+	}
+
+	if op, ok := nextOp().(*fuseops.StatFSOp); !ok {
+		t.Fatalf("Unexpected op: %#v", op)
+	}
+
+	// Unmount.
+	kernelSide.Close()
+	if err := <-served; err != io.EOF {
+		t.Errorf("ReadOp: %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	flags := fusekernel.InitBigWrites |
+		fusekernel.InitWritebackCache |
+		fusekernel.InitFlockLocks
+
+	c := capabilities(flags)
+
+	want := Capabilities{
+		Flags:          uint64(flags),
+		BigWrites:      true,
+		WritebackCache: true,
+		FlockLocks:     true,
+	}
+
+	if c != want {
+		t.Errorf("Got %+v, want %+v", c, want)
+	}
+
+	if c := capabilities(0); c != (Capabilities{}) {
+		t.Errorf("No flags: got %+v", c)
+	}
+}
+
+// A stand-in for the fuse device that fails writes in the ways scripted, then
+// accepts them whole.
+type fakeDevice struct {
+	// The results of the first writes. A nil error with a count means a short
+	// write.
+	script []fakeWrite
+
+	// The messages accepted whole.
+	accepted [][]byte
+	calls    int
+}
+
+type fakeWrite struct {
+	n   int
+	err error
+}
+
+func (d *fakeDevice) write(fd int, p []byte) (n int, err error) {
+	d.calls++
+	if len(d.script) > 0 {
+		w := d.script[0]
+		d.script = d.script[1:]
+		return w.n, w.err
+	}
+
+	d.accepted = append(d.accepted, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestWriteDeviceMessage(t *testing.T) {
+	msg := []byte("taco burrito enchilada")
+
+	// Interrupted writes are retried until the message is delivered whole.
+	d := &fakeDevice{
+		script: []fakeWrite{
+			{0, syscall.EINTR},
+			{0, syscall.EINTR},
+		},
+	}
+
+	if err := writeDeviceMessage(17, msg, d.write); err != nil {
+		t.Errorf("Interrupted writes: %v", err)
+	}
+
+	if d.calls != 3 || len(d.accepted) != 1 || string(d.accepted[0]) != string(msg) {
+		t.Errorf("Interrupted writes: %d calls, accepted %q", d.calls, d.accepted)
+	}
+
+	// A short write isn't continued, which the kernel would misparse.
+	d = &fakeDevice{
+		script: []fakeWrite{
+			{5, nil},
+		},
+	}
+
+	err := writeDeviceMessage(17, msg, d.write)
+	if err == nil || !strings.Contains(err.Error(), "wrote 5 of 22 bytes") {
+		t.Errorf("Short write: got %v", err)
+	}
+
+	if d.calls != 1 {
+		t.Errorf("Short write: %d calls", d.calls)
+	}
+
+	// Other errors are returned as they are.
+	d = &fakeDevice{
+		script: []fakeWrite{
+			{0, syscall.ENOENT},
+		},
+	}
+
+	if err := writeDeviceMessage(17, msg, d.write); err != syscall.ENOENT {
+		t.Errorf("Rejected write: got %v", err)
+	}
+
+	if d.calls != 1 {
+		t.Errorf("Rejected write: %d calls", d.calls)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"reflect"
 	"syscall"
@@ -40,7 +41,9 @@ import (
 func convertInMessage(
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
-	protocol fusekernel.Protocol) (o interface{}, err error) {
+	protocol fusekernel.Protocol,
+	maskMode func(mode, callerUmask os.FileMode) (os.FileMode, os.FileMode)) (
+	o interface{}, err error) {
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -56,9 +59,18 @@ func convertInMessage(
 		}
 
 	case fusekernel.OpGetattr:
-		o = &fuseops.GetInodeAttributesOp{
+		to := &fuseops.GetInodeAttributesOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 		}
+		o = to
+
+		// Kernels older than protocol 7.9 send no input.
+		type input fusekernel.GetattrIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in != nil && fusekernel.GetattrFlags(in.GetattrFlags)&fusekernel.GetattrFh != 0 {
+			handle := fuseops.HandleID(in.Fh)
+			to.Handle = &handle
+		}
 
 	case fusekernel.OpSetattr:
 		type input fusekernel.SetattrIn
@@ -93,6 +105,8 @@ func convertInMessage(
 			to.Mtime = &t
 		}
 
+		to.KillPrivileges = valid&fusekernel.SetattrKillSuidgid != 0
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -106,6 +120,35 @@ func convertInMessage(
 			N:     in.Nlookup,
 		}
 
+	case fusekernel.OpBatchForget:
+		type input fusekernel.BatchForgetIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpBatchForget")
+			return
+		}
+
+		type entry fusekernel.ForgetOne
+		entrySize := unsafe.Sizeof(entry{})
+		if uintptr(in.Count)*entrySize > uintptr(inMsg.Len()) {
+			err = errors.New("Corrupt OpBatchForget")
+			return
+		}
+
+		op := &fuseops.BatchForgetOp{
+			Entries: make([]fuseops.BatchForgetEntry, in.Count),
+		}
+
+		for i := range op.Entries {
+			e := (*entry)(inMsg.Consume(entrySize))
+			op.Entries[i] = fuseops.BatchForgetEntry{
+				Inode: fuseops.InodeID(e.Nodeid),
+				N:     e.Nlookup,
+			}
+		}
+
+		o = op
+
 	case fusekernel.OpMkdir:
 		in := (*fusekernel.MkdirIn)(inMsg.Consume(fusekernel.MkdirInSize(protocol)))
 		if in == nil {
@@ -121,7 +164,7 @@ func convertInMessage(
 		}
 		name = name[:i]
 
-		o = &fuseops.MkDirOp{
+		to := &fuseops.MkDirOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(name),
 
@@ -130,10 +173,19 @@ func convertInMessage(
 			// passes that on directly (cf. https://goo.gl/f31aMo). In other words,
 			// the fact that this is a directory is implicit in the fact that the
 			// opcode is mkdir. But we want the correct mode to go through, so ensure
-			// that os.ModeDir is set.
-			Mode: convertFileMode(in.Mode) | os.ModeDir,
+			// that os.ModeDir is set (and not os.ModeDevice, which convertFileMode
+			// uses for modes of unknown type).
+			Mode: convertFileMode(in.Mode | syscall.S_IFDIR),
+		}
+
+		var umask os.FileMode
+		if protocol.HasUmask() {
+			umask = os.FileMode(in.Umask)
 		}
 
+		to.Mode, to.Umask = maskMode(to.Mode, umask)
+		o = to
+
 	case fusekernel.OpMknod:
 		in := (*fusekernel.MknodIn)(inMsg.Consume(fusekernel.MknodInSize(protocol)))
 		if in == nil {
@@ -149,12 +201,20 @@ func convertInMessage(
 		}
 		name = name[:i]
 
-		o = &fuseops.MkNodeOp{
+		to := &fuseops.MkNodeOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(name),
 			Mode:   convertFileMode(in.Mode),
 		}
 
+		var umask os.FileMode
+		if protocol.HasUmask() {
+			umask = os.FileMode(in.Umask)
+		}
+
+		to.Mode, to.Umask = maskMode(to.Mode, umask)
+		o = to
+
 	case fusekernel.OpCreate:
 		in := (*fusekernel.CreateIn)(inMsg.Consume(fusekernel.CreateInSize(protocol)))
 		if in == nil {
@@ -170,12 +230,20 @@ func convertInMessage(
 		}
 		name = name[:i]
 
-		o = &fuseops.CreateFileOp{
+		to := &fuseops.CreateFileOp{
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(name),
 			Mode:   convertFileMode(in.Mode),
 		}
 
+		var umask os.FileMode
+		if protocol.HasUmask() {
+			umask = os.FileMode(in.Umask)
+		}
+
+		to.Mode, to.Umask = maskMode(to.Mode, umask)
+		o = to
+
 	case fusekernel.OpSymlink:
 		// The message is "newName\0target\0".
 		names := inMsg.ConsumeBytes(inMsg.Len())
@@ -255,13 +323,27 @@ func convertInMessage(
 		}
 
 	case fusekernel.OpOpen:
+		in := (*fusekernel.OpenIn)(inMsg.Consume(unsafe.Sizeof(fusekernel.OpenIn{})))
+		if in == nil {
+			err = errors.New("Corrupt OpOpen")
+			return
+		}
+
 		o = &fuseops.OpenFileOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Flags: fuseops.OpenFlags(in.OpenFlags()),
 		}
 
 	case fusekernel.OpOpendir:
+		in := (*fusekernel.OpenIn)(inMsg.Consume(unsafe.Sizeof(fusekernel.OpenIn{})))
+		if in == nil {
+			err = errors.New("Corrupt OpOpendir")
+			return
+		}
+
 		o = &fuseops.OpenDirOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Flags: fuseops.OpenFlags(in.OpenFlags()),
 		}
 
 	case fusekernel.OpRead:
@@ -316,6 +398,32 @@ func convertInMessage(
 		sh.Len = readSize
 		sh.Cap = readSize
 
+	case fusekernel.OpReaddirplus:
+		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
+		if in == nil {
+			err = errors.New("Corrupt OpReaddirplus")
+			return
+		}
+
+		to := &fuseops.ReadDirPlusOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: fuseops.DirOffset(in.Offset),
+		}
+		o = to
+
+		readSize := int(in.Size)
+		p := outMsg.GrowNoZero(readSize)
+		if p == nil {
+			err = fmt.Errorf("Can't grow for %d-byte read", readSize)
+			return
+		}
+
+		sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
+		sh.Data = uintptr(p)
+		sh.Len = readSize
+		sh.Cap = readSize
+
 	case fusekernel.OpRelease:
 		type input fusekernel.ReleaseIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -325,7 +433,9 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ReleaseFileHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
+			Handle:        fuseops.HandleID(in.Fh),
+			ReleaseFlocks: fusekernel.ReleaseFlags(in.ReleaseFlags)&fusekernel.ReleaseFlockUnlock != 0,
+			LockOwner:     in.LockOwner,
 		}
 
 	case fusekernel.OpReleasedir:
@@ -358,6 +468,9 @@ func convertInMessage(
 			Handle: fuseops.HandleID(in.Fh),
 			Data:   buf,
 			Offset: int64(in.Offset),
+
+			KillPrivileges: fusekernel.WriteFlags(in.WriteFlags)&
+				fusekernel.WriteKillSuidgid != 0,
 		}
 
 	case fusekernel.OpFsync:
@@ -382,8 +495,54 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FlushFileOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			LockOwner: in.LockOwner,
+		}
+
+	case fusekernel.OpGetlk:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			err = errors.New("Corrupt OpGetlk")
+			return
+		}
+
+		o = &fuseops.GetLockOp{
 			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle: fuseops.HandleID(in.Fh),
+			Owner:  in.Owner,
+			Lock:   convertFileLock(&in.Lk),
+		}
+
+	case fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			err = errors.New("Corrupt OpSetlk")
+			return
+		}
+
+		inode := fuseops.InodeID(inMsg.Header().Nodeid)
+		handle := fuseops.HandleID(in.Fh)
+		lock := convertFileLock(&in.Lk)
+		flock := protocol.HasLockFlags() &&
+			fusekernel.LkFlags(in.LkFlags)&fusekernel.LkFlock != 0
+
+		if inMsg.Header().Opcode == fusekernel.OpSetlkw {
+			o = &fuseops.SetLockWaitOp{
+				Inode:  inode,
+				Handle: handle,
+				Owner:  in.Owner,
+				Lock:   lock,
+				Flock:  flock,
+			}
+		} else {
+			o = &fuseops.SetLockOp{
+				Inode:  inode,
+				Handle: handle,
+				Owner:  in.Owner,
+				Lock:   lock,
+				Flock:  flock,
+			}
 		}
 
 	case fusekernel.OpReadlink:
@@ -406,6 +565,112 @@ func convertInMessage(
 			FuseID: in.Unique,
 		}
 
+	case fusekernel.OpFallocate:
+		type input fusekernel.FallocateIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpFallocate")
+			return
+		}
+
+		o = &fuseops.FallocateOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: in.Offset,
+			Length: in.Length,
+			Mode:   fuseops.FallocateMode(in.Mode),
+		}
+
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpIoctl")
+			return
+		}
+
+		buf := inMsg.ConsumeBytes(uintptr(in.InSize))
+		if len(buf) < int(in.InSize) {
+			err = errors.New("Corrupt OpIoctl")
+			return
+		}
+
+		to := &fuseops.IoctlOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Cmd:    in.Cmd,
+			Arg:    in.Arg,
+			Flags:  fuseops.IoctlFlags(in.Flags),
+			Input:  buf,
+		}
+		o = to
+
+		// The output follows the fixed-size part of the reply, which is filled
+		// in by kernelResponseForOp.
+		if outMsg.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{}))) == nil {
+			err = errors.New("Can't grow for ioctl reply")
+			return
+		}
+
+		readSize := int(in.OutSize)
+		p := outMsg.GrowNoZero(readSize)
+		if p == nil {
+			err = fmt.Errorf("Can't grow for %d-byte ioctl output", readSize)
+			return
+		}
+
+		sh := (*reflect.SliceHeader)(unsafe.Pointer(&to.Dst))
+		sh.Data = uintptr(p)
+		sh.Len = readSize
+		sh.Cap = readSize
+
+	case fusekernel.OpPoll:
+		type input fusekernel.PollIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpPoll")
+			return
+		}
+
+		// Kernels that predate the events field zero it, whatever protocol
+		// version is negotiated.
+		o = &fuseops.PollOp{
+			Inode:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:         fuseops.HandleID(in.Fh),
+			KernelHandle:   in.Kh,
+			ScheduleNotify: in.Flags&fusekernel.PollScheduleNotify != 0,
+			Events:         fuseops.PollEvents(in.Events),
+		}
+
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpCopyFileRange")
+			return
+		}
+
+		// The reply can only express a 32-bit count, so ask for no more than
+		// that. Copying less than requested is fine.
+		length := in.Len
+		if length > math.MaxUint32&^0xfff {
+			length = math.MaxUint32 &^ 0xfff
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			SrcInode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			SrcHandle: fuseops.HandleID(in.FhIn),
+			SrcOffset: in.OffIn,
+			DstInode:  fuseops.InodeID(in.NodeidOut),
+			DstHandle: fuseops.HandleID(in.FhOut),
+			DstOffset: in.OffOut,
+			Length:    length,
+			Flags:     in.Flags,
+		}
+
+	case fusekernel.OpDestroy:
+		o = &destroyOp{}
+
 	case fusekernel.OpInit:
 		type input fusekernel.InitIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -574,7 +839,7 @@ func (c *Connection) kernelResponse(
 	// Special case: handle the ops for which the kernel expects no response.
 	// interruptOp .
 	switch op.(type) {
-	case *fuseops.ForgetInodeOp:
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
 		noResponse = true
 		return
 
@@ -588,22 +853,28 @@ func (c *Connection) kernelResponse(
 	if opErr != nil {
 		handled := false
 
+		// A caller asking for the size of an extended attribute or of the list of
+		// them passes an empty buffer, so ERANGE with the size required is the
+		// expected outcome, and is reported to the kernel as success. For a
+		// buffer that is merely too small, the kernel wants the error.
 		if opErr == syscall.ERANGE {
 			switch o := op.(type) {
 			case *fuseops.GetXattrOp:
-				writeXattrSize(m, uint32(o.BytesRead))
-				handled = true
+				if len(o.Dst) == 0 {
+					writeXattrSize(m, uint32(o.BytesRead))
+					handled = true
+				}
+
 			case *fuseops.ListXattrOp:
-				writeXattrSize(m, uint32(o.BytesRead))
-				handled = true
+				if len(o.Dst) == 0 {
+					writeXattrSize(m, uint32(o.BytesRead))
+					handled = true
+				}
 			}
 		}
 
 		if !handled {
-			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
-				m.OutHeader().Error = -int32(errno)
-			}
+			m.OutHeader().Error = -int32(c.errno(opErr))
 
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
@@ -633,37 +904,37 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		fuseops.ConvertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.GetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
+		out.AttrValid, out.AttrValidNsec = fuseops.ConvertExpirationTime(
 			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		fuseops.ConvertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
+		out.AttrValid, out.AttrValidNsec = fuseops.ConvertExpirationTime(
 			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		fuseops.ConvertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		fuseops.ConvertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		fuseops.ConvertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		fuseops.ConvertChildInodeEntry(&o.Entry, e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
@@ -671,12 +942,12 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		fuseops.ConvertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		fuseops.ConvertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -697,6 +968,10 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		// As for ReadDirOp.
+		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
@@ -712,6 +987,10 @@ func (c *Connection) kernelResponseForOp(
 			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
 		}
 
+		if o.NonSeekable && c.protocol.HasOpenNonSeekable() {
+			out.OpenFlags |= uint32(fusekernel.OpenNonSeekable)
+		}
+
 	case *fuseops.ReadFileOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
@@ -770,21 +1049,27 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Bsize = o.IoSize
 		out.St.Frsize = o.BlockSize
 
+		// Report the conventional limit on the length of a name, rather than
+		// zero, which confuses pathconf(3) users. The kernel itself accepts names
+		// of up to 1024 bytes.
+		out.St.Namelen = 255
+
 	case *fuseops.RemoveXattrOp:
 		// Empty response
 
 	case *fuseops.GetXattrOp:
+		// For a request for the size alone, reply with the size. Otherwise
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
 		// much the user read.
-		if o.BytesRead == 0 {
+		if len(o.Dst) == 0 {
 			writeXattrSize(m, uint32(o.BytesRead))
 		} else {
 			m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 		}
 
 	case *fuseops.ListXattrOp:
-		if o.BytesRead == 0 {
+		if len(o.Dst) == 0 {
 			writeXattrSize(m, uint32(o.BytesRead))
 		} else {
 			m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
@@ -793,8 +1078,43 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.SetXattrOp:
 		// Empty response
 
+	case *fuseops.GetLockOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		convertFileLockToKernel(&o.Conflict, &out.Lk)
+
+	case *fuseops.SetLockOp:
+		// Empty response
+
+	case *fuseops.SetLockWaitOp:
+		// Empty response
+
+	case *fuseops.FallocateOp:
+		// Empty response
+
+	case *fuseops.IoctlOp:
+		// convertInMessage already set up the fixed-size part of the reply and
+		// the destination buffer after it.
+		size := int(unsafe.Sizeof(fusekernel.IoctlOut{}))
+		out := (*fusekernel.IoctlOut)(unsafe.Pointer(&m.Bytes()[buffer.OutMessageHeaderSize]))
+		out.Result = o.Result
+		m.ShrinkTo(buffer.OutMessageHeaderSize + size + o.BytesRead)
+
+	case *fuseops.PollOp:
+		out := (*fusekernel.PollOut)(m.Grow(int(unsafe.Sizeof(fusekernel.PollOut{}))))
+		out.Revents = uint32(o.Revents)
+
+	case *fuseops.CopyFileRangeOp:
+		// The kernel's reply struct has only 32 bits for the count.
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = uint32(o.BytesCopied)
+
+	case *destroyOp:
+		// Empty response
+
 	case *initOp:
-		out := (*fusekernel.InitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.InitOut{}))))
+		// Only the fields that exist in the negotiated protocol may be sent.
+		size := fusekernel.InitOutSize(o.Library)
+		out := (*fusekernel.InitOut)(m.Grow(int(size)))
 
 		out.Major = o.Library.Major
 		out.Minor = o.Library.Minor
@@ -813,78 +1133,6 @@ func (c *Connection) kernelResponseForOp(
 // General conversions
 ////////////////////////////////////////////////////////////////////////
 
-func convertTime(t time.Time) (secs uint64, nsec uint32) {
-	totalNano := t.UnixNano()
-	secs = uint64(totalNano / 1e9)
-	nsec = uint32(totalNano % 1e9)
-	return
-}
-
-func convertAttributes(
-	inodeID fuseops.InodeID,
-	in *fuseops.InodeAttributes,
-	out *fusekernel.Attr) {
-	out.Ino = uint64(inodeID)
-	out.Size = in.Size
-	out.Atime, out.AtimeNsec = convertTime(in.Atime)
-	out.Mtime, out.MtimeNsec = convertTime(in.Mtime)
-	out.Ctime, out.CtimeNsec = convertTime(in.Ctime)
-	out.SetCrtime(convertTime(in.Crtime))
-	out.Nlink = in.Nlink
-	out.Uid = in.Uid
-	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
-
-	// Set the mode.
-	out.Mode = uint32(in.Mode) & 0777
-	switch {
-	default:
-		out.Mode |= syscall.S_IFREG
-	case in.Mode&os.ModeDir != 0:
-		out.Mode |= syscall.S_IFDIR
-	case in.Mode&os.ModeDevice != 0:
-		if in.Mode&os.ModeCharDevice != 0 {
-			out.Mode |= syscall.S_IFCHR
-		} else {
-			out.Mode |= syscall.S_IFBLK
-		}
-	case in.Mode&os.ModeNamedPipe != 0:
-		out.Mode |= syscall.S_IFIFO
-	case in.Mode&os.ModeSymlink != 0:
-		out.Mode |= syscall.S_IFLNK
-	case in.Mode&os.ModeSocket != 0:
-		out.Mode |= syscall.S_IFSOCK
-	}
-}
-
-// Convert an absolute cache expiration time to a relative time from now for
-// consumption by the fuse kernel module.
-func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
-	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
-	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
-	// are right out. There is no need to cap the positive magnitude, because
-	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
-	d := t.Sub(time.Now())
-	if d > 0 {
-		secs = uint64(d / time.Second)
-		nsecs = uint32((d % time.Second) / time.Nanosecond)
-	}
-
-	return
-}
-
-func convertChildInodeEntry(
-	in *fuseops.ChildInodeEntry,
-	out *fusekernel.EntryOut) {
-	out.Nodeid = uint64(in.Child)
-	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
-
-	convertAttributes(in.Child, &in.Attributes, &out.Attr)
-}
-
 func convertFileMode(unixMode uint32) os.FileMode {
 	mode := os.FileMode(unixMode & 0777)
 	switch unixMode & syscall.S_IFMT {
@@ -912,9 +1160,48 @@ func convertFileMode(unixMode uint32) os.FileMode {
 	if unixMode&syscall.S_ISGID != 0 {
 		mode |= os.ModeSetgid
 	}
+	if unixMode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
 	return mode
 }
 
+// Convert a lock from the kernel. Lock types are the platform's F_RDLCK and
+// friends.
+func convertFileLock(in *fusekernel.FileLock) (out fuseops.FileLock) {
+	out = fuseops.FileLock{
+		Start: in.Start,
+		End:   in.End,
+		Pid:   in.Pid,
+	}
+
+	switch in.Type {
+	case syscall.F_RDLCK:
+		out.Type = fuseops.ReadLock
+	case syscall.F_WRLCK:
+		out.Type = fuseops.WriteLock
+	default:
+		out.Type = fuseops.Unlock
+	}
+
+	return
+}
+
+func convertFileLockToKernel(in *fuseops.FileLock, out *fusekernel.FileLock) {
+	out.Start = in.Start
+	out.End = in.End
+	out.Pid = in.Pid
+
+	switch in.Type {
+	case fuseops.ReadLock:
+		out.Type = syscall.F_RDLCK
+	case fuseops.WriteLock:
+		out.Type = syscall.F_WRLCK
+	default:
+		out.Type = syscall.F_UNLCK
+	}
+}
+
 func writeXattrSize(m *buffer.OutMessage, size uint32) {
 	out := (*fusekernel.GetxattrOut)(m.Grow(int(unsafe.Sizeof(fusekernel.GetxattrOut{}))))
 	out.Size = size
@@ -0,0 +1,420 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"math"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/buffer"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+func TestInitReply(t *testing.T) {
+	testCases := []struct {
+		library fusekernel.Protocol
+		size    int
+	}{
+		// Old protocols get the original short reply.
+		{
+			library: fusekernel.Protocol{Major: 7, Minor: 12},
+			size:    24,
+		},
+
+		// Newer ones get the full reply.
+		{
+			library: fusekernel.Protocol{Major: 7, Minor: 23},
+			size:    64,
+		},
+	}
+
+	for _, tc := range testCases {
+		op := &initOp{
+			Library:  tc.library,
+			Flags:    fusekernel.InitBigWrites,
+			MaxWrite: 1 << 17,
+		}
+
+		var m buffer.OutMessage
+		m.Reset()
+
+		c := &Connection{}
+		c.kernelResponseForOp(&m, op)
+
+		payload := m.Bytes()[buffer.OutMessageHeaderSize:]
+		if len(payload) != tc.size {
+			t.Errorf("%v: got %d bytes, want %d", tc.library, len(payload), tc.size)
+			continue
+		}
+
+		out := (*fusekernel.InitOut)(unsafe.Pointer(&payload[0]))
+		if out.Minor != tc.library.Minor ||
+			out.Flags != uint32(fusekernel.InitBigWrites) ||
+			out.MaxWrite != 1<<17 {
+			t.Errorf("%v: unexpected reply %#v", tc.library, *out)
+		}
+	}
+}
+
+func TestInitOutSize(t *testing.T) {
+	// Cf. FUSE_COMPAT_22_INIT_OUT_SIZE and struct fuse_init_out in
+	// include/uapi/linux/fuse.h.
+	if got := fusekernel.InitOutSize(fusekernel.Protocol{Major: 7, Minor: 22}); got != 24 {
+		t.Errorf("7.22: got %d, want 24", got)
+	}
+
+	if got := fusekernel.InitOutSize(fusekernel.Protocol{Major: 7, Minor: 23}); got != 64 {
+		t.Errorf("7.23: got %d, want 64", got)
+	}
+
+	if got := unsafe.Offsetof(fusekernel.InitOut{}.MapAlignment); got != 30 {
+		t.Errorf("MapAlignment at offset %d, want 30", got)
+	}
+}
+
+// Return the in-memory representation of the supplied struct.
+func structBytes(p unsafe.Pointer, size uintptr) []byte {
+	return append([]byte(nil), (*[1 << 16]byte)(p)[:size]...)
+}
+
+// Build a message from the kernel with the supplied opcode and payload.
+func makeInMessage(t *testing.T, opcode uint32, payload []byte) (m *buffer.InMessage) {
+	h := fusekernel.InHeader{
+		Len:    uint32(fusekernel.InHeaderSize + len(payload)),
+		Opcode: opcode,
+		Nodeid: 17,
+	}
+
+	b := structBytes(unsafe.Pointer(&h), unsafe.Sizeof(h))
+	b = append(b, payload...)
+
+	m = new(buffer.InMessage)
+	if err := m.Init(bytes.NewReader(b)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	return
+}
+
+func TestKillPrivileges(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 12}
+
+	for _, kill := range []bool{false, true} {
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+
+		// Write
+		writeIn := fusekernel.WriteIn{Size: 4}
+		if kill {
+			writeIn.WriteFlags = uint32(fusekernel.WriteKillSuidgid)
+		}
+
+		payload := structBytes(
+			unsafe.Pointer(&writeIn),
+			fusekernel.WriteInSize(protocol))
+
+		payload = append(payload, "taco"...)
+
+		op, err := convertInMessage(
+			makeInMessage(t, uint32(fusekernel.OpWrite), payload),
+			&outMsg,
+			protocol,
+			nil)
+
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		if got := op.(*fuseops.WriteFileOp).KillPrivileges; got != kill {
+			t.Errorf("Write: got KillPrivileges %v, want %v", got, kill)
+		}
+
+		// Truncate
+		setattrIn := fusekernel.SetattrIn{}
+		setattrIn.Valid = uint32(fusekernel.SetattrSize)
+		if kill {
+			setattrIn.Valid |= uint32(fusekernel.SetattrKillSuidgid)
+		}
+
+		payload = structBytes(unsafe.Pointer(&setattrIn), unsafe.Sizeof(setattrIn))
+
+		op, err = convertInMessage(
+			makeInMessage(t, uint32(fusekernel.OpSetattr), payload),
+			&outMsg,
+			protocol,
+			nil)
+
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		if got := op.(*fuseops.SetInodeAttributesOp).KillPrivileges; got != kill {
+			t.Errorf("Setattr: got KillPrivileges %v, want %v", got, kill)
+		}
+	}
+}
+
+func TestGetattrHandle(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 12}
+
+	testCases := []struct {
+		in         fusekernel.GetattrIn
+		wantHandle bool
+	}{
+		{fusekernel.GetattrIn{Fh: 19}, false},
+		{fusekernel.GetattrIn{GetattrFlags: uint32(fusekernel.GetattrFh), Fh: 19}, true},
+	}
+
+	for _, tc := range testCases {
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+
+		payload := structBytes(unsafe.Pointer(&tc.in), unsafe.Sizeof(tc.in))
+		op, err := convertInMessage(
+			makeInMessage(t, uint32(fusekernel.OpGetattr), payload),
+			&outMsg,
+			protocol,
+			nil)
+
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		handle := op.(*fuseops.GetInodeAttributesOp).Handle
+		switch {
+		case !tc.wantHandle && handle != nil:
+			t.Errorf("Flags %#x: got handle %d, want none", tc.in.GetattrFlags, *handle)
+
+		case tc.wantHandle && handle == nil:
+			t.Errorf("Flags %#x: got no handle", tc.in.GetattrFlags)
+
+		case tc.wantHandle && *handle != 19:
+			t.Errorf("Flags %#x: got handle %d, want 19", tc.in.GetattrFlags, *handle)
+		}
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 12}
+
+	flags := uint32(syscall.O_RDWR | syscall.O_APPEND | syscall.O_DIRECTORY)
+	in := fusekernel.OpenIn{Flags: flags}
+	payload := structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in))
+
+	for _, opcode := range []uint32{
+		uint32(fusekernel.OpOpen),
+		uint32(fusekernel.OpOpendir),
+	} {
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+
+		op, err := convertInMessage(
+			makeInMessage(t, opcode, payload),
+			&outMsg,
+			protocol,
+			nil)
+
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		var got fuseops.OpenFlags
+		switch typed := op.(type) {
+		case *fuseops.OpenFileOp:
+			got = typed.Flags
+
+		case *fuseops.OpenDirOp:
+			got = typed.Flags
+		}
+
+		if got != fuseops.OpenFlags(flags) {
+			t.Errorf("Opcode %d: got flags %#x, want %#x", opcode, got, flags)
+		}
+
+		if got.AccessMode() != syscall.O_RDWR || !got.Directory() {
+			t.Errorf("Opcode %d: flags %#x misreported", opcode, got)
+		}
+	}
+}
+
+func TestGetXattrReplies(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 12}
+	sizeOutLen := int(unsafe.Sizeof(fusekernel.GetxattrOut{}))
+
+	testCases := []struct {
+		size      uint32
+		bytesRead int
+		opErr     error
+
+		// The expected error and payload length in the reply. If wantSize is
+		// set, the payload is a GetxattrOut carrying it.
+		wantErrno syscall.Errno
+		wantLen   int
+		wantSize  bool
+		sizeInfo  uint32
+	}{
+		// A request for the size alone, answered with or without ERANGE.
+		{size: 0, bytesRead: 11, opErr: syscall.ERANGE, wantLen: sizeOutLen, wantSize: true, sizeInfo: 11},
+		{size: 0, bytesRead: 11, wantLen: sizeOutLen, wantSize: true, sizeInfo: 11},
+		{size: 0, bytesRead: 0, wantLen: sizeOutLen, wantSize: true, sizeInfo: 0},
+
+		// A request for the value.
+		{size: 16, bytesRead: 11, wantLen: 11},
+		{size: 16, bytesRead: 0, wantLen: 0},
+
+		// A buffer too small for the value.
+		{size: 4, bytesRead: 11, opErr: syscall.ERANGE, wantErrno: syscall.ERANGE},
+	}
+
+	for i, tc := range testCases {
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+
+		var in fusekernel.GetxattrIn
+		in.Size = tc.size
+		payload := structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in))
+		payload = append(payload, "user.foo\x00"...)
+
+		op, err := convertInMessage(
+			makeInMessage(t, uint32(fusekernel.OpGetxattr), payload),
+			&outMsg,
+			protocol,
+			nil)
+
+		if err != nil {
+			t.Fatalf("Test case %d: convertInMessage: %v", i, err)
+		}
+
+		getOp := op.(*fuseops.GetXattrOp)
+		if getOp.Name != "user.foo" || len(getOp.Dst) != int(tc.size) {
+			t.Fatalf("Test case %d: unexpected op %+v", i, getOp)
+		}
+
+		getOp.BytesRead = tc.bytesRead
+
+		c := &Connection{}
+		c.kernelResponse(&outMsg, 1, op, tc.opErr)
+
+		h := outMsg.OutHeader()
+		if h.Error != -int32(tc.wantErrno) {
+			t.Errorf("Test case %d: got error %d, want %d", i, h.Error, -int32(tc.wantErrno))
+		}
+
+		reply := outMsg.Bytes()[buffer.OutMessageHeaderSize:]
+		if len(reply) != tc.wantLen || int(h.Len) != outMsg.Len() {
+			t.Errorf("Test case %d: got %d-byte payload, want %d", i, len(reply), tc.wantLen)
+			continue
+		}
+
+		if tc.wantSize {
+			out := (*fusekernel.GetxattrOut)(unsafe.Pointer(&reply[0]))
+			if out.Size != tc.sizeInfo {
+				t.Errorf("Test case %d: got size %d, want %d", i, out.Size, tc.sizeInfo)
+			}
+		}
+	}
+}
+
+func TestLockOps(t *testing.T) {
+	protocol := fusekernel.Protocol{Major: 7, Minor: 17}
+
+	convert := func(opcode uint32, in *fusekernel.LkIn) interface{} {
+		var outMsg buffer.OutMessage
+		outMsg.Reset()
+
+		payload := structBytes(unsafe.Pointer(in), unsafe.Sizeof(*in))
+		op, err := convertInMessage(
+			makeInMessage(t, opcode, payload),
+			&outMsg,
+			protocol,
+			nil)
+
+		if err != nil {
+			t.Fatalf("convertInMessage: %v", err)
+		}
+
+		return op
+	}
+
+	// A POSIX write lock to the end of the file.
+	in := fusekernel.LkIn{
+		Fh:    19,
+		Owner: 23,
+		Lk: fusekernel.FileLock{
+			Start: 100,
+			End:   math.MaxInt64,
+			Type:  syscall.F_WRLCK,
+			Pid:   1234,
+		},
+	}
+
+	setOp, ok := convert(fusekernel.OpSetlk, &in).(*fuseops.SetLockOp)
+	if !ok {
+		t.Fatalf("OpSetlk: got the wrong op type")
+	}
+
+	want := fuseops.FileLock{
+		Start: 100,
+		End:   math.MaxInt64,
+		Type:  fuseops.WriteLock,
+		Pid:   1234,
+	}
+
+	if setOp.Handle != 19 || setOp.Owner != 23 || setOp.Lock != want || setOp.Flock {
+		t.Errorf("OpSetlk: got %+v", setOp)
+	}
+
+	// A blocking flock(2) read lock.
+	in.Lk.Type = syscall.F_RDLCK
+	in.LkFlags = uint32(fusekernel.LkFlock)
+
+	waitOp, ok := convert(fusekernel.OpSetlkw, &in).(*fuseops.SetLockWaitOp)
+	if !ok {
+		t.Fatalf("OpSetlkw: got the wrong op type")
+	}
+
+	if waitOp.Lock.Type != fuseops.ReadLock || !waitOp.Flock {
+		t.Errorf("OpSetlkw: got %+v", waitOp)
+	}
+
+	// A test whose conflict is sent back to the kernel.
+	getOp, ok := convert(fusekernel.OpGetlk, &in).(*fuseops.GetLockOp)
+	if !ok {
+		t.Fatalf("OpGetlk: got the wrong op type")
+	}
+
+	getOp.Conflict = fuseops.FileLock{Start: 0, End: 9, Type: fuseops.WriteLock, Pid: 17}
+
+	var m buffer.OutMessage
+	m.Reset()
+
+	c := &Connection{}
+	c.kernelResponseForOp(&m, getOp)
+
+	payload := m.Bytes()[buffer.OutMessageHeaderSize:]
+	if len(payload) != int(unsafe.Sizeof(fusekernel.LkOut{})) {
+		t.Fatalf("OpGetlk: got %d bytes", len(payload))
+	}
+
+	out := (*fusekernel.LkOut)(unsafe.Pointer(&payload[0]))
+	wantOut := fusekernel.FileLock{Start: 0, End: 9, Type: syscall.F_WRLCK, Pid: 17}
+	if out.Lk != wantOut {
+		t.Errorf("OpGetlk: got %+v, want %+v", out.Lk, wantOut)
+	}
+}
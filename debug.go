@@ -63,6 +63,11 @@ func describeRequest(op interface{}) (s string) {
 	case *unknownOp:
 		addComponent("opcode %d", typed.OpCode)
 
+	case *fuseops.GetInodeAttributesOp:
+		if typed.Handle != nil {
+			addComponent("handle %d", *typed.Handle)
+		}
+
 	case *fuseops.SetInodeAttributesOp:
 		if typed.Size != nil {
 			addComponent("size %d", *typed.Size)
@@ -80,6 +85,10 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+		if typed.KillPrivileges {
+			addComponent("kill privileges")
+		}
+
 	case *fuseops.ReadFileOp:
 		addComponent("handle %d", typed.Handle)
 		addComponent("offset %d", typed.Offset)
@@ -90,6 +99,40 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("offset %d", typed.Offset)
 		addComponent("%d bytes", len(typed.Data))
 
+		if typed.KillPrivileges {
+			addComponent("kill privileges")
+		}
+
+	case *fuseops.FallocateOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("offset %d", typed.Offset)
+		addComponent("%d bytes", typed.Length)
+
+		if typed.Mode != 0 {
+			addComponent("mode %#x", uint32(typed.Mode))
+		}
+
+	case *fuseops.IoctlOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("cmd %#x", typed.Cmd)
+		addComponent("%d bytes in", len(typed.Input))
+		addComponent("%d bytes out", len(typed.Dst))
+
+	case *fuseops.PollOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("events %#x", uint32(typed.Events))
+		if typed.ScheduleNotify {
+			addComponent("kh %d", typed.KernelHandle)
+		}
+
+	case *fuseops.CopyFileRangeOp:
+		addComponent("handle %d", typed.SrcHandle)
+		addComponent("offset %d", typed.SrcOffset)
+		addComponent("to inode %d", typed.DstInode)
+		addComponent("handle %d", typed.DstHandle)
+		addComponent("offset %d", typed.DstOffset)
+		addComponent("%d bytes", typed.Length)
+
 	case *fuseops.RemoveXattrOp:
 		addComponent("name %s", typed.Name)
 
@@ -98,6 +141,18 @@ func describeRequest(op interface{}) (s string) {
 
 	case *fuseops.SetXattrOp:
 		addComponent("name %s", typed.Name)
+
+	case *fuseops.GetLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("%v %d-%d", typed.Lock.Type, typed.Lock.Start, typed.Lock.End)
+
+	case *fuseops.SetLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("%v %d-%d", typed.Lock.Type, typed.Lock.Start, typed.Lock.End)
+
+	case *fuseops.SetLockWaitOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("%v %d-%d", typed.Lock.Type, typed.Lock.Start, typed.Lock.End)
 	}
 
 	// Use just the name if there is no extra info.
@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// A dirCookieChecker remembers the directory offsets (cookies) that the file
+// system has issued on each open directory handle since the listing was last
+// started from offset zero, and checks that the kernel only continues reading
+// from those. See MountConfig.CheckDirCookies.
+type dirCookieChecker struct {
+	mu sync.Mutex
+
+	// The cookies issued on each directory handle during the current pass
+	// over the directory.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*dirPass
+}
+
+// The cookies issued during one pass over a directory, i.e. since the most
+// recent read at offset zero.
+type dirPass struct {
+	// The name of the entry that each cookie follows.
+	names map[fuseops.DirOffset]string
+
+	// The cookie following each name. Together with names, this lets us notice
+	// both a cookie that names two entries and an entry that was returned
+	// twice with different cookies, which is what happens when a file system
+	// uses indices into a listing that changes between reads.
+	cookies map[string]fuseops.DirOffset
+}
+
+func newDirCookieChecker() *dirCookieChecker {
+	return &dirCookieChecker{
+		handles: make(map[fuseops.HandleID]*dirPass),
+	}
+}
+
+// Check the offset of a read on the supplied directory handle before it is
+// passed to the file system, returning a description of the problem if it is
+// not a cookie issued during the current pass. A read at offset zero begins a
+// new pass.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *dirCookieChecker) check(
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset) (problem string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if offset == 0 {
+		c.handles[handle] = &dirPass{
+			names:   make(map[fuseops.DirOffset]string),
+			cookies: make(map[string]fuseops.DirOffset),
+		}
+
+		return
+	}
+
+	p, ok := c.handles[handle]
+	if !ok {
+		problem = fmt.Sprintf(
+			"read at offset %d on handle %v, which has issued no cookies",
+			offset,
+			handle)
+
+		return
+	}
+
+	if _, ok := p.names[offset]; !ok {
+		problem = fmt.Sprintf(
+			"read at offset %d on handle %v, which was never issued as a cookie",
+			offset,
+			handle)
+
+		return
+	}
+
+	return
+}
+
+// Update state based on the reply to the supplied op, before the reply is sent
+// to the kernel. If the entries in a successful directory read reuse a cookie
+// or an entry inconsistently, a description of the problem is returned.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *dirCookieChecker) observeReply(
+	op interface{},
+	opErr error) (problem string) {
+	var handle fuseops.HandleID
+	var entries []issuedDirent
+
+	switch typed := op.(type) {
+	case *fuseops.ReadDirOp:
+		handle = typed.Handle
+		entries = issuedDirents(typed.Dst[:typed.BytesRead], 0)
+
+	case *fuseops.ReadDirPlusOp:
+		handle = typed.Handle
+		entries = issuedDirents(
+			typed.Dst[:typed.BytesRead],
+			int(unsafe.Sizeof(fusekernel.EntryOut{})))
+
+	case *fuseops.ReleaseDirHandleOp:
+		c.mu.Lock()
+		delete(c.handles, typed.Handle)
+		c.mu.Unlock()
+		return
+
+	default:
+		return
+	}
+
+	if opErr != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.handles[handle]
+	if !ok {
+		return
+	}
+
+	for _, e := range entries {
+		if e.cookie == 0 {
+			problem = fmt.Sprintf(
+				"entry %q on handle %v has cookie zero, which means the start "+
+					"of the directory",
+				e.name,
+				handle)
+
+			return
+		}
+
+		if name, ok := p.names[e.cookie]; ok && name != e.name {
+			problem = fmt.Sprintf(
+				"cookie %d on handle %v issued for both %q and %q",
+				e.cookie,
+				handle,
+				name,
+				e.name)
+
+			return
+		}
+
+		if cookie, ok := p.cookies[e.name]; ok && cookie != e.cookie {
+			problem = fmt.Sprintf(
+				"entry %q on handle %v returned with both cookie %d and cookie %d",
+				e.name,
+				handle,
+				cookie,
+				e.cookie)
+
+			return
+		}
+
+		p.names[e.cookie] = e.name
+		p.cookies[e.name] = e.cookie
+	}
+
+	return
+}
+
+// An entry in a directory read reply, along with the cookie that follows it.
+type issuedDirent struct {
+	name   string
+	cookie fuseops.DirOffset
+}
+
+// Return the entries in the supplied ReadDirOp or ReadDirPlusOp output, each
+// of which is preceded by prefixSize bytes (the fuse_entry_out for
+// ReadDirPlusOp).
+func issuedDirents(buf []byte, prefixSize int) (entries []issuedDirent) {
+	const direntAlignment = 8
+
+	for len(buf) >= prefixSize+fusekernel.DirentSize {
+		dirent := (*fusekernel.Dirent)(unsafe.Pointer(&buf[prefixSize]))
+
+		nameStart := prefixSize + fusekernel.DirentSize
+		nameEnd := nameStart + int(dirent.Namelen)
+		if nameEnd > len(buf) {
+			return
+		}
+
+		entries = append(entries, issuedDirent{
+			name:   string(buf[nameStart:nameEnd]),
+			cookie: fuseops.DirOffset(dirent.Off),
+		})
+
+		// Skip to the next entry, which is aligned.
+		next := nameEnd + (direntAlignment-nameEnd%direntAlignment)%direntAlignment
+		if next > len(buf) {
+			return
+		}
+
+		buf = buf[next:]
+	}
+
+	return
+}
@@ -0,0 +1,244 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+type testDirent struct {
+	name   string
+	cookie fuseops.DirOffset
+}
+
+// Build the output of a ReadDirOp, as fuseutil.WriteDirent would, or of a
+// ReadDirPlusOp, as fuseutil.WriteDirentPlus would.
+func buildDirents(plus bool, entries ...testDirent) (dst []byte) {
+	for _, e := range entries {
+		if plus {
+			var entry fusekernel.EntryOut
+			dst = append(dst, (*[unsafe.Sizeof(entry)]byte)(unsafe.Pointer(&entry))[:]...)
+		}
+
+		// fusekernel.Dirent has trailing padding, so spell out its fields.
+		var out struct {
+			ino     uint64
+			off     uint64
+			namelen uint32
+			typ     uint32
+			name    [8]byte
+		}
+
+		out.off = uint64(e.cookie)
+		out.namelen = uint32(len(e.name))
+		copy(out.name[:], e.name)
+
+		dst = append(dst, (*[unsafe.Sizeof(out)]byte)(unsafe.Pointer(&out))[:]...)
+	}
+
+	return
+}
+
+func readDirReply(
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset,
+	entries ...testDirent) *fuseops.ReadDirOp {
+	dst := buildDirents(false, entries...)
+	return &fuseops.ReadDirOp{
+		Handle:    handle,
+		Offset:    offset,
+		Dst:       dst,
+		BytesRead: len(dst),
+	}
+}
+
+func TestDirCookieChecker_Continuation(t *testing.T) {
+	c := &Connection{dirCookies: newDirCookieChecker()}
+	d := c.dirCookies
+
+	// Continuing on a handle that has never been read from is a problem.
+	if problem := c.checkDirCookie(&fuseops.ReadDirOp{Handle: 3, Offset: 1}); problem == "" {
+		t.Errorf("Read on unread handle was not reported")
+	}
+
+	// Read the first part of the directory.
+	op := readDirReply(3, 0, testDirent{"foo", 1}, testDirent{"bar", 2})
+	if problem := c.checkDirCookie(op); problem != "" {
+		t.Fatalf("Unexpected problem on first read: %s", problem)
+	}
+
+	if problem := d.observeReply(op, nil); problem != "" {
+		t.Fatalf("Unexpected problem on first reply: %s", problem)
+	}
+
+	// Continuing from either cookie issued is fine, including with
+	// ReadDirPlusOp.
+	if problem := c.checkDirCookie(&fuseops.ReadDirOp{Handle: 3, Offset: 2}); problem != "" {
+		t.Errorf("Unexpected problem on continuation: %s", problem)
+	}
+
+	if problem := c.checkDirCookie(&fuseops.ReadDirPlusOp{Handle: 3, Offset: 1}); problem != "" {
+		t.Errorf("Unexpected problem on seek back: %s", problem)
+	}
+
+	// Other offsets, or the same one on another handle, are not.
+	if problem := c.checkDirCookie(&fuseops.ReadDirOp{Handle: 3, Offset: 17}); problem == "" {
+		t.Errorf("Read at unissued offset was not reported")
+	}
+
+	if problem := c.checkDirCookie(&fuseops.ReadDirOp{Handle: 4, Offset: 2}); problem == "" {
+		t.Errorf("Read on another handle was not reported")
+	}
+
+	// Once the handle is released, its cookies are forgotten.
+	d.observeReply(&fuseops.ReleaseDirHandleOp{Handle: 3}, nil)
+	if problem := c.checkDirCookie(&fuseops.ReadDirOp{Handle: 3, Offset: 2}); problem == "" {
+		t.Errorf("Read on released handle was not reported")
+	}
+}
+
+func TestDirCookieChecker_InconsistentCookies(t *testing.T) {
+	d := newDirCookieChecker()
+
+	testCases := []struct {
+		name string
+
+		// A first read at offset zero, and a continuation at the supplied
+		// offset.
+		first   []testDirent
+		offset  fuseops.DirOffset
+		second  []testDirent
+		problem bool
+	}{
+		{
+			name:   "consistent",
+			first:  []testDirent{{"foo", 1}, {"bar", 2}},
+			offset: 2,
+			second: []testDirent{{"baz", 3}},
+		},
+		{
+			name:   "seek back",
+			first:  []testDirent{{"foo", 1}, {"bar", 2}},
+			offset: 1,
+			second: []testDirent{{"bar", 2}, {"baz", 3}},
+		},
+		{
+			name:    "zero cookie",
+			first:   []testDirent{{"foo", 0}},
+			problem: true,
+		},
+		{
+			// An entry was inserted before the continuation.
+			name:    "entry repeated",
+			first:   []testDirent{{"foo", 1}, {"bar", 2}},
+			offset:  2,
+			second:  []testDirent{{"bar", 3}, {"baz", 4}},
+			problem: true,
+		},
+		{
+			// An entry was removed before seeking back.
+			name:    "cookie reused",
+			first:   []testDirent{{"foo", 1}, {"bar", 2}},
+			offset:  1,
+			second:  []testDirent{{"baz", 2}},
+			problem: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		for _, plus := range []bool{false, true} {
+			handle := fuseops.HandleID(2*i + 1)
+			if plus {
+				handle++
+			}
+
+			var problem string
+			reply := func(offset fuseops.DirOffset, entries []testDirent) {
+				if problem != "" || entries == nil {
+					return
+				}
+
+				if problem = d.check(handle, offset); problem != "" {
+					t.Errorf("%s: unexpected problem on read: %s", tc.name, problem)
+					return
+				}
+
+				dst := buildDirents(plus, entries...)
+				var op interface{} = &fuseops.ReadDirOp{
+					Handle:    handle,
+					Dst:       dst,
+					BytesRead: len(dst),
+				}
+
+				if plus {
+					op = &fuseops.ReadDirPlusOp{
+						Handle:    handle,
+						Dst:       dst,
+						BytesRead: len(dst),
+					}
+				}
+
+				problem = d.observeReply(op, nil)
+			}
+
+			reply(0, tc.first)
+			reply(tc.offset, tc.second)
+
+			if tc.problem && problem == "" {
+				t.Errorf("%s (plus: %v): problem was not reported", tc.name, plus)
+			}
+
+			if !tc.problem && problem != "" {
+				t.Errorf("%s (plus: %v): unexpected problem: %s", tc.name, plus, problem)
+			}
+		}
+	}
+}
+
+func TestDirCookieChecker_Rewind(t *testing.T) {
+	d := newDirCookieChecker()
+
+	// File systems may use indices into a listing taken at offset zero, so a
+	// fresh listing may reuse the cookies of the previous one for different
+	// entries.
+	op := readDirReply(3, 0, testDirent{"foo", 1}, testDirent{"bar", 2})
+	d.check(3, 0)
+	if problem := d.observeReply(op, nil); problem != "" {
+		t.Fatalf("Unexpected problem on first pass: %s", problem)
+	}
+
+	op = readDirReply(3, 0, testDirent{"bar", 1}, testDirent{"baz", 2})
+	d.check(3, 0)
+	if problem := d.observeReply(op, nil); problem != "" {
+		t.Errorf("Unexpected problem on second pass: %s", problem)
+	}
+
+	// Failed reads issue no cookies.
+	op = readDirReply(3, 2, testDirent{"qux", 2})
+	if problem := d.observeReply(op, ENOENT); problem != "" {
+		t.Errorf("Unexpected problem on failed read: %s", problem)
+	}
+}
+
+func TestDirCookieChecker_Disabled(t *testing.T) {
+	c := &Connection{}
+	if problem := c.checkDirCookie(&fuseops.ReadDirOp{Handle: 3, Offset: 17}); problem != "" {
+		t.Errorf("Unexpected problem: %s", problem)
+	}
+}
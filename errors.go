@@ -14,17 +14,158 @@
 
 package fuse
 
-import "syscall"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
 	// specially by Connection.Reply.
+	EACCES    = syscall.EACCES
+	EBADF     = syscall.EBADF
+	EBUSY     = syscall.EBUSY
 	EEXIST    = syscall.EEXIST
+	EFBIG     = syscall.EFBIG
+	EINTR     = syscall.EINTR
 	EINVAL    = syscall.EINVAL
 	EIO       = syscall.EIO
+	EISDIR    = syscall.EISDIR
+	ELOOP     = syscall.ELOOP
+	ENFILE    = syscall.ENFILE
 	ENOATTR   = syscall.ENODATA
 	ENOENT    = syscall.ENOENT
+	ENOSPC    = syscall.ENOSPC
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
+	ENOTTY    = syscall.ENOTTY
+	EPERM     = syscall.EPERM
+	EROFS     = syscall.EROFS
+	EXDEV     = syscall.EXDEV
+)
+
+// ErrFuseUnavailable is the error returned by Mount when the fuse device
+// can't be used at all, as is common in containers and other restricted
+// environments. Its message includes guidance on fixing the problem.
+type ErrFuseUnavailable struct {
+	// Why the device is unavailable.
+	Reason FuseUnavailableReason
+
+	// The path of the device, e.g. "/dev/fuse".
+	Path string
+
+	// The underlying error from opening the device.
+	Err error
+}
+
+// FuseUnavailableReason classifies an ErrFuseUnavailable.
+type FuseUnavailableReason int
+
+const (
+	// The device node doesn't exist, although the kernel supports fuse. In a
+	// container this usually means that the device hasn't been passed through.
+	FuseDeviceMissing FuseUnavailableReason = iota
+
+	// The device exists but the process isn't allowed to open it.
+	FuseDevicePermissionDenied
+
+	// The kernel doesn't support fuse, probably because the module isn't
+	// loaded.
+	FuseModuleNotLoaded
 )
+
+func (r FuseUnavailableReason) String() string {
+	switch r {
+	case FuseDeviceMissing:
+		return "device missing"
+
+	case FuseDevicePermissionDenied:
+		return "permission denied"
+
+	case FuseModuleNotLoaded:
+		return "module not loaded"
+
+	default:
+		return fmt.Sprintf("FuseUnavailableReason(%d)", int(r))
+	}
+}
+
+func (e *ErrFuseUnavailable) Error() string {
+	var guidance string
+	switch e.Reason {
+	case FuseDeviceMissing:
+		guidance = fmt.Sprintf(
+			"%s does not exist. If running in a container, pass the device "+
+				"through (e.g. docker run --device %s).",
+			e.Path,
+			e.Path)
+
+	case FuseDevicePermissionDenied:
+		guidance = fmt.Sprintf(
+			"Check the permissions on %s. If running in a container, it may need "+
+				"to be allowed by the device cgroup (e.g. docker run --device %s), "+
+				"and the container may need the SYS_ADMIN capability.",
+			e.Path,
+			e.Path)
+
+	case FuseModuleNotLoaded:
+		guidance = "The kernel does not appear to support fuse. Try " +
+			"`modprobe fuse` on the host."
+	}
+
+	return fmt.Sprintf("fuse unavailable (%v): %v. %s", e.Reason, e.Err, guidance)
+}
+
+// ErrConnectionClosed is the error returned by MountedFileSystem.Join when the
+// connection to the kernel ended other than by a clean unmount, for which Join
+// returns nil. A supervisor can use the Reason to decide whether to remount.
+type ErrConnectionClosed struct {
+	Reason ConnectionClosedReason
+
+	// For ConnectionDeviceError, the error from reading the device.
+	Err error
+}
+
+// ConnectionClosedReason classifies an ErrConnectionClosed.
+type ConnectionClosedReason int
+
+const (
+	// The connection was aborted, e.g. by writing to the abort file in
+	// /sys/fs/fuse/connections. The mount point is left in place, but any
+	// access to it fails with ENOTCONN until it is unmounted.
+	//
+	// Requires Linux 4.17 or later; older kernels report an abort as though the
+	// file system had been unmounted.
+	ConnectionAborted ConnectionClosedReason = iota
+
+	// Reading from the device failed, or returned a message that couldn't be
+	// understood.
+	ConnectionDeviceError
+)
+
+func (r ConnectionClosedReason) String() string {
+	switch r {
+	case ConnectionAborted:
+		return "connection aborted"
+
+	case ConnectionDeviceError:
+		return "device error"
+
+	default:
+		return fmt.Sprintf("ConnectionClosedReason(%d)", int(r))
+	}
+}
+
+func (e *ErrConnectionClosed) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("fuse: %v", e.Reason)
+	}
+
+	return fmt.Sprintf("fuse: %v: %v", e.Reason, e.Err)
+}
+
+// Returned by Connection.readMessage when the kernel reports that the
+// connection was aborted.
+var errConnectionAborted = errors.New("connection aborted")
@@ -62,6 +62,11 @@ type StatFSOp struct {
 	// only powers of 2 in the range [2^7, 2^20] are preserved, and a value of
 	// zero is treated as 4096.
 	//
+	// Beware of leaving this zero while setting IoSize: Linux then reports
+	// IoSize as statfs::f_frsize too, so that df(1) and friends take the block
+	// counts to be in units of IoSize and show sizes that are too large by a
+	// factor of IoSize over the block size that was meant.
+	//
 	// This interface does not distinguish between blocks and block fragments.
 	BlockSize uint32
 
@@ -90,8 +95,17 @@ type StatFSOp struct {
 	IoSize uint32
 
 	// The total number of inodes in the file system, and how many remain free.
+	// These are reported by `df -i`. A file system with a limit on the number
+	// of inodes should set them, and fail creates with ENOSPC once none are
+	// free.
+	//
+	// The protocol has no separate count of inodes available to non-root
+	// users; statvfs(3) reports InodesFree as f_favail as well as f_ffree.
 	Inodes     uint64
 	InodesFree uint64
+
+	// There is no field for the maximum length of a name; statfs(2) on Linux
+	// reports 255 bytes as statfs::f_namelen.
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -100,6 +114,11 @@ type StatFSOp struct {
 
 // Look up a child by name within a parent directory. The kernel sends this
 // when resolving user paths to dentry structs, which are then cached.
+//
+// Symlinks reported to the kernel are followed by the kernel, which guards
+// against cycles. A file system that instead follows links of its own while
+// looking up a name must bound how many it follows and return ELOOP past
+// that; see fuseutil.FollowLinks.
 type LookUpInodeOp struct {
 	// The ID of the directory inode to which the child belongs.
 	Parent InodeID
@@ -117,8 +136,8 @@ type LookUpInodeOp struct {
 
 	// The resulting entry. Must be filled out by the file system.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// If the op succeeds, the lookup count for the inode is implicitly
+	// incremented by one. See notes on ForgetInodeOp for more information.
 	Entry ChildInodeEntry
 }
 
@@ -130,6 +149,13 @@ type GetInodeAttributesOp struct {
 	// The inode of interest.
 	Inode InodeID
 
+	// The handle for the open file on whose behalf the kernel is asking, or nil
+	// if it didn't supply one. It does so when it needs fresh attributes for an
+	// open file, e.g. to find its size for lseek(2) with SEEK_END. A file system
+	// that keeps per-handle state, such as writes not yet flushed to a backend,
+	// can use it to report attributes that reflect that state.
+	Handle *HandleID
+
 	// Set by the file system: attributes for the inode, and the time at which
 	// they should expire. See notes on ChildInodeEntry.AttributesExpiration for
 	// more.
@@ -151,6 +177,13 @@ type SetInodeAttributesOp struct {
 	Atime *time.Time
 	Mtime *time.Time
 
+	// If set, the file system should clear the set-user-ID bit, and the
+	// set-group-ID bit if the group execute bit is set, along with making the
+	// changes above. The kernel sets this when a caller without CAP_FSETID
+	// truncates the file. Only sent if fuse.MountConfig.HandleKillPrivileges
+	// is set.
+	KillPrivileges bool
+
 	// Set by the file system: the new attributes for the inode, and the time at
 	// which they should expire. See notes on
 	// ChildInodeEntry.AttributesExpiration for more.
@@ -168,6 +201,16 @@ type SetInodeAttributesOp struct {
 // fuse_reply_entry fuse_reply_create implicitly increments (cf.
 // http://goo.gl/o5C7Dx).
 //
+// To be explicit: each successful reply to a LookUpInodeOp, CreateFileOp,
+// MkDirOp, MkNodeOp, CreateSymlinkOp, or CreateLinkOp increments the count
+// for the inode in its Entry by exactly one, however many times the same
+// inode has been returned before, as does each entry with a non-zero child
+// in the reply to a ReadDirPlusOp. No other op changes the count, and replies
+// with an error don't either. The file system must keep its own count per
+// inode ID, increasing it by one for each such reply and decreasing it by N
+// for each ForgetInodeOp; fuse.MountConfig.CheckLookupCounts makes the library
+// check that forgets balance the replies it has sent.
+//
 // If the reference count hits zero, the file system can forget about that ID
 // entirely, and even re-use it in future responses. The kernel guarantees that
 // it will not otherwise use it again.
@@ -205,6 +248,33 @@ type ForgetInodeOp struct {
 	N uint64
 }
 
+// Decrement the reference counts of several inodes at once, as would a
+// ForgetInodeOp for each entry. The kernel sends this rather than a string of
+// ForgetInodeOps when it has many inodes to forget at once, e.g. when evicting
+// them under memory pressure, but only to file systems speaking protocol 7.16
+// or later.
+//
+// The library currently speaks at most 7.12 (see fuse.MaxProtocolVersion), so
+// the kernel never sends this op and file systems receive only
+// ForgetInodeOps. It is decoded anyway, so that handling it now keeps a file
+// system correct once the negotiated version is raised.
+//
+// Like ForgetInodeOp, this gets no reply; the error returned is ignored.
+type BatchForgetOp struct {
+	// The inodes whose reference counts should be decremented, in the order
+	// the kernel sent them.
+	Entries []BatchForgetEntry
+}
+
+// An entry in a BatchForgetOp.
+type BatchForgetEntry struct {
+	// The inode whose reference count should be decremented.
+	Inode InodeID
+
+	// The amount to decrement the reference count.
+	N uint64
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Inode creation
 ////////////////////////////////////////////////////////////////////////
@@ -228,10 +298,15 @@ type MkDirOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the caller, which the file system must apply to Mode
+	// itself. This is set only when fuse.MountConfig.DontMask is in effect;
+	// otherwise Mode has already been masked and Umask is zero.
+	Umask os.FileMode
+
 	// Set by the file system: information about the inode that was created.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// If the op succeeds, the lookup count for the inode is implicitly
+	// incremented by one. See notes on ForgetInodeOp for more information.
 	Entry ChildInodeEntry
 }
 
@@ -255,10 +330,13 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the caller, as for MkDirOp.
+	Umask os.FileMode
+
 	// Set by the file system: information about the inode that was created.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// If the op succeeds, the lookup count for the inode is implicitly
+	// incremented by one. See notes on ForgetInodeOp for more information.
 	Entry ChildInodeEntry
 }
 
@@ -280,10 +358,13 @@ type CreateFileOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The umask of the caller, as for MkDirOp.
+	Umask os.FileMode
+
 	// Set by the file system: information about the inode that was created.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// If the op succeeds, the lookup count for the inode is implicitly
+	// incremented by one. See notes on ForgetInodeOp for more information.
 	Entry ChildInodeEntry
 
 	// Set by the file system: an opaque ID that will be echoed in follow-up
@@ -312,13 +393,17 @@ type CreateSymlinkOp struct {
 	// Set by the file system: information about the symlink inode that was
 	// created.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// If the op succeeds, the lookup count for the inode is implicitly
+	// incremented by one. See notes on ForgetInodeOp for more information.
 	Entry ChildInodeEntry
 }
 
 // Create a hard link to an inode. If the name already exists, the file system
 // should return EEXIST (cf. the notes on CreateFileOp and MkDirOp).
+//
+// The kernel refuses links between different mounts itself, but a file system
+// that spans several backends must return EXDEV if the target can't be linked
+// into the new parent, as for RenameOp.
 type CreateLinkOp struct {
 	// The ID of parent directory inode within which to create the child hard
 	// link.
@@ -332,8 +417,8 @@ type CreateLinkOp struct {
 
 	// Set by the file system: information about the inode that was created.
 	//
-	// The lookup count for the inode is implicitly incremented. See notes on
-	// ForgetInodeOp for more information.
+	// If the op succeeds, the lookup count for the inode is implicitly
+	// incremented by one. See notes on ForgetInodeOp for more information.
 	Entry ChildInodeEntry
 }
 
@@ -356,6 +441,11 @@ type CreateLinkOp struct {
 //     is empty before replacing it, returning ENOTEMPTY otherwise. (This is
 //     per the posix spec: http://goo.gl/4XtT79)
 //
+//  *  A file system that spans several backends, between which the child
+//     can't simply be relinked, must return EXDEV for a rename from one to
+//     another. Callers such as mv(1) treat that as they would a rename
+//     between file systems, and copy the data and remove the original.
+//
 //  *  The rename must be atomic from the point of view of an observer of the
 //     new name. That is, if the new name already exists, there must be no
 //     point at which it doesn't exist.
@@ -428,6 +518,9 @@ type OpenDirOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
 
+	// The flags passed to open(2). See OpenFlags.
+	Flags OpenFlags
+
 	// Set by the file system: an opaque ID that will be echoed in follow-up
 	// calls for this directory using the same struct file in the kernel. In
 	// practice this usually means follow-up calls using the file descriptor
@@ -531,12 +624,51 @@ type ReadDirOp struct {
 	BytesRead int
 }
 
+// Read entries from a directory previously opened with OpenDir, along with the
+// attributes of each child. This saves the kernel from sending a
+// LookUpInodeOp for each child when e.g. ls -l stats every entry. Only sent if
+// fuse.MountConfig.EnableReadDirPlus is set; the kernel then decides for each
+// read whether to send this or ReadDirOp.
+//
+// fuseutil.NewFileSystemServer answers this with the file system's ReadDir
+// method, without attributes, if ReadDirPlus fails with ENOSYS.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset within the directory at which to read. See notes on
+	// ReadDirOp.Offset.
+	Offset DirOffset
+
+	// The destination buffer, whose length gives the size of the read.
+	//
+	// The output data should consist of a sequence of FUSE directory entries
+	// with attributes, in the format generated by libfuse's
+	// fuse_add_direntry_plus. Use fuseutil.WriteDirentPlus to generate this
+	// data.
+	//
+	// Each entry with a non-zero child inode ID implicitly increments the
+	// lookup count for that inode by one, exactly as a LookUpInodeOp reply
+	// does. See notes on ForgetInodeOp.
+	Dst []byte
+
+	// Set by the file system: the number of bytes read into Dst. See notes on
+	// ReadDirOp.BytesRead.
+	BytesRead int
+}
+
 // Release a previously-minted directory handle. The kernel sends this when
 // there are no more references to an open directory: all file descriptors are
 // closed and all memory mappings are unmapped.
 //
 // The kernel guarantees that the handle ID will not be used in further ops
-// sent to the file system (unless it is reissued by the file system).
+// sent to the file system (unless it is reissued by the file system). It may
+// however send this while a ReadDirOp for the handle is still being served,
+// if the application interrupted the readdir and then closed the directory.
+// A file system that frees state for the handle here must wait for such ops
+// to finish; fuseutil.HandleMap.Borrow does this.
 //
 // Errors from this op are ignored by the kernel (cf. http://goo.gl/RL38Do).
 type ReleaseDirHandleOp struct {
@@ -556,10 +688,23 @@ type ReleaseDirHandleOp struct {
 // with type file, usually in response to an open(2) call from a user-space
 // process. On OS X it may not be sent for every open(2)
 // (cf.https://github.com/osxfuse/osxfuse/issues/199).
+//
+// On Linux this is not sent for open(2) with O_PATH, which yields a
+// descriptor that can be used only to refer to the file (e.g. with fstat(2)
+// or the *at(2) family), never for I/O. Such an open needs only the
+// LookUpInodeOp for the name, and the file system sees nothing further but
+// GetInodeAttributesOp for any fstat(2). In particular any permission checks
+// the file system makes here don't apply, which is harmless since the
+// descriptor can't be used to read or write.
 type OpenFileOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
 
+	// The flags passed to open(2), from which the file system can tell
+	// whether the file is being opened for reading, writing, or both. See
+	// OpenFlags.
+	Flags OpenFlags
+
 	// An opaque ID that will be echoed in follow-up calls for this file using
 	// the same struct file in the kernel. In practice this usually means
 	// follow-up calls using the file descriptor returned by open(2).
@@ -593,6 +738,18 @@ type OpenFileOp struct {
 	// layer. This allows for filesystems whose file sizes are not known in
 	// advance, for example, because contents are generated on the fly.
 	UseDirectIO bool
+
+	// Whether the file handle is a stream that can't be seeked, like a pipe.
+	// If set, lseek(2), pread(2), and pwrite(2) on the handle fail with ESPIPE
+	// without reaching the file system, so that ReadFileOp and WriteFileOp
+	// offsets only ever advance sequentially. Tools like cat(1) and tail(1)
+	// that probe with lseek then fall back to plain sequential reads.
+	//
+	// This sets FOPEN_NONSEEKABLE, not the newer FOPEN_STREAM. The latter also
+	// stops the kernel from tracking the file position, so every op would
+	// carry offset zero, and it requires protocol 7.31. Not supported on OS X,
+	// where this field is ignored.
+	NonSeekable bool
 }
 
 // Read data from a file previously opened with CreateFile or OpenFile.
@@ -600,6 +757,17 @@ type OpenFileOp struct {
 // Note that this op is not sent for every call to read(2) by the end user;
 // some reads may be served by the page cache. See notes on WriteFileOp for
 // more.
+//
+// The kernel doesn't forward posix_fadvise(2) hints to the file system, and
+// this op carries no indication of the access pattern. The hints affect only
+// the kernel's own readahead for the handle: POSIX_FADV_SEQUENTIAL enlarges
+// it (still bounded by the readahead size negotiated at mount time),
+// POSIX_FADV_RANDOM disables it so that reads arrive with the sizes the user
+// asked for, and POSIX_FADV_WILLNEED issues readahead immediately. A file
+// system that wants to tune prefetching per handle must infer the pattern
+// itself, e.g. by checking whether each read starts where the previous one on
+// the same handle ended. None of this applies to handles using direct IO,
+// which bypass the page cache and readahead entirely.
 type ReadFileOp struct {
 	// The file inode that we are reading, and the handle previously returned by
 	// CreateFile or OpenFile when opening that inode.
@@ -609,7 +777,8 @@ type ReadFileOp struct {
 	// The offset within the file at which to read.
 	Offset int64
 
-	// The destination buffer, whose length gives the size of the read.
+	// The destination buffer, whose length gives the size of the read. It is
+	// never empty: the library answers zero-length reads itself.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read.
@@ -622,6 +791,10 @@ type ReadFileOp struct {
 	// by a previous call to LookUpInode, GetInodeAttributes, etc.
 	//
 	// If direct IO is enabled, semantics should match those of read(2).
+	//
+	// A read that straddles EOF should set this to the number of bytes before
+	// EOF, and one that starts at or past EOF should set it to zero. Neither
+	// is an error; for convenience io.EOF is treated the same as nil.
 	BytesRead int
 }
 
@@ -647,6 +820,16 @@ type ReadFileOp struct {
 //
 // (See also http://goo.gl/ocdTdM, fuse-devel thread "Fuse guarantees on
 // concurrent requests".)
+//
+// When writeback caching is disabled the writing process waits for this op,
+// and if it receives a signal meanwhile the kernel interrupts the op, which
+// cancels its context. A file system that writes to its backend in several
+// steps, such as a multi-part upload, should watch the context, abort any
+// partial backend operation when it is cancelled, and return the context's
+// error, which the caller sees as EINTR. write(2) then returns the number of
+// bytes written by earlier ops for the same call, if any, so a caller that
+// handles the signal can resume from there. Writes sent from the page cache
+// under writeback caching are never interrupted.
 type WriteFileOp struct {
 	// The file inode that we are modifying, and the handle previously returned
 	// by CreateFile or OpenFile when opening that inode.
@@ -681,7 +864,171 @@ type WriteFileOp struct {
 	// be written, except on error (http://goo.gl/KUpwwn). This appears to be
 	// because it uses file mmapping machinery (http://goo.gl/SGxnaN) to write a
 	// page at a time.
+	//
+	// A file system that writes only a prefix of the data before failing, e.g.
+	// because it runs out of space, should set Data to that prefix and return
+	// nil. The kernel then updates the size it has cached for the file and
+	// gives the caller a short write, and the caller sees the error when it
+	// retries the remainder. Returning the error instead tells the kernel that
+	// nothing was written, leaving its cached size stale until the attributes
+	// expire or the file system calls fuse.Connection.InvalidateInode.
+	//
+	// Data is never empty: the library answers zero-length writes itself.
 	Data []byte
+
+	// If set, the file system should clear the set-user-ID bit, and the
+	// set-group-ID bit if the group execute bit is set, as part of the write.
+	// The kernel sets this when the writer lacks CAP_FSETID, as POSIX requires.
+	// Only sent if fuse.MountConfig.HandleKillPrivileges is set.
+	KillPrivileges bool
+}
+
+// Allocate or deallocate space for a range of an open file, as for
+// fallocate(2) and posix_fallocate(3).
+//
+// With no mode flags the file system should make sure that the range is
+// backed by storage, so that later writes to it don't fail for lack of
+// space, and extend the file with zeroes if the range ends beyond its size.
+// The kernel updates its idea of the size itself when the op succeeds.
+//
+// If this fails with ENOSYS the kernel doesn't send it again, and fails
+// fallocate(2) with EOPNOTSUPP, which glibc's posix_fallocate(3) handles by
+// writing zeroes instead.
+type FallocateOp struct {
+	// The file and handle concerned.
+	Inode  InodeID
+	Handle HandleID
+
+	// The range of bytes concerned.
+	Offset uint64
+	Length uint64
+
+	// Flags modifying the operation. The kernel itself refuses other
+	// combinations, so this is zero, FallocKeepSize, or FallocKeepSize and
+	// FallocPunchHole together.
+	Mode FallocateMode
+}
+
+// Report which events are ready on an open file, for poll(2), select(2), and
+// epoll(7). This matters only for files whose readiness changes over time,
+// such as event or message files; the kernel considers a file system that
+// fails this op with ENOSYS to be always ready, and doesn't send it again.
+//
+// If nothing the caller is waiting for is ready and ScheduleNotify is set,
+// the file system should remember KernelHandle and, once something becomes
+// ready, call fuse.Connection.NotifyPollWakeup with it. The kernel then polls
+// again, and this time the file system reports the event in Revents. A
+// wakeup only prompts the kernel to ask again, so spurious ones are harmless,
+// but a missed one leaves the caller blocked until it times out. A file
+// system should therefore check readiness and record the handle atomically
+// with respect to the events it reports.
+//
+// Note that Go's os package registers files with epoll when opening them, so
+// the kernel polls each file once as it is opened by a Go program, whether or
+// not the program ever waits on it.
+type PollOp struct {
+	// The file and handle being polled.
+	Inode  InodeID
+	Handle HandleID
+
+	// The kernel's identifier for this poll, to be passed to
+	// fuse.Connection.NotifyPollWakeup. It is the same for every poll of the
+	// same open file.
+	KernelHandle uint64
+
+	// Whether the kernel wants to be woken up with NotifyPollWakeup once one
+	// of the events becomes ready. If false, the caller won't wait and the
+	// file system needn't remember KernelHandle.
+	ScheduleNotify bool
+
+	// The events the caller is interested in. Zero for kernels that predate
+	// protocol 7.21, which don't say; the file system should then report
+	// everything that is ready.
+	Events PollEvents
+
+	// Set by the file system: the events that are ready now. Events that the
+	// caller isn't interested in are ignored by the kernel.
+	Revents PollEvents
+}
+
+// Carry out an ioctl(2) on an open file. Ioctls that the kernel handles
+// itself, such as FIONBIO, never reach the file system. If this fails with
+// ENOSYS, the caller sees ENOTTY, as for a file that supports no ioctls.
+//
+// For a file system the kernel works out the sizes of the command's input and
+// output from the size and direction encoded in Cmd (cf. _IOR and _IOW in
+// <asm-generic/ioctl.h>), treating Arg as a pointer to a buffer of that size.
+// It copies the input in before sending the op, and copies the output back to
+// the caller once the op succeeds. Commands whose arguments are laid out
+// differently, for example those pointing to structs that contain further
+// pointers, can't be supported.
+//
+// The protocol also lets the server ask the kernel to send the op again with
+// buffers of its choosing, for commands whose sizes the kernel can't know
+// (FUSE_IOCTL_RETRY). The kernel honours such requests only for CUSE
+// character devices, for which it sets IoctlUnrestricted, and fails the
+// caller's ioctl with EIO otherwise, so the library doesn't support them.
+type IoctlOp struct {
+	// The file and handle on which the ioctl was issued.
+	Inode  InodeID
+	Handle HandleID
+
+	// The command and argument passed to ioctl(2). Arg is an address in the
+	// caller's memory, useful only for commands that take an integer argument
+	// rather than a pointer.
+	Cmd   uint32
+	Arg   uint64
+	Flags IoctlFlags
+
+	// The command's input, copied from the caller's buffer. Its length is the
+	// input size encoded in Cmd, or zero for commands that take no input.
+	//
+	// This aliases the kernel's message, and must not be used after the op is
+	// replied to.
+	Input []byte
+
+	// The buffer into which the file system should write the command's output.
+	// Its length is the output size encoded in Cmd, or zero for commands that
+	// produce none. The file system should set BytesRead to the number of
+	// bytes of output, and only those are copied back to the caller.
+	Dst       []byte
+	BytesRead int
+
+	// Set by the file system: the value that ioctl(2) returns to the caller.
+	// Negative values are allowed but unusual; to fail the ioctl with an
+	// errno, return the error instead.
+	Result int32
+}
+
+// Copy a range of bytes from one open file to another within the file system,
+// as for copy_file_range(2), without the data passing through the kernel's
+// page cache or the caller's memory.
+//
+// There is no init flag for this op: the kernel sends it whenever it supports
+// it (Linux 4.20 and later), and the library always forwards it. If it fails
+// with ENOSYS the kernel doesn't send it again, and copy_file_range(2) falls
+// back to copying by reading and writing.
+type CopyFileRangeOp struct {
+	// The source file, handle, and offset.
+	SrcInode  InodeID
+	SrcHandle HandleID
+	SrcOffset uint64
+
+	// The destination file, handle, and offset. The destination may be the
+	// same file as the source.
+	DstInode  InodeID
+	DstHandle HandleID
+	DstOffset uint64
+
+	// The maximum number of bytes to copy.
+	Length uint64
+
+	// Flags passed to copy_file_range(2). Currently always zero.
+	Flags uint64
+
+	// Set by the file system: the number of bytes actually copied, which may
+	// be less than Length if the end of the source is reached.
+	BytesCopied uint64
 }
 
 // Synchronize the current contents of an open file to storage.
@@ -758,6 +1105,11 @@ type FlushFileOp struct {
 	// The file and handle being flushed.
 	Inode  InodeID
 	Handle HandleID
+
+	// The owner of the POSIX locks released by the close(2) causing this
+	// flush. A file system that handles locks (see fuse.MountConfig.HandleLocks)
+	// should release all POSIX locks on the inode held by this owner.
+	LockOwner uint64
 }
 
 // Release a previously-minted file handle. The kernel calls this when there
@@ -767,12 +1119,89 @@ type FlushFileOp struct {
 // The kernel guarantees that the handle ID will not be used in further calls
 // to the file system (unless it is reissued by the file system).
 //
+// There is no way for the file system to make the kernel release a handle
+// sooner; invalidating the inode drops cached data but leaves open files
+// open. A file system whose handles hold scarce backend resources should
+// acquire them lazily and give them up when idle instead. See the poolfs
+// sample for an example.
+//
 // Errors from this op are ignored by the kernel (cf. http://goo.gl/RL38Do).
 type ReleaseFileHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
 	Handle HandleID
+
+	// If set, the file system should release all flock(2) locks held by
+	// LockOwner. The kernel doesn't send a SetLockOp to unlock them when the
+	// file is closed. See fuse.MountConfig.HandleLocks.
+	ReleaseFlocks bool
+	LockOwner     uint64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Locks
+////////////////////////////////////////////////////////////////////////
+
+// Test whether a lock could be placed on a file, for fcntl(2) with F_GETLK.
+// The kernel sends lock ops only when fuse.MountConfig.HandleLocks is set;
+// otherwise it handles locks itself, locally to the machine.
+//
+// Locks belong to an owner, identified by an opaque ID: for POSIX locks the
+// owner is a process's file descriptor table, and for flock(2) locks an open
+// file. Locks held by the same owner never conflict with each other.
+type GetLockOp struct {
+	// The file and handle concerned.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the proposed lock, and the lock itself.
+	Owner uint64
+	Lock  FileLock
+
+	// Set by the file system: a lock held by another owner that conflicts with
+	// Lock, or one of type Unlock (the zero value) if there is none.
+	Conflict FileLock
+}
+
+// Place or remove a lock on a file, failing with EAGAIN if it conflicts with a
+// lock held by another owner. The kernel sends this for fcntl(2) with F_SETLK,
+// and for flock(2) with LOCK_NB. See GetLockOp for more about lock ops.
+//
+// A lock replaces any locks held by the same owner over the same range, which
+// may require splitting or merging existing POSIX locks. A lock of type Unlock
+// removes the owner's locks over the range.
+type SetLockOp struct {
+	// The file and handle concerned.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the lock, and the lock to place.
+	Owner uint64
+	Lock  FileLock
+
+	// Set if this is a flock(2) lock rather than a POSIX record lock.
+	Flock bool
+}
+
+// Like SetLockOp, but rather than failing with EAGAIN the file system should
+// wait until the lock can be placed. The kernel sends this for fcntl(2) with
+// F_SETLKW, and for flock(2) without LOCK_NB.
+//
+// The wait may be interrupted, e.g. by a signal, in which case the op's
+// context is cancelled and the file system should return promptly with the
+// context's error.
+type SetLockWaitOp struct {
+	// The file and handle concerned.
+	Inode  InodeID
+	Handle HandleID
+
+	// The owner of the lock, and the lock to place.
+	Owner uint64
+	Lock  FileLock
+
+	// Set if this is a flock(2) lock rather than a POSIX record lock.
+	Flock bool
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -808,6 +1237,11 @@ type RemoveXattrOp struct {
 //
 // This is sent in response to getxattr(2). Return ENOATTR if the
 // extended attribute does not exist.
+//
+// Callers that don't know the size of the value typically make two calls:
+// one with an empty buffer to learn the size, and another with a buffer of
+// that size. For the first, Dst is empty, and the file system should set
+// BytesRead to the size of the value, returning either nil or ERANGE.
 type GetXattrOp struct {
 	// The inode whose extended attribute we are reading.
 	Inode InodeID
@@ -827,7 +1261,8 @@ type GetXattrOp struct {
 
 // List all the extended attributes for a file.
 //
-// This is sent in response to listxattr(2).
+// This is sent in response to listxattr(2). As with GetXattrOp, Dst is empty
+// when the caller wants only the size of the list.
 type ListXattrOp struct {
 	// The inode whose extended attributes we are listing.
 	Inode InodeID
@@ -859,9 +1294,10 @@ type SetXattrOp struct {
 	// The value to for the extened attribute.
 	Value []byte
 
-	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
-	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
-	// If Flags is 0x0, the extended attribute will be created if need be, or will
-	// simply replace the value if the attribute exists.
+	// If Flags is SetXattrCreate (0x1), and the attribute exists already,
+	// EEXIST should be returned. If Flags is SetXattrReplace (0x2), and the
+	// attribute does not exist, ENOATTR should be returned. If Flags is 0x0, the
+	// extended attribute will be created if need be, or will simply replace the
+	// value if the attribute exists.
 	Flags uint32
 }
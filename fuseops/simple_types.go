@@ -17,6 +17,7 @@ package fuseops
 import (
 	"fmt"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/sbg/fuse/internal/fusekernel"
@@ -62,6 +63,14 @@ type InodeAttributes struct {
 	Size uint64
 
 	// The number of incoming hard links to this inode.
+	//
+	// For directories this should be two plus the number of subdirectories,
+	// counting the directory's entry in its parent, its own "." entry, and the
+	// ".." entry of each subdirectory. Some tools (e.g. older versions of find)
+	// use this to skip stat'ing entries once they have seen that many
+	// subdirectories, so reporting too small a count can cause them to miss
+	// parts of the tree. File systems that can't count subdirectories cheaply
+	// should report 1, which such tools recognize as meaning "unknown".
 	Nlink uint32
 
 	// The mode of the inode. This is exposed to the user in e.g. the result of
@@ -88,6 +97,13 @@ type InodeAttributes struct {
 	Mode os.FileMode
 
 	// Time information. See `man 2 stat` for full details.
+	//
+	// POSIX requires that creating, removing, or renaming an entry within a
+	// directory update the directory's mtime and ctime, and tools like make
+	// rely on this to notice that a directory has changed. The kernel doesn't
+	// do this on the file system's behalf, so ops like MkDirOp, CreateFileOp,
+	// UnlinkOp, RmDirOp, and RenameOp should update the times of each parent
+	// directory involved.
 	Atime  time.Time // Time of last access
 	Mtime  time.Time // Time of last modification
 	Ctime  time.Time // Time of last modification to inode
@@ -96,6 +112,16 @@ type InodeAttributes struct {
 	// Ownership information
 	Uid uint32
 	Gid uint32
+
+	// The preferred size for I/O on this inode, reported as st_blksize by
+	// stat(2). Tools like dd(1) and cp(1) size their buffers from it, so file
+	// systems may use it to steer them towards e.g. larger transfers for large
+	// media files than for small configuration files.
+	//
+	// If zero, the kernel uses the block size of the mount instead, which on
+	// Linux is the page size. This is unrelated to the IoSize and BlockSize
+	// fields of StatFSOp. Linux rounds values down to a power of two.
+	Blksize uint32
 }
 
 func (a *InodeAttributes) DebugString() string {
@@ -132,9 +158,14 @@ type GenerationNumber uint64
 // This corresponds to fuse_file_info::fh.
 type HandleID uint64
 
-// DirOffset is an offset into an open directory handle. This is opaque to
-// FUSE, and can be used for whatever purpose the file system desires. See
-// notes on ReadDirOp.Offset for details.
+// DirOffset is an offset into an open directory handle: an opaque 64-bit
+// cookie that the file system issues with each entry it returns (see
+// fuseutil.Dirent.Offset), and that the kernel hands back in order to continue
+// reading after that entry. FUSE never interprets it, so the file system is
+// free to choose any non-zero values, with zero reserved for the start of the
+// directory. See notes on ReadDirOp.Offset for details, and
+// fuse.MountConfig.CheckDirCookies for a way to check that cookies are used
+// consistently.
 type DirOffset uint64
 
 // ChildInodeEntry contains information about a child inode within its parent
@@ -192,6 +223,14 @@ type ChildInodeEntry struct {
 	// stashed in the struct inode should be re-queried. Leave at the zero value
 	// to disable caching.
 	//
+	// The choice is made separately for each reply, so a file system may
+	// disable caching for particular inodes, e.g. one whose attributes reflect
+	// a live clock or counter, while letting the kernel cache the attributes of
+	// others for a long time. The kernel then sends a GetInodeAttributesOp for
+	// every stat(2) of the former. Use the same expiration in every reply
+	// describing such an inode, including those to GetInodeAttributesOp and
+	// ReadDirPlusOp.
+	//
 	// More reading:
 	//     http://stackoverflow.com/q/21540315/1505451
 	AttributesExpiration time.Time
@@ -220,3 +259,133 @@ type ChildInodeEntry struct {
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
 }
+
+// LockType is the type of a FileLock.
+type LockType int
+
+const (
+	// No lock. Used to unlock a range in SetLockOp, and to report the absence
+	// of a conflicting lock from GetLockOp.
+	Unlock LockType = iota
+
+	// A shared lock, which may be held by any number of owners at once.
+	ReadLock
+
+	// An exclusive lock.
+	WriteLock
+)
+
+func (t LockType) String() string {
+	switch t {
+	case Unlock:
+		return "unlock"
+	case ReadLock:
+		return "read"
+	case WriteLock:
+		return "write"
+	}
+
+	return fmt.Sprintf("LockType(%d)", int(t))
+}
+
+// FileLock is a lock on a range of bytes within a file. See GetLockOp.
+type FileLock struct {
+	// The first and last bytes of the range, inclusive. A lock that extends to
+	// the end of the file, however far it grows, has an End of math.MaxInt64.
+	// flock(2) locks always cover the whole file.
+	Start uint64
+	End   uint64
+
+	Type LockType
+
+	// The process holding the lock, reported to the caller of fcntl(2) with
+	// F_GETLK. Zero for flock(2) locks.
+	Pid uint32
+}
+
+// FallocateMode holds the flags of a FallocateOp.
+type FallocateMode uint32
+
+const (
+	// Don't change the file's size, even if the range extends beyond it.
+	// Corresponds to FALLOC_FL_KEEP_SIZE.
+	FallocKeepSize FallocateMode = 0x01
+
+	// Deallocate the range, so that it reads as zeroes. Always accompanied by
+	// FallocKeepSize. Corresponds to FALLOC_FL_PUNCH_HOLE.
+	FallocPunchHole FallocateMode = 0x02
+)
+
+// Values for SetXattrOp.Flags.
+const (
+	// Fail with EEXIST if the attribute exists. Corresponds to XATTR_CREATE.
+	SetXattrCreate = 0x1
+
+	// Fail with ENOATTR if the attribute doesn't exist. Corresponds to
+	// XATTR_REPLACE.
+	SetXattrReplace = 0x2
+)
+
+// PollEvents is a set of poll(2) event bits, such as PollIn. See PollOp.
+type PollEvents uint32
+
+const (
+	// There is data to read. Corresponds to POLLIN.
+	PollIn PollEvents = 0x001
+
+	// There is urgent data to read. Corresponds to POLLPRI.
+	PollPri PollEvents = 0x002
+
+	// Writing won't block. Corresponds to POLLOUT.
+	PollOut PollEvents = 0x004
+
+	// An error condition. Corresponds to POLLERR.
+	PollErr PollEvents = 0x008
+
+	// The other end has hung up. Corresponds to POLLHUP.
+	PollHup PollEvents = 0x010
+)
+
+// IoctlFlags describes the circumstances of an ioctl(2). See IoctlOp.
+type IoctlFlags uint32
+
+const (
+	// The caller is a 32-bit program running on a 64-bit kernel, and the
+	// command was issued through the compat_ioctl path.
+	IoctlCompat IoctlFlags = 0x01
+
+	// The sizes of the command's input and output aren't known to the kernel.
+	// This is set only for CUSE character devices, never for file systems.
+	IoctlUnrestricted IoctlFlags = 0x02
+
+	// The caller is a 32-bit program. Set only by kernels speaking protocol
+	// 7.16 or newer.
+	Ioctl32Bit IoctlFlags = 0x08
+
+	// The target is a directory. The kernel sends ioctls on directories only
+	// when speaking protocol 7.18 or newer.
+	IoctlDir IoctlFlags = 0x10
+)
+
+// OpenFlags holds the flags passed to open(2), such as
+// os.O_WRONLY|os.O_APPEND, as seen in OpenFileOp and OpenDirOp.
+//
+// The kernel removes O_CREAT, O_EXCL, O_NOCTTY, and O_TRUNC before sending
+// them: creation is sent as CreateFileOp, and truncation as a separate
+// SetInodeAttributesOp.
+//
+// The kernel also checks O_DIRECTORY itself, failing open(2) with ENOTDIR for
+// anything but a directory, and sends OpenFileOp only for inodes that it
+// knows not to be directories. So O_DIRECTORY is seen only in OpenDirOp.
+type OpenFlags uint32
+
+// AccessMode returns the access mode part of the flags: os.O_RDONLY,
+// os.O_WRONLY, or os.O_RDWR.
+func (fl OpenFlags) AccessMode() OpenFlags {
+	return fl & syscall.O_ACCMODE
+}
+
+// Directory returns whether O_DIRECTORY is set.
+func (fl OpenFlags) Directory() bool {
+	return fl&syscall.O_DIRECTORY != 0
+}
@@ -19,6 +19,7 @@ import (
 	"unsafe"
 
 	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
 )
 
 type DirentType uint32
@@ -103,3 +104,78 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return
 }
+
+// Read a directory entry written by WriteDirent from the start of the given
+// buffer, returning the entry and its length including padding. Return zero if
+// the buffer doesn't start with a complete entry.
+func readDirent(buf []byte) (d Dirent, n int) {
+	const direntAlignment = 8
+	const direntSize = 8 + 8 + 4 + 4
+
+	if len(buf) < direntSize {
+		return
+	}
+
+	var header [direntSize]byte
+	copy(header[:], buf)
+
+	d.Inode = fuseops.InodeID(*(*uint64)(unsafe.Pointer(&header[0])))
+	d.Offset = fuseops.DirOffset(*(*uint64)(unsafe.Pointer(&header[8])))
+	nameLen := int(*(*uint32)(unsafe.Pointer(&header[16])))
+	d.Type = DirentType(*(*uint32)(unsafe.Pointer(&header[20])))
+
+	// Round up to the alignment.
+	totalLen := direntSize + nameLen
+	totalLen += (direntAlignment - totalLen%direntAlignment) % direntAlignment
+	if totalLen > len(buf) {
+		return
+	}
+
+	d.Name = string(buf[direntSize : direntSize+nameLen])
+	n = totalLen
+
+	return
+}
+
+// A struct representing an entry within a directory file along with the
+// child's attributes. See notes on fuseops.ReadDirPlusOp and on
+// WriteDirentPlus for details.
+type DirentPlus struct {
+	Dirent Dirent
+
+	// The entry for the child, exactly as it would be returned for a
+	// LookUpInodeOp, including its effect on the lookup count. Entry.Child
+	// should be the same as Dirent.Inode.
+	//
+	// If Entry.Child is zero, the kernel receives no attributes for the child
+	// and looks it up as usual if it needs them. The kernel ignores the
+	// entries for "." and "..", so they should be written this way.
+	Entry fuseops.ChildInodeEntry
+}
+
+// Write the supplied directory entry and attributes into the given buffer in
+// the format expected in fuseops.ReadDirPlusOp.Dst, returning the number of
+// bytes written. Return zero if the entry would not fit.
+func WriteDirentPlus(buf []byte, d DirentPlus) (n int) {
+	// We want to write bytes with the layout of fuse_direntplus: a
+	// fuse_entry_out followed by a fuse_dirent as written by WriteDirent. Both
+	// are multiples of the 8-byte alignment.
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	if len(buf) < entrySize {
+		return
+	}
+
+	// Write the dirent first, to find out whether it fits.
+	direntLen := WriteDirent(buf[entrySize:], d.Dirent)
+	if direntLen == 0 {
+		return
+	}
+
+	var out fusekernel.EntryOut
+	fuseops.ConvertChildInodeEntry(&d.Entry, &out)
+
+	n += copy(buf, (*[entrySize]byte)(unsafe.Pointer(&out))[:])
+	n += direntLen
+
+	return
+}
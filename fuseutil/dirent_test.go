@@ -0,0 +1,262 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+func TestWriteDirentPlus(t *testing.T) {
+	d := fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{
+			Offset: 1,
+			Inode:  17,
+			Name:   "taco",
+			Type:   fuseutil.DT_File,
+		},
+	}
+
+	d.Entry.Child = 17
+
+	// The entry is the plain dirent preceded by the kernel's entry structure.
+	plainLen := fuseutil.WriteDirent(make([]byte, 1024), d.Dirent)
+	n := fuseutil.WriteDirentPlus(make([]byte, 1024), d)
+	if n <= plainLen || n%8 != 0 {
+		t.Errorf("WriteDirentPlus wrote %d bytes; WriteDirent wrote %d", n, plainLen)
+	}
+
+	// Nothing is written if the entry doesn't fit.
+	if got := fuseutil.WriteDirentPlus(make([]byte, n-1), d); got != 0 {
+		t.Errorf("WriteDirentPlus wrote %d bytes to a short buffer", got)
+	}
+}
+
+// A file system whose root contains the files "a", "b", and "c". It counts
+// the LookUpInodeOps it receives, and may decline to implement ReadDirPlus.
+type readDirPlusFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Constant data.
+	plus bool
+
+	mu      sync.Mutex
+	lookUps int // GUARDED_BY(mu)
+}
+
+var readDirPlusNames = []string{"a", "b", "c"}
+
+func (fs *readDirPlusFS) LookUps() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.lookUps
+}
+
+func (fs *readDirPlusFS) entry(i int) (e fuseops.ChildInodeEntry) {
+	e.Child = fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+	e.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  uint64(i),
+	}
+
+	e.AttributesExpiration = time.Now().Add(time.Hour)
+	e.EntryExpiration = e.AttributesExpiration
+	return
+}
+
+func (fs *readDirPlusFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	fs.lookUps++
+	fs.mu.Unlock()
+
+	for i, name := range readDirPlusNames {
+		if op.Parent == fuseops.RootInodeID && op.Name == name {
+			op.Entry = fs.entry(i)
+			return
+		}
+	}
+
+	err = fuse.ENOENT
+	return
+}
+
+func (fs *readDirPlusFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+
+		return
+	}
+
+	e := fs.entry(int(op.Inode - fuseops.RootInodeID - 1))
+	op.Attributes = e.Attributes
+	op.AttributesExpiration = e.AttributesExpiration
+	return
+}
+
+func (fs *readDirPlusFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	return
+}
+
+func (fs *readDirPlusFS) dirent(i int) fuseutil.Dirent {
+	return fuseutil.Dirent{
+		Offset: fuseops.DirOffset(i + 1),
+		Inode:  fs.entry(i).Child,
+		Name:   readDirPlusNames[i],
+		Type:   fuseutil.DT_File,
+	}
+}
+
+func (fs *readDirPlusFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	for i := int(op.Offset); i < len(readDirPlusNames); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fs.dirent(i))
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *readDirPlusFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) (err error) {
+	if !fs.plus {
+		err = fuse.ENOSYS
+		return
+	}
+
+	for i := int(op.Offset); i < len(readDirPlusNames); i++ {
+		n := fuseutil.WriteDirentPlus(
+			op.Dst[op.BytesRead:],
+			fuseutil.DirentPlus{Dirent: fs.dirent(i), Entry: fs.entry(i)})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+// Mount the file system, list its root and stat each entry, and return the
+// number of lookups it received.
+func listAndStat(t *testing.T, fs *readDirPlusFS) int {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "dirent_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			EnableReadDirPlus: true,
+			CheckLookupCounts: true,
+		})
+
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Fatalf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(ctx); err != nil {
+			t.Fatalf("Join: %v", err)
+		}
+	}()
+
+	// ioutil.ReadDir stats each entry, like ls -l.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	for i, fi := range entries {
+		names = append(names, fi.Name())
+		if fi.Size() != int64(strings.Index("abc", fi.Name())) {
+			t.Errorf("Entry %d: got size %d for %q", i, fi.Size(), fi.Name())
+		}
+	}
+
+	sort.Strings(names)
+	if got, want := strings.Join(names, ","), "a,b,c"; got != want {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+
+	// So does stat.
+	for _, name := range readDirPlusNames {
+		if _, err := os.Stat(path.Join(dir, name)); err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+	}
+
+	return fs.LookUps()
+}
+
+func TestReadDirPlus(t *testing.T) {
+	// Only Linux supports READDIRPLUS.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	if got := listAndStat(t, &readDirPlusFS{plus: true}); got != 0 {
+		t.Errorf("Got %d lookups, want none", got)
+	}
+}
+
+func TestReadDirPlus_Fallback(t *testing.T) {
+	// Without ReadDirPlus, the listing works and each entry is looked up.
+	if got := listAndStat(t, &readDirPlusFS{}); got < len(readDirPlusNames) {
+		t.Errorf("Got %d lookups, want at least %d", got, len(readDirPlusNames))
+	}
+}
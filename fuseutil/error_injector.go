@@ -0,0 +1,593 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// An Injection records an error returned by an ErrorInjector in place of
+// calling the wrapped file system.
+type Injection struct {
+	// The op type, e.g. reflect.TypeOf(&fuseops.WriteFileOp{}).
+	Type reflect.Type
+
+	// The one-based count of ops of this type seen by the injector when the
+	// error was injected.
+	Call int
+
+	// The error that was returned.
+	Err syscall.Errno
+}
+
+// ErrorInjector is a FileSystem that wraps another, returning configured
+// errors for chosen op types instead of passing those ops through. It is
+// intended for testing how applications and file systems cope with failure.
+//
+// Ops that aren't chosen for injection are passed to the wrapped file system
+// unmodified. Safe for concurrent use.
+type ErrorInjector struct {
+	wrapped FileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	rules map[reflect.Type]*injectionRule
+
+	// GUARDED_BY(mu)
+	rand *rand.Rand
+
+	// GUARDED_BY(mu)
+	fired []Injection
+}
+
+type injectionRule struct {
+	err syscall.Errno
+
+	// If non-zero, inject on every nth call. Otherwise inject with the given
+	// probability.
+	nth         int
+	probability float64
+
+	// The number of ops of this type seen so far.
+	calls int
+}
+
+var _ FileSystem = &ErrorInjector{}
+
+// NewErrorInjector creates an injector wrapping the supplied file system.
+// Initially no errors are injected.
+func NewErrorInjector(wrapped FileSystem) (ei *ErrorInjector) {
+	ei = &ErrorInjector{
+		wrapped: wrapped,
+		rules:   make(map[reflect.Type]*injectionRule),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	return
+}
+
+// InjectEveryNth causes the injector to return the supplied error for every
+// nth op of the supplied type (the nth, the 2nth, and so on), replacing any
+// rule previously set for that type.
+//
+// The type is that of a pointer to the op struct, e.g.
+// reflect.TypeOf(&fuseops.WriteFileOp{}).
+//
+// LOCKS_EXCLUDED(ei.mu)
+func (ei *ErrorInjector) InjectEveryNth(
+	t reflect.Type,
+	n int,
+	err syscall.Errno) {
+	if n <= 0 {
+		panic("n must be positive")
+	}
+
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	ei.rules[t] = &injectionRule{err: err, nth: n}
+}
+
+// InjectWithProbability causes the injector to return the supplied error for
+// each op of the supplied type with probability p, replacing any rule
+// previously set for that type.
+//
+// LOCKS_EXCLUDED(ei.mu)
+func (ei *ErrorInjector) InjectWithProbability(
+	t reflect.Type,
+	p float64,
+	err syscall.Errno) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	ei.rules[t] = &injectionRule{err: err, probability: p}
+}
+
+// Clear removes any rule for the supplied op type.
+//
+// LOCKS_EXCLUDED(ei.mu)
+func (ei *ErrorInjector) Clear(t reflect.Type) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	delete(ei.rules, t)
+}
+
+// Seed seeds the source of randomness used by InjectWithProbability, for
+// reproducible tests.
+//
+// LOCKS_EXCLUDED(ei.mu)
+func (ei *ErrorInjector) Seed(seed int64) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	ei.rand.Seed(seed)
+}
+
+// Fired returns the injections that have happened so far, in order.
+//
+// LOCKS_EXCLUDED(ei.mu)
+func (ei *ErrorInjector) Fired() (injections []Injection) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	injections = append(injections, ei.fired...)
+	return
+}
+
+// Return the error to inject for the supplied op, or nil if it should be
+// passed through.
+//
+// LOCKS_EXCLUDED(ei.mu)
+func (ei *ErrorInjector) inject(op interface{}) (err error) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+
+	t := reflect.TypeOf(op)
+	r, ok := ei.rules[t]
+	if !ok {
+		return
+	}
+
+	r.calls++
+
+	var fire bool
+	if r.nth != 0 {
+		fire = r.calls%r.nth == 0
+	} else {
+		fire = ei.rand.Float64() < r.probability
+	}
+
+	if !fire {
+		return
+	}
+
+	ei.fired = append(ei.fired, Injection{
+		Type: t,
+		Call: r.calls,
+		Err:  r.err,
+	})
+
+	err = r.err
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// File system methods
+////////////////////////////////////////////////////////////////////////
+
+func (ei *ErrorInjector) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.StatFS(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.LookUpInode(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.GetInodeAttributes(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.SetInodeAttributes(ctx, op)
+	return
+}
+
+// ForgetInode is always passed through, since the kernel ignores the result
+// and failing it would only leak lookup counts in the wrapped file system.
+func (ei *ErrorInjector) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	err = ei.wrapped.ForgetInode(ctx, op)
+	return
+}
+
+// BatchForget is always passed through, as ForgetInode is.
+func (ei *ErrorInjector) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	err = ei.wrapped.BatchForget(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.MkDir(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.MkNode(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.CreateFile(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.CreateLink(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.CreateSymlink(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.Rename(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.RmDir(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.Unlink(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.OpenDir(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ReadDir(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ReadDirPlus(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ReleaseDirHandle(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.OpenFile(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ReadFile(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.WriteFile(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.Fallocate(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.CopyFileRange(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.Ioctl(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.Poll(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.SyncFile(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.FlushFile(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ReleaseFileHandle(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ReadSymlink(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.RemoveXattr(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.GetXattr(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.ListXattr(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.SetXattr(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.GetLock(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.SetLock(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) SetLockWait(
+	ctx context.Context,
+	op *fuseops.SetLockWaitOp) (err error) {
+	if err = ei.inject(op); err != nil {
+		return
+	}
+
+	err = ei.wrapped.SetLockWait(ctx, op)
+	return
+}
+
+func (ei *ErrorInjector) Destroy() {
+	ei.wrapped.Destroy()
+}
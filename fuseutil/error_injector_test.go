@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestErrorInjector(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+const sinkInodeID = fuseops.RootInodeID + 1
+
+// A file system containing a single file named "sink" that accepts and
+// discards all writes.
+type sinkFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *sinkFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0666,
+	}
+}
+
+func (fs *sinkFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "sink" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = sinkInodeID
+	op.Entry.Attributes = fs.attributes(sinkInodeID)
+
+	return
+}
+
+func (fs *sinkFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *sinkFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *sinkFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	return
+}
+
+func (fs *sinkFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ErrorInjectorTest struct {
+	samples.SampleTest
+	injector *fuseutil.ErrorInjector
+}
+
+var _ SetUpInterface = &ErrorInjectorTest{}
+var _ TearDownInterface = &ErrorInjectorTest{}
+
+func init() { RegisterTestSuite(&ErrorInjectorTest{}) }
+
+func (t *ErrorInjectorTest) SetUp(ti *TestInfo) {
+	// Make sure that each write(2) turns into exactly one WriteFileOp.
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.injector = fuseutil.NewErrorInjector(&sinkFS{})
+	t.Server = fuseutil.NewFileSystemServer(t.injector)
+
+	t.SampleTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ErrorInjectorTest) EveryThirdWrite() {
+	writeType := reflect.TypeOf(&fuseops.WriteFileOp{})
+	t.injector.InjectEveryNth(writeType, 3, syscall.ENOSPC)
+
+	f, err := os.OpenFile(path.Join(t.Dir, "sink"), os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	// Write nine times, checking the results.
+	for i := 1; i <= 9; i++ {
+		_, err = f.Write([]byte("taco"))
+		if i%3 == 0 {
+			pathErr, ok := err.(*os.PathError)
+			AssertTrue(ok, "write %d: %v", i, err)
+			ExpectEq(syscall.ENOSPC, pathErr.Err, "write %d", i)
+		} else {
+			ExpectEq(nil, err, "write %d", i)
+		}
+	}
+
+	// The injector should agree.
+	fired := t.injector.Fired()
+	AssertEq(3, len(fired))
+	for i, inj := range fired {
+		ExpectEq(writeType, inj.Type)
+		ExpectEq(3*(i+1), inj.Call)
+		ExpectEq(syscall.ENOSPC, inj.Err)
+	}
+}
+
+func (t *ErrorInjectorTest) OtherOpsUnaffected() {
+	t.injector.InjectWithProbability(
+		reflect.TypeOf(&fuseops.WriteFileOp{}),
+		1,
+		syscall.ENOSPC)
+
+	// Opening and statting work fine.
+	f, err := os.OpenFile(path.Join(t.Dir, "sink"), os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	_, err = f.Stat()
+	AssertEq(nil, err)
+
+	// But writing always fails.
+	_, err = f.Write([]byte("taco"))
+	ExpectNe(nil, err)
+	ExpectEq(1, len(t.injector.Fired()))
+}
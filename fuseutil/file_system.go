@@ -15,7 +15,7 @@
 package fuseutil
 
 import (
-	"io"
+	"fmt"
 	"sync"
 
 	"golang.org/x/net/context"
@@ -40,6 +40,12 @@ type FileSystem interface {
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
+
+	// If this returns ENOSYS, as NotImplementedFileSystem's implementation
+	// does, the server answers BatchForgetOp by calling ForgetInode for each
+	// of its entries instead.
+	BatchForget(context.Context, *fuseops.BatchForgetOp) error
+
 	MkDir(context.Context, *fuseops.MkDirOp) error
 	MkNode(context.Context, *fuseops.MkNodeOp) error
 	CreateFile(context.Context, *fuseops.CreateFileOp) error
@@ -50,10 +56,19 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+
+	// If this returns ENOSYS, as NotImplementedFileSystem's implementation
+	// does, the server answers ReadDirPlusOp by calling ReadDir instead.
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
+
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
 	WriteFile(context.Context, *fuseops.WriteFileOp) error
+	Fallocate(context.Context, *fuseops.FallocateOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
+	Ioctl(context.Context, *fuseops.IoctlOp) error
+	Poll(context.Context, *fuseops.PollOp) error
 	SyncFile(context.Context, *fuseops.SyncFileOp) error
 	FlushFile(context.Context, *fuseops.FlushFileOp) error
 	ReleaseFileHandle(context.Context, *fuseops.ReleaseFileHandleOp) error
@@ -62,10 +77,19 @@ type FileSystem interface {
 	GetXattr(context.Context, *fuseops.GetXattrOp) error
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
+	GetLock(context.Context, *fuseops.GetLockOp) error
+	SetLock(context.Context, *fuseops.SetLockOp) error
+	SetLockWait(context.Context, *fuseops.SetLockWaitOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
 	// system. No further calls to the file system will be made.
+	//
+	// This is called exactly once, when the mount is torn down (after the
+	// kernel's FUSE_DESTROY request, if it sends one) and every op in flight
+	// has been responded to, and before fuse.MountedFileSystem.Join returns.
+	// It is the place for a persistent file system to write a final
+	// checkpoint. NotImplementedFileSystem's implementation does nothing.
 	Destroy()
 }
 
@@ -73,15 +97,42 @@ type FileSystem interface {
 // method.Respond with the resulting error. Unsupported ops are responded to
 // directly with ENOSYS.
 //
-// Each call to a FileSystem method (except ForgetInode) is made on
-// its own goroutine, and is free to block. ForgetInode may be called
-// synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// Each call to a FileSystem method (except ForgetInode and BatchForget) is
+// made on its own goroutine, and is free to block. ForgetInode and BatchForget
+// may be called synchronously, and should not depend on calls to other
+// methods being received concurrently.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
 // cf. http://goo.gl/jnkHPO, fuse-devel thread "Fuse guarantees on concurrent
 // requests").
+//
+// The returned server may be passed to several calls to fuse.Mount, so that
+// one FileSystem backs file systems mounted at several paths. Each mount has
+// its own connection to the kernel, with its own state, but ops from all of
+// them are delivered to the same FileSystem, which must therefore be prepared
+// for the following:
+//
+//  *  The kernel keeps a separate lookup count for each mount, so an inode is
+//     looked up and forgotten independently through each one. A file system
+//     that adds up lookups and forgets per inode ID, as described on
+//     ForgetInodeOp, stays correct without knowing which mount an op came
+//     from.
+//
+//  *  File and directory handles from all mounts share a single namespace, so
+//     the file system must not mint the same handle ID for two of them.
+//
+//  *  Each mount caches entries, attributes, and contents independently. A
+//     change made through one mount doesn't invalidate what the kernel has
+//     cached for the others, so a file system whose state is shared between
+//     mounts must either use short expiration times or invalidate the kernel's
+//     caches through every mount's connection (see
+//     fuse.Connection.InvalidateInode) in order for users of one mount to see
+//     changes made through another promptly.
+//
+//  *  Destroy is called only once, when the server has stopped serving every
+//     mount it was serving. Mount all of the file systems before unmounting
+//     any of them, or Destroy may be called early.
 func NewFileSystemServer(fs FileSystem) fuse.Server {
 	return NewFileSystemServerWithRecover(fs, nil)
 }
@@ -96,10 +147,10 @@ func NewFileSystemServer(fs FileSystem) fuse.Server {
 // to re-panic or stop the execution gracefully.
 // If panicHandler is nil, it will be ignored.
 //
-// Each call to a FileSystem method (except ForgetInode) is made on
-// its own goroutine, and is free to block. ForgetInode may be called
-// synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// Each call to a FileSystem method (except ForgetInode and BatchForget) is
+// made on its own goroutine, and is free to block. ForgetInode and BatchForget
+// may be called synchronously, and should not depend on calls to other
+// methods being received concurrently.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
@@ -122,6 +173,14 @@ type fileSystemServer struct {
 	opsInFlight       sync.WaitGroup
 	handleOpFunc      func(*fileSystemServer)
 	filesystemRecover func(interface{})
+
+	mu sync.Mutex
+
+	// The number of calls to ServeOps that haven't yet returned, one for each
+	// mount served by this server.
+	//
+	// GUARDED_BY(mu)
+	serving int
 }
 
 var (
@@ -138,31 +197,42 @@ var (
 )
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
-	// When we are done, we clean up by waiting for all in-flight ops then
-	// destroying the file system.
+	s.mu.Lock()
+	s.serving++
+	s.mu.Unlock()
+
+	// When the last mount we are serving is done, we clean up by waiting for all
+	// in-flight ops then destroying the file system.
 	defer func() {
-		s.opsInFlight.Wait()
-		s.fs.Destroy()
+		s.mu.Lock()
+		s.serving--
+		last := s.serving == 0
+		s.mu.Unlock()
+
+		if last {
+			s.opsInFlight.Wait()
+			s.fs.Destroy()
+		}
 	}()
 
 	for {
+		// Stop on any error. The connection is unusable, and the reason is
+		// reported by fuse.MountedFileSystem.Join.
 		ctx, op, err := c.ReadOp()
-		if err == io.EOF {
-			break
-		}
-
 		if err != nil {
-			panic(err)
+			break
 		}
 
 		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
 			// Special case: call in this goroutine for
 			// forget inode ops, which may come in a
 			// flurry from the kernel and are generally
 			// cheap for the file system to handle
 			s.handleOp(c, ctx, op)
-		} else {
+
+		default:
 			go s.handleOp(c, ctx, op)
 		}
 	}
@@ -175,92 +245,202 @@ func (s *fileSystemServer) handleOp(
 	defer s.handleOpFunc(s)
 
 	// Dispatch to the appropriate method.
-	var err error
+	err := dispatchOp(s.fs, ctx, op)
+
+	// Fall back to plain ReadDir if the file system doesn't support
+	// ReadDirPlus.
+	if typed, ok := op.(*fuseops.ReadDirPlusOp); ok && err == fuse.ENOSYS {
+		err = s.readDirWithoutAttributes(ctx, typed)
+	}
+
+	// Likewise fall back to ForgetInode if the file system doesn't support
+	// BatchForget.
+	if typed, ok := op.(*fuseops.BatchForgetOp); ok && err == fuse.ENOSYS {
+		err = s.forgetEach(ctx, typed)
+	}
+
+	c.Reply(ctx, err)
+}
+
+// Call the FileSystem method for the supplied op, returning ENOSYS for ops
+// that have none.
+func dispatchOp(
+	fs FileSystem,
+	ctx context.Context,
+	op interface{}) (err error) {
 	switch typed := op.(type) {
 	default:
 		err = fuse.ENOSYS
 
 	case *fuseops.StatFSOp:
-		err = s.fs.StatFS(ctx, typed)
+		err = fs.StatFS(ctx, typed)
 
 	case *fuseops.LookUpInodeOp:
-		err = s.fs.LookUpInode(ctx, typed)
+		err = fs.LookUpInode(ctx, typed)
 
 	case *fuseops.GetInodeAttributesOp:
-		err = s.fs.GetInodeAttributes(ctx, typed)
+		err = fs.GetInodeAttributes(ctx, typed)
 
 	case *fuseops.SetInodeAttributesOp:
-		err = s.fs.SetInodeAttributes(ctx, typed)
+		err = fs.SetInodeAttributes(ctx, typed)
 
 	case *fuseops.ForgetInodeOp:
-		err = s.fs.ForgetInode(ctx, typed)
+		err = fs.ForgetInode(ctx, typed)
+
+	case *fuseops.BatchForgetOp:
+		err = fs.BatchForget(ctx, typed)
 
 	case *fuseops.MkDirOp:
-		err = s.fs.MkDir(ctx, typed)
+		err = fs.MkDir(ctx, typed)
 
 	case *fuseops.MkNodeOp:
-		err = s.fs.MkNode(ctx, typed)
+		err = fs.MkNode(ctx, typed)
 
 	case *fuseops.CreateFileOp:
-		err = s.fs.CreateFile(ctx, typed)
+		err = fs.CreateFile(ctx, typed)
 
 	case *fuseops.CreateLinkOp:
-		err = s.fs.CreateLink(ctx, typed)
+		err = fs.CreateLink(ctx, typed)
 
 	case *fuseops.CreateSymlinkOp:
-		err = s.fs.CreateSymlink(ctx, typed)
+		err = fs.CreateSymlink(ctx, typed)
 
 	case *fuseops.RenameOp:
-		err = s.fs.Rename(ctx, typed)
+		err = fs.Rename(ctx, typed)
 
 	case *fuseops.RmDirOp:
-		err = s.fs.RmDir(ctx, typed)
+		err = fs.RmDir(ctx, typed)
 
 	case *fuseops.UnlinkOp:
-		err = s.fs.Unlink(ctx, typed)
+		err = fs.Unlink(ctx, typed)
 
 	case *fuseops.OpenDirOp:
-		err = s.fs.OpenDir(ctx, typed)
+		err = fs.OpenDir(ctx, typed)
 
 	case *fuseops.ReadDirOp:
-		err = s.fs.ReadDir(ctx, typed)
+		err = fs.ReadDir(ctx, typed)
+
+	case *fuseops.ReadDirPlusOp:
+		err = fs.ReadDirPlus(ctx, typed)
 
 	case *fuseops.ReleaseDirHandleOp:
-		err = s.fs.ReleaseDirHandle(ctx, typed)
+		err = fs.ReleaseDirHandle(ctx, typed)
 
 	case *fuseops.OpenFileOp:
-		err = s.fs.OpenFile(ctx, typed)
+		err = fs.OpenFile(ctx, typed)
 
 	case *fuseops.ReadFileOp:
-		err = s.fs.ReadFile(ctx, typed)
+		err = fs.ReadFile(ctx, typed)
 
 	case *fuseops.WriteFileOp:
-		err = s.fs.WriteFile(ctx, typed)
+		err = fs.WriteFile(ctx, typed)
+
+	case *fuseops.FallocateOp:
+		err = fs.Fallocate(ctx, typed)
+
+	case *fuseops.CopyFileRangeOp:
+		err = fs.CopyFileRange(ctx, typed)
+
+	case *fuseops.IoctlOp:
+		err = fs.Ioctl(ctx, typed)
+
+	case *fuseops.PollOp:
+		err = fs.Poll(ctx, typed)
 
 	case *fuseops.SyncFileOp:
-		err = s.fs.SyncFile(ctx, typed)
+		err = fs.SyncFile(ctx, typed)
 
 	case *fuseops.FlushFileOp:
-		err = s.fs.FlushFile(ctx, typed)
+		err = fs.FlushFile(ctx, typed)
 
 	case *fuseops.ReleaseFileHandleOp:
-		err = s.fs.ReleaseFileHandle(ctx, typed)
+		err = fs.ReleaseFileHandle(ctx, typed)
 
 	case *fuseops.ReadSymlinkOp:
-		err = s.fs.ReadSymlink(ctx, typed)
+		err = fs.ReadSymlink(ctx, typed)
 
 	case *fuseops.RemoveXattrOp:
-		err = s.fs.RemoveXattr(ctx, typed)
+		err = fs.RemoveXattr(ctx, typed)
 
 	case *fuseops.GetXattrOp:
-		err = s.fs.GetXattr(ctx, typed)
+		err = fs.GetXattr(ctx, typed)
 
 	case *fuseops.ListXattrOp:
-		err = s.fs.ListXattr(ctx, typed)
+		err = fs.ListXattr(ctx, typed)
 
 	case *fuseops.SetXattrOp:
-		err = s.fs.SetXattr(ctx, typed)
+		err = fs.SetXattr(ctx, typed)
+
+	case *fuseops.GetLockOp:
+		err = fs.GetLock(ctx, typed)
+
+	case *fuseops.SetLockOp:
+		err = fs.SetLock(ctx, typed)
+
+	case *fuseops.SetLockWaitOp:
+		err = fs.SetLockWait(ctx, typed)
 	}
 
-	c.Reply(ctx, err)
+	return
+}
+
+// Answer a BatchForgetOp with a ForgetInodeOp for each of its entries. Every
+// entry is forgotten even if some fail, and the first error is returned.
+func (s *fileSystemServer) forgetEach(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	for _, e := range op.Entries {
+		forgetOp := &fuseops.ForgetInodeOp{
+			Inode: e.Inode,
+			N:     e.N,
+		}
+
+		if forgetErr := s.fs.ForgetInode(ctx, forgetOp); err == nil {
+			err = forgetErr
+		}
+	}
+
+	return
+}
+
+// Answer a ReadDirPlusOp for a file system that doesn't implement
+// ReadDirPlus, using its ReadDir method and giving the kernel no attributes.
+func (s *fileSystemServer) readDirWithoutAttributes(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) (err error) {
+	// Plain entries are smaller than those with attributes, so a read of the
+	// same size returns at least as many entries as will fit.
+	readOp := &fuseops.ReadDirOp{
+		Inode:  op.Inode,
+		Handle: op.Handle,
+		Offset: op.Offset,
+		Dst:    make([]byte, len(op.Dst)),
+	}
+
+	if err = s.fs.ReadDir(ctx, readOp); err != nil {
+		return
+	}
+
+	// Copy over as many entries as fit. Those that don't will be read again
+	// next time, starting from the offset of the last one that did.
+	buf := readOp.Dst[:readOp.BytesRead]
+	for len(buf) > 0 {
+		d, direntLen := readDirent(buf)
+		if direntLen == 0 {
+			err = fmt.Errorf(
+				"ReadDir returned a corrupt entry at offset %d",
+				readOp.BytesRead-len(buf))
+			return
+		}
+
+		n := WriteDirentPlus(op.Dst[op.BytesRead:], DirentPlus{Dirent: d})
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+		buf = buf[direntLen:]
+	}
+
+	return
 }
@@ -0,0 +1,314 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// A sinkFS that counts calls to Destroy.
+type destroyCountingFS struct {
+	sinkFS
+
+	mu        sync.Mutex
+	destroyed int // GUARDED_BY(mu)
+}
+
+func (fs *destroyCountingFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.destroyed++
+}
+
+func (fs *destroyCountingFS) Destroyed() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.destroyed
+}
+
+func TestFileSystemServer_MultipleMounts(t *testing.T) {
+	ctx := context.Background()
+	fs := &destroyCountingFS{}
+	server := fuseutil.NewFileSystemServer(fs)
+
+	// Mount the same server twice.
+	var mfss []*fuse.MountedFileSystem
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "file_system_test")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+		if err != nil {
+			t.Fatalf("Mount: %v", err)
+		}
+
+		mfss = append(mfss, mfs)
+	}
+
+	// Both mounts work.
+	for _, mfs := range mfss {
+		if _, err := os.Stat(path.Join(mfs.Dir(), "sink")); err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+	}
+
+	// Unmounting the first doesn't destroy the file system, and the second
+	// keeps working.
+	if err := fuse.Unmount(mfss[0].Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfss[0].Join(ctx); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if got := fs.Destroyed(); got != 0 {
+		t.Errorf("Destroyed %d times after first unmount", got)
+	}
+
+	if _, err := os.Stat(path.Join(mfss[1].Dir(), "sink")); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	// Unmounting the second does.
+	if err := fuse.Unmount(mfss[1].Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfss[1].Join(ctx); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if got := fs.Destroyed(); got != 1 {
+		t.Errorf("Destroyed %d times after second unmount", got)
+	}
+}
+
+func TestFileSystemServer_Destroy(t *testing.T) {
+	ctx := context.Background()
+	fs := &destroyCountingFS{}
+
+	dir, err := ioutil.TempDir("", "file_system_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(mfs.Dir(), "sink")); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	if got := fs.Destroyed(); got != 0 {
+		t.Errorf("Destroyed %d times while mounted", got)
+	}
+
+	// Once Join returns, the file system has been destroyed exactly once.
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if got := fs.Destroyed(); got != 1 {
+		t.Errorf("Destroyed %d times after unmount", got)
+	}
+}
+
+// A file system that keeps lookup counts for a few inodes, decrementing them
+// as they are forgotten.
+type forgetCountingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu     sync.Mutex
+	counts map[fuseops.InodeID]uint64 // GUARDED_BY(mu)
+}
+
+func (fs *forgetCountingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.counts[op.Inode] -= op.N
+	return
+}
+
+// A version of forgetCountingFS that handles batches itself.
+type batchForgetCountingFS struct {
+	forgetCountingFS
+	batches int // GUARDED_BY(mu)
+}
+
+func (fs *batchForgetCountingFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.batches++
+	for _, e := range op.Entries {
+		fs.counts[e.Inode] -= e.N
+	}
+
+	return
+}
+
+// Serve the supplied file system over a socket, playing the kernel's part:
+// complete the init handshake, send a FUSE_BATCH_FORGET with the supplied
+// entries, and hang up. Return once the server has finished.
+func sendBatchForget(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	entries []fusekernel.ForgetOne) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	kernelSide := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernelSide.Close()
+
+	// Queue the init request, which MountWithFD reads and replies to.
+	var initMsg struct {
+		header fusekernel.InHeader
+		in     fusekernel.InitIn
+	}
+
+	initMsg.header.Len = uint32(unsafe.Sizeof(initMsg))
+	initMsg.header.Opcode = fusekernel.OpInit
+	initMsg.header.Unique = 1
+	initMsg.in.Major = fuse.MaxProtocolVersion.Major
+	initMsg.in.Minor = fuse.MaxProtocolVersion.Minor
+
+	_, err = kernelSide.Write((*[unsafe.Sizeof(initMsg)]byte)(unsafe.Pointer(&initMsg))[:])
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "file_system_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mfs, err := fuse.MountWithFD(
+		dir,
+		fds[0],
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("MountWithFD: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	if _, err := kernelSide.Read(buf); err != nil {
+		t.Fatalf("Read init reply: %v", err)
+	}
+
+	// Send the batch forget, which gets no reply.
+	var forgetMsg struct {
+		header fusekernel.InHeader
+		in     fusekernel.BatchForgetIn
+	}
+
+	forgetMsg.header.Opcode = fusekernel.OpBatchForget
+	forgetMsg.header.Unique = 2
+	forgetMsg.in = fusekernel.BatchForgetIn{Count: uint32(len(entries))}
+
+	msg := (*[unsafe.Sizeof(forgetMsg)]byte)(unsafe.Pointer(&forgetMsg))[:]
+	for i := range entries {
+		e := (*[unsafe.Sizeof(entries[i])]byte)(unsafe.Pointer(&entries[i]))
+		msg = append(msg, e[:]...)
+	}
+
+	(*fusekernel.InHeader)(unsafe.Pointer(&msg[0])).Len = uint32(len(msg))
+	if _, err := kernelSide.Write(msg); err != nil {
+		t.Fatalf("Write batch forget: %v", err)
+	}
+
+	// Hang up, and wait for the server to see that.
+	kernelSide.Close()
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+}
+
+func TestFileSystemServer_BatchForget(t *testing.T) {
+	entries := []fusekernel.ForgetOne{
+		{Nodeid: 17, Nlookup: 2},
+		{Nodeid: 19, Nlookup: 1},
+		{Nodeid: 17, Nlookup: 1},
+	}
+
+	newCounts := func() map[fuseops.InodeID]uint64 {
+		return map[fuseops.InodeID]uint64{17: 5, 19: 1, 23: 1}
+	}
+
+	want := map[fuseops.InodeID]uint64{17: 2, 19: 0, 23: 1}
+
+	// A file system without BatchForget gets a ForgetInode per entry.
+	fs := &forgetCountingFS{counts: newCounts()}
+	sendBatchForget(t, fs, entries)
+
+	for inode, count := range want {
+		if fs.counts[inode] != count {
+			t.Errorf("ForgetInode: inode %v has count %d, want %d", inode, fs.counts[inode], count)
+		}
+	}
+
+	// One with BatchForget gets the batch whole.
+	batchFS := &batchForgetCountingFS{}
+	batchFS.counts = newCounts()
+	sendBatchForget(t, batchFS, entries)
+
+	if batchFS.batches != 1 {
+		t.Errorf("BatchForget called %d times", batchFS.batches)
+	}
+
+	for inode, count := range want {
+		if batchFS.counts[inode] != count {
+			t.Errorf("BatchForget: inode %v has count %d, want %d", inode, batchFS.counts[inode], count)
+		}
+	}
+}
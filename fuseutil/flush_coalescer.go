@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// NewFlushCoalescer wraps the supplied file system so that FlushFileOps for
+// the same inode that arrive within the supplied window of each other are
+// combined into a single call to the wrapped file system's FlushFile. This is
+// intended for file systems where a flush triggers an expensive commit to a
+// backing store, and where many handles to the same file tend to be closed in
+// a burst.
+//
+// The first FlushFileOp for an inode opens a window. Any further ops for the
+// inode that arrive before the window closes join it. When it closes, the
+// wrapped file system is called once, with the first op, and every joined op
+// receives the result. An op that arrives while that call is in progress opens
+// a new window, since its data may not be covered by the commit that is
+// already underway. All other ops are passed through unmodified.
+//
+// Durability: no op returns until a flush that started after it arrived has
+// completed, so a successful close(2) still means what it did without the
+// coalescer. The cost is that each close(2) may be delayed by up to the
+// window. Because only one handle is passed to the wrapped file system, its
+// FlushFile must commit everything written to the inode through any handle,
+// not just the one it is given.
+func NewFlushCoalescer(
+	wrapped FileSystem,
+	window time.Duration) FileSystem {
+	return &flushCoalescer{
+		FileSystem: wrapped,
+		window:     window,
+		batches:    make(map[fuseops.InodeID]*flushBatch),
+	}
+}
+
+type flushCoalescer struct {
+	// The wrapped file system, to which everything but FlushFile is delegated.
+	FileSystem
+
+	window time.Duration
+
+	mu sync.Mutex
+
+	// The currently open window for each inode, if any. A batch is removed
+	// from the map when its window closes, before the wrapped file system is
+	// called.
+	//
+	// GUARDED_BY(mu)
+	batches map[fuseops.InodeID]*flushBatch
+}
+
+type flushBatch struct {
+	// Closed when the flush has completed, after which err is set.
+	done chan struct{}
+	err  error
+}
+
+// LOCKS_EXCLUDED(fc.mu)
+func (fc *flushCoalescer) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	fc.mu.Lock()
+	b, ok := fc.batches[op.Inode]
+	if !ok {
+		b = &flushBatch{done: make(chan struct{})}
+		fc.batches[op.Inode] = b
+
+		time.AfterFunc(fc.window, func() { fc.flush(ctx, op, b) })
+	}
+	fc.mu.Unlock()
+
+	<-b.done
+	err = b.err
+	return
+}
+
+// Close the batch's window and flush it.
+//
+// LOCKS_EXCLUDED(fc.mu)
+func (fc *flushCoalescer) flush(
+	ctx context.Context,
+	op *fuseops.FlushFileOp,
+	b *flushBatch) {
+	fc.mu.Lock()
+	delete(fc.batches, op.Inode)
+	fc.mu.Unlock()
+
+	b.err = fc.FileSystem.FlushFile(ctx, op)
+	close(b.done)
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFlushCoalescer(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A sinkFS that counts the flushes it receives, taking a little while over
+// each one in the manner of a commit to a backing store.
+type flushCountingFS struct {
+	sinkFS
+
+	mu      sync.Mutex
+	flushes int // GUARDED_BY(mu)
+	err     error
+}
+
+func (fs *flushCountingFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	time.Sleep(10 * time.Millisecond)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.flushes++
+	err = fs.err
+	return
+}
+
+func (fs *flushCountingFS) Flushes() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.flushes
+}
+
+// Call f n times concurrently, returning the errors.
+func concurrently(n int, f func() error) (errs []error) {
+	errs = make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f()
+		}(i)
+	}
+
+	wg.Wait()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Unit tests
+////////////////////////////////////////////////////////////////////////
+
+func TestFlushCoalescer_Burst(t *testing.T) {
+	wrapped := &flushCountingFS{}
+	fs := fuseutil.NewFlushCoalescer(wrapped, 50*time.Millisecond)
+
+	errs := concurrently(10, func() error {
+		return fs.FlushFile(
+			context.Background(),
+			&fuseops.FlushFileOp{Inode: sinkInodeID})
+	})
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("FlushFile %d: %v", i, err)
+		}
+	}
+
+	if n := wrapped.Flushes(); n != 1 {
+		t.Errorf("Wrapped file system saw %d flushes, expected 1", n)
+	}
+}
+
+func TestFlushCoalescer_ErrorsShared(t *testing.T) {
+	wrapped := &flushCountingFS{err: syscall.EIO}
+	fs := fuseutil.NewFlushCoalescer(wrapped, 50*time.Millisecond)
+
+	errs := concurrently(3, func() error {
+		return fs.FlushFile(
+			context.Background(),
+			&fuseops.FlushFileOp{Inode: sinkInodeID})
+	})
+
+	for i, err := range errs {
+		if err != syscall.EIO {
+			t.Errorf("FlushFile %d: %v, expected EIO", i, err)
+		}
+	}
+}
+
+func TestFlushCoalescer_InodesIndependent(t *testing.T) {
+	wrapped := &flushCountingFS{}
+	fs := fuseutil.NewFlushCoalescer(wrapped, 50*time.Millisecond)
+
+	var mu sync.Mutex
+	next := fuseops.InodeID(100)
+
+	concurrently(4, func() error {
+		mu.Lock()
+		inode := next
+		next++
+		mu.Unlock()
+
+		return fs.FlushFile(
+			context.Background(),
+			&fuseops.FlushFileOp{Inode: inode})
+	})
+
+	if n := wrapped.Flushes(); n != 4 {
+		t.Errorf("Wrapped file system saw %d flushes, expected 4", n)
+	}
+}
+
+func TestFlushCoalescer_SequentialNotCoalesced(t *testing.T) {
+	wrapped := &flushCountingFS{}
+	fs := fuseutil.NewFlushCoalescer(wrapped, time.Millisecond)
+
+	// Each flush waits for its own commit, so none can share.
+	for i := 0; i < 3; i++ {
+		err := fs.FlushFile(
+			context.Background(),
+			&fuseops.FlushFileOp{Inode: sinkInodeID})
+
+		if err != nil {
+			t.Fatalf("FlushFile %d: %v", i, err)
+		}
+	}
+
+	if n := wrapped.Flushes(); n != 3 {
+		t.Errorf("Wrapped file system saw %d flushes, expected 3", n)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Mounted
+////////////////////////////////////////////////////////////////////////
+
+type FlushCoalescerTest struct {
+	samples.SampleTest
+	wrapped *flushCountingFS
+}
+
+var _ SetUpInterface = &FlushCoalescerTest{}
+var _ TearDownInterface = &FlushCoalescerTest{}
+
+func init() { RegisterTestSuite(&FlushCoalescerTest{}) }
+
+func (t *FlushCoalescerTest) SetUp(ti *TestInfo) {
+	t.wrapped = &flushCountingFS{}
+	t.Server = fuseutil.NewFileSystemServer(
+		fuseutil.NewFlushCoalescer(t.wrapped, 100*time.Millisecond))
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *FlushCoalescerTest) ManyHandlesClosedAtOnce() {
+	const n = 10
+
+	// Open several handles to the same file.
+	var files []*os.File
+	for i := 0; i < n; i++ {
+		f, err := os.OpenFile(path.Join(t.Dir, "sink"), os.O_WRONLY, 0)
+		AssertEq(nil, err)
+		files = append(files, f)
+	}
+
+	// Close them all at once.
+	var mu sync.Mutex
+	errs := concurrently(n, func() error {
+		mu.Lock()
+		f := files[0]
+		files = files[1:]
+		mu.Unlock()
+
+		return f.Close()
+	})
+
+	for i, err := range errs {
+		ExpectEq(nil, err, "close %d", i)
+	}
+
+	// The file system should have seen fewer flushes than closes.
+	flushes := t.wrapped.Flushes()
+	ExpectGe(flushes, 1)
+	ExpectLt(flushes, n)
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import "github.com/sbg/fuse"
+
+// The maximum number of links that FollowLinks follows by default. This
+// matches the limit that Linux applies to symlinks during path resolution
+// (MAXSYMLINKS).
+const DefaultMaxLinkDepth = 40
+
+// FollowLinks resolves a chain of links that a file system follows itself,
+// rather than exposing them to the kernel as symlinks.
+//
+// The kernel resolves the symlinks that a file system returns from
+// ReadSymlinkOp, and fails with ELOOP when they form a cycle. But a file
+// system that follows links internally, for example so that a lookup of an
+// alias returns the inode that it refers to, gets no such protection: a cycle
+// would have it loop forever while the kernel waits. Such a file system must
+// bound the number of links it follows, and return ELOOP when that is
+// exceeded.
+//
+// FollowLinks starts from the supplied name and repeatedly calls next, which
+// returns the name that a link refers to, or ok == false if the name isn't a
+// link. It returns the first name that isn't a link, or fuse.ELOOP if that
+// takes more than maxDepth steps. Pass DefaultMaxLinkDepth to behave as the
+// kernel does. Errors from next are returned unmodified.
+func FollowLinks(
+	name string,
+	maxDepth int,
+	next func(name string) (target string, ok bool, err error)) (
+	resolved string, err error) {
+	resolved = name
+	for depth := 0; ; depth++ {
+		var target string
+		var ok bool
+
+		target, ok, err = next(resolved)
+		if err != nil || !ok {
+			return
+		}
+
+		if depth == maxDepth {
+			err = fuse.ELOOP
+			return
+		}
+
+		resolved = target
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+func TestFollowLinks(t *testing.T) {
+	links := map[string]string{
+		"a":    "b",
+		"b":    "c",
+		"loop": "loop",
+	}
+
+	next := func(name string) (target string, ok bool, err error) {
+		if name == "broken" {
+			err = errors.New("taco")
+			return
+		}
+
+		target, ok = links[name]
+		return
+	}
+
+	testCases := []struct {
+		name     string
+		maxDepth int
+		resolved string
+		err      error
+	}{
+		{"c", 0, "c", nil},
+		{"a", 2, "c", nil},
+		{"a", 1, "", fuse.ELOOP},
+		{"loop", fuseutil.DefaultMaxLinkDepth, "", fuse.ELOOP},
+	}
+
+	for _, tc := range testCases {
+		resolved, err := fuseutil.FollowLinks(tc.name, tc.maxDepth, next)
+		if err != tc.err {
+			t.Errorf("%s (depth %d): got error %v, want %v", tc.name, tc.maxDepth, err, tc.err)
+			continue
+		}
+
+		if err == nil && resolved != tc.resolved {
+			t.Errorf("%s (depth %d): got %q, want %q", tc.name, tc.maxDepth, resolved, tc.resolved)
+		}
+	}
+
+	// Errors are passed through.
+	if _, err := fuseutil.FollowLinks("broken", 1, next); err == nil || err.Error() != "taco" {
+		t.Errorf("broken: got error %v", err)
+	}
+}
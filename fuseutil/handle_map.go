@@ -0,0 +1,302 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+)
+
+// The value stored in a HandleMap for a handle that has been marked dead.
+type deadHandle struct{}
+
+// HandleMap allocates handle IDs for a file system and maps them to whatever
+// state it keeps for an open file or directory, e.g. a connection to a
+// backend.
+//
+// The kernel owns the lifetime of a handle: it stays valid until the kernel
+// sends ReleaseFileHandleOp or ReleaseDirHandleOp, which in turn happens only
+// once the application has closed every descriptor for it. A file system that
+// loses the state behind a handle early (say because the backend connection
+// died) can't make the kernel forget it, but it can call MarkDead. From then
+// on Get returns EIO for the handle, so that reads and writes fail fast rather
+// than hang, until the application closes the file and the handle is released.
+//
+// A file system whose handles are backed by a scarce resource, such as
+// connections to a backend with a connection limit, can create the map with
+// NewBoundedHandleMap and allocate handles with TryAdd. Opens beyond the limit
+// then fail with ENFILE, rather than exhausting the backend.
+//
+// The kernel may send a release while an op using the handle is still being
+// served, if the application gave up on the op by interrupting it. A file
+// system that frees the value when releasing the handle should therefore
+// access it with Borrow rather than Get, so that Release waits until it is
+// no longer in use.
+//
+// Safe for concurrent use.
+type HandleMap struct {
+	mu sync.Mutex
+
+	// Signalled when a borrow count drops to zero.
+	returned *sync.Cond
+
+	// The values for allocated handles, or deadHandle{} for those marked dead.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]interface{}
+
+	// The next handle ID to hand out.
+	//
+	// GUARDED_BY(mu)
+	next fuseops.HandleID
+
+	// The number of outstanding calls to Borrow for each handle that has any.
+	//
+	// INVARIANT: For each k, v > 0 and k is in handles
+	//
+	// GUARDED_BY(mu)
+	borrows map[fuseops.HandleID]int
+
+	// The maximum number of handles that TryAdd allows to be allocated at
+	// once, or zero for no limit.
+	//
+	// Constant.
+	limit int
+}
+
+// NewHandleMap creates an empty handle map.
+func NewHandleMap() (hm *HandleMap) {
+	hm = &HandleMap{
+		handles: make(map[fuseops.HandleID]interface{}),
+		borrows: make(map[fuseops.HandleID]int),
+	}
+
+	hm.returned = sync.NewCond(&hm.mu)
+	return
+}
+
+// NewBoundedHandleMap creates an empty handle map in which TryAdd refuses to
+// allocate more than limit handles at once. Handles marked dead count towards
+// the limit until they are released, since the kernel still holds them.
+func NewBoundedHandleMap(limit int) (hm *HandleMap) {
+	hm = NewHandleMap()
+	hm.limit = limit
+	return
+}
+
+// Add allocates a new handle ID referring to the supplied value. It ignores
+// any limit on the number of handles; see TryAdd.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) Add(v interface{}) (h fuseops.HandleID) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	h = hm.add(v)
+	return
+}
+
+// TryAdd is like Add, except that if the map was created with
+// NewBoundedHandleMap and already holds as many handles as its limit allows,
+// it returns fuse.ENFILE, which the file system should return from the op.
+// Releasing a handle makes room for another.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) TryAdd(v interface{}) (h fuseops.HandleID, err error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	if hm.limit > 0 && len(hm.handles) >= hm.limit {
+		err = fuse.ENFILE
+		return
+	}
+
+	h = hm.add(v)
+	return
+}
+
+// LOCKS_REQUIRED(hm.mu)
+func (hm *HandleMap) add(v interface{}) (h fuseops.HandleID) {
+	h = hm.next
+	hm.next++
+
+	hm.handles[h] = v
+	return
+}
+
+// Get returns the value for the supplied handle. If the handle has been marked
+// dead, it returns fuse.EIO, which the file system should return from the op.
+// It panics if the handle is unknown, since the kernel never sends a handle
+// that the file system didn't give it.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) Get(h fuseops.HandleID) (v interface{}, err error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	v, ok := hm.handles[h]
+	if !ok {
+		panic(fmt.Sprintf("Unknown handle: %v", h))
+	}
+
+	if _, dead := v.(deadHandle); dead {
+		v = nil
+		err = fuse.EIO
+		return
+	}
+
+	return
+}
+
+// Borrow is like Get, except that Release waits for the value to be handed
+// back with Return before releasing the handle. Call this when serving an op
+// that uses the value beyond looking at it, e.g. reading from a listing that
+// the file system frees on release, and call Return when done:
+//
+//     v, err := fs.handles.Borrow(op.Handle)
+//     if err != nil {
+//     	return
+//     }
+//
+//     defer fs.handles.Return(op.Handle)
+//
+// If the handle has been marked dead, nothing is borrowed and Return must not
+// be called.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) Borrow(h fuseops.HandleID) (v interface{}, err error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	v, ok := hm.handles[h]
+	if !ok {
+		panic(fmt.Sprintf("Unknown handle: %v", h))
+	}
+
+	if _, dead := v.(deadHandle); dead {
+		v = nil
+		err = fuse.EIO
+		return
+	}
+
+	hm.borrows[h]++
+	return
+}
+
+// Return hands back a value obtained with Borrow.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) Return(h fuseops.HandleID) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	n, ok := hm.borrows[h]
+	if !ok {
+		panic(fmt.Sprintf("Handle not borrowed: %v", h))
+	}
+
+	if n > 1 {
+		hm.borrows[h] = n - 1
+		return
+	}
+
+	delete(hm.borrows, h)
+	hm.returned.Broadcast()
+}
+
+// MarkDead drops the value for the supplied handle and returns it, so that the
+// caller can clean it up. Later calls to Get for the handle return fuse.EIO.
+// The handle ID remains allocated until Release is called for it; the
+// application must still close the file for that to happen.
+//
+// MarkDead doesn't wait for the value to be returned by those who borrowed
+// it, since it may be called while serving an op that did so.
+//
+// Returns nil if the handle is already dead.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) MarkDead(h fuseops.HandleID) (v interface{}) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	v, ok := hm.handles[h]
+	if !ok {
+		panic(fmt.Sprintf("Unknown handle: %v", h))
+	}
+
+	if _, dead := v.(deadHandle); dead {
+		v = nil
+		return
+	}
+
+	hm.handles[h] = deadHandle{}
+	return
+}
+
+// Release forgets the supplied handle, returning its value, or nil if it was
+// marked dead. Call this from ReleaseFileHandleOp or ReleaseDirHandleOp.
+//
+// If the value has been borrowed, Release first waits for it to be returned.
+//
+// Unlike Get, this doesn't panic if the handle is unknown, since by the time
+// the kernel releases a handle, a bug in the file system's own accounting
+// (e.g. releasing the handle twice) has usually done its damage already and
+// there is nothing left to protect. Instead it returns fuse.EBADF, which the
+// file system may return from the op: the kernel ignores errors from
+// releases, and the connection logs this one only to the debug logger.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) Release(h fuseops.HandleID) (v interface{}, err error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	// Wait for the value to be returned, checking again afterward that the
+	// handle wasn't released by someone else meanwhile.
+	var ok bool
+	for {
+		v, ok = hm.handles[h]
+		if !ok {
+			err = fuse.EBADF
+			return
+		}
+
+		if hm.borrows[h] == 0 {
+			break
+		}
+
+		hm.returned.Wait()
+	}
+
+	delete(hm.handles, h)
+
+	if _, dead := v.(deadHandle); dead {
+		v = nil
+	}
+
+	return
+}
+
+// Len returns the number of allocated handles, including dead ones.
+//
+// LOCKS_EXCLUDED(hm.mu)
+func (hm *HandleMap) Len() int {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+
+	return len(hm.handles)
+}
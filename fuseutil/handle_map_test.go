@@ -0,0 +1,195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+func TestHandleMap(t *testing.T) {
+	hm := fuseutil.NewHandleMap()
+
+	h0 := hm.Add("taco")
+	h1 := hm.Add("burrito")
+	if h0 == h1 {
+		t.Fatalf("Duplicate handle: %v", h0)
+	}
+
+	// Both handles are live.
+	if v, err := hm.Get(h0); err != nil || v != "taco" {
+		t.Errorf("Get(%v): got (%v, %v)", h0, v, err)
+	}
+
+	if v, err := hm.Get(h1); err != nil || v != "burrito" {
+		t.Errorf("Get(%v): got (%v, %v)", h1, v, err)
+	}
+
+	// Marking one dead hands back its value, and makes it fail with EIO.
+	if v := hm.MarkDead(h0); v != "taco" {
+		t.Errorf("MarkDead: got %v", v)
+	}
+
+	if v := hm.MarkDead(h0); v != nil {
+		t.Errorf("Second MarkDead: got %v", v)
+	}
+
+	if v, err := hm.Get(h0); err != fuse.EIO || v != nil {
+		t.Errorf("Get(%v) after MarkDead: got (%v, %v)", h0, v, err)
+	}
+
+	// The other is unaffected.
+	if v, err := hm.Get(h1); err != nil || v != "burrito" {
+		t.Errorf("Get(%v): got (%v, %v)", h1, v, err)
+	}
+
+	// The dead handle stays allocated until it's released.
+	if n := hm.Len(); n != 2 {
+		t.Errorf("Len: got %d, want 2", n)
+	}
+
+	if v, err := hm.Release(h0); err != nil || v != nil {
+		t.Errorf("Release(%v): got (%v, %v)", h0, v, err)
+	}
+
+	if v, err := hm.Release(h1); err != nil || v != "burrito" {
+		t.Errorf("Release(%v): got (%v, %v)", h1, v, err)
+	}
+
+	if n := hm.Len(); n != 0 {
+		t.Errorf("Len: got %d, want 0", n)
+	}
+}
+
+func TestHandleMap_Bounded(t *testing.T) {
+	hm := fuseutil.NewBoundedHandleMap(2)
+
+	h0, err := hm.TryAdd("taco")
+	if err != nil {
+		t.Fatalf("TryAdd: %v", err)
+	}
+
+	if _, err := hm.TryAdd("burrito"); err != nil {
+		t.Fatalf("TryAdd: %v", err)
+	}
+
+	// The map is full.
+	if _, err := hm.TryAdd("enchilada"); err != fuse.ENFILE {
+		t.Errorf("TryAdd when full: got %v, want ENFILE", err)
+	}
+
+	// Dead handles still count, until they're released.
+	hm.MarkDead(h0)
+	if _, err := hm.TryAdd("enchilada"); err != fuse.ENFILE {
+		t.Errorf("TryAdd after MarkDead: got %v, want ENFILE", err)
+	}
+
+	hm.Release(h0)
+	if _, err := hm.TryAdd("enchilada"); err != nil {
+		t.Errorf("TryAdd after Release: %v", err)
+	}
+
+	// Add ignores the limit.
+	hm.Add("queso")
+	if n := hm.Len(); n != 3 {
+		t.Errorf("Len: got %d, want 3", n)
+	}
+}
+
+func TestHandleMap_ReleaseUnknown(t *testing.T) {
+	hm := fuseutil.NewHandleMap()
+	h := hm.Add("taco")
+
+	if _, err := hm.Release(h); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// Releasing again, or releasing a handle that was never allocated, is
+	// reported rather than panicking.
+	if v, err := hm.Release(h); err != fuse.EBADF || v != nil {
+		t.Errorf("Second Release: got (%v, %v), want EBADF", v, err)
+	}
+
+	if v, err := hm.Release(h + 17); err != fuse.EBADF || v != nil {
+		t.Errorf("Release(%v): got (%v, %v), want EBADF", h+17, v, err)
+	}
+}
+
+func TestHandleMap_ReleaseWaitsForBorrowers(t *testing.T) {
+	hm := fuseutil.NewHandleMap()
+	h := hm.Add("taco")
+
+	// Borrow twice, as two concurrent ops would.
+	for i := 0; i < 2; i++ {
+		if v, err := hm.Borrow(h); err != nil || v != "taco" {
+			t.Fatalf("Borrow: got (%v, %v)", v, err)
+		}
+	}
+
+	// Release in the background. It shouldn't finish while the value is out.
+	released := make(chan interface{}, 1)
+	go func() {
+		v, err := hm.Release(h)
+		if err != nil {
+			t.Errorf("Release: %v", err)
+		}
+
+		released <- v
+	}()
+
+	hm.Return(h)
+
+	select {
+	case <-released:
+		t.Fatal("Release finished while the value was still borrowed")
+
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Once the last borrower returns it, the release goes ahead.
+	hm.Return(h)
+
+	select {
+	case v := <-released:
+		if v != "taco" {
+			t.Errorf("Release: got %v", v)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("Release didn't finish after the value was returned")
+	}
+
+	if n := hm.Len(); n != 0 {
+		t.Errorf("Len: got %d, want 0", n)
+	}
+}
+
+func TestHandleMap_BorrowDead(t *testing.T) {
+	hm := fuseutil.NewHandleMap()
+	h := hm.Add("taco")
+	hm.MarkDead(h)
+
+	// Nothing is borrowed, so releasing doesn't wait.
+	if v, err := hm.Borrow(h); err != fuse.EIO || v != nil {
+		t.Errorf("Borrow after MarkDead: got (%v, %v), want EIO", v, err)
+	}
+
+	if v, err := hm.Release(h); err != nil || v != nil {
+		t.Errorf("Release: got (%v, %v)", v, err)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+)
+
+// Invalidator is the interface through which a LeaseManager asks the kernel to
+// drop cached state. *fuse.Connection satisfies it.
+type Invalidator interface {
+	InvalidateInode(inode fuseops.InodeID, off int64, length int64) error
+	InvalidateEntry(parent fuseops.InodeID, name string) error
+}
+
+var _ Invalidator = &fuse.Connection{}
+
+// LeaseManager tracks which inodes and directory entries the kernel may be
+// caching on behalf of a file system, so that they can be recalled when the
+// file system learns that the backing store has changed underneath it, in the
+// style of an NFSv4 delegation or SMB oplock break.
+//
+// A file system grants a lease whenever it hands the kernel something with a
+// non-zero expiration time (e.g. in a LookUpInodeOp response), and forgets
+// leases for inodes whose lookup count has dropped to zero. When the backing
+// store changes, it recalls the affected leases (or all of them), which
+// results in the appropriate invalidation notifications being sent.
+//
+// Safe for concurrent use.
+type LeaseManager struct {
+	inv Invalidator
+
+	mu sync.Mutex
+
+	// Inodes for which the kernel may have cached attributes or contents.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]struct{}
+
+	// Directory entries the kernel may have cached, indexed by parent.
+	//
+	// INVARIANT: For each v, len(v) > 0
+	//
+	// GUARDED_BY(mu)
+	entries map[fuseops.InodeID]map[string]struct{}
+}
+
+// NewLeaseManager creates a lease manager that sends invalidations through
+// the supplied invalidator.
+func NewLeaseManager(inv Invalidator) (lm *LeaseManager) {
+	lm = &LeaseManager{
+		inv:     inv,
+		inodes:  make(map[fuseops.InodeID]struct{}),
+		entries: make(map[fuseops.InodeID]map[string]struct{}),
+	}
+
+	return
+}
+
+// GrantInode records that the kernel may be caching attributes or contents
+// for the supplied inode.
+//
+// LOCKS_EXCLUDED(lm.mu)
+func (lm *LeaseManager) GrantInode(inode fuseops.InodeID) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	lm.inodes[inode] = struct{}{}
+}
+
+// GrantEntry records that the kernel may be caching the entry for the supplied
+// name within the supplied parent, and the attributes of the child it names.
+//
+// LOCKS_EXCLUDED(lm.mu)
+func (lm *LeaseManager) GrantEntry(
+	parent fuseops.InodeID,
+	name string,
+	child fuseops.InodeID) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	names := lm.entries[parent]
+	if names == nil {
+		names = make(map[string]struct{})
+		lm.entries[parent] = names
+	}
+
+	names[name] = struct{}{}
+	lm.inodes[child] = struct{}{}
+}
+
+// Forget discards any leases on the supplied inode, including those for
+// entries within it if it is a directory, without sending invalidations. Call
+// this when the inode's lookup count drops to zero, since at that point the
+// kernel no longer has anything cached for it.
+//
+// LOCKS_EXCLUDED(lm.mu)
+func (lm *LeaseManager) Forget(inode fuseops.InodeID) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	delete(lm.inodes, inode)
+	delete(lm.entries, inode)
+}
+
+// RecallInode invalidates the kernel's cached attributes and contents for the
+// supplied inode, if a lease is outstanding.
+//
+// LOCKS_EXCLUDED(lm.mu)
+func (lm *LeaseManager) RecallInode(inode fuseops.InodeID) (err error) {
+	lm.mu.Lock()
+	_, ok := lm.inodes[inode]
+	delete(lm.inodes, inode)
+	lm.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	err = lm.invalidateInode(inode)
+	return
+}
+
+// RecallEntry invalidates the kernel's cached entry for the supplied name
+// within the supplied parent, if a lease is outstanding.
+//
+// LOCKS_EXCLUDED(lm.mu)
+func (lm *LeaseManager) RecallEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	lm.mu.Lock()
+	_, ok := lm.entries[parent][name]
+	if ok {
+		lm.removeEntry(parent, name)
+	}
+	lm.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	err = lm.invalidateEntry(parent, name)
+	return
+}
+
+// RecallAll invalidates everything for which a lease is outstanding. Entries
+// are recalled before inodes, so that a subsequent access to a name results in
+// a fresh lookup rather than a revalidation of the old inode.
+//
+// All leases are recalled even if some invalidations fail; the first error is
+// returned.
+//
+// LOCKS_EXCLUDED(lm.mu)
+func (lm *LeaseManager) RecallAll() (err error) {
+	// Swap out the current state, so that we don't hold the lock while talking
+	// to the kernel.
+	lm.mu.Lock()
+	inodes := lm.inodes
+	entries := lm.entries
+	lm.inodes = make(map[fuseops.InodeID]struct{})
+	lm.entries = make(map[fuseops.InodeID]map[string]struct{})
+	lm.mu.Unlock()
+
+	for parent, names := range entries {
+		for name := range names {
+			if tmp := lm.invalidateEntry(parent, name); tmp != nil && err == nil {
+				err = tmp
+			}
+		}
+	}
+
+	for inode := range inodes {
+		if tmp := lm.invalidateInode(inode); tmp != nil && err == nil {
+			err = tmp
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(lm.mu)
+func (lm *LeaseManager) removeEntry(
+	parent fuseops.InodeID,
+	name string) {
+	names := lm.entries[parent]
+	delete(names, name)
+	if len(names) == 0 {
+		delete(lm.entries, parent)
+	}
+}
+
+// The kernel reports ENOENT when it has already dropped what we're
+// invalidating, which is what we wanted anyway.
+func (lm *LeaseManager) invalidateInode(inode fuseops.InodeID) (err error) {
+	err = lm.inv.InvalidateInode(inode, 0, 0)
+	if err == syscall.ENOENT {
+		err = nil
+	}
+
+	if err != nil {
+		err = fmt.Errorf("InvalidateInode(%v): %v", inode, err)
+		return
+	}
+
+	return
+}
+
+func (lm *LeaseManager) invalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	err = lm.inv.InvalidateEntry(parent, name)
+	if err == syscall.ENOENT {
+		err = nil
+	}
+
+	if err != nil {
+		err = fmt.Errorf("InvalidateEntry(%v, %q): %v", parent, name, err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,186 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// An invalidator that records the notifications it is asked to send.
+type recordingInvalidator struct {
+	mu   sync.Mutex
+	sent []string
+
+	// Inodes for which to pretend that the kernel has nothing cached.
+	unknown map[fuseops.InodeID]bool
+}
+
+func (r *recordingInvalidator) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.unknown[inode] {
+		err = syscall.ENOENT
+		return
+	}
+
+	r.sent = append(r.sent, fmt.Sprintf("inode %d", inode))
+	return
+}
+
+func (r *recordingInvalidator) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sent = append(r.sent, fmt.Sprintf("entry %d/%s", parent, name))
+	return
+}
+
+func (r *recordingInvalidator) Sent() (sent []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sent = append(sent, r.sent...)
+	sort.Strings(sent)
+	r.sent = nil
+
+	return
+}
+
+func TestLeaseManager_RecallAll(t *testing.T) {
+	inv := &recordingInvalidator{}
+	lm := fuseutil.NewLeaseManager(inv)
+
+	lm.GrantEntry(fuseops.RootInodeID, "foo", 2)
+	lm.GrantEntry(fuseops.RootInodeID, "bar", 3)
+	lm.GrantEntry(3, "baz", 4)
+	lm.GrantInode(5)
+
+	if err := lm.RecallAll(); err != nil {
+		t.Fatalf("RecallAll: %v", err)
+	}
+
+	expected := []string{
+		"entry 1/bar",
+		"entry 1/foo",
+		"entry 3/baz",
+		"inode 2",
+		"inode 3",
+		"inode 4",
+		"inode 5",
+	}
+
+	if sent := inv.Sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Sent %q, expected %q", sent, expected)
+	}
+
+	// Everything has been recalled, so doing it again should be a no-op.
+	if err := lm.RecallAll(); err != nil {
+		t.Fatalf("RecallAll: %v", err)
+	}
+
+	if sent := inv.Sent(); len(sent) != 0 {
+		t.Errorf("Unexpected notifications on second recall: %q", sent)
+	}
+}
+
+func TestLeaseManager_RecallIndividually(t *testing.T) {
+	inv := &recordingInvalidator{}
+	lm := fuseutil.NewLeaseManager(inv)
+
+	lm.GrantEntry(fuseops.RootInodeID, "foo", 2)
+
+	// Recalling things for which no lease is outstanding sends nothing.
+	if err := lm.RecallEntry(fuseops.RootInodeID, "bar"); err != nil {
+		t.Fatalf("RecallEntry: %v", err)
+	}
+
+	if err := lm.RecallInode(17); err != nil {
+		t.Fatalf("RecallInode: %v", err)
+	}
+
+	if sent := inv.Sent(); len(sent) != 0 {
+		t.Errorf("Unexpected notifications: %q", sent)
+	}
+
+	// Recalling outstanding leases does.
+	if err := lm.RecallEntry(fuseops.RootInodeID, "foo"); err != nil {
+		t.Fatalf("RecallEntry: %v", err)
+	}
+
+	if err := lm.RecallInode(2); err != nil {
+		t.Fatalf("RecallInode: %v", err)
+	}
+
+	expected := []string{"entry 1/foo", "inode 2"}
+	if sent := inv.Sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Sent %q, expected %q", sent, expected)
+	}
+}
+
+func TestLeaseManager_Forget(t *testing.T) {
+	inv := &recordingInvalidator{}
+	lm := fuseutil.NewLeaseManager(inv)
+
+	lm.GrantEntry(fuseops.RootInodeID, "dir", 2)
+	lm.GrantEntry(2, "foo", 3)
+	lm.GrantInode(4)
+
+	// Once the kernel forgets the directory, neither it nor its entries need
+	// to be invalidated.
+	lm.Forget(2)
+
+	if err := lm.RecallAll(); err != nil {
+		t.Fatalf("RecallAll: %v", err)
+	}
+
+	expected := []string{"entry 1/dir", "inode 3", "inode 4"}
+	if sent := inv.Sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Sent %q, expected %q", sent, expected)
+	}
+}
+
+func TestLeaseManager_KernelAlreadyForgot(t *testing.T) {
+	inv := &recordingInvalidator{
+		unknown: map[fuseops.InodeID]bool{2: true},
+	}
+
+	lm := fuseutil.NewLeaseManager(inv)
+	lm.GrantInode(2)
+	lm.GrantInode(3)
+
+	// ENOENT from the kernel is not an error.
+	if err := lm.RecallAll(); err != nil {
+		t.Fatalf("RecallAll: %v", err)
+	}
+
+	expected := []string{"inode 3"}
+	if sent := inv.Sent(); !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Sent %q, expected %q", sent, expected)
+	}
+}
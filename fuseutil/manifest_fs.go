@@ -0,0 +1,425 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+)
+
+// LoadManifestFS reads the manifest in the file with the supplied path; see
+// ReadManifestFS.
+func LoadManifestFS(
+	manifestPath string,
+	uid uint32,
+	gid uint32) (fs FileSystem, err error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	fs, err = ReadManifestFS(f, uid, gid)
+	if err != nil {
+		err = fmt.Errorf("%s: %v", manifestPath, err)
+		return
+	}
+
+	return
+}
+
+// ReadManifestFS creates a read-only file system containing the fixed tree
+// described by the supplied manifest, with every inode owned by the supplied
+// user and group. This is handy for demos and tests that want a known
+// directory structure without writing a file system for it.
+//
+// The manifest has one entry per line, in one of these forms:
+//
+//     dir     <mode> <path>
+//     file    <mode> <path> <contents>
+//     symlink <path> <target>
+//
+// Modes are in octal, and paths are slash-separated and relative to the root
+// of the file system. A path, contents, or target containing spaces or special
+// characters may be written as a double-quoted Go string literal, e.g.
+// "Hello, world!\n". Parent directories that aren't listed are created with
+// mode 0755. Blank lines and lines starting with # are ignored.
+func ReadManifestFS(
+	r io.Reader,
+	uid uint32,
+	gid uint32) (fs FileSystem, err error) {
+	mfs := &manifestFS{
+		uid: uid,
+		gid: gid,
+	}
+
+	mfs.nodes = []*manifestNode{
+		// Unused, so that inode IDs can be used as indices.
+		nil,
+
+		// The root.
+		&manifestNode{
+			mode:     os.ModeDir | 0755,
+			children: make(map[string]fuseops.InodeID),
+		},
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err = mfs.addEntry(line); err != nil {
+			err = fmt.Errorf("line %d: %v", lineNum, err)
+			return
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	fs = mfs
+	return
+}
+
+type manifestNode struct {
+	// The type and permissions of the inode.
+	mode os.FileMode
+
+	// For files, the contents. For symlinks, the target.
+	contents string
+
+	// For directories, the children by name, and their names in order.
+	children map[string]fuseops.InodeID
+	names    []string
+}
+
+// All fields are immutable once the manifest has been read.
+type manifestFS struct {
+	NotImplementedFileSystem
+
+	uid uint32
+	gid uint32
+
+	// The nodes of the tree, indexed by inode ID.
+	nodes []*manifestNode
+}
+
+// Split a manifest line into fields, unquoting those that are quoted.
+func splitManifestLine(line string) (fields []string, err error) {
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return
+		}
+
+		// An unquoted field runs to the next space.
+		if line[0] != '"' {
+			end := strings.IndexFunc(line, unicode.IsSpace)
+			if end < 0 {
+				end = len(line)
+			}
+
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		// A quoted field runs to the next unescaped quote.
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+
+			end++
+		}
+
+		if end >= len(line) {
+			err = fmt.Errorf("unterminated string: %s", line)
+			return
+		}
+
+		var field string
+		field, err = strconv.Unquote(line[:end+1])
+		if err != nil {
+			err = fmt.Errorf("bad string %s: %v", line[:end+1], err)
+			return
+		}
+
+		fields = append(fields, field)
+		line = line[end+1:]
+	}
+}
+
+func (fs *manifestFS) addEntry(line string) (err error) {
+	fields, err := splitManifestLine(line)
+	if err != nil {
+		return
+	}
+
+	// Work out what we're creating.
+	var wantFields int
+	switch fields[0] {
+	case "dir":
+		wantFields = 3
+	case "file":
+		wantFields = 4
+	case "symlink":
+		wantFields = 3
+	default:
+		err = fmt.Errorf("unknown entry type %q", fields[0])
+		return
+	}
+
+	if len(fields) != wantFields {
+		err = fmt.Errorf(
+			"%s entries have %d fields, not %d",
+			fields[0],
+			wantFields,
+			len(fields))
+		return
+	}
+
+	node := &manifestNode{}
+	var p string
+
+	switch fields[0] {
+	case "dir", "file":
+		var perm uint64
+		perm, err = strconv.ParseUint(fields[1], 8, 32)
+		if err != nil || perm&^uint64(os.ModePerm) != 0 {
+			err = fmt.Errorf("bad mode %q", fields[1])
+			return
+		}
+
+		node.mode = os.FileMode(perm)
+		p = fields[2]
+
+		if fields[0] == "dir" {
+			node.mode |= os.ModeDir
+			node.children = make(map[string]fuseops.InodeID)
+		} else {
+			node.contents = fields[3]
+		}
+
+	case "symlink":
+		node.mode = os.ModeSymlink | 0777
+		p = fields[1]
+		node.contents = fields[2]
+	}
+
+	// Find the parent, creating it if necessary.
+	p = path.Clean("/" + p)
+	if p == "/" {
+		err = fmt.Errorf("the root can't be listed")
+		return
+	}
+
+	dir, name := path.Split(p)
+	parent, err := fs.mkdirAll(dir)
+	if err != nil {
+		return
+	}
+
+	// A directory created implicitly may be listed later, to set its mode.
+	if id, ok := fs.nodes[parent].children[name]; ok {
+		existing := fs.nodes[id]
+		if existing.mode.IsDir() && node.mode.IsDir() {
+			existing.mode = node.mode
+			return
+		}
+
+		err = fmt.Errorf("%s listed twice", p)
+		return
+	}
+
+	fs.link(parent, name, node)
+	return
+}
+
+// Add a new node to the supplied directory.
+func (fs *manifestFS) link(
+	parent fuseops.InodeID,
+	name string,
+	node *manifestNode) (id fuseops.InodeID) {
+	id = fuseops.InodeID(len(fs.nodes))
+	fs.nodes = append(fs.nodes, node)
+
+	p := fs.nodes[parent]
+	p.children[name] = id
+	p.names = append(p.names, name)
+	sort.Strings(p.names)
+
+	return
+}
+
+// Return the directory with the supplied absolute path, creating it and its
+// ancestors if they don't exist.
+func (fs *manifestFS) mkdirAll(dir string) (id fuseops.InodeID, err error) {
+	id = fuseops.RootInodeID
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		child, ok := fs.nodes[id].children[name]
+		if !ok {
+			child = fs.link(id, name, &manifestNode{
+				mode:     os.ModeDir | 0755,
+				children: make(map[string]fuseops.InodeID),
+			})
+		}
+
+		if !fs.nodes[child].mode.IsDir() {
+			err = fmt.Errorf("%s is not a directory", name)
+			return
+		}
+
+		id = child
+	}
+
+	return
+}
+
+func (fs *manifestFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	node := fs.nodes[id]
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  node.mode,
+		Size:  uint64(len(node.contents)),
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	}
+
+	if node.mode.IsDir() {
+		attrs.Nlink = 2
+		attrs.Size = 0
+	}
+
+	return attrs
+}
+
+func (fs *manifestFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *manifestFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	id, ok := fs.nodes[op.Parent].children[op.Name]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.attributes(id)
+
+	return
+}
+
+func (fs *manifestFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *manifestFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	return
+}
+
+func (fs *manifestFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	node := fs.nodes[op.Inode]
+
+	for i := int(op.Offset); i < len(node.names); i++ {
+		name := node.names[i]
+		child := node.children[name]
+
+		dt := DT_File
+		switch mode := fs.nodes[child].mode; {
+		case mode.IsDir():
+			dt = DT_Directory
+		case mode&os.ModeSymlink != 0:
+			dt = DT_Link
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  child,
+			Name:   name,
+			Type:   dt,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *manifestFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *manifestFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	op.BytesRead, err = strings.NewReader(fs.nodes[op.Inode].contents).ReadAt(
+		op.Dst,
+		op.Offset)
+
+	// Special case: FUSE doesn't expect us to return io.EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (fs *manifestFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	op.Target = fs.nodes[op.Inode].contents
+	return
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+const testManifest = `
+# A small tree for testing.
+dir     0750 docs
+file    0644 docs/readme.txt "Hello, world!\n"
+file    0600 docs/secret     "shh"
+file    0755 bin/tool        ""
+file    0644 "with space"    taco
+symlink      latest          docs/readme.txt
+`
+
+func TestReadManifestFS_Errors(t *testing.T) {
+	testCases := []struct {
+		manifest string
+		wantErr  string
+	}{
+		{"block 0644 foo", "line 1: unknown entry type"},
+		{"file 0644 foo", "line 1: file entries have 4 fields"},
+		{"dir 0999 foo", `line 1: bad mode "0999"`},
+		{"dir 01777 foo", `line 1: bad mode "01777"`},
+		{"\nfile 0644 foo \"bar", "line 2: unterminated string"},
+		{"dir 0755 /", "line 1: the root can't be listed"},
+		{"file 0644 foo x\nfile 0644 foo y", "line 2: /foo listed twice"},
+		{"file 0644 foo x\nfile 0644 foo/bar y", "line 2: foo is not a directory"},
+	}
+
+	for _, tc := range testCases {
+		_, err := fuseutil.ReadManifestFS(strings.NewReader(tc.manifest), 0, 0)
+		if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+			t.Errorf("%q: got error %v, want %q", tc.manifest, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLoadManifestFS(t *testing.T) {
+	ctx := context.Background()
+
+	// Write out the manifest and load it.
+	f, err := ioutil.TempFile("", "manifest_fs_test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(testManifest); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fs, err := fuseutil.LoadManifestFS(
+		f.Name(),
+		uint32(os.Getuid()),
+		uint32(os.Getgid()))
+
+	if err != nil {
+		t.Fatalf("LoadManifestFS: %v", err)
+	}
+
+	// Mount it.
+	dir, err := ioutil.TempDir("", "manifest_fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Fatalf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(ctx); err != nil {
+			t.Fatalf("Join: %v", err)
+		}
+	}()
+
+	// The root contains the listed entries and the implicit directory.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	for _, fi := range entries {
+		names = append(names, fi.Name())
+	}
+
+	sort.Strings(names)
+	if got, want := strings.Join(names, ","), "bin,docs,latest,with space"; got != want {
+		t.Errorf("Root contents: got %q, want %q", got, want)
+	}
+
+	// Each entry has the right type, permissions, and size.
+	testCases := []struct {
+		name string
+		mode os.FileMode
+		size int64
+	}{
+		{"docs", os.ModeDir | 0750, 0},
+		{"docs/readme.txt", 0644, int64(len("Hello, world!\n"))},
+		{"docs/secret", 0600, 3},
+		{"bin", os.ModeDir | 0755, 0},
+		{"bin/tool", 0755, 0},
+		{"with space", 0644, 4},
+	}
+
+	for _, tc := range testCases {
+		fi, err := os.Stat(path.Join(dir, tc.name))
+		if err != nil {
+			t.Errorf("Stat(%q): %v", tc.name, err)
+			continue
+		}
+
+		if fi.Mode() != tc.mode {
+			t.Errorf("%q: got mode %v, want %v", tc.name, fi.Mode(), tc.mode)
+		}
+
+		if !fi.IsDir() && fi.Size() != tc.size {
+			t.Errorf("%q: got size %d, want %d", tc.name, fi.Size(), tc.size)
+		}
+	}
+
+	// File contents.
+	contents, err := ioutil.ReadFile(path.Join(dir, "docs/readme.txt"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got, want := string(contents), "Hello, world!\n"; got != want {
+		t.Errorf("Contents: got %q, want %q", got, want)
+	}
+
+	// The symlink.
+	target, err := os.Readlink(path.Join(dir, "latest"))
+	if err != nil {
+		t.Fatalf("Readlink: %v", err)
+	}
+
+	if got, want := target, "docs/readme.txt"; got != want {
+		t.Errorf("Readlink: got %q, want %q", got, want)
+	}
+
+	contents, err = ioutil.ReadFile(path.Join(dir, "latest"))
+	if err != nil {
+		t.Fatalf("ReadFile via symlink: %v", err)
+	}
+
+	if got, want := string(contents), "Hello, world!\n"; got != want {
+		t.Errorf("Contents via symlink: got %q, want %q", got, want)
+	}
+
+	// Nothing can be modified.
+	err = ioutil.WriteFile(path.Join(dir, "new"), []byte("taco"), 0644)
+	if err == nil {
+		t.Errorf("WriteFile succeeded unexpectedly")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// MetadataBatcher helps a file system avoid writing metadata to its backing
+// store once per WriteFileOp. A streaming write of a large file arrives as
+// many ops, each of which changes the file's mtime and ctime; persisting that
+// change every time mostly produces churn.
+//
+// Instead, the file system calls Touch from WriteFileOp (after the data has
+// been accepted) and Flush from FlushFileOp and SyncFileOp. The batcher
+// persists the most recent modification time for each inode at most once per
+// interval while writes continue, and immediately when flushed. Until then,
+// Pending reports the time that GetInodeAttributesOp should return, so that
+// callers never observe the stale persisted value.
+//
+// Errors from background persists are retained and returned by the next call
+// to Flush for that inode, in the same way that errors from writeback caching
+// surface at close(2).
+//
+// Safe for concurrent use.
+type MetadataBatcher struct {
+	interval time.Duration
+	persist  func(inode fuseops.InodeID, mtime time.Time) error
+
+	mu sync.Mutex
+
+	// Inodes with modification times that have not yet been persisted, or
+	// whose most recent background persist failed.
+	//
+	// GUARDED_BY(mu)
+	dirty map[fuseops.InodeID]*dirtyMetadata
+}
+
+type dirtyMetadata struct {
+	// The most recent modification time, if not yet persisted.
+	mtime   time.Time
+	pending bool
+
+	// Whether a background persist has been scheduled.
+	scheduled bool
+
+	// The first error from a background persist since the last flush, if any.
+	err error
+}
+
+// NewMetadataBatcher creates a batcher that calls persist to write an inode's
+// modification time (and by implication its change time) to the backing
+// store, at most once per interval per inode while writes are in progress.
+//
+// persist is called with the batcher's internal lock held, so calls are never
+// concurrent. It must not call back into the batcher.
+func NewMetadataBatcher(
+	interval time.Duration,
+	persist func(inode fuseops.InodeID, mtime time.Time) error) (
+	b *MetadataBatcher) {
+	b = &MetadataBatcher{
+		interval: interval,
+		persist:  persist,
+		dirty:    make(map[fuseops.InodeID]*dirtyMetadata),
+	}
+
+	return
+}
+
+// Touch records that the supplied inode was modified at the supplied time,
+// scheduling a background persist if one isn't already pending.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *MetadataBatcher) Touch(
+	inode fuseops.InodeID,
+	mtime time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.dirty[inode]
+	if d == nil {
+		d = &dirtyMetadata{}
+		b.dirty[inode] = d
+	}
+
+	d.mtime = mtime
+	d.pending = true
+
+	if !d.scheduled {
+		d.scheduled = true
+		time.AfterFunc(b.interval, func() { b.persistInBackground(inode) })
+	}
+}
+
+// Pending returns the modification time recorded for the inode that has not
+// yet been persisted, if any.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *MetadataBatcher) Pending(
+	inode fuseops.InodeID) (mtime time.Time, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if d := b.dirty[inode]; d != nil && d.pending {
+		mtime = d.mtime
+		ok = true
+	}
+
+	return
+}
+
+// Flush persists any pending modification time for the supplied inode now,
+// returning the result along with any error from an earlier background
+// persist.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *MetadataBatcher) Flush(inode fuseops.InodeID) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.dirty[inode]
+	if d == nil {
+		return
+	}
+
+	err = d.err
+	d.err = nil
+
+	if d.pending {
+		if tmp := b.persist(inode, d.mtime); tmp != nil && err == nil {
+			err = tmp
+		}
+
+		d.pending = false
+	}
+
+	b.cleanUp(inode, d)
+	return
+}
+
+// FlushAll flushes every inode, e.g. when the file system is being destroyed.
+// It returns the first error encountered.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *MetadataBatcher) FlushAll() (err error) {
+	b.mu.Lock()
+	var inodes []fuseops.InodeID
+	for inode := range b.dirty {
+		inodes = append(inodes, inode)
+	}
+	b.mu.Unlock()
+
+	for _, inode := range inodes {
+		if tmp := b.Flush(inode); tmp != nil && err == nil {
+			err = tmp
+		}
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(b.mu)
+func (b *MetadataBatcher) persistInBackground(inode fuseops.InodeID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := b.dirty[inode]
+	if d == nil {
+		return
+	}
+
+	d.scheduled = false
+	if d.pending {
+		if err := b.persist(inode, d.mtime); err != nil && d.err == nil {
+			d.err = err
+		}
+
+		d.pending = false
+	}
+
+	b.cleanUp(inode, d)
+}
+
+// Forget the inode if there is nothing left to do for it.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *MetadataBatcher) cleanUp(
+	inode fuseops.InodeID,
+	d *dirtyMetadata) {
+	if !d.pending && !d.scheduled && d.err == nil {
+		delete(b.dirty, inode)
+	}
+}
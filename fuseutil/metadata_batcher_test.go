@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// A fake backing store that records the modification times persisted to it.
+type fakeMetadataStore struct {
+	mu       sync.Mutex
+	persists int
+	mtimes   map[fuseops.InodeID]time.Time
+	err      error
+}
+
+func (s *fakeMetadataStore) persist(
+	inode fuseops.InodeID,
+	mtime time.Time) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.persists++
+	if s.err != nil {
+		err = s.err
+		return
+	}
+
+	if s.mtimes == nil {
+		s.mtimes = make(map[fuseops.InodeID]time.Time)
+	}
+
+	s.mtimes[inode] = mtime
+	return
+}
+
+func (s *fakeMetadataStore) stats() (persists int, mtimes map[fuseops.InodeID]time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	persists = s.persists
+	mtimes = make(map[fuseops.InodeID]time.Time)
+	for k, v := range s.mtimes {
+		mtimes[k] = v
+	}
+
+	return
+}
+
+func TestMetadataBatcher_StreamingWrites(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	const inode = 17
+
+	store := &fakeMetadataStore{}
+	b := fuseutil.NewMetadataBatcher(interval, store.persist)
+
+	// Simulate a stream of writes, each of which touches the inode.
+	start := time.Now()
+	var last time.Time
+	for time.Since(start) < 6*interval {
+		last = time.Now()
+		b.Touch(inode, last)
+		time.Sleep(time.Millisecond)
+	}
+
+	elapsed := time.Since(start)
+
+	// The most recent time should be visible while pending.
+	if mtime, ok := b.Pending(inode); ok && !mtime.Equal(last) {
+		t.Errorf("Pending returned %v, expected %v", mtime, last)
+	}
+
+	// Flushing should persist the final time.
+	if err := b.Flush(inode); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	persists, mtimes := store.stats()
+	if !mtimes[inode].Equal(last) {
+		t.Errorf("Persisted %v, expected %v", mtimes[inode], last)
+	}
+
+	// We should have persisted at most once per interval, plus the flush.
+	max := int(elapsed/interval) + 1
+	if persists < 1 || persists > max {
+		t.Errorf("%d persists in %v; expected between 1 and %d", persists, elapsed, max)
+	}
+
+	if _, ok := b.Pending(inode); ok {
+		t.Errorf("Still pending after flush")
+	}
+}
+
+func TestMetadataBatcher_FlushWithNothingPending(t *testing.T) {
+	store := &fakeMetadataStore{}
+	b := fuseutil.NewMetadataBatcher(time.Hour, store.persist)
+
+	if err := b.Flush(17); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if err := b.FlushAll(); err != nil {
+		t.Fatalf("FlushAll: %v", err)
+	}
+
+	if persists, _ := store.stats(); persists != 0 {
+		t.Errorf("Unexpected persists: %d", persists)
+	}
+}
+
+func TestMetadataBatcher_BackgroundErrorReturnedByFlush(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	const inode = 17
+
+	store := &fakeMetadataStore{err: errors.New("taco")}
+	b := fuseutil.NewMetadataBatcher(interval, store.persist)
+
+	b.Touch(inode, time.Now())
+
+	// Wait for the background persist to happen.
+	for {
+		if persists, _ := store.stats(); persists > 0 {
+			break
+		}
+
+		time.Sleep(interval)
+	}
+
+	// The error should show up at the next flush, and only then.
+	if err := b.Flush(inode); err == nil || err.Error() != "taco" {
+		t.Errorf("Flush returned %v, expected taco", err)
+	}
+
+	if err := b.Flush(inode); err != nil {
+		t.Errorf("Second flush returned %v", err)
+	}
+}
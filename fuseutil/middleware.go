@@ -0,0 +1,374 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// An OpHandler serves an op of any of the types in package fuseops, returning
+// the error with which to respond to it, as a FileSystem method does.
+type OpHandler func(ctx context.Context, op interface{}) error
+
+// A Middleware wraps the serving of every op, e.g. to log, time, or trace it.
+// It is given the handler that serves the op, which it may call or not, and
+// returns a handler to use in its place:
+//
+//     func logOps(next fuseutil.OpHandler) fuseutil.OpHandler {
+//     	return func(ctx context.Context, op interface{}) (err error) {
+//     		err = next(ctx, op)
+//     		log.Printf("%T: %v", op, err)
+//     		return
+//     	}
+//     }
+//
+// The handler is called concurrently, as FileSystem methods are.
+type Middleware func(next OpHandler) OpHandler
+
+// WrapFileSystem returns a FileSystem that passes every op through the
+// supplied middleware before it reaches the wrapped file system. The first
+// middleware is the outermost: it sees each op first, and its error last.
+//
+// Every method taking an op goes through the middleware, with the op as
+// received, so that it can treat all op types alike and switch on the type
+// only where it cares. Destroy, which doesn't, is passed straight through.
+//
+// When the wrapped file system doesn't support ReadDirPlusOp, the middleware
+// sees that op fail with ENOSYS, followed by the ReadDirOp with which
+// NewFileSystemServer answers it instead. Likewise an unsupported
+// BatchForgetOp is followed by a ForgetInodeOp for each of its entries.
+func WrapFileSystem(wrapped FileSystem, middleware ...Middleware) FileSystem {
+	handler := func(ctx context.Context, op interface{}) error {
+		return dispatchOp(wrapped, ctx, op)
+	}
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return &wrappedFileSystem{
+		wrapped: wrapped,
+		handler: handler,
+	}
+}
+
+type wrappedFileSystem struct {
+	wrapped FileSystem
+	handler OpHandler
+}
+
+var _ FileSystem = &wrappedFileSystem{}
+
+func (fs *wrappedFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) SetLockWait(
+	ctx context.Context,
+	op *fuseops.SetLockWaitOp) error {
+	return fs.handler(ctx, op)
+}
+
+func (fs *wrappedFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
+
+////////////////////////////////////////////////////////////////////////
+// OpCounter
+////////////////////////////////////////////////////////////////////////
+
+// OpStats summarizes the ops of one type seen by an OpCounter.
+type OpStats struct {
+	// The number of ops served, and how many of those failed.
+	Count  int
+	Errors int
+
+	// The total time spent serving them.
+	Time time.Duration
+}
+
+// OpCounter is an example of a Middleware, which counts and times the ops
+// passing through it by type. Use its Middleware method with WrapFileSystem.
+//
+// Safe for concurrent use.
+type OpCounter struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	stats map[reflect.Type]OpStats
+}
+
+// NewOpCounter creates a counter that has seen no ops.
+func NewOpCounter() (oc *OpCounter) {
+	oc = &OpCounter{
+		stats: make(map[reflect.Type]OpStats),
+	}
+
+	return
+}
+
+// Middleware records each op passed to next.
+//
+// LOCKS_EXCLUDED(oc.mu)
+func (oc *OpCounter) Middleware(next OpHandler) OpHandler {
+	return func(ctx context.Context, op interface{}) (err error) {
+		start := time.Now()
+		err = next(ctx, op)
+		elapsed := time.Since(start)
+
+		oc.mu.Lock()
+		defer oc.mu.Unlock()
+
+		t := reflect.TypeOf(op)
+		s := oc.stats[t]
+		s.Count++
+		if err != nil {
+			s.Errors++
+		}
+
+		s.Time += elapsed
+		oc.stats[t] = s
+
+		return
+	}
+}
+
+// Stats returns the statistics for each op type seen so far. The type is that
+// of a pointer to the op struct, e.g. reflect.TypeOf(&fuseops.WriteFileOp{}).
+//
+// LOCKS_EXCLUDED(oc.mu)
+func (oc *OpCounter) Stats() (stats map[reflect.Type]OpStats) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	stats = make(map[reflect.Type]OpStats, len(oc.stats))
+	for t, s := range oc.stats {
+		stats[t] = s
+	}
+
+	return
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMiddleware(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MiddlewareTest struct {
+	samples.SampleTest
+	counter *fuseutil.OpCounter
+
+	mu sync.Mutex
+
+	// The op types seen by the outer middleware, in order.
+	//
+	// GUARDED_BY(mu)
+	seen []reflect.Type
+}
+
+func init() { RegisterTestSuite(&MiddlewareTest{}) }
+
+func (t *MiddlewareTest) SetUp(ti *TestInfo) {
+	// Make sure that each write(2) turns into exactly one WriteFileOp.
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.counter = fuseutil.NewOpCounter()
+	t.Server = fuseutil.NewFileSystemServer(
+		fuseutil.WrapFileSystem(
+			&sinkFS{},
+			t.record,
+			t.refuseTruncation,
+			t.counter.Middleware))
+
+	t.SampleTest.SetUp(ti)
+}
+
+// A middleware that records the type of each op.
+func (t *MiddlewareTest) record(next fuseutil.OpHandler) fuseutil.OpHandler {
+	return func(ctx context.Context, op interface{}) error {
+		t.mu.Lock()
+		t.seen = append(t.seen, reflect.TypeOf(op))
+		t.mu.Unlock()
+
+		return next(ctx, op)
+	}
+}
+
+// A middleware that fails truncations with EPERM rather than passing them on.
+func (t *MiddlewareTest) refuseTruncation(
+	next fuseutil.OpHandler) fuseutil.OpHandler {
+	return func(ctx context.Context, op interface{}) error {
+		if typed, ok := op.(*fuseops.SetInodeAttributesOp); ok && typed.Size != nil {
+			return syscall.EPERM
+		}
+
+		return next(ctx, op)
+	}
+}
+
+func (t *MiddlewareTest) seenCount(opType reflect.Type) (n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, seen := range t.seen {
+		if seen == opType {
+			n++
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MiddlewareTest) CountsOpsByType() {
+	writeType := reflect.TypeOf(&fuseops.WriteFileOp{})
+	lookUpType := reflect.TypeOf(&fuseops.LookUpInodeOp{})
+
+	// Write three times.
+	f, err := os.OpenFile(path.Join(t.Dir, "sink"), os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = f.Write([]byte("taco"))
+		AssertEq(nil, err)
+	}
+
+	// Look up a name that doesn't exist.
+	_, err = os.Stat(path.Join(t.Dir, "missing"))
+	AssertTrue(os.IsNotExist(err), "err: %v", err)
+
+	stats := t.counter.Stats()
+	ExpectEq(3, stats[writeType].Count)
+	ExpectEq(0, stats[writeType].Errors)
+
+	// The failed lookup is counted as an error; the others succeeded.
+	ExpectLe(1, stats[lookUpType].Errors)
+	ExpectLe(stats[lookUpType].Errors, stats[lookUpType].Count)
+
+	// Both middleware saw the same ops.
+	ExpectEq(3, t.seenCount(writeType))
+	ExpectEq(stats[lookUpType].Count, t.seenCount(lookUpType))
+}
+
+func (t *MiddlewareTest) MiddlewareCanAnswerOps() {
+	setAttrType := reflect.TypeOf(&fuseops.SetInodeAttributesOp{})
+
+	// Truncating fails with the middleware's error.
+	err := os.Truncate(path.Join(t.Dir, "sink"), 0)
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "err: %v", err)
+	ExpectEq(syscall.EPERM, pathErr.Err)
+
+	// The outer middleware saw the op, but the inner one, like the file
+	// system, never did.
+	ExpectEq(1, t.seenCount(setAttrType))
+	ExpectEq(0, t.counter.Stats()[setAttrType].Count)
+}
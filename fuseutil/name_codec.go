@@ -0,0 +1,152 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// A NameCodec translates between the names of directory entries, which may
+// contain any byte other than '/' and NUL, and the names used by a backend
+// that allows only a restricted set of characters (for example an object
+// store that disallows some characters in keys).
+//
+// A file system applies Encode to the names in the ops it receives (e.g.
+// LookUpInodeOp.Name, CreateFileOp.Name, and both names in RenameOp) before
+// handing them to its backend, and Decode to the names it gets back from the
+// backend before returning them in Dirents. For every name,
+// Decode(Encode(name)) must return name.
+type NameCodec interface {
+	// Encode the supplied directory entry name for use with the backend.
+	Encode(name string) string
+
+	// Decode a name previously returned by Encode. Return an error if the name
+	// couldn't have been produced by Encode, which may indicate that it was
+	// written to the backend by some other means.
+	Decode(encoded string) (name string, err error)
+}
+
+// NewPercentNameCodec returns a NameCodec that replaces each byte of the
+// supplied set of reserved characters with a percent sign followed by two
+// upper-case hex digits, as in URLs. Percent signs themselves, ASCII control
+// characters, and bytes outside of ASCII are escaped in the same way, so the
+// encoded names consist only of printable ASCII characters that are not in
+// reserved.
+//
+// reserved must consist of ASCII characters.
+func NewPercentNameCodec(reserved string) NameCodec {
+	c := &percentNameCodec{}
+	for i := 0; i < len(reserved); i++ {
+		b := reserved[i]
+		if b >= 0x80 {
+			panic(fmt.Sprintf("Non-ASCII reserved character: %q", reserved))
+		}
+
+		c.reserved[b] = true
+	}
+
+	return c
+}
+
+type percentNameCodec struct {
+	// Which ASCII characters must be escaped, in addition to '%' and control
+	// characters.
+	reserved [0x80]bool
+}
+
+func (c *percentNameCodec) shouldEscape(b byte) bool {
+	return b == '%' || b < 0x20 || b >= 0x7f || c.reserved[b]
+}
+
+func (c *percentNameCodec) Encode(name string) string {
+	// Avoid allocating in the common case.
+	i := 0
+	for i < len(name) && !c.shouldEscape(name[i]) {
+		i++
+	}
+
+	if i == len(name) {
+		return name
+	}
+
+	const hex = "0123456789ABCDEF"
+
+	var buf bytes.Buffer
+	buf.WriteString(name[:i])
+	for ; i < len(name); i++ {
+		b := name[i]
+		if !c.shouldEscape(b) {
+			buf.WriteByte(b)
+			continue
+		}
+
+		buf.WriteByte('%')
+		buf.WriteByte(hex[b>>4])
+		buf.WriteByte(hex[b&0xf])
+	}
+
+	return buf.String()
+}
+
+func (c *percentNameCodec) Decode(encoded string) (name string, err error) {
+	if strings.IndexByte(encoded, '%') < 0 {
+		name = encoded
+		return
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(encoded); i++ {
+		b := encoded[i]
+		if b != '%' {
+			buf.WriteByte(b)
+			continue
+		}
+
+		if i+2 >= len(encoded) {
+			err = fmt.Errorf("Truncated escape in %q", encoded)
+			return
+		}
+
+		hi, okHi := unhex(encoded[i+1])
+		lo, okLo := unhex(encoded[i+2])
+		if !okHi || !okLo {
+			err = fmt.Errorf("Invalid escape in %q", encoded)
+			return
+		}
+
+		buf.WriteByte(hi<<4 | lo)
+		i += 2
+	}
+
+	name = buf.String()
+	return
+}
+
+func unhex(c byte) (b byte, ok bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	}
+
+	return
+}
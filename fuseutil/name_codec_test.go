@@ -0,0 +1,92 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// The characters that our pretend object store refuses in keys.
+const backendReserved = `\:*?"<>|`
+
+// A pretend object store that refuses keys containing reserved characters.
+type restrictedBackend map[string][]byte
+
+func (b restrictedBackend) Put(key string, data []byte) (err error) {
+	if strings.ContainsAny(key, backendReserved) {
+		err = fmt.Errorf("Illegal key: %q", key)
+		return
+	}
+
+	b[key] = data
+	return
+}
+
+func TestPercentNameCodec_RoundTrip(t *testing.T) {
+	codec := fuseutil.NewPercentNameCodec(backendReserved)
+	backend := make(restrictedBackend)
+
+	names := []string{
+		"plain.txt",
+		"",
+		`C:\Windows`,
+		"what?*",
+		"100%",
+		"%41",
+		"tab\there",
+		"new\nline",
+		"caf\u00e9",
+		"\xff\xfe",
+	}
+
+	for _, name := range names {
+		// The raw name may be refused by the backend, but the encoded one must
+		// not be.
+		encoded := codec.Encode(name)
+		if err := backend.Put(encoded, []byte(name)); err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+
+		decoded, err := codec.Decode(encoded)
+		if err != nil {
+			t.Errorf("%q: Decode(%q): %v", name, encoded, err)
+			continue
+		}
+
+		if decoded != name {
+			t.Errorf("%q: round-tripped as %q via %q", name, decoded, encoded)
+		}
+	}
+
+	// Names that need no escaping are left alone.
+	if got := codec.Encode("plain.txt"); got != "plain.txt" {
+		t.Errorf("Encode(plain.txt) = %q", got)
+	}
+}
+
+func TestPercentNameCodec_DecodeErrors(t *testing.T) {
+	codec := fuseutil.NewPercentNameCodec(backendReserved)
+
+	for _, encoded := range []string{"%", "foo%4", "%zz", "%4g"} {
+		if name, err := codec.Decode(encoded); err == nil {
+			t.Errorf("Decode(%q) = %q, want error", encoded, name)
+		}
+	}
+}
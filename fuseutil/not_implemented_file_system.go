@@ -64,6 +64,13 @@ func (fs *NotImplementedFileSystem) ForgetInode(
 	return
 }
 
+func (fs *NotImplementedFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
 func (fs *NotImplementedFileSystem) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
@@ -134,6 +141,13 @@ func (fs *NotImplementedFileSystem) ReadDir(
 	return
 }
 
+func (fs *NotImplementedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
 func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) (err error) {
@@ -162,6 +176,34 @@ func (fs *NotImplementedFileSystem) WriteFile(
 	return
 }
 
+func (fs *NotImplementedFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
+func (fs *NotImplementedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
+func (fs *NotImplementedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
+func (fs *NotImplementedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
 func (fs *NotImplementedFileSystem) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
@@ -218,5 +260,26 @@ func (fs *NotImplementedFileSystem) SetXattr(
 	return
 }
 
+func (fs *NotImplementedFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
+func (fs *NotImplementedFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
+func (fs *NotImplementedFileSystem) SetLockWait(
+	ctx context.Context,
+	op *fuseops.SetLockWaitOp) (err error) {
+	err = fuse.ENOSYS
+	return
+}
+
 func (fs *NotImplementedFileSystem) Destroy() {
 }
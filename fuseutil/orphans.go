@@ -0,0 +1,247 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// OrphanList records, durably, the inodes that a persistent file system has
+// unlinked but not yet freed because the kernel still holds references to them
+// (e.g. files that are unlinked while open, or created with O_TMPFILE).
+//
+// Normally such an inode is freed once the kernel forgets it. If the daemon
+// crashes first, the kernel's references vanish with the mount, and nothing
+// will ever free the inode: it has no name, so it can't be reached. Recording
+// it here lets the next incarnation of the file system find and reclaim it.
+//
+// Use it like this:
+//
+//  *  Call Add when an inode's link count drops to zero while the kernel
+//     still has references to it. Don't free the inode yet.
+//
+//  *  Call Remove once the inode has been freed, i.e. when its lookup count
+//     also drops to zero.
+//
+//  *  At startup, before mounting, call Reap to free every inode left over by
+//     a crash.
+//
+// Safe for concurrent use.
+type OrphanList struct {
+	path string
+
+	mu sync.Mutex
+
+	// The inodes in the list, mirroring the contents of the file at path.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]struct{}
+}
+
+// OpenOrphanList opens the orphan list stored in the file with the supplied
+// path, which should live alongside the file system's other persistent state.
+// The file is created if it doesn't exist.
+func OpenOrphanList(path string) (ol *OrphanList, err error) {
+	ol = &OrphanList{
+		path:   path,
+		inodes: make(map[fuseops.InodeID]struct{}),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Open: %v", err)
+		return
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var id uint64
+		id, err = strconv.ParseUint(scanner.Text(), 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Parsing %q: %v", scanner.Text(), err)
+			return
+		}
+
+		ol.inodes[fuseops.InodeID(id)] = struct{}{}
+	}
+
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("Reading: %v", err)
+		return
+	}
+
+	return
+}
+
+// Add records that the supplied inode has been unlinked but not freed. It
+// returns once the record is durable.
+//
+// LOCKS_EXCLUDED(ol.mu)
+func (ol *OrphanList) Add(id fuseops.InodeID) (err error) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	if _, ok := ol.inodes[id]; ok {
+		return
+	}
+
+	ol.inodes[id] = struct{}{}
+	err = ol.save()
+	if err != nil {
+		delete(ol.inodes, id)
+	}
+
+	return
+}
+
+// Remove records that the supplied inode has been freed. It is not an error
+// if the inode isn't in the list.
+//
+// LOCKS_EXCLUDED(ol.mu)
+func (ol *OrphanList) Remove(id fuseops.InodeID) (err error) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	if _, ok := ol.inodes[id]; !ok {
+		return
+	}
+
+	delete(ol.inodes, id)
+	err = ol.save()
+	if err != nil {
+		ol.inodes[id] = struct{}{}
+	}
+
+	return
+}
+
+// Inodes returns the inodes in the list, in increasing order.
+//
+// LOCKS_EXCLUDED(ol.mu)
+func (ol *OrphanList) Inodes() (ids []fuseops.InodeID) {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+
+	ids = ol.sorted()
+	return
+}
+
+// Reap calls free for each inode in the list, removing those for which it
+// succeeds. It should be called at startup, before mounting, when no inode
+// can still be in use. free must tolerate inodes that have already been freed,
+// since a crash may happen between freeing an inode and removing it from the
+// list.
+//
+// Returns the number of inodes reclaimed. If free fails for an inode, Reap
+// carries on with the rest, and returns the first error.
+//
+// LOCKS_EXCLUDED(ol.mu)
+func (ol *OrphanList) Reap(
+	free func(id fuseops.InodeID) error) (n int, err error) {
+	for _, id := range ol.Inodes() {
+		if freeErr := free(id); freeErr != nil {
+			if err == nil {
+				err = fmt.Errorf("Freeing inode %d: %v", id, freeErr)
+			}
+
+			continue
+		}
+
+		if removeErr := ol.Remove(id); removeErr != nil {
+			if err == nil {
+				err = fmt.Errorf("Remove: %v", removeErr)
+			}
+
+			continue
+		}
+
+		n++
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(ol.mu)
+func (ol *OrphanList) sorted() (ids []fuseops.InodeID) {
+	for id := range ol.inodes {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return
+}
+
+// Replace the file with the current contents of the list, atomically and
+// durably.
+//
+// LOCKS_REQUIRED(ol.mu)
+func (ol *OrphanList) save() (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(ol.path), ".orphans")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	for _, id := range ol.sorted() {
+		fmt.Fprintf(w, "%d\n", id)
+	}
+
+	if err = w.Flush(); err != nil {
+		f.Close()
+		err = fmt.Errorf("Flush: %v", err)
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		err = fmt.Errorf("Sync: %v", err)
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	if err = os.Rename(f.Name(), ol.path); err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
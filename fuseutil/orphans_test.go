@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+func TestOrphanList_ReapAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orphans_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "orphans")
+
+	// The first incarnation of the file system unlinks three open files. One of
+	// them is closed and freed before the crash.
+	ol, err := fuseutil.OpenOrphanList(p)
+	if err != nil {
+		t.Fatalf("OpenOrphanList: %v", err)
+	}
+
+	for _, id := range []fuseops.InodeID{17, 19, 23} {
+		if err := ol.Add(id); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	if err := ol.Remove(19); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// Crash, dropping the list on the floor. The next incarnation finds the
+	// other two.
+	ol, err = fuseutil.OpenOrphanList(p)
+	if err != nil {
+		t.Fatalf("OpenOrphanList: %v", err)
+	}
+
+	want := []fuseops.InodeID{17, 23}
+	if got := ol.Inodes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Inodes: got %v, want %v", got, want)
+	}
+
+	// Reap them, with freeing one failing the first time.
+	var freed []fuseops.InodeID
+	failing := true
+	free := func(id fuseops.InodeID) error {
+		if id == 23 && failing {
+			return errors.New("taco")
+		}
+
+		freed = append(freed, id)
+		return nil
+	}
+
+	n, err := ol.Reap(free)
+	if err == nil || n != 1 {
+		t.Errorf("Reap: got (%d, %v), want one reclaimed and an error", n, err)
+	}
+
+	failing = false
+	n, err = ol.Reap(free)
+	if err != nil || n != 1 {
+		t.Errorf("Reap: got (%d, %v), want one reclaimed", n, err)
+	}
+
+	if !reflect.DeepEqual(freed, want) {
+		t.Errorf("Freed: got %v, want %v", freed, want)
+	}
+
+	// Nothing remains, even after another restart.
+	ol, err = fuseutil.OpenOrphanList(p)
+	if err != nil {
+		t.Fatalf("OpenOrphanList: %v", err)
+	}
+
+	if got := ol.Inodes(); len(got) != 0 {
+		t.Errorf("Inodes after reaping: %v", got)
+	}
+}
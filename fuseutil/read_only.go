@@ -0,0 +1,160 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+)
+
+// NewReadOnlyFileSystem wraps the supplied file system so that every op that
+// would modify it fails with EROFS without reaching it. This is intended for
+// use alongside fuse.MountConfig.ReadOnly, which has the kernel refuse
+// modifications before they are sent, as a second line of defence for file
+// systems whose write paths must never run, for example because the mount is
+// serving a snapshot.
+//
+// The ops rejected are those that create, remove, or rename inodes, that
+// write to files, and that change attributes or extended attributes. Every
+// SetInodeAttributesOp is rejected, including those for chown(2), whose IDs
+// the op doesn't carry. An OpenFileOp is rejected if its access mode is
+// O_WRONLY or O_RDWR, and passed through if it is O_RDONLY. Other ops are
+// passed through unmodified, including IoctlOp, since only the file system
+// knows which of its commands modify anything.
+func NewReadOnlyFileSystem(wrapped FileSystem) FileSystem {
+	return &readOnlyFileSystem{
+		FileSystem: wrapped,
+	}
+}
+
+type readOnlyFileSystem struct {
+	// The wrapped file system, to which ops that don't modify anything are
+	// delegated.
+	FileSystem
+}
+
+func (fs *readOnlyFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	if op.Flags.AccessMode() != syscall.O_RDONLY {
+		err = fuse.EROFS
+		return
+	}
+
+	err = fs.FileSystem.OpenFile(ctx, op)
+	return
+}
+
+func (fs *readOnlyFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	err = fuse.EROFS
+	return
+}
+
+func (fs *readOnlyFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	err = fuse.EROFS
+	return
+}
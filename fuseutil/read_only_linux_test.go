@@ -0,0 +1,240 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestReadOnlyFileSystem(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+const (
+	treeFileID = fuseops.RootInodeID + 1 + iota
+	treeDirID
+)
+
+const treeFileContents = "taco"
+
+// A file system whose root contains a file named "file" and an empty
+// directory named "dir", and which implements only the ops needed to read
+// them.
+type treeFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *treeFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	switch inode {
+	case treeFileID:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0666,
+			Size:  uint64(len(treeFileContents)),
+		}
+
+	default:
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+	}
+}
+
+func (fs *treeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	switch op.Name {
+	case "file":
+		op.Entry.Child = treeFileID
+
+	case "dir":
+		op.Entry.Child = treeDirID
+
+	default:
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *treeFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *treeFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *treeFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if op.Offset < int64(len(treeFileContents)) {
+		op.BytesRead = copy(op.Dst, treeFileContents[op.Offset:])
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReadOnlyFileSystemTest struct {
+	samples.SampleTest
+
+	// Sits between the read-only layer and the file system, failing every
+	// modifying op that gets past the former with EIO.
+	injector *fuseutil.ErrorInjector
+}
+
+func init() { RegisterTestSuite(&ReadOnlyFileSystemTest{}) }
+
+func (t *ReadOnlyFileSystemTest) SetUp(ti *TestInfo) {
+	// Don't set MountConfig.ReadOnly, which would have the kernel reject
+	// modifications itself. Make sure that writes reach the file system
+	// rather than the page cache.
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.injector = fuseutil.NewErrorInjector(&treeFS{})
+	for _, op := range []interface{}{
+		&fuseops.SetInodeAttributesOp{},
+		&fuseops.MkDirOp{},
+		&fuseops.MkNodeOp{},
+		&fuseops.CreateFileOp{},
+		&fuseops.CreateLinkOp{},
+		&fuseops.CreateSymlinkOp{},
+		&fuseops.RenameOp{},
+		&fuseops.RmDirOp{},
+		&fuseops.UnlinkOp{},
+		&fuseops.WriteFileOp{},
+		&fuseops.FallocateOp{},
+		&fuseops.CopyFileRangeOp{},
+		&fuseops.RemoveXattrOp{},
+		&fuseops.SetXattrOp{},
+	} {
+		t.injector.InjectWithProbability(reflect.TypeOf(op), 1, syscall.EIO)
+	}
+
+	t.Server = fuseutil.NewFileSystemServer(
+		fuseutil.NewReadOnlyFileSystem(t.injector))
+
+	t.SampleTest.SetUp(ti)
+}
+
+// Return the errno underlying the supplied error, if any.
+func errno(err error) error {
+	switch typed := err.(type) {
+	case *os.PathError:
+		return typed.Err
+
+	case *os.LinkError:
+		return typed.Err
+
+	case *os.SyscallError:
+		return typed.Err
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadOnlyFileSystemTest) Reads() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "file"))
+	AssertEq(nil, err)
+	ExpectEq(treeFileContents, string(contents))
+
+	fi, err := os.Stat(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+}
+
+func (t *ReadOnlyFileSystemTest) Mutations() {
+	file := path.Join(t.Dir, "file")
+	dir := path.Join(t.Dir, "dir")
+	other := path.Join(t.Dir, "other")
+
+	testCases := []struct {
+		name string
+		f    func() error
+	}{
+		{"truncate", func() error { return os.Truncate(file, 0) }},
+		{"chmod", func() error { return os.Chmod(file, 0600) }},
+		{"chown", func() error { return os.Chown(file, 17, 19) }},
+		{"utimes", func() error { return os.Chtimes(file, time.Now(), time.Now()) }},
+		{"mkdir", func() error { return os.Mkdir(other, 0700) }},
+		{"mknod", func() error { return syscall.Mknod(other, syscall.S_IFIFO|0600, 0) }},
+		{"create", func() error {
+			_, err := os.OpenFile(other, os.O_WRONLY|os.O_CREATE, 0600)
+			return err
+		}},
+		{"link", func() error { return os.Link(file, other) }},
+		{"symlink", func() error { return os.Symlink("file", other) }},
+		{"rename", func() error { return os.Rename(file, other) }},
+		{"rmdir", func() error { return syscall.Rmdir(dir) }},
+		{"unlink", func() error { return syscall.Unlink(file) }},
+		{"setxattr", func() error { return syscall.Setxattr(file, "user.foo", []byte("bar"), 0) }},
+		{"removexattr", func() error { return syscall.Removexattr(file, "user.foo") }},
+	}
+
+	for _, tc := range testCases {
+		ExpectEq(syscall.EROFS, errno(tc.f()), "%s", tc.name)
+	}
+
+	// Opening the file for writing fails, while opening it for reading
+	// doesn't.
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_WRONLY | os.O_TRUNC} {
+		_, err := os.OpenFile(file, flag, 0)
+		ExpectEq(syscall.EROFS, errno(err), "open with flags %#x", flag)
+	}
+
+	f, err := os.OpenFile(file, os.O_RDONLY, 0)
+	AssertEq(nil, err)
+	ExpectEq(nil, f.Close())
+
+	// None of the ops reached the file system.
+	ExpectEq(0, len(t.injector.Fired()))
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// ReadSeekerFile serves GetInodeAttributesOp and ReadFileOp for a single
+// read-only file inode whose contents come from an io.ReadSeeker. A file
+// system containing such a file can forward those ops for the inode to it,
+// rather than dealing with offsets and short reads itself.
+//
+// If the io.ReadSeeker also implements io.ReaderAt, reads are served
+// concurrently using ReadAt. Otherwise they are serialized, each seeking to
+// the appropriate offset before reading.
+type ReadSeekerFile struct {
+	inode fuseops.InodeID
+	attrs fuseops.InodeAttributes
+
+	// If non-nil, used for all reads.
+	ra io.ReaderAt
+
+	// Otherwise, we seek and read under mu.
+	mu sync.Mutex
+	rs io.ReadSeeker // GUARDED_BY(mu)
+}
+
+// FileFromReadSeeker creates a ReadSeekerFile for the supplied inode. The
+// file's size is determined by seeking to the end of rs; the other attributes
+// are taken from attrs.
+func FileFromReadSeeker(
+	inode fuseops.InodeID,
+	rs io.ReadSeeker,
+	attrs fuseops.InodeAttributes) (f *ReadSeekerFile, err error) {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	attrs.Size = uint64(size)
+
+	f = &ReadSeekerFile{
+		inode: inode,
+		attrs: attrs,
+		rs:    rs,
+	}
+
+	if ra, ok := rs.(io.ReaderAt); ok {
+		f.ra = ra
+	}
+
+	return
+}
+
+// Inode returns the ID of the inode served by f.
+func (f *ReadSeekerFile) Inode() fuseops.InodeID {
+	return f.inode
+}
+
+// Attributes returns the file's attributes, e.g. for use in a
+// LookUpInodeOp response.
+func (f *ReadSeekerFile) Attributes() fuseops.InodeAttributes {
+	return f.attrs
+}
+
+// GetInodeAttributes serves the supplied op, which must be for f's inode.
+func (f *ReadSeekerFile) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if op.Inode != f.inode {
+		err = fmt.Errorf("Unexpected inode: %v", op.Inode)
+		return
+	}
+
+	op.Attributes = f.attrs
+	return
+}
+
+// ReadFile serves the supplied op, which must be for f's inode.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *ReadSeekerFile) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if op.Inode != f.inode {
+		err = fmt.Errorf("Unexpected inode: %v", op.Inode)
+		return
+	}
+
+	if f.ra != nil {
+		op.BytesRead, err = f.ra.ReadAt(op.Dst, op.Offset)
+	} else {
+		op.BytesRead, err = f.seekAndRead(op.Dst, op.Offset)
+	}
+
+	// Short reads are how we indicate EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(f.mu)
+func (f *ReadSeekerFile) seekAndRead(
+	p []byte,
+	off int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err = f.rs.Seek(off, io.SeekStart); err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	n, err = io.ReadFull(f.rs, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestReadSeekerFile(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Hide the ReadAt method of a *bytes.Reader, forcing ReadSeekerFile to seek.
+type seekOnlyReader struct {
+	io.ReadSeeker
+}
+
+// A file system with files named "reader_at" and "seek_only", each served by
+// a ReadSeekerFile.
+type readSeekerFS struct {
+	fuseutil.NotImplementedFileSystem
+	files map[string]*fuseutil.ReadSeekerFile
+}
+
+func (fs *readSeekerFS) findInode(
+	inode fuseops.InodeID) (f *fuseutil.ReadSeekerFile) {
+	for _, f = range fs.files {
+		if f.Inode() == inode {
+			return
+		}
+	}
+
+	return nil
+}
+
+func (fs *readSeekerFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	f, ok := fs.files[op.Name]
+	if op.Parent != fuseops.RootInodeID || !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = f.Inode()
+	op.Entry.Attributes = f.Attributes()
+
+	return
+}
+
+func (fs *readSeekerFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+
+		return
+	}
+
+	f := fs.findInode(op.Inode)
+	if f == nil {
+		err = fuse.ENOENT
+		return
+	}
+
+	err = f.GetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *readSeekerFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *readSeekerFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	f := fs.findInode(op.Inode)
+	if f == nil {
+		err = fuse.ENOENT
+		return
+	}
+
+	err = f.ReadFile(ctx, op)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ReadSeekerFileTest struct {
+	samples.SampleTest
+	contents []byte
+}
+
+var _ SetUpInterface = &ReadSeekerFileTest{}
+var _ TearDownInterface = &ReadSeekerFileTest{}
+
+func init() { RegisterTestSuite(&ReadSeekerFileTest{}) }
+
+func (t *ReadSeekerFileTest) SetUp(ti *TestInfo) {
+	// Set up contents that span several pages, with no two equal offsets
+	// holding the same data.
+	for i := 0; i < 3*4096+17; i++ {
+		t.contents = append(t.contents, byte(i*7+i/256))
+	}
+
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+	}
+
+	readerAt, err := fuseutil.FileFromReadSeeker(
+		fuseops.RootInodeID+1,
+		bytes.NewReader(t.contents),
+		attrs)
+	AssertEq(nil, err)
+
+	seekOnly, err := fuseutil.FileFromReadSeeker(
+		fuseops.RootInodeID+2,
+		seekOnlyReader{bytes.NewReader(t.contents)},
+		attrs)
+	AssertEq(nil, err)
+
+	t.Server = fuseutil.NewFileSystemServer(&readSeekerFS{
+		files: map[string]*fuseutil.ReadSeekerFile{
+			"reader_at": readerAt,
+			"seek_only": seekOnly,
+		},
+	})
+
+	t.SampleTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ReadSeekerFileTest) Stat() {
+	for _, name := range []string{"reader_at", "seek_only"} {
+		fi, err := os.Stat(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+
+		ExpectEq(len(t.contents), fi.Size(), "%s", name)
+		ExpectEq(os.FileMode(0444), fi.Mode(), "%s", name)
+	}
+}
+
+func (t *ReadSeekerFileTest) ReadAtVariousOffsets() {
+	testCases := []struct {
+		off int64
+		n   int
+	}{
+		{0, 0},
+		{0, 10},
+		{17, 4096},
+		{4095, 2},
+		{int64(len(t.contents)) - 5, 5},
+
+		// Straddling and beyond EOF.
+		{int64(len(t.contents)) - 5, 100},
+		{int64(len(t.contents)), 10},
+		{int64(len(t.contents)) + 100, 10},
+	}
+
+	for _, name := range []string{"reader_at", "seek_only"} {
+		f, err := os.Open(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+		defer f.Close()
+
+		for _, tc := range testCases {
+			buf := make([]byte, tc.n)
+			n, err := f.ReadAt(buf, tc.off)
+
+			// Figure out what we expect.
+			var expected []byte
+			if tc.off < int64(len(t.contents)) {
+				expected = t.contents[tc.off:]
+			}
+
+			if len(expected) > tc.n {
+				expected = expected[:tc.n]
+			}
+
+			if len(expected) < tc.n {
+				ExpectEq(io.EOF, err, "%s: %v", name, tc)
+			} else {
+				ExpectEq(nil, err, "%s: %v", name, tc)
+			}
+
+			ExpectEq(string(expected), string(buf[:n]), "%s: %v", name, tc)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// SequentialReadDetector remembers where the most recent read on each file
+// handle ended, so that a file system can tell whether a read carries on from
+// the previous one. A file system with a slow backend can use this to start
+// fetching the part of the file after a sequential read before the kernel
+// asks for it.
+//
+// This is most useful for files opened with fuseops.OpenFileOp.UseDirectIO,
+// whose reads reach the file system exactly as the application issues them.
+// Reads through the page cache are already subject to the kernel's own
+// readahead (see fuse.MountConfig.MaxReadahead), which makes them sequential
+// and overlapping even for an application reading in bursts.
+//
+// Safe for concurrent use.
+type SequentialReadDetector struct {
+	mu sync.Mutex
+
+	// The offset just past the end of the most recent read on each handle.
+	//
+	// GUARDED_BY(mu)
+	next map[fuseops.HandleID]int64
+}
+
+// NewSequentialReadDetector creates a detector that has seen no reads.
+func NewSequentialReadDetector() (d *SequentialReadDetector) {
+	d = &SequentialReadDetector{
+		next: make(map[fuseops.HandleID]int64),
+	}
+
+	return
+}
+
+// Observe records the supplied read, which should be called from
+// FileSystem.ReadFile before the read is served, and returns whether it
+// begins where the previous read on the same handle ended. The first read on
+// a handle counts as sequential if it begins at the start of the file.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *SequentialReadDetector) Observe(
+	op *fuseops.ReadFileOp) (sequential bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A missing entry reads as zero.
+	sequential = op.Offset == d.next[op.Handle]
+	d.next[op.Handle] = op.Offset + int64(len(op.Dst))
+
+	return
+}
+
+// Forget discards what is known about the supplied handle. Call this from
+// FileSystem.ReleaseFileHandle.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *SequentialReadDetector) Forget(h fuseops.HandleID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.next, h)
+}
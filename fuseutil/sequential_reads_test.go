@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+func TestSequentialReadDetector(t *testing.T) {
+	d := fuseutil.NewSequentialReadDetector()
+
+	read := func(h fuseops.HandleID, offset int64, size int) bool {
+		return d.Observe(&fuseops.ReadFileOp{
+			Handle: h,
+			Offset: offset,
+			Dst:    make([]byte, size),
+		})
+	}
+
+	testCases := []struct {
+		handle     fuseops.HandleID
+		offset     int64
+		size       int
+		sequential bool
+	}{
+		// Reading a file from its start.
+		{0, 0, 10, true},
+		{0, 10, 20, true},
+
+		// Another handle starting part way through the file, and then carrying
+		// on.
+		{1, 100, 10, false},
+		{1, 110, 10, true},
+
+		// The first handle is unaffected, until it skips ahead.
+		{0, 30, 5, true},
+		{0, 50, 5, false},
+		{0, 55, 5, true},
+
+		// Rereading isn't sequential.
+		{0, 55, 5, false},
+	}
+
+	for i, tc := range testCases {
+		if got := read(tc.handle, tc.offset, tc.size); got != tc.sequential {
+			t.Errorf("Read %d: got %v, want %v", i, got, tc.sequential)
+		}
+	}
+
+	// Forgetting a handle starts it afresh.
+	d.Forget(1)
+	if !read(1, 0, 10) {
+		t.Errorf("Read from start after Forget: not sequential")
+	}
+}
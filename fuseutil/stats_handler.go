@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbg/fuse"
+)
+
+// StatsHandler returns an HTTP handler that serves the live stats of the
+// supplied file system, for operators to keep an eye on it:
+//
+//     mux.Handle("/debug/fuse", fuseutil.StatsHandler(mfs))
+//
+// It serves MountedFileSystem.Stats, which requires MountConfig.CollectStats,
+// and MountedFileSystem.DumpRecentOps, which requires
+// MountConfig.TraceRingSize. Durations are in microseconds. Browsers, which
+// ask for text/html, get a page of tables; everything else gets JSON.
+func StatsHandler(mfs *fuse.MountedFileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := newStatsReport(mfs)
+
+		if strings.Contains(r.Header.Get("Accept"), "text/html") {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			statsTemplate.Execute(w, report)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// The document served by StatsHandler.
+type statsReport struct {
+	Dir          string           `json:"dir"`
+	InFlight     int              `json:"in_flight"`
+	BytesRead    uint64           `json:"bytes_read"`
+	BytesWritten uint64           `json:"bytes_written"`
+	Ops          []opTypeReport   `json:"ops"`
+	RecentOps    []opRecordReport `json:"recent_ops"`
+}
+
+type opTypeReport struct {
+	Op          string `json:"op"`
+	Count       uint64 `json:"count"`
+	Errors      uint64 `json:"errors"`
+	MeanLatency int64  `json:"mean_latency_us"`
+	MaxLatency  int64  `json:"max_latency_us"`
+}
+
+type opRecordReport struct {
+	Op       string    `json:"op"`
+	Inode    uint64    `json:"inode"`
+	Start    time.Time `json:"start"`
+	Duration int64     `json:"duration_us"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newStatsReport(mfs *fuse.MountedFileSystem) (report statsReport) {
+	stats := mfs.Stats()
+	report = statsReport{
+		Dir:          mfs.Dir(),
+		InFlight:     stats.InFlight,
+		BytesRead:    stats.BytesRead,
+		BytesWritten: stats.BytesWritten,
+		Ops:          []opTypeReport{},
+		RecentOps:    []opRecordReport{},
+	}
+
+	for name, t := range stats.Ops {
+		report.Ops = append(report.Ops, opTypeReport{
+			Op:          name,
+			Count:       t.Count,
+			Errors:      t.Errors,
+			MeanLatency: int64(t.TotalDuration / time.Duration(t.Count) / time.Microsecond),
+			MaxLatency:  int64(t.MaxDuration / time.Microsecond),
+		})
+	}
+
+	sort.Slice(report.Ops, func(i, j int) bool {
+		return report.Ops[i].Op < report.Ops[j].Op
+	})
+
+	for _, rec := range mfs.DumpRecentOps() {
+		r := opRecordReport{
+			Op:       rec.Op,
+			Inode:    uint64(rec.Inode),
+			Start:    rec.Start,
+			Duration: int64(rec.Duration / time.Microsecond),
+		}
+
+		if rec.Err != nil {
+			r.Error = rec.Err.Error()
+		}
+
+		report.RecentOps = append(report.RecentOps, r)
+	}
+
+	return
+}
+
+var statsTemplate = template.Must(template.New("stats").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Dir}}</title></head>
+<body>
+<h1>{{.Dir}}</h1>
+<p>
+In flight: {{.InFlight}}<br>
+Bytes read: {{.BytesRead}}<br>
+Bytes written: {{.BytesWritten}}
+</p>
+<h2>Ops</h2>
+<table>
+<tr><th>Op</th><th>Count</th><th>Errors</th><th>Mean (&micro;s)</th><th>Max (&micro;s)</th></tr>
+{{range .Ops}}<tr><td>{{.Op}}</td><td>{{.Count}}</td><td>{{.Errors}}</td><td>{{.MeanLatency}}</td><td>{{.MaxLatency}}</td></tr>
+{{end}}</table>
+<h2>Recent ops</h2>
+<table>
+<tr><th>Start</th><th>Op</th><th>Inode</th><th>Duration (&micro;s)</th><th>Error</th></tr>
+{{range .RecentOps}}<tr><td>{{.Start.Format "15:04:05.000000"}}</td><td>{{.Op}}</td><td>{{.Inode}}</td><td>{{.Duration}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
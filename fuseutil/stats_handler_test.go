@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// The parts of the JSON served by StatsHandler that the test looks at.
+type statsReport struct {
+	Dir          string `json:"dir"`
+	InFlight     *int   `json:"in_flight"`
+	BytesWritten uint64 `json:"bytes_written"`
+	Ops          []struct {
+		Op     string `json:"op"`
+		Count  uint64 `json:"count"`
+		Errors uint64 `json:"errors"`
+	} `json:"ops"`
+	RecentOps []struct {
+		Op    string `json:"op"`
+		Error string `json:"error"`
+	} `json:"recent_ops"`
+}
+
+// Return the number of ops of the given type, or of those that failed.
+func (r *statsReport) count(op string, errors bool) uint64 {
+	for _, o := range r.Ops {
+		if o.Op != op {
+			continue
+		}
+
+		if errors {
+			return o.Errors
+		}
+
+		return o.Count
+	}
+
+	return 0
+}
+
+func getStatsReport(t *testing.T, url string) (report statsReport) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	if report.InFlight == nil {
+		t.Fatalf("No in_flight in %+v", report)
+	}
+
+	return
+}
+
+func TestStatsHandler(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "stats_handler_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, making sure that each write(2) turns into exactly one
+	// WriteFileOp.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&sinkFS{}),
+		&fuse.MountConfig{
+			DisableWritebackCaching: true,
+			CollectStats:            true,
+			TraceRingSize:           16,
+		})
+
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	server := httptest.NewServer(fuseutil.StatsHandler(mfs))
+	defer server.Close()
+
+	// Write three times, and fail a lookup.
+	f, err := os.OpenFile(path.Join(dir, "sink"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := f.Write([]byte("taco")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// Fetch the stats as JSON. Ops are counted just after their replies are
+	// sent, so wait for the last of them to show up.
+	var report statsReport
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		report = getStatsReport(t, server.URL)
+		if *report.InFlight == 0 && report.count("LookUpInodeOp", true) > 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for ops to be counted: %+v", report)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if report.Dir != dir {
+		t.Errorf("dir: got %q, want %q", report.Dir, dir)
+	}
+
+	if report.BytesWritten != 12 {
+		t.Errorf("bytes_written: got %d, want 12", report.BytesWritten)
+	}
+
+	if n := report.count("WriteFileOp", false); n != 3 {
+		t.Errorf("WriteFileOp: got %d ops, want 3", n)
+	}
+
+	if n := report.count("WriteFileOp", true); n != 0 {
+		t.Errorf("WriteFileOp: got %d errors, want 0", n)
+	}
+
+	// The failed lookup is among the recent ops.
+	found := false
+	for _, o := range report.RecentOps {
+		if o.Op == "LookUpInodeOp" && o.Error != "" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("Failed lookup not in recent ops: %+v", report.RecentOps)
+	}
+
+	// Browsers get a page.
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+
+	req.Header.Set("Accept", "text/html,*/*")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type: %q", ct)
+	}
+
+	if !strings.Contains(string(body), "<td>WriteFileOp</td><td>3</td>") {
+		t.Errorf("Unexpected page: %s", body)
+	}
+}
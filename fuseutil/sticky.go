@@ -0,0 +1,43 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// StickyDirAllowsRemoval reports whether the user with the supplied ID may
+// remove or rename away the child with attributes child from the directory
+// with attributes dir, as far as the sticky bit is concerned. In a directory
+// with os.ModeSticky set (like /tmp) only the owner of the child, the owner of
+// the directory, or root may do so; elsewhere this always returns true.
+//
+// File systems should refuse UnlinkOp, RmDirOp, and RenameOp (for both the
+// source and any existing target) with fuse.EPERM when this returns false,
+// taking the uid from fuse.CallerFromContext. With the default_permissions
+// mount option, which this package always sets, the kernel performs the same
+// check before sending the op, so this is a second line of defense.
+func StickyDirAllowsRemoval(
+	dir fuseops.InodeAttributes,
+	child fuseops.InodeAttributes,
+	uid uint32) bool {
+	if dir.Mode&os.ModeSticky == 0 {
+		return true
+	}
+
+	return uid == 0 || uid == child.Uid || uid == dir.Uid
+}
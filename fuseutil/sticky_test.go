@@ -0,0 +1,55 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+func TestStickyDirAllowsRemoval(t *testing.T) {
+	const (
+		root     = 0
+		dirOwner = 1000
+		owner    = 1001
+		other    = 1002
+	)
+
+	dir := fuseops.InodeAttributes{Mode: os.ModeDir | 0777, Uid: dirOwner}
+	sticky := fuseops.InodeAttributes{Mode: os.ModeDir | os.ModeSticky | 0777, Uid: dirOwner}
+	child := fuseops.InodeAttributes{Mode: 0644, Uid: owner}
+
+	testCases := []struct {
+		dir  fuseops.InodeAttributes
+		uid  uint32
+		want bool
+	}{
+		{dir, other, true},
+		{sticky, root, true},
+		{sticky, dirOwner, true},
+		{sticky, owner, true},
+		{sticky, other, false},
+	}
+
+	for _, tc := range testCases {
+		got := fuseutil.StickyDirAllowsRemoval(tc.dir, child, tc.uid)
+		if got != tc.want {
+			t.Errorf("%v, uid %d: got %v, want %v", tc.dir.Mode, tc.uid, got, tc.want)
+		}
+	}
+}
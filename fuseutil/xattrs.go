@@ -0,0 +1,150 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sort"
+	"strconv"
+	"syscall"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+)
+
+// By convention, extended attributes whose values a file system computes
+// rather than stores live under the "user.fs." prefix, so that ordinary tools
+// can read them without privileges. Their values are printable ASCII with no
+// trailing newline, and they can't be set or removed.
+//
+// PhysicalSizeXattr is the number of bytes a file occupies in the file
+// system's backing store, in decimal, e.g. after compression or
+// deduplication. Comparing it with the file's size gives its compression
+// ratio.
+const PhysicalSizeXattr = "user.fs.physical_size"
+
+// Return the value of PhysicalSizeXattr for the supplied number of bytes.
+func PhysicalSizeValue(n uint64) []byte {
+	return []byte(strconv.FormatUint(n, 10))
+}
+
+// Copy the supplied value of an extended attribute into op.Dst, following the
+// conventions described on fuseops.GetXattrOp: op.BytesRead is set to the
+// size of the value, and ERANGE is returned if the caller supplied a buffer
+// that is too small for it.
+func WriteXattrValue(op *fuseops.GetXattrOp, value []byte) (err error) {
+	op.BytesRead = len(value)
+	if len(op.Dst) < len(value) {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, value)
+	return
+}
+
+// Write the supplied extended attribute names into op.Dst in the format
+// listxattr(2) returns, each followed by a NUL byte. op.BytesRead is set to
+// the size of the list, and ERANGE is returned if the caller supplied a
+// buffer that is too small for it.
+func WriteXattrNames(op *fuseops.ListXattrOp, names []string) (err error) {
+	op.BytesRead = 0
+	for _, name := range names {
+		op.BytesRead += len(name) + 1
+	}
+
+	if len(op.Dst) < op.BytesRead {
+		err = syscall.ERANGE
+		return
+	}
+
+	dst := op.Dst
+	for _, name := range names {
+		n := copy(dst, name)
+		dst[n] = 0
+		dst = dst[n+1:]
+	}
+
+	return
+}
+
+// ComputedXattrs maps the names of extended attributes whose values a file
+// system computes, such as PhysicalSizeXattr, to functions computing them for
+// a given inode. A function returns false if the attribute doesn't apply to
+// the inode, e.g. because it is a directory.
+//
+// Its methods let a file system serve these attributes alongside the ones it
+// stores on behalf of users, by consulting it before its own storage:
+//
+//     func (fs *myFS) GetXattr(
+//     	ctx context.Context,
+//     	op *fuseops.GetXattrOp) (err error) {
+//     	if ok, err := fs.computed.GetXattr(op); ok {
+//     		return err
+//     	}
+//
+//     	// Look up op.Name among the inode's stored attributes.
+//     	...
+//     }
+//
+// The functions may be called concurrently.
+type ComputedXattrs map[string]func(inode fuseops.InodeID) (value []byte, ok bool)
+
+// If op names a computed attribute that applies to its inode, answer it as
+// WriteXattrValue does and return true. Otherwise return false, leaving op
+// alone.
+func (cx ComputedXattrs) GetXattr(
+	op *fuseops.GetXattrOp) (handled bool, err error) {
+	f := cx[op.Name]
+	if f == nil {
+		return
+	}
+
+	value, ok := f(op.Inode)
+	if !ok {
+		return
+	}
+
+	handled = true
+	err = WriteXattrValue(op, value)
+	return
+}
+
+// Answer op with the names of the computed attributes that apply to its
+// inode, in sorted order, followed by the supplied names of attributes stored
+// for it.
+func (cx ComputedXattrs) ListXattr(
+	op *fuseops.ListXattrOp,
+	stored []string) (err error) {
+	var names []string
+	for name, f := range cx {
+		if _, ok := f(op.Inode); ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	err = WriteXattrNames(op, append(names, stored...))
+	return
+}
+
+// Return EPERM if name is that of a computed attribute, which callers can't
+// set or remove. Call this from SetXattr and RemoveXattr.
+func (cx ComputedXattrs) CheckWritable(name string) (err error) {
+	if _, ok := cx[name]; ok {
+		err = fuse.EPERM
+	}
+
+	return
+}
@@ -0,0 +1,330 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestXattrs(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+const compressedID = fuseops.RootInodeID + 1
+
+// A file system whose root contains a single file named "foo", stored
+// compressed. It reports the compressed size as fuseutil.PhysicalSizeXattr,
+// and stores other extended attributes for the file in memory.
+type compressedFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	size       int
+	compressed []byte
+	computed   fuseutil.ComputedXattrs
+
+	mu     sync.Mutex
+	xattrs map[string][]byte // GUARDED_BY(mu)
+}
+
+func newCompressedFS(contents []byte) (fs *compressedFS) {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression)
+	w.Write(contents)
+	w.Close()
+
+	fs = &compressedFS{
+		size:       len(contents),
+		compressed: buf.Bytes(),
+		xattrs:     make(map[string][]byte),
+	}
+
+	fs.computed = fuseutil.ComputedXattrs{
+		fuseutil.PhysicalSizeXattr: func(
+			inode fuseops.InodeID) (value []byte, ok bool) {
+			if inode != compressedID {
+				return
+			}
+
+			value = fuseutil.PhysicalSizeValue(uint64(len(fs.compressed)))
+			ok = true
+			return
+		},
+	}
+
+	return
+}
+
+func (fs *compressedFS) attributes(
+	inode fuseops.InodeID) (attrs fuseops.InodeAttributes, err error) {
+	switch inode {
+	case fuseops.RootInodeID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+
+	case compressedID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+			Size:  uint64(fs.size),
+		}
+
+	default:
+		err = fuse.ENOENT
+	}
+
+	return
+}
+
+func (fs *compressedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = compressedID
+	op.Entry.Attributes, err = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *compressedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes, err = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *compressedFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if ok, err := fs.computed.GetXattr(op); ok {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	value, ok := fs.xattrs[op.Name]
+	if op.Inode != compressedID || !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	err = fuseutil.WriteXattrValue(op, value)
+	return
+}
+
+func (fs *compressedFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var stored []string
+	if op.Inode == compressedID {
+		for name := range fs.xattrs {
+			stored = append(stored, name)
+		}
+	}
+
+	err = fs.computed.ListXattr(op, stored)
+	return
+}
+
+func (fs *compressedFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if err = fs.computed.CheckWritable(op.Name); err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.xattrs[op.Name] = append([]byte(nil), op.Value...)
+	return
+}
+
+func (fs *compressedFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if err = fs.computed.CheckWritable(op.Name); err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.xattrs[op.Name]; !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	delete(fs.xattrs, op.Name)
+	return
+}
+
+// Read all of the extended attribute names for the supplied file.
+func listXattrs(p string) (names []string, err error) {
+	n, err := syscall.Listxattr(p, nil)
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, n)
+	n, err = syscall.Listxattr(p, buf)
+	if err != nil || n == 0 {
+		return
+	}
+
+	names = strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	sort.Strings(names)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type XattrsTest struct {
+	samples.SampleTest
+	fs *compressedFS
+}
+
+var _ SetUpInterface = &XattrsTest{}
+var _ TearDownInterface = &XattrsTest{}
+
+func init() { RegisterTestSuite(&XattrsTest{}) }
+
+func (t *XattrsTest) SetUp(ti *TestInfo) {
+	t.fs = newCompressedFS(bytes.Repeat([]byte("taco"), 1<<16))
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+	t.SampleTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *XattrsTest) WriteXattrValue() {
+	value := []byte("taco")
+
+	// A request for the size alone.
+	op := &fuseops.GetXattrOp{}
+	ExpectEq(syscall.ERANGE, fuseutil.WriteXattrValue(op, value))
+	ExpectEq(4, op.BytesRead)
+
+	// Too small.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, 3)}
+	ExpectEq(syscall.ERANGE, fuseutil.WriteXattrValue(op, value))
+
+	// Large enough.
+	op = &fuseops.GetXattrOp{Dst: make([]byte, 8)}
+	ExpectEq(nil, fuseutil.WriteXattrValue(op, value))
+	ExpectEq("taco", string(op.Dst[:op.BytesRead]))
+}
+
+func (t *XattrsTest) WriteXattrNames() {
+	names := []string{"user.foo", "user.bar"}
+
+	op := &fuseops.ListXattrOp{}
+	ExpectEq(syscall.ERANGE, fuseutil.WriteXattrNames(op, names))
+	ExpectEq(18, op.BytesRead)
+
+	op = &fuseops.ListXattrOp{Dst: make([]byte, 17)}
+	ExpectEq(syscall.ERANGE, fuseutil.WriteXattrNames(op, names))
+
+	op = &fuseops.ListXattrOp{Dst: make([]byte, 18)}
+	ExpectEq(nil, fuseutil.WriteXattrNames(op, names))
+	ExpectEq("user.foo\x00user.bar\x00", string(op.Dst[:op.BytesRead]))
+
+	op = &fuseops.ListXattrOp{}
+	ExpectEq(nil, fuseutil.WriteXattrNames(op, nil))
+	ExpectEq(0, op.BytesRead)
+}
+
+func (t *XattrsTest) PhysicalSize() {
+	p := path.Join(t.Dir, "foo")
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(4<<16, fi.Size())
+
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(p, fuseutil.PhysicalSizeXattr, buf)
+	AssertEq(nil, err)
+
+	physical, err := strconv.ParseInt(string(buf[:n]), 10, 64)
+	AssertEq(nil, err)
+	ExpectEq(len(t.fs.compressed), physical)
+	ExpectLt(physical, fi.Size()/100)
+
+	// The root directory has no physical size.
+	_, err = syscall.Getxattr(t.Dir, fuseutil.PhysicalSizeXattr, buf)
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrsTest) ListedAlongsideStoredXattrs() {
+	p := path.Join(t.Dir, "foo")
+
+	names, err := listXattrs(p)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre(fuseutil.PhysicalSizeXattr))
+
+	err = syscall.Setxattr(p, "user.flavor", []byte("carnitas"), 0)
+	AssertEq(nil, err)
+
+	names, err = listXattrs(p)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("user.flavor", fuseutil.PhysicalSizeXattr))
+
+	// The root directory has neither.
+	names, err = listXattrs(t.Dir)
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre())
+}
+
+func (t *XattrsTest) ComputedXattrsAreReadOnly() {
+	p := path.Join(t.Dir, "foo")
+
+	err := syscall.Setxattr(p, fuseutil.PhysicalSizeXattr, []byte("17"), 0)
+	ExpectEq(syscall.EPERM, err)
+
+	err = syscall.Removexattr(p, fuseutil.PhysicalSizeXattr)
+	ExpectEq(syscall.EPERM, err)
+}
@@ -66,7 +66,7 @@ type Kstatfs struct {
 	Spare   [6]uint32
 }
 
-type fileLock struct {
+type FileLock struct {
 	Start uint64
 	End   uint64
 	Type  uint32
@@ -107,6 +107,9 @@ const (
 	SetattrMtimeNow  SetattrValid = 1 << 8
 	SetattrLockOwner SetattrValid = 1 << 9 // http://www.mail-archive.com/git-commits-head@vger.kernel.org/msg27852.html
 
+	// Sent only if InitKillPrivV2 was negotiated.
+	SetattrKillSuidgid SetattrValid = 1 << 11
+
 	// OS X only
 	SetattrCrtime   SetattrValid = 1 << 28
 	SetattrChgtime  SetattrValid = 1 << 29
@@ -144,6 +147,7 @@ var setattrValidNames = []flagName{
 	{uint32(SetattrAtimeNow), "SetattrAtimeNow"},
 	{uint32(SetattrMtimeNow), "SetattrMtimeNow"},
 	{uint32(SetattrLockOwner), "SetattrLockOwner"},
+	{uint32(SetattrKillSuidgid), "SetattrKillSuidgid"},
 	{uint32(SetattrCrtime), "SetattrCrtime"},
 	{uint32(SetattrChgtime), "SetattrChgtime"},
 	{uint32(SetattrBkuptime), "SetattrBkuptime"},
@@ -266,6 +270,9 @@ const (
 	InitAsyncDIO        InitFlags = 1 << 15
 	InitWritebackCache  InitFlags = 1 << 16
 	InitNoOpenSupport   InitFlags = 1 << 17
+	InitAbortError      InitFlags = 1 << 21
+	InitMapAlignment    InitFlags = 1 << 26
+	InitKillPrivV2      InitFlags = 1 << 28
 
 	InitCaseSensitive InitFlags = 1 << 29 // OS X only
 	InitVolRename     InitFlags = 1 << 30 // OS X only
@@ -296,6 +303,9 @@ var initFlagNames = []flagName{
 	{uint32(InitAsyncDIO), "InitAsyncDIO"},
 	{uint32(InitWritebackCache), "InitWritebackCache"},
 	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
+	{uint32(InitAbortError), "InitAbortError"},
+	{uint32(InitMapAlignment), "InitMapAlignment"},
+	{uint32(InitKillPrivV2), "InitKillPrivV2"},
 
 	{uint32(InitCaseSensitive), "InitCaseSensitive"},
 	{uint32(InitVolRename), "InitVolRename"},
@@ -329,7 +339,8 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
 func (fl ReleaseFlags) String() string {
@@ -338,48 +349,53 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
 }
 
 // Opcodes
 const (
-	OpLookup      = 1
-	OpForget      = 2 // no reply
-	OpGetattr     = 3
-	OpSetattr     = 4
-	OpReadlink    = 5
-	OpSymlink     = 6
-	OpMknod       = 8
-	OpMkdir       = 9
-	OpUnlink      = 10
-	OpRmdir       = 11
-	OpRename      = 12
-	OpLink        = 13
-	OpOpen        = 14
-	OpRead        = 15
-	OpWrite       = 16
-	OpStatfs      = 17
-	OpRelease     = 18
-	OpFsync       = 20
-	OpSetxattr    = 21
-	OpGetxattr    = 22
-	OpListxattr   = 23
-	OpRemovexattr = 24
-	OpFlush       = 25
-	OpInit        = 26
-	OpOpendir     = 27
-	OpReaddir     = 28
-	OpReleasedir  = 29
-	OpFsyncdir    = 30
-	OpGetlk       = 31
-	OpSetlk       = 32
-	OpSetlkw      = 33
-	OpAccess      = 34
-	OpCreate      = 35
-	OpInterrupt   = 36
-	OpBmap        = 37
-	OpDestroy     = 38
-	OpIoctl       = 39 // Linux?
-	OpPoll        = 40 // Linux?
+	OpLookup        = 1
+	OpForget        = 2 // no reply
+	OpGetattr       = 3
+	OpSetattr       = 4
+	OpReadlink      = 5
+	OpSymlink       = 6
+	OpMknod         = 8
+	OpMkdir         = 9
+	OpUnlink        = 10
+	OpRmdir         = 11
+	OpRename        = 12
+	OpLink          = 13
+	OpOpen          = 14
+	OpRead          = 15
+	OpWrite         = 16
+	OpStatfs        = 17
+	OpRelease       = 18
+	OpFsync         = 20
+	OpSetxattr      = 21
+	OpGetxattr      = 22
+	OpListxattr     = 23
+	OpRemovexattr   = 24
+	OpFlush         = 25
+	OpInit          = 26
+	OpOpendir       = 27
+	OpReaddir       = 28
+	OpReleasedir    = 29
+	OpFsyncdir      = 30
+	OpGetlk         = 31
+	OpSetlk         = 32
+	OpSetlkw        = 33
+	OpAccess        = 34
+	OpCreate        = 35
+	OpInterrupt     = 36
+	OpBmap          = 37
+	OpDestroy       = 38
+	OpIoctl         = 39 // Linux?
+	OpPoll          = 40 // Linux?
+	OpBatchForget   = 42 // no reply
+	OpFallocate     = 43 // Linux
+	OpReaddirplus   = 44 // Linux
+	OpCopyFileRange = 47 // Linux
 
 	// OS X
 	OpSetvolname = 61
@@ -410,6 +426,16 @@ type ForgetIn struct {
 	Nlookup uint64
 }
 
+type ForgetOne struct {
+	Nodeid  uint64
+	Nlookup uint64
+}
+
+type BatchForgetIn struct {
+	Count uint32
+	dummy uint32
+}
+
 type GetattrIn struct {
 	GetattrFlags uint32
 	dummy        uint32
@@ -512,6 +538,11 @@ type OpenIn struct {
 	Unused uint32
 }
 
+// OpenFlags returns the flags, less any that reflect only the caller's ABI.
+func (in *OpenIn) OpenFlags() OpenFlags {
+	return openFlags(in.Flags)
+}
+
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
@@ -538,7 +569,7 @@ type ReleaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type FlushIn struct {
@@ -614,11 +645,15 @@ const (
 	WriteCache WriteFlags = 1 << 0
 	// LockOwner field is valid.
 	WriteLockOwner WriteFlags = 1 << 1
+	// Clear the set-user-ID and set-group-ID bits. Sent only if
+	// InitKillPrivV2 was negotiated.
+	WriteKillSuidgid WriteFlags = 1 << 2
 )
 
 var writeFlagNames = []flagName{
 	{uint32(WriteCache), "WriteCache"},
 	{uint32(WriteLockOwner), "WriteLockOwner"},
+	{uint32(WriteKillSuidgid), "WriteKillSuidgid"},
 }
 
 func (fl WriteFlags) String() string {
@@ -668,7 +703,7 @@ type ListxattrIn struct {
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
-	Lk      fileLock
+	Lk      FileLock
 	LkFlags uint32
 	padding uint32
 }
@@ -682,8 +717,87 @@ func LkInSize(p Protocol) uintptr {
 	}
 }
 
+// The LkFlags are passed in LkIn.
+type LkFlags uint32
+
+const (
+	// The lock is a flock(2) lock rather than a POSIX record lock.
+	LkFlock LkFlags = 1 << 0
+)
+
 type LkOut struct {
-	Lk fileLock
+	Lk FileLock
+}
+
+type FallocateIn struct {
+	Fh      uint64
+	Offset  uint64
+	Length  uint64
+	Mode    uint32
+	Padding uint32
+}
+
+type IoctlIn struct {
+	Fh      uint64
+	Flags   uint32
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+// Flags for IoctlIn.Flags and IoctlOut.Flags.
+const (
+	IoctlCompat       = 1 << 0
+	IoctlUnrestricted = 1 << 1
+	IoctlRetry        = 1 << 2 // reply only
+	Ioctl32Bit        = 1 << 3 // since 7.16
+	IoctlDir          = 1 << 4 // since 7.18
+	IoctlCompatX32    = 1 << 5 // since 7.30
+)
+
+// The most iovecs that a reply with IoctlRetry may request.
+const IoctlMaxIov = 256
+
+type IoctlOut struct {
+	Result  int32
+	Flags   uint32
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// Follows IoctlOut in a reply with IoctlRetry, InIovs times and then OutIovs
+// times.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+type PollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  uint32
+	Events uint32 // zero from kernels predating 7.21
+}
+
+// Flags for PollIn.Flags.
+const (
+	PollScheduleNotify = 1 << 0
+)
+
+type PollOut struct {
+	Revents uint32
+	Padding uint32
+}
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
 }
 
 type AccessIn struct {
@@ -701,12 +815,33 @@ type InitIn struct {
 const InitInSize = int(unsafe.Sizeof(InitIn{}))
 
 type InitOut struct {
-	Major        uint32
-	Minor        uint32
-	MaxReadahead uint32
-	Flags        uint32
-	Unused       uint32
-	MaxWrite     uint32
+	Major               uint32
+	Minor               uint32
+	MaxReadahead        uint32
+	Flags               uint32
+	MaxBackground       uint16
+	CongestionThreshold uint16
+	MaxWrite            uint32
+
+	// Protocol 7.23 and later.
+	TimeGran uint32
+	MaxPages uint16
+
+	// Protocol 7.31 and later. Used only by virtio-fs, for DAX mappings.
+	MapAlignment uint16
+	Flags2       uint32
+	Unused       [7]uint32
+}
+
+// InitOutSize returns the size of the init reply for the supplied negotiated
+// protocol. Kernels before 7.23 insist on the original 24 bytes.
+func InitOutSize(p Protocol) uintptr {
+	switch {
+	case p.LT(Protocol{7, 23}):
+		return unsafe.Offsetof(InitOut{}.TimeGran)
+	default:
+		return unsafe.Sizeof(InitOut{})
+	}
 }
 
 type InterruptIn struct {
@@ -764,6 +899,10 @@ type NotifyInvalInodeOut struct {
 	Len int64
 }
 
+type NotifyPollWakeupOut struct {
+	Kh uint64
+}
+
 type NotifyInvalEntryOut struct {
 	Parent  uint64
 	Namelen uint32
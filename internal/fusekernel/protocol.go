@@ -48,6 +48,11 @@ func (a Protocol) HasGetattrFlags() bool {
 	return a.is79()
 }
 
+// HasLockFlags returns whether LkIn field LkFlags is valid.
+func (a Protocol) HasLockFlags() bool {
+	return a.is79()
+}
+
 func (a Protocol) is710() bool {
 	return a.GE(Protocol{7, 10})
 }
@@ -58,6 +63,16 @@ func (a Protocol) HasOpenNonSeekable() bool {
 	return a.is710()
 }
 
+func (a Protocol) is711() bool {
+	return a.GE(Protocol{7, 11})
+}
+
+// HasPoll returns whether PollIn is sent and NotifyPollWakeupOut is
+// understood.
+func (a Protocol) HasPoll() bool {
+	return a.is711()
+}
+
 func (a Protocol) is712() bool {
 	return a.GE(Protocol{7, 12})
 }
@@ -73,3 +88,37 @@ func (a Protocol) HasUmask() bool {
 func (a Protocol) HasInvalidate() bool {
 	return a.is712()
 }
+
+// The protocol version in which the Linux kernel started to understand each
+// init flag, from the change log in include/uapi/linux/fuse.h.
+var initFlagMinProtocols = map[InitFlags]Protocol{
+	InitAsyncRead:       {7, 6},
+	InitPosixLocks:      {7, 7},
+	InitFileOps:         {7, 9},
+	InitAtomicTrunc:     {7, 9},
+	InitBigWrites:       {7, 9},
+	InitExportSupport:   {7, 10},
+	InitDontMask:        {7, 12},
+	InitSpliceWrite:     {7, 14},
+	InitSpliceMove:      {7, 14},
+	InitSpliceRead:      {7, 14},
+	InitFlockLocks:      {7, 17},
+	InitHasIoctlDir:     {7, 18},
+	InitAutoInvalData:   {7, 20},
+	InitDoReaddirplus:   {7, 21},
+	InitReaddirplusAuto: {7, 21},
+	InitAsyncDIO:        {7, 22},
+	InitWritebackCache:  {7, 23},
+	InitNoOpenSupport:   {7, 23},
+	InitAbortError:      {7, 27},
+	InitMapAlignment:    {7, 31},
+	InitKillPrivV2:      {7, 33},
+}
+
+// MinProtocol returns the earliest protocol version in which the kernel
+// understands the supplied flag, which must be a single bit. ok is false for
+// flags with no known minimum, such as the OS X-only flags.
+func (fl InitFlags) MinProtocol() (p Protocol, ok bool) {
+	p, ok = initFlagMinProtocols[fl]
+	return
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// A lookupCountChecker keeps its own tally of the lookup count that the
+// kernel holds on each inode ID, based on the replies the file system sends
+// and the forgets the kernel sends back. See MountConfig.CheckLookupCounts.
+type lookupCountChecker struct {
+	mu sync.Mutex
+
+	// The lookup count for each inode ID that the kernel knows about. Inodes
+	// whose count drops to zero are removed.
+	//
+	// INVARIANT: For each v, v > 0
+	//
+	// GUARDED_BY(mu)
+	counts map[fuseops.InodeID]uint64
+}
+
+func newLookupCountChecker() *lookupCountChecker {
+	return &lookupCountChecker{
+		counts: map[fuseops.InodeID]uint64{
+			// The root begins with an implicit count of one. See the notes on
+			// fuseops.ForgetInodeOp.
+			fuseops.RootInodeID: 1,
+		},
+	}
+}
+
+// Update state based on a successful reply to the supplied op, before the
+// reply is sent to the kernel.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *lookupCountChecker) observeReply(op interface{}) {
+	var e *fuseops.ChildInodeEntry
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		e = &typed.Entry
+
+	case *fuseops.MkDirOp:
+		e = &typed.Entry
+
+	case *fuseops.MkNodeOp:
+		e = &typed.Entry
+
+	case *fuseops.CreateSymlinkOp:
+		e = &typed.Entry
+
+	case *fuseops.CreateLinkOp:
+		e = &typed.Entry
+
+	case *fuseops.CreateFileOp:
+		e = &typed.Entry
+
+	case *fuseops.ReadDirPlusOp:
+		children := direntPlusChildren(typed.Dst[:typed.BytesRead])
+
+		lc.mu.Lock()
+		defer lc.mu.Unlock()
+
+		for _, child := range children {
+			lc.counts[child]++
+		}
+
+		return
+
+	default:
+		return
+	}
+
+	// An entry with a zero ID is a negative entry, for which the kernel keeps
+	// no inode.
+	if e.Child == 0 {
+		return
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.counts[e.Child]++
+}
+
+// Update state based on the supplied op read from the kernel. If it is a
+// forget that takes an inode's count below zero, a description of the problem
+// is returned.
+//
+// LOCKS_EXCLUDED(lc.mu)
+func (lc *lookupCountChecker) observeRequest(op interface{}) (problem string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	switch typed := op.(type) {
+	case *fuseops.ForgetInodeOp:
+		problem = lc.forget(typed.Inode, typed.N)
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range typed.Entries {
+			if problem = lc.forget(e.Inode, e.N); problem != "" {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Subtract n from the supplied inode's count, returning a description of the
+// problem if that would take it below zero.
+//
+// LOCKS_REQUIRED(lc.mu)
+func (lc *lookupCountChecker) forget(
+	inode fuseops.InodeID,
+	n uint64) (problem string) {
+	count := lc.counts[inode]
+	if n > count {
+		problem = fmt.Sprintf(
+			"kernel forgot %d lookups of inode %v, but only %d were replied",
+			n,
+			inode,
+			count)
+
+		return
+	}
+
+	count -= n
+	if count == 0 {
+		delete(lc.counts, inode)
+	} else {
+		lc.counts[inode] = count
+	}
+
+	return
+}
+
+// Return the IDs of the children in the supplied ReadDirPlusOp output for which
+// the kernel takes a lookup: those with a non-zero ID, other than "." and "..".
+func direntPlusChildren(buf []byte) (children []fuseops.InodeID) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	const direntAlignment = 8
+
+	for len(buf) >= entrySize+fusekernel.DirentSize {
+		entry := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+		dirent := (*fusekernel.Dirent)(unsafe.Pointer(&buf[entrySize]))
+
+		nameStart := entrySize + fusekernel.DirentSize
+		nameEnd := nameStart + int(dirent.Namelen)
+		if nameEnd > len(buf) {
+			return
+		}
+
+		name := string(buf[nameStart:nameEnd])
+		if entry.Nodeid != 0 && name != "." && name != ".." {
+			children = append(children, fuseops.InodeID(entry.Nodeid))
+		}
+
+		// Skip to the next entry, which is aligned.
+		next := nameEnd + (direntAlignment-nameEnd%direntAlignment)%direntAlignment
+		if next > len(buf) {
+			return
+		}
+
+		buf = buf[next:]
+	}
+
+	return
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+func TestLookupCountChecker_CreateAndForget(t *testing.T) {
+	lc := newLookupCountChecker()
+
+	const inode = 17
+
+	// Create a file, then look it up twice.
+	create := &fuseops.CreateFileOp{}
+	create.Entry.Child = inode
+	lc.observeReply(create)
+
+	lookUp := &fuseops.LookUpInodeOp{}
+	lookUp.Entry.Child = inode
+	lc.observeReply(lookUp)
+	lc.observeReply(lookUp)
+
+	// Other ops mentioning the inode don't count.
+	lc.observeReply(&fuseops.GetInodeAttributesOp{Inode: inode})
+	lc.observeReply(&fuseops.OpenFileOp{Inode: inode})
+
+	// Negative entries don't count either.
+	lc.observeReply(&fuseops.LookUpInodeOp{})
+
+	// Forgetting all three lookups, in two parts, is balanced.
+	for _, n := range []uint64{2, 1} {
+		forget := &fuseops.ForgetInodeOp{Inode: inode, N: n}
+		if problem := lc.observeRequest(forget); problem != "" {
+			t.Fatalf("Unexpected problem on forget of %d: %s", n, problem)
+		}
+	}
+
+	if count, ok := lc.counts[inode]; ok {
+		t.Errorf("Inode still has count %d after balanced forgets", count)
+	}
+
+	// Only the root is left, with its implicit count.
+	if len(lc.counts) != 1 || lc.counts[fuseops.RootInodeID] != 1 {
+		t.Errorf("Unexpected counts: %v", lc.counts)
+	}
+}
+
+func TestLookupCountChecker_Mismatch(t *testing.T) {
+	lc := newLookupCountChecker()
+
+	const inode = 17
+
+	mkDir := &fuseops.MkDirOp{}
+	mkDir.Entry.Child = inode
+	lc.observeReply(mkDir)
+
+	// Forgetting more than was replied is reported.
+	forget := &fuseops.ForgetInodeOp{Inode: inode, N: 2}
+	if problem := lc.observeRequest(forget); problem == "" {
+		t.Errorf("Overly large forget was not reported")
+	}
+
+	// As is forgetting an inode that was never replied.
+	forget = &fuseops.ForgetInodeOp{Inode: inode + 1, N: 1}
+	if problem := lc.observeRequest(forget); problem == "" {
+		t.Errorf("Forget of unknown inode was not reported")
+	}
+
+	// The root's implicit count may be forgotten.
+	forget = &fuseops.ForgetInodeOp{Inode: fuseops.RootInodeID, N: 1}
+	if problem := lc.observeRequest(forget); problem != "" {
+		t.Errorf("Unexpected problem on forget of root: %s", problem)
+	}
+}
+
+func TestLookupCountChecker_BatchForget(t *testing.T) {
+	lc := newLookupCountChecker()
+
+	// Look up two inodes, one of them twice.
+	for _, child := range []fuseops.InodeID{17, 19, 19} {
+		lookUp := &fuseops.LookUpInodeOp{}
+		lookUp.Entry.Child = child
+		lc.observeReply(lookUp)
+	}
+
+	// A batch forget is counted entry by entry.
+	forget := &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{
+			{Inode: 17, N: 1},
+			{Inode: 19, N: 1},
+		},
+	}
+
+	if problem := lc.observeRequest(forget); problem != "" {
+		t.Fatalf("Unexpected problem: %s", problem)
+	}
+
+	if _, ok := lc.counts[17]; ok || lc.counts[19] != 1 {
+		t.Errorf("Unexpected counts: %v", lc.counts)
+	}
+
+	// An entry taking a count below zero is reported.
+	forget.Entries = []fuseops.BatchForgetEntry{{Inode: 19, N: 2}}
+	if problem := lc.observeRequest(forget); problem == "" {
+		t.Errorf("Overly large forget in batch was not reported")
+	}
+}
+
+func TestLookupCountChecker_ReadDirPlus(t *testing.T) {
+	lc := newLookupCountChecker()
+
+	// Build the output of a ReadDirPlusOp, as fuseutil.WriteDirentPlus would.
+	var dst []byte
+	appendEntry := func(child fuseops.InodeID, name string) {
+		// fusekernel.Dirent has trailing padding, so spell out its fields.
+		var out struct {
+			entry   fusekernel.EntryOut
+			ino     uint64
+			off     uint64
+			namelen uint32
+			typ     uint32
+			name    [8]byte
+		}
+
+		out.entry.Nodeid = uint64(child)
+		out.ino = uint64(child)
+		out.namelen = uint32(len(name))
+		copy(out.name[:], name)
+
+		dst = append(dst, (*[unsafe.Sizeof(out)]byte)(unsafe.Pointer(&out))[:]...)
+	}
+
+	appendEntry(fuseops.RootInodeID, ".")
+	appendEntry(fuseops.RootInodeID, "..")
+	appendEntry(17, "foo")
+	appendEntry(0, "bar")
+	appendEntry(19, "baz")
+
+	lc.observeReply(&fuseops.ReadDirPlusOp{Dst: dst, BytesRead: len(dst)})
+
+	// Only the named children with IDs are counted.
+	want := map[fuseops.InodeID]uint64{
+		fuseops.RootInodeID: 1,
+		17:                  1,
+		19:                  1,
+	}
+
+	if len(lc.counts) != len(want) {
+		t.Errorf("Got counts %v, want %v", lc.counts, want)
+	}
+
+	for inode, count := range want {
+		if lc.counts[inode] != count {
+			t.Errorf("Got counts %v, want %v", lc.counts, want)
+			break
+		}
+	}
+}
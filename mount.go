@@ -16,7 +16,9 @@ package fuse
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -33,6 +35,9 @@ type Server interface {
 // Mount attempts to mount a file system on the given directory, using the
 // supplied Server to serve connection requests. It blocks until the file
 // system is successfully mounted.
+//
+// On Linux, if the fuse device can't be used at all the error is an
+// *ErrFuseUnavailable describing why.
 func Mount(
 	dir string,
 	server Server,
@@ -53,20 +58,74 @@ func Mount(
 		return
 	}
 
-	// Initialize the struct.
-	mfs = &MountedFileSystem{
-		dir:                 dir,
-		joinStatusAvailable: make(chan struct{}),
+	if config.ApplyUmask && config.DontMask {
+		err = fmt.Errorf("ApplyUmask and DontMask may not both be set")
+		return
 	}
 
 	// Begin the mounting process, which will continue in the background.
 	ready := make(chan error, 1)
 	dev, err := mount(dir, config, ready)
 	if err != nil {
-		err = fmt.Errorf("mount: %v", err)
+		// Pass on *ErrFuseUnavailable as is, so that callers can inspect it.
+		if _, ok := err.(*ErrFuseUnavailable); !ok {
+			err = fmt.Errorf("mount: %v", err)
+		}
+
 		return
 	}
 
+	mfs, err = serve(dir, dev, ready, server, config)
+	return
+}
+
+// MountWithFD is like Mount, but serves a file system that has already been
+// mounted on the given directory by some other process, such as a rootless
+// container runtime, which opened the fuse device and passed the resulting
+// file descriptor on. The mount itself is left alone: no mount helper is run,
+// and MountConfig fields that set mount options (e.g. FSName, ReadOnly,
+// Options, AllowOther, UserID) have no effect, since the mount's options are
+// chosen by whoever mounted it. The remaining fields, including those that
+// take effect in the init exchange with the kernel, apply as usual.
+//
+// The directory is reported by MountedFileSystem.Dir and unmounted by
+// MountedFileSystem.Unmount, which works only if the mount is visible to this
+// process. Otherwise serving ends when the mounting process unmounts it.
+//
+// The file descriptor belongs to the MountedFileSystem from then on, and is
+// closed once serving ends.
+func MountWithFD(
+	dir string,
+	fd int,
+	server Server,
+	config *MountConfig) (mfs *MountedFileSystem, err error) {
+	if config.ApplyUmask && config.DontMask {
+		err = fmt.Errorf("ApplyUmask and DontMask may not both be set")
+		return
+	}
+
+	// The mount already exists.
+	ready := make(chan error, 1)
+	ready <- nil
+
+	mfs, err = serve(dir, os.NewFile(uintptr(fd), "/dev/fuse"), ready, server, config)
+	return
+}
+
+// Serve the file system mounted on the given directory and connected to the
+// supplied fuse device, once the mounting process has written to ready.
+func serve(
+	dir string,
+	dev *os.File,
+	ready <-chan error,
+	server Server,
+	config *MountConfig) (mfs *MountedFileSystem, err error) {
+	// Initialize the struct.
+	mfs = &MountedFileSystem{
+		dir:                 dir,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
 	// Choose a parent context for ops.
 	cfgCopy := *config
 	if cfgCopy.OpContext == nil {
@@ -85,10 +144,26 @@ func Mount(
 		return
 	}
 
+	mfs.trace = connection.trace
+	mfs.stats = connection.stats
+	mfs.maxReadahead = connection.maxReadahead
+	mfs.maxWrite = connection.maxWrite
+	mfs.maxReadSize = connection.maxReadSize
+	mfs.kernelFeatures = connection.kernelFeatures
+
 	// Serve the connection in the background. When done, set the join status.
 	go func() {
 		server.ServeOps(connection)
 		mfs.joinStatus = connection.close()
+
+		// If we were unmounted because the shutdown context was cancelled, say
+		// so. Wait for any attempt to unmount in progress to find out.
+		mfs.mu.Lock()
+		if mfs.joinStatus == nil && mfs.unmountedForShutdown {
+			mfs.joinStatus = config.ShutdownContext.Err()
+		}
+		mfs.mu.Unlock()
+
 		close(mfs.joinStatusAvailable)
 	}()
 
@@ -98,5 +173,65 @@ func Mount(
 		return
 	}
 
+	// Unmount when asked to, if the user has configured that.
+	if config.ShutdownContext != nil {
+		go mfs.unmountOnShutdown(config.ShutdownContext, config.ErrorLogger)
+	}
+
 	return
 }
+
+// How long to wait before trying again when unmounting for a cancelled
+// shutdown context fails, e.g. because the file system is busy. The wait
+// doubles after each failure, up to the maximum, so that a file system that
+// stays busy doesn't flood the error log.
+const (
+	shutdownUnmountRetryInterval    = 100 * time.Millisecond
+	shutdownUnmountMaxRetryInterval = 10 * time.Second
+)
+
+// Wait for ctx to be cancelled, then unmount the file system, retrying until
+// it succeeds or the file system is unmounted by some other means.
+//
+// LOCKS_EXCLUDED(mfs.mu)
+func (mfs *MountedFileSystem) unmountOnShutdown(
+	ctx context.Context,
+	errorLogger *log.Logger) {
+	select {
+	case <-ctx.Done():
+	case <-mfs.joinStatusAvailable:
+		return
+	}
+
+	retryInterval := shutdownUnmountRetryInterval
+	for attempt := 1; ; attempt++ {
+		mfs.mu.Lock()
+		err := Unmount(mfs.dir)
+		mfs.unmountedForShutdown = err == nil
+		mfs.mu.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		if errorLogger != nil {
+			errorLogger.Printf(
+				"Unmounting %s for shutdown (attempt %d, retrying in %v): %v",
+				mfs.dir,
+				attempt,
+				retryInterval,
+				err)
+		}
+
+		select {
+		case <-time.After(retryInterval):
+		case <-mfs.joinStatusAvailable:
+			return
+		}
+
+		retryInterval *= 2
+		if retryInterval > shutdownUnmountMaxRetryInterval {
+			retryInterval = shutdownUnmountMaxRetryInterval
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/net/context"
+)
+
+// MountAndServe mounts the supplied server at the supplied directory, as with
+// Mount, and serves it until it is unmounted. If the process receives SIGINT
+// or SIGTERM in the meantime, the file system is unmounted (retrying while it
+// is busy, as for MountConfig.ShutdownContext) so that no dangling mount is
+// left behind when the program exits. This is a convenience for the main
+// function of a program that serves a single file system.
+//
+// The result is nil if the file system was unmounted cleanly, whether because
+// of a signal, because config.ShutdownContext was cancelled, or by some other
+// means. While MountAndServe is running it takes over delivery of SIGINT and
+// SIGTERM from the default handlers, so the signals don't terminate the
+// process; it restores them before returning.
+func MountAndServe(
+	dir string,
+	server Server,
+	config *MountConfig) (err error) {
+	// Arrange to be told about signals before mounting, so that there is no
+	// window in which one would kill the process and leave the mount behind.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// Unmount when a signal arrives, or when the user's shutdown context (if
+	// any) is cancelled.
+	parent := config.ShutdownContext
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	shutdown, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+
+		case <-shutdown.Done():
+		}
+	}()
+
+	// Mount.
+	cfgCopy := *config
+	cfgCopy.ShutdownContext = shutdown
+
+	mfs, err := Mount(dir, server, &cfgCopy)
+	if err != nil {
+		return
+	}
+
+	// Wait for the file system to be unmounted. An unmount that we performed in
+	// response to a signal or the user's shutdown context is a clean exit, for
+	// which Join reports the context's error.
+	err = mfs.Join(context.Background())
+	if err != nil && err == shutdown.Err() {
+		err = nil
+	}
+
+	return
+}
@@ -17,8 +17,11 @@ package fuse
 import (
 	"fmt"
 	"log"
+	"os"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -29,21 +32,320 @@ type MountConfig struct {
 	// should inherit. If nil, context.Background() will be used.
 	OpContext context.Context
 
+	// If non-nil, a context whose cancellation causes the file system to be
+	// unmounted, for integration with context-based shutdown of the surrounding
+	// program. Unmounting is retried, at intervals growing to ten seconds,
+	// until it succeeds (for example once any open files are closed), after
+	// which MountedFileSystem.Join returns the context's error. If the file
+	// system is unmounted by other means first, Join returns nil as usual.
+	ShutdownContext context.Context
+
 	// If non-empty, the name of the file system as displayed by e.g. `mount`.
 	// This is important because the `umount` command requires root privileges if
 	// it doesn't agree with /etc/fstab.
+	//
+	// On Linux this is the mount source field of /proc/self/mountinfo, which
+	// immediately precedes the per-superblock options. It may contain any
+	// characters, including commas and equals signs, so it is the place to put
+	// file system specific metadata for monitoring tools to find, e.g.
+	// "myfs:bucket=foo,region=bar". The superblock options themselves can't be
+	// extended: the kernel shows only the fuse options it knows about, and
+	// refuses to mount if given any that it doesn't.
 	FSName string
 
 	// Mount the file system in read-only mode. File modes will appear as normal,
 	// but opening a file for writing and metadata operations like chmod,
 	// chtimes, etc. will fail.
+	//
+	// This is a property of the mount rather than something the file system
+	// reports, so statvfs(3) will show ST_RDONLY in f_flag and mount(8) will
+	// list the "ro" option regardless of what StatFSOp returns.
+	//
+	// The kernel's check is the only one made: the library passes on whatever
+	// modifying ops it receives. To guard the file system's write paths as
+	// well, wrap it with fuseutil.NewReadOnlyFileSystem.
 	ReadOnly bool
 
+	// Linux only. If non-nil, the user and group IDs that the kernel records
+	// as the mount's owner, shown as the user_id and group_id options in
+	// /proc/self/mountinfo. Unless AllowOther is set, only processes running
+	// as that user may access the file system. By default the owner is the
+	// user mounting the file system.
+	//
+	// fusermount doesn't accept these as options, instead taking them from its
+	// own real user and group IDs, so they are applied by running fusermount
+	// with the requested credentials. Changing them requires the mounting
+	// process to be root, and fusermount then checks access to the mount point
+	// as the new user. Otherwise each may only be set to the process's own
+	// real ID: a GroupID other than the process's group fails the mount, even
+	// with UserID unset. Both IDs must exist in the user and group databases.
+	UserID  *uint32
+	GroupID *uint32
+
+	// Linux only. How many more times to run fusermount when it fails with a
+	// transient error, i.e. when it can't be started because of EAGAIN or
+	// EINTR, or when the mount(2) call it makes fails with one of them, as
+	// happens on busy systems. Attempts are spaced by a backoff starting at
+	// 10 ms and doubling each time. Other failures, such as EPERM or
+	// fusermount not being installed, are returned immediately.
+	//
+	// If zero, a default of 3 is used. Set a negative number to never retry.
+	MountRetries int
+
+	// Mount with the allow_other option, letting users other than the mount's
+	// owner (see UserID) access the file system. Only root may do this unless
+	// /etc/fuse.conf contains user_allow_other.
+	//
+	// The kernel still checks each access against the modes and owners that
+	// the file system reports, since default_permissions is always set. A file
+	// system that wants to restrict particular users beyond that, for example
+	// to expose each user's own data only, can do its own checks: the
+	// credentials of the process behind each op are available from
+	// CallerFromContext, and are those of the calling user regardless of who
+	// mounted the file system. Return EACCES or EPERM to refuse an op.
+	AllowOther bool
+
+	// Mount the file system with the nosuid, nodev, and noexec options
+	// respectively. With NoSuid the kernel ignores set-user-ID and
+	// set-group-ID bits when executing files from the mount, with NoDev device
+	// nodes in the file system can't be opened, and with NoExec no file in the
+	// file system can be executed, with execve(2) failing with EACCES.
+	//
+	// Like ReadOnly, these are enforced by the kernel regardless of the
+	// permissions the file system reports.
+	NoSuid bool
+	NoDev  bool
+	NoExec bool
+
 	// A logger to use for logging errors. All errors are logged, with the
 	// exception of a few blacklisted errors that are expected. If nil, no error
 	// logging is performed.
 	ErrorLogger *log.Logger
 
+	// The errno that the kernel receives when the file system returns an error
+	// that isn't a syscall.Errno, e.g. one wrapped by fmt.Errorf or returned
+	// unchanged from a backend library. If zero, EIO is used.
+	//
+	// Such errors are logged to ErrorLogger along with their type, so that an
+	// unexpected errno seen by an application can be traced to its source.
+	DefaultErrno syscall.Errno
+
+	// If positive, a dedicated goroutine reads messages from the kernel ahead
+	// of ReadOp, buffering up to this many of them. This keeps the device
+	// drained promptly when decoding and dispatching ops momentarily stalls,
+	// e.g. under a burst of requests. By default messages are read only when
+	// ReadOp is called.
+	//
+	// Each buffered message holds a buffer large enough for the largest write
+	// (128 KiB on Linux, 1 MiB on OS X), so the depth bounds the extra memory
+	// used. Ops are still delivered in the order they were read.
+	ReadBufferDepth int
+
+	// If positive, the most ops that the connection hands to the server at
+	// once. Connection.ReadOp doesn't return another op while this many ops
+	// that it returned are awaiting Connection.Reply. By default there is no
+	// limit: fuseutil.NewFileSystemServer runs each op on its own goroutine as
+	// soon as it is read, so the number in flight is bounded only by the
+	// kernel, by one per thread blocked in a system call plus a few dozen
+	// asynchronous requests such as readahead and writeback.
+	//
+	// Setting a limit bounds the load placed on the file system's backend, at
+	// the cost of making callers wait when it is reached. The kernel's requests
+	// are still read while the limit is reached, so that interrupts for the
+	// ops in flight, such as a SetLockWaitOp for a lock that is held
+	// elsewhere, are seen. Ops read meanwhile wait in order for room, each
+	// holding a buffer large enough for the largest write (128 KiB on Linux,
+	// 1 MiB on OS X). Interrupts and forgets don't count towards the limit.
+	MaxOpsInFlight int
+
+	// If non-nil, called for every op to which the file system replies with an
+	// error, after the reply has been sent to the kernel. This allows denied
+	// accesses and other failures to be audited centrally. The information
+	// passed includes only identifying arguments, never file contents or
+	// other payload data.
+	//
+	// Unlike with ErrorLogger, the error is passed as the value the file system
+	// returned rather than formatted, so that it can be inspected (e.g. with
+	// errors.Is) and grouped when forwarding it to an error-tracking service.
+	// This is independent of ErrorLogger; both may be set.
+	//
+	// The function is called on the goroutine that replied to the op, and may
+	// be called concurrently. It should not block for long.
+	OnOpError func(info OpErrorInfo)
+
+	// If positive, the number of most recent ops to remember, along with their
+	// durations and results, for retrieval with
+	// MountedFileSystem.DumpRecentOps. This is intended for diagnosing
+	// intermittent errors and hangs after the fact; unlike DebugLogger it
+	// formats nothing while ops are being served, costing only a lock
+	// acquisition per op. Ops are recorded when they are replied to, so an op
+	// that is hung doesn't appear.
+	TraceRingSize int
+
+	// If set, keep running totals of the ops served, by type, for retrieval
+	// with MountedFileSystem.Stats, e.g. to serve to operators with
+	// fuseutil.StatsHandler. Like TraceRingSize, this costs a lock acquisition
+	// per op.
+	CollectStats bool
+
+	// If non-nil, called for every op after the file system's reply has been
+	// sent to the kernel, with the name of the op type (e.g. "LookUpInodeOp"),
+	// the time from reading the op to replying to it, and the error replied
+	// with. This is intended for exporting metrics such as op rates, latencies,
+	// and error counts to a monitoring system, without the library depending
+	// on one.
+	//
+	// The function is called on the goroutine that replied to the op, and may
+	// be called concurrently. It must be fast and must not block: forgets are
+	// replied to on the goroutine that reads ops, which doesn't read the
+	// next op until the function returns. Anything slow, like sending metrics
+	// over the network, should be done elsewhere.
+	OpObserver func(opType string, duration time.Duration, err error)
+
+	// Linux only. By default the kernel clears the set-user-ID and
+	// set-group-ID bits itself when a file is written or truncated by an
+	// unprivileged caller, by sending a SetInodeAttributesOp to change the mode
+	// before the write. If this is set, the kernel instead leaves it to the
+	// file system, marking the WriteFileOp or SetInodeAttributesOp with
+	// KillPrivileges so that it can clear the bits in the same step. This
+	// saves a round trip per write to such files, and avoids a window in which
+	// the data has changed but the bits haven't.
+	//
+	// Requires Linux 5.11 or later; older kernels keep their default behavior.
+	// File systems that set this must honor KillPrivileges.
+	HandleKillPrivileges bool
+
+	// Linux only. By default byte range locks taken with fcntl(2) and whole
+	// file locks taken with flock(2) are managed by the kernel, and are local
+	// to the machine. If this is set, the kernel instead sends them to the
+	// file system as GetLockOp, SetLockOp, and SetLockWaitOp, so that a
+	// network file system can make them visible to other clients.
+	//
+	// The kernel doesn't send unlocks when a file is closed; the file system
+	// must release the POSIX locks held by FlushFileOp.LockOwner on flush, and
+	// flock locks on ReleaseFileHandleOp if ReleaseFlocks is set. flock
+	// support requires protocol 7.17; older kernels keep handling flock(2)
+	// locally.
+	HandleLocks bool
+
+	// Linux only. If set, ask the kernel to use fuseops.ReadDirPlusOp, which
+	// returns the attributes of each child along with the directory listing,
+	// when it expects them to be needed, e.g. for ls -l. This saves a
+	// LookUpInodeOp per child, which matters for file systems with a slow
+	// backend. The kernel still sends ReadDirOp when it doesn't expect to need
+	// the attributes.
+	//
+	// Requires protocol 7.21. A server must handle both ops; see
+	// fuseutil.FileSystem.ReadDirPlus for the fallback offered by
+	// fuseutil.NewFileSystemServer.
+	EnableReadDirPlus bool
+
+	// Linux only. If set, ask the kernel to split a large read(2) or write(2)
+	// on a file opened with O_DIRECT into ReadFileOps or WriteFileOps that are
+	// all sent at once, rather than waiting for each to complete before
+	// sending the next. This lets a file system with a slow backend work on
+	// them in parallel, and makes asynchronous I/O (io_submit(2)) on such
+	// files actually asynchronous.
+	//
+	// The ops for a single system call then arrive concurrently for the same
+	// handle, at different offsets, and may complete in any order.
+	// fuseutil.NewFileSystemServer calls each op's method in its own
+	// goroutine, so they reach the file system concurrently too. A file system
+	// that serializes the ops on a handle, e.g. by holding a lock while talking
+	// to its backend, gains nothing from this; one that assumes the ops on a
+	// handle arrive in order of offset, e.g. to stream to a backend that needs
+	// sequential writes, must not set it.
+	//
+	// Requires protocol 7.22.
+	EnableAsyncDirectIO bool
+
+	// If non-zero, the largest file size that the file system supports, in
+	// bytes. Writes that start at or beyond this offset, and truncations and
+	// allocations that would grow a file beyond it, fail with EFBIG without
+	// reaching the file system. A write that straddles the limit is shortened
+	// to end at it, so the caller sees a short write, as with RLIMIT_FSIZE.
+	// Note that with writeback caching (see DisableWritebackCaching) writes are
+	// sent to the file system only later, so the error surfaces from fsync(2)
+	// or close(2) rather than write(2).
+	//
+	// This is useful for file systems whose backing store has a hard cap on
+	// object size, so that the problem shows up when the data is written
+	// rather than when it is flushed.
+	MaxFileSize uint64
+
+	// Linux only. The furthest, in bytes, that the kernel should read ahead of
+	// sequential reads from a file, which determines how many reads it has
+	// outstanding at once. File systems with a high-latency backend may want to
+	// raise this to get deeper prefetching. Zero means 1 MiB.
+	//
+	// The kernel won't go beyond the limit it offers when mounting, which is
+	// the default readahead of its block device layer (usually 128 KiB), so the
+	// value is clamped to that; see MountedFileSystem.MaxReadahead for the
+	// outcome. The limit for an existing mount can be raised by root through
+	// /sys/class/bdi/0:N/read_ahead_kb, where N is the mount's device minor.
+	MaxReadahead uint32
+
+	// Linux only. The largest WriteFileOp, in bytes, that the kernel should
+	// send. Zero means the size of the library's buffers (128 KiB), which is
+	// also the upper limit; values below 4 KiB are raised to that. Smaller
+	// writes suit file systems that must stage each write in a bounded buffer.
+	// See MountedFileSystem.MaxWrite for the outcome.
+	MaxWrite uint32
+
+	// A debugging aid for file system implementations. If set, the library
+	// remembers the generation number (see fuseops.ChildInodeEntry) that each
+	// inode ID had when a file handle was opened on it. A ReadFileOp or
+	// WriteFileOp on a handle whose inode ID has since been reported with a
+	// different generation is never passed to the file system; the kernel
+	// receives ESTALE and the problem is logged to ErrorLogger. The
+	// reallocation itself is also logged when it is first seen.
+	//
+	// This catches file systems that reuse an inode ID while the kernel still
+	// has a handle open on the old inode, which otherwise tends to show up as
+	// silently corrupted data. Note that kernels since Linux 5.11 notice the
+	// reuse themselves when they see the new generation, and fail I/O on the
+	// old inode with EIO before it reaches the file system; the log is then
+	// the more useful signal.
+	//
+	// The bookkeeping costs a lock acquisition per op and memory proportional
+	// to the number of inode IDs ever seen, so this is not intended for
+	// production use.
+	DetectStaleHandles bool
+
+	// A debugging aid for file system implementations. If set, the library
+	// keeps its own count of the lookups that the kernel holds on each inode
+	// ID, adding one for each successful reply carrying a
+	// fuseops.ChildInodeEntry and subtracting N for each fuseops.ForgetInodeOp
+	// (see the notes on that op) and each entry of a fuseops.BatchForgetOp. A
+	// forget that takes an inode's count below zero means that the file
+	// system's replies and the kernel's accounting disagree, e.g. because the
+	// file system returned a different inode ID than it recorded, and causes a
+	// panic describing the inode.
+	//
+	// Like DetectStaleHandles, this costs a lock acquisition per op and memory
+	// proportional to the number of inodes the kernel knows about, so it is
+	// not intended for production use.
+	CheckLookupCounts bool
+
+	// A debugging aid for file system implementations. If set, the library
+	// remembers the cookies (see fuseops.DirOffset) that the file system
+	// issues on each directory handle since the directory was last read from
+	// offset zero. A ReadDirOp or ReadDirPlusOp at any other offset is never
+	// passed to the file system; the kernel receives EINVAL and the problem is
+	// logged to ErrorLogger. Replies that issue a cookie of zero, issue the
+	// same cookie for two entries, or return an entry twice with different
+	// cookies are logged too. (The kernel itself only ever continues from a
+	// cookie it was given, so a refused read means either a bug in the file
+	// system or a user passing an arbitrary offset to lseek(2) or seekdir(3).)
+	//
+	// The last two usually mean that the file system's cookies are indices
+	// into a listing that changed between reads, so that a continued read
+	// skips or repeats entries. See the notes on fuseops.ReadDirOp.Offset.
+	//
+	// Like CheckLookupCounts, this is not intended for production use; it
+	// keeps every cookie issued on every open directory handle.
+	CheckDirCookies bool
+
 	// A logger to use for logging debug information. If nil, no debug logging is
 	// performed.
 	DebugLogger *log.Logger
@@ -114,6 +416,35 @@ type MountConfig struct {
 	// syscall doesn't return until the file system returns.
 	DisableWritebackCaching bool
 
+	// Linux only. By default the kernel applies the calling process's umask to
+	// the mode for CreateFileOp, MkDirOp, and MkNodeOp before sending the op
+	// to the file system. Set ApplyUmask to have the library apply it instead,
+	// which allows Umask below to take effect.
+	//
+	// With ApplyUmask set and Umask nil, the mode is masked with the umask the
+	// kernel reports for the caller of each op, so behaviour is the same as by
+	// default. Set Umask to mask every mode with a fixed umask instead,
+	// regardless of the caller's, e.g. for consistent permissions in a shared
+	// file system.
+	//
+	// This relies on the kernel sending unmasked modes, which it does starting
+	// with protocol 7.12. Older kernels mask with the caller's umask
+	// unconditionally, so the modes that reach the file system are masked with
+	// both.
+	ApplyUmask bool
+	Umask      *os.FileMode
+
+	// Linux only. Like ApplyUmask, ask the kernel to send unmasked modes for
+	// CreateFileOp, MkDirOp, and MkNodeOp, but leave applying the umask to the
+	// file system: the library passes the caller's umask in the op's Umask
+	// field. This is what a file system supporting POSIX ACLs needs, since
+	// when the parent directory has a default ACL, the ACL rather than the
+	// umask limits the new inode's mode.
+	//
+	// As with ApplyUmask, kernels older than protocol 7.12 mask the mode
+	// themselves, and Umask is zero. May not be combined with ApplyUmask.
+	DontMask bool
+
 	// OS X only.
 	//
 	// Normally on OS X we mount with the novncache option
@@ -135,6 +466,13 @@ type MountConfig struct {
 	// default name involving the string 'osxfuse' is used.
 	VolumeName string
 
+	// OS X only.
+	//
+	// Mark the volume as local rather than as a network volume, which is the
+	// default. Local volumes appear in the Finder's sidebar and can be indexed
+	// by Spotlight, which may result in a lot of extra traffic.
+	LocalVolume bool
+
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
 	// system-specific information.
@@ -188,6 +526,23 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["ro"] = ""
 	}
 
+	// Restrictions on what may be done with files in the mount?
+	if c.NoSuid {
+		opts["nosuid"] = ""
+	}
+
+	if c.NoDev {
+		opts["nodev"] = ""
+	}
+
+	if c.NoExec {
+		opts["noexec"] = ""
+	}
+
+	if c.AllowOther {
+		opts["allow_other"] = ""
+	}
+
 	// Handle OS X options.
 	if isDarwin {
 		if !c.EnableVnodeCaching {
@@ -198,6 +553,11 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#volname
 			opts["volname"] = c.VolumeName
 		}
+
+		if c.LocalVolume {
+			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#local
+			opts["local"] = ""
+		}
 	}
 
 	// OS X: disable the use of "Apple Double" (._foo and .DS_Store) files, which
@@ -217,7 +577,9 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	return
 }
 
-func escapeOptionsKey(s string) (res string) {
+// Escape a key or value for inclusion in an options string. The mount helper
+// splits the string on unescaped commas and then removes the escaping.
+func escapeOption(s string) (res string) {
 	res = s
 	res = strings.Replace(res, `\`, `\\`, -1)
 	res = strings.Replace(res, `,`, `\,`, -1)
@@ -228,7 +590,8 @@ func escapeOptionsKey(s string) (res string) {
 func (c *MountConfig) toOptionsString() string {
 	var components []string
 	for k, v := range c.toMap() {
-		k = escapeOptionsKey(k)
+		k = escapeOption(k)
+		v = escapeOption(v)
 
 		component := k
 		if v != "" {
@@ -16,9 +16,9 @@ import (
 var errNoAvail = errors.New("no available fuse devices")
 var errNotLoaded = errors.New("osxfuse is not loaded")
 
-// errOSXFUSENotFound is returned from Mount when the OSXFUSE installation is
-// not detected. Make sure OSXFUSE is installed.
-var errOSXFUSENotFound = errors.New("cannot locate OSXFUSE")
+// errOSXFUSENotFound is returned from Mount when neither a macFUSE nor an
+// OSXFUSE installation is detected. Make sure one of them is installed.
+var errOSXFUSENotFound = errors.New("cannot locate macFUSE or OSXFUSE")
 
 // osxfuseInstallation describes the paths used by an installed OSXFUSE
 // version.
@@ -37,10 +37,22 @@ type osxfuseInstallation struct {
 	// Environment variable used to pass the path to the executable calling the
 	// mount helper.
 	DaemonVar string
+
+	// If set, the mount helper opens the device itself and passes it back over
+	// a unix socket, as fusermount does on Linux. DevicePrefix and Load are
+	// unused.
+	CommFD bool
 }
 
 var (
 	osxfuseInstallations = []osxfuseInstallation{
+		// macFUSE v4
+		{
+			Mount:     "/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse",
+			DaemonVar: "_FUSE_DAEMON_PATH",
+			CommFD:    true,
+		},
+
 		// v3
 		{
 			DevicePrefix: "/dev/osxfuse",
@@ -165,6 +177,100 @@ func callMount(
 	return
 }
 
+// Call a mount helper that opens the device itself, receiving the device over
+// a unix socket. As with callMount, the helper finishes mounting in the
+// background once the file system has answered the kernel's init request.
+func callMountCommFD(
+	bin string,
+	daemonVar string,
+	dir string,
+	cfg *MountConfig,
+	ready chan<- error) (dev *os.File, err error) {
+	// The mount helper doesn't understand any escaping.
+	for k, v := range cfg.toMap() {
+		if strings.Contains(k, ",") || strings.Contains(v, ",") {
+			err = fmt.Errorf(
+				"mount options cannot contain commas on darwin: %q=%q",
+				k,
+				v)
+			return
+		}
+	}
+
+	// Create a socket pair.
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		err = fmt.Errorf("Socketpair: %v", err)
+		return
+	}
+
+	writeFile := os.NewFile(uintptr(fds[0]), "mount-helper-writes")
+
+	readFile := os.NewFile(uintptr(fds[1]), "mount-parent-reads")
+	defer readFile.Close()
+
+	cmd := exec.Command(
+		bin,
+		"-o", cfg.toOptionsString(),
+		// See callMount.
+		"-o", "iosize="+strconv.FormatUint(buffer.MaxWriteSize, 10),
+		dir,
+	)
+
+	cmd.ExtraFiles = []*os.File{writeFile}
+	cmd.Env = append(
+		os.Environ(),
+		"_FUSE_COMMFD=3",
+		"_FUSE_COMMVERS=2",
+		"_FUSE_CALL_BY_LIB=",
+		daemonVar+"="+os.Args[0])
+
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+
+	// Once the helper has its own copy of the socket, close ours so that
+	// reading from the other end fails rather than hangs if the helper exits
+	// without sending the device.
+	err = cmd.Start()
+	writeFile.Close()
+	if err != nil {
+		return
+	}
+
+	// In the background, wait for the command to complete.
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			if buf.Len() > 0 {
+				output := buf.Bytes()
+				output = bytes.TrimRight(output, "\n")
+				err = fmt.Errorf("%v: %s", err, output)
+			}
+		}
+
+		done <- err
+	}()
+
+	// Receive the device. If the helper fails before sending it, report its
+	// output rather than the socket error.
+	dev, err = receiveDeviceFD(readFile, "/dev/macfuse")
+	if err != nil {
+		if helperErr := <-done; helperErr != nil {
+			err = helperErr
+		}
+
+		return
+	}
+
+	go func() {
+		ready <- <-done
+	}()
+
+	return
+}
+
 // Begin the process of mounting at the given directory, returning a connection
 // to the kernel. Mounting continues in the background, and is complete when an
 // error is written to the supplied channel. The file system may need to
@@ -173,6 +279,11 @@ func mount(
 	dir string,
 	cfg *MountConfig,
 	ready chan<- error) (dev *os.File, err error) {
+	if cfg.UserID != nil || cfg.GroupID != nil {
+		err = errors.New("UserID and GroupID are not supported on OS X")
+		return
+	}
+
 	// Find the version of osxfuse installed on this machine.
 	for _, loc := range osxfuseInstallations {
 		if _, err := os.Stat(loc.Mount); os.IsNotExist(err) {
@@ -180,6 +291,16 @@ func mount(
 			continue
 		}
 
+		// Newer helpers open the device themselves.
+		if loc.CommFD {
+			dev, err = callMountCommFD(loc.Mount, loc.DaemonVar, dir, cfg, ready)
+			if err != nil {
+				err = fmt.Errorf("callMountCommFD: %v", err)
+			}
+
+			return
+		}
+
 		// Open the device.
 		dev, err = openOSXFUSEDev(loc.DevicePrefix)
 
@@ -1,12 +1,147 @@
 package fuse
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
+)
+
+// Where to look for the fuse device and the list of file systems supported
+// by the kernel.
+const (
+	fuseDevicePath      = "/dev/fuse"
+	procFilesystemsPath = "/proc/filesystems"
+)
+
+// Make sure that the fuse device can be opened, returning an
+// *ErrFuseUnavailable if not. fusermount would otherwise fail with a less
+// helpful message.
+func checkFuseDevice(devPath string, filesystemsPath string) (err error) {
+	f, err := os.OpenFile(devPath, os.O_RDWR, 0)
+	if err == nil {
+		f.Close()
+		return
+	}
+
+	e := &ErrFuseUnavailable{
+		Path: devPath,
+		Err:  err,
+	}
+
+	var errno syscall.Errno
+	if pathErr, ok := err.(*os.PathError); ok {
+		errno, _ = pathErr.Err.(syscall.Errno)
+	}
+
+	switch errno {
+	case syscall.ENOENT:
+		// Distinguish a missing device node from a kernel without fuse.
+		if kernelSupportsFuse(filesystemsPath) {
+			e.Reason = FuseDeviceMissing
+		} else {
+			e.Reason = FuseModuleNotLoaded
+		}
+
+	case syscall.EACCES, syscall.EPERM:
+		e.Reason = FuseDevicePermissionDenied
+
+	case syscall.ENODEV, syscall.ENXIO:
+		// The node exists but no driver is bound to it.
+		e.Reason = FuseModuleNotLoaded
+
+	default:
+		// Something else; let fusermount report it.
+		return nil
+	}
+
+	err = e
+	return
+}
+
+// Choose the credentials with which to run fusermount in order to honor
+// MountConfig.UserID and GroupID, making sure that the IDs exist.
+func fusermountCredential(cfg *MountConfig) (cred *syscall.Credential, err error) {
+	cred = &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if cfg.UserID != nil {
+		cred.Uid = *cfg.UserID
+		_, err = user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+		if err != nil {
+			err = fmt.Errorf("UserID %d: %v", cred.Uid, err)
+			return
+		}
+	}
+
+	if cfg.GroupID != nil {
+		cred.Gid = *cfg.GroupID
+		_, err = user.LookupGroupId(strconv.FormatUint(uint64(cred.Gid), 10))
+		if err != nil {
+			err = fmt.Errorf("GroupID %d: %v", cred.Gid, err)
+			return
+		}
+	}
+
+	// Only root may run fusermount as another user or group. Anyone else may
+	// only ask for their own IDs, and then mustn't have exec set the
+	// supplementary groups, which fails with a bare EPERM.
+	if os.Geteuid() != 0 {
+		if cred.Uid != uint32(os.Getuid()) {
+			err = fmt.Errorf(
+				"UserID %d: changing the mount's owner requires root",
+				cred.Uid)
+			return
+		}
+
+		if cred.Gid != uint32(os.Getgid()) {
+			err = fmt.Errorf(
+				"GroupID %d: changing the mount's group requires root",
+				cred.Gid)
+			return
+		}
+
+		cred.NoSetGroups = true
+	}
+
+	return
+}
+
+// Does the supplied list of file systems (in the format of /proc/filesystems)
+// include fuse? If it can't be read we assume so, erring on the side of the
+// less drastic diagnosis.
+func kernelSupportsFuse(filesystemsPath string) bool {
+	f, err := os.Open(filesystemsPath)
+	if err != nil {
+		return true
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "fuse" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The number of times to retry fusermount when MountConfig.MountRetries is
+// zero, and the delay before the first retry.
+const (
+	defaultMountRetries      = 3
+	mountRetryInitialBackoff = 10 * time.Millisecond
 )
 
 // Begin the process of mounting at the given directory, returning a connection
@@ -20,6 +155,49 @@ func mount(
 	// On linux, mounting is never delayed.
 	ready <- nil
 
+	// Fail early and descriptively if we can't possibly succeed.
+	err = checkFuseDevice(fuseDevicePath, procFilesystemsPath)
+	if err != nil {
+		return
+	}
+
+	// Run as a different user or group if asked to, since that's what
+	// determines the mount's owner.
+	var cred *syscall.Credential
+	if cfg.UserID != nil || cfg.GroupID != nil {
+		cred, err = fusermountCredential(cfg)
+		if err != nil {
+			return
+		}
+	}
+
+	// Run fusermount, trying again with backoff for as long as it fails
+	// transiently and we have retries left.
+	retries := cfg.MountRetries
+	if retries == 0 {
+		retries = defaultMountRetries
+	}
+
+	backoff := mountRetryInitialBackoff
+	for attempt := 0; ; attempt++ {
+		var transient bool
+		dev, transient, err = runFusermount(dir, cfg, cred)
+		if err == nil || !transient || attempt >= retries {
+			return
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Run fusermount once to mount at the given directory, receiving the fuse
+// device from it. If it fails, transient says whether that was for a reason
+// that may go away if we try again.
+func runFusermount(
+	dir string,
+	cfg *MountConfig,
+	cred *syscall.Credential) (dev *os.File, transient bool, err error) {
 	// Create a socket pair.
 	fds, err := syscall.Socketpair(syscall.AF_FILE, syscall.SOCK_STREAM, 0)
 	if err != nil {
@@ -44,6 +222,10 @@ func mount(
 		dir,
 	)
 
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+
 	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
 	cmd.ExtraFiles = []*os.File{writeFile}
 	cmd.Stderr = &stderr
@@ -51,63 +233,47 @@ func mount(
 	// Run the command.
 	err = cmd.Run()
 	if err != nil {
+		transient = isTransientFusermountError(err, stderr.Bytes())
 		err = fmt.Errorf("running fusermount: %v\n\nstderr:\n%s", err, stderr.Bytes())
 		return
 	}
 
-	// Wrap the socket file in a connection.
-	c, err := net.FileConn(readFile)
-	if err != nil {
-		err = fmt.Errorf("FileConn: %v", err)
-		return
-	}
-	defer c.Close()
-
-	// We expect to have a Unix domain socket.
-	uc, ok := c.(*net.UnixConn)
-	if !ok {
-		err = fmt.Errorf("Expected UnixConn, got %T", c)
-		return
-	}
-
-	// Read a message.
-	buf := make([]byte, 32) // expect 1 byte
-	oob := make([]byte, 32) // expect 24 bytes
-	_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
-	if err != nil {
-		err = fmt.Errorf("ReadMsgUnix: %v", err)
-		return
-	}
-
-	// Parse the message.
-	scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
-	if err != nil {
-		err = fmt.Errorf("ParseSocketControlMessage: %v", err)
-		return
-	}
+	// Receive the device from fusermount.
+	dev, err = receiveDeviceFD(readFile, "/dev/fuse")
 
-	// We expect one message.
-	if len(scms) != 1 {
-		err = fmt.Errorf("expected 1 SocketControlMessage; got scms = %#v", scms)
-		return
-	}
+	return
+}
 
-	scm := scms[0]
+// Is the supplied error from running fusermount, along with what it wrote to
+// stderr, one that may go away if we try again? That is the case when it
+// couldn't be started for lack of resources or because of a signal, or when
+// it reports that mount(2) failed for one of those reasons.
+func isTransientFusermountError(err error, stderr []byte) bool {
+	transientErrnos := []syscall.Errno{syscall.EAGAIN, syscall.EINTR}
 
-	// Pull out the FD returned by fusermount
-	gotFds, err := syscall.ParseUnixRights(&scm)
-	if err != nil {
-		err = fmt.Errorf("syscall.ParseUnixRights: %v", err)
-		return
-	}
+	switch err := err.(type) {
+	case *os.PathError:
+		// Starting the process failed.
+		for _, errno := range transientErrnos {
+			if err.Err == errno {
+				return true
+			}
+		}
 
-	if len(gotFds) != 1 {
-		err = fmt.Errorf("wanted 1 fd; got %#v", gotFds)
-		return
+	case *exec.ExitError:
+		// fusermount failed, and says why on stderr, e.g.
+		//
+		//     fusermount: mount failed: Interrupted system call
+		//
+		// The reason is glibc's strerror text, which is capitalized where
+		// syscall.Errno's isn't, so compare in lower case.
+		lower := bytes.ToLower(stderr)
+		for _, errno := range transientErrnos {
+			if bytes.Contains(lower, []byte("mount failed: "+errno.Error())) {
+				return true
+			}
+		}
 	}
 
-	// Turn the FD into an os.File.
-	dev = os.NewFile(uintptr(gotFds[0]), "/dev/fuse")
-
-	return
+	return false
 }
@@ -0,0 +1,330 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestCheckFuseDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount_linux_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Set up some files standing in for the device and /proc/filesystems.
+	writeFile := func(name string, contents string, perm os.FileMode) string {
+		p := path.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(contents), perm); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		// WriteFile is subject to the umask.
+		if err := os.Chmod(p, perm); err != nil {
+			t.Fatalf("Chmod: %v", err)
+		}
+
+		return p
+	}
+
+	usableDev := writeFile("usable_dev", "", 0600)
+	forbiddenDev := writeFile("forbidden_dev", "", 0000)
+	missingDev := path.Join(dir, "missing_dev")
+
+	withFuse := writeFile("with_fuse", "nodev\tsysfs\nnodev\tfuse\n\text4\n", 0600)
+	withoutFuse := writeFile("without_fuse", "nodev\tsysfs\n\text4\n", 0600)
+	missingList := path.Join(dir, "missing_list")
+
+	testCases := []struct {
+		name        string
+		devPath     string
+		listPath    string
+		unavailable bool
+		reason      FuseUnavailableReason
+		guidance    string
+	}{
+		{
+			name:     "usable",
+			devPath:  usableDev,
+			listPath: withFuse,
+		},
+		{
+			name:        "device missing",
+			devPath:     missingDev,
+			listPath:    withFuse,
+			unavailable: true,
+			reason:      FuseDeviceMissing,
+			guidance:    "--device",
+		},
+		{
+			name:        "device missing, no list",
+			devPath:     missingDev,
+			listPath:    missingList,
+			unavailable: true,
+			reason:      FuseDeviceMissing,
+			guidance:    "--device",
+		},
+		{
+			name:        "module not loaded",
+			devPath:     missingDev,
+			listPath:    withoutFuse,
+			unavailable: true,
+			reason:      FuseModuleNotLoaded,
+			guidance:    "modprobe",
+		},
+		{
+			name:        "permission denied",
+			devPath:     forbiddenDev,
+			listPath:    withFuse,
+			unavailable: true,
+			reason:      FuseDevicePermissionDenied,
+			guidance:    "permissions",
+		},
+	}
+
+	for _, tc := range testCases {
+		// Root can open anything.
+		if tc.reason == FuseDevicePermissionDenied && os.Geteuid() == 0 {
+			continue
+		}
+
+		err := checkFuseDevice(tc.devPath, tc.listPath)
+		if !tc.unavailable {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+
+			continue
+		}
+
+		e, ok := err.(*ErrFuseUnavailable)
+		if !ok {
+			t.Errorf("%s: got %#v, want *ErrFuseUnavailable", tc.name, err)
+			continue
+		}
+
+		if e.Reason != tc.reason {
+			t.Errorf("%s: got reason %v, want %v", tc.name, e.Reason, tc.reason)
+		}
+
+		if e.Path != tc.devPath {
+			t.Errorf("%s: got path %q, want %q", tc.name, e.Path, tc.devPath)
+		}
+
+		if msg := e.Error(); !strings.Contains(msg, tc.guidance) {
+			t.Errorf("%s: message %q lacks guidance %q", tc.name, msg, tc.guidance)
+		}
+	}
+}
+
+// Put a fake fusermount at the front of $PATH for the duration of the test.
+// Unmounting is passed straight to the real fusermount. For mounting, it
+// appends a line to a log file each time it is run, then fails with the
+// supplied message on its first failures runs and execs the real fusermount
+// afterward. Returns the path of the log.
+func fakeFusermount(
+	t *testing.T,
+	failures int,
+	message string) (logPath string, cleanup func()) {
+	real, err := exec.LookPath("fusermount")
+	if err != nil {
+		t.Skipf("exec.LookPath: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "mount_linux_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	logPath = path.Join(dir, "runs")
+	script := fmt.Sprintf(`#!/bin/sh
+if [ "$1" = "-u" ]; then
+	exec %s "$@"
+fi
+echo run >> %s
+if [ $(wc -l < %s) -le %d ]; then
+	echo "fusermount: %s" >&2
+	exit 1
+fi
+exec %s "$@"
+`, real, logPath, logPath, failures, message, real)
+
+	err = ioutil.WriteFile(path.Join(dir, "fusermount"), []byte(script), 0755)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldPath)
+
+	cleanup = func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+
+	return
+}
+
+// Return the number of times the fake fusermount has been run.
+func fusermountRuns(t *testing.T, logPath string) int {
+	contents, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	return strings.Count(string(contents), "\n")
+}
+
+// Mount at a fresh directory using the lower-level mount function, without
+// serving the connection.
+func mountUnserved(t *testing.T, cfg *MountConfig) (err error) {
+	dir, err := ioutil.TempDir("", "mount_linux_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	dev, err := mount(dir, cfg, make(chan error, 1))
+	if err != nil {
+		return
+	}
+
+	// Abort the connection before unmounting, so that nothing waits for us to
+	// answer the kernel.
+	dev.Close()
+	if err := unmount(dir); err != nil {
+		t.Errorf("unmount: %v", err)
+	}
+
+	return
+}
+
+func TestMountRetriesTransientFailures(t *testing.T) {
+	logPath, cleanup := fakeFusermount(
+		t,
+		2,
+		"mount failed: Interrupted system call")
+
+	defer cleanup()
+
+	if err := mountUnserved(t, &MountConfig{}); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+
+	if n := fusermountRuns(t, logPath); n != 3 {
+		t.Errorf("fusermount ran %d times; want 3", n)
+	}
+}
+
+func TestMountGivesUpAfterRetries(t *testing.T) {
+	logPath, cleanup := fakeFusermount(
+		t,
+		100,
+		"mount failed: Resource temporarily unavailable")
+
+	defer cleanup()
+
+	err := mountUnserved(t, &MountConfig{MountRetries: 1})
+	if err == nil || !strings.Contains(err.Error(), "Resource temporarily") {
+		t.Errorf("mount returned %v; want an EAGAIN failure", err)
+	}
+
+	if n := fusermountRuns(t, logPath); n != 2 {
+		t.Errorf("fusermount ran %d times; want 2", n)
+	}
+}
+
+func TestMountDoesntRetryPermanentFailures(t *testing.T) {
+	logPath, cleanup := fakeFusermount(
+		t,
+		100,
+		"mount failed: Operation not permitted")
+
+	defer cleanup()
+
+	err := mountUnserved(t, &MountConfig{})
+	if err == nil || !strings.Contains(err.Error(), "Operation not permitted") {
+		t.Errorf("mount returned %v; want an EPERM failure", err)
+	}
+
+	if n := fusermountRuns(t, logPath); n != 1 {
+		t.Errorf("fusermount ran %d times; want 1", n)
+	}
+}
+
+func TestMountWithFD(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Mounting without fusermount requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "mount_linux_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount as a container runtime would, handing over the device.
+	fd, err := syscall.Open(fuseDevicePath, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	err = syscall.Mount(
+		"mount_linux_test",
+		dir,
+		"fuse",
+		syscall.MS_NOSUID|syscall.MS_NODEV,
+		fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", fd))
+
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatalf("Mount: %v", err)
+	}
+
+	mfs, err := MountWithFD(dir, fd, probeServer{}, &MountConfig{})
+	if err != nil {
+		syscall.Unmount(dir, syscall.MNT_DETACH)
+		t.Fatalf("MountWithFD: %v", err)
+	}
+
+	// The init exchange happened, and the file system is served.
+	if mfs.kernelFeatures.Major != 7 {
+		t.Errorf("Unexpected kernel features: %+v", mfs.kernelFeatures)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Errorf("Stat: %v", err)
+	} else if fi.Mode() != os.ModeDir|0500 {
+		t.Errorf("Unexpected mode: %v", fi.Mode())
+	}
+
+	if err := mfs.Unmount(context.Background()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+}
@@ -1,12 +1,22 @@
 package fuse_test
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
+	"os/user"
 	"path"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -140,3 +150,2261 @@ func TestNonexistentMountPoint(t *testing.T) {
 		t.Errorf("Unexpected error: %v", got)
 	}
 }
+
+func TestShutdownContext(t *testing.T) {
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount with a shutdown context.
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			ShutdownContext: shutdownCtx,
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Cancelling the context should cause the file system to be unmounted, and
+	// Join to return the context's error.
+	cancel()
+
+	joinCtx, joinCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer joinCancel()
+
+	if err := mfs.Join(joinCtx); err != context.Canceled {
+		fuse.Unmount(dir)
+		t.Fatalf("Join returned %v; expected %v", err, context.Canceled)
+	}
+
+	// The mount point should now be an ordinary directory on the same device
+	// as its parent.
+	var dirStat, parentStat syscall.Stat_t
+	if err := syscall.Stat(dir, &dirStat); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if err := syscall.Stat(path.Dir(dir), &parentStat); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if dirStat.Dev != parentStat.Dev {
+		t.Errorf("Mount point still appears to be mounted")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// eofFS
+////////////////////////////////////////////////////////////////////////
+
+const eofFileContents = "taco"
+
+// A file system containing a single file named "foo", read with direct IO so
+// that every read(2) reaches ReadFile. Reads return io.EOF in the manner of
+// io.ReaderAt.
+type eofFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const eofFileInode = fuseops.RootInodeID + 1
+
+func (fs *eofFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  uint64(len(eofFileContents)),
+	}
+}
+
+func (fs *eofFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = eofFileInode
+	op.Entry.Attributes = fs.attributes(eofFileInode)
+	return
+}
+
+func (fs *eofFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *eofFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	op.UseDirectIO = true
+	return
+}
+
+func (fs *eofFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	op.BytesRead, err = strings.NewReader(eofFileContents).ReadAt(
+		op.Dst,
+		op.Offset)
+
+	return
+}
+
+func TestReadsAtAndPastEOF(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&eofFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Open the file.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+
+	defer f.Close()
+
+	// Each read should succeed, returning only the bytes before EOF.
+	testCases := []struct {
+		name     string
+		offset   int64
+		expected string
+	}{
+		{"straddling EOF", 2, "co"},
+		{"at EOF", 4, ""},
+		{"past EOF", 100, ""},
+	}
+
+	for _, tc := range testCases {
+		buf := make([]byte, 4)
+		n, err := syscall.Pread(int(f.Fd()), buf, tc.offset)
+		if err != nil {
+			t.Errorf("Read %s: %v", tc.name, err)
+			continue
+		}
+
+		if got := string(buf[:n]); got != tc.expected {
+			t.Errorf("Read %s: got %q, expected %q", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestMountInfo(t *testing.T) {
+	// mountinfo is Linux only.
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount with a name carrying some metadata, including characters that are
+	// special to the mount helper.
+	const fsName = `sample:bucket=foo,region=bar\baz`
+
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			FSName:  fsName,
+			Subtype: "sample",
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	contents, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	// Find the line for our mount point. The fifth field is the mount point,
+	// and the fields following the "-" separator are the file system type, the
+	// mount source, and the superblock options.
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != dir {
+			continue
+		}
+
+		var i int
+		for i = 5; i < len(fields) && fields[i] != "-"; i++ {
+		}
+
+		if len(fields) < i+4 {
+			t.Fatalf("Malformed mountinfo line: %q", line)
+		}
+
+		if got, want := fields[i+1], "fuse.sample"; got != want {
+			t.Errorf("File system type: got %q, want %q", got, want)
+		}
+
+		// The kernel escapes backslashes in the source as octal.
+		if got, want := fields[i+2], `sample:bucket=foo,region=bar\134baz`; got != want {
+			t.Errorf("Mount source: got %q, want %q", got, want)
+		}
+
+		superOpts := strings.Split(fields[i+3], ",")
+		if !containsString(superOpts, "default_permissions") {
+			t.Errorf("Superblock options missing default_permissions: %q", superOpts)
+		}
+
+		return
+	}
+
+	t.Errorf("No mount found for %s in:\n%s", dir, contents)
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the ID of an existing group other than our own, or zero if there is
+// none that we know of.
+func otherGroupID() (gid uint32) {
+	for _, name := range []string{"nogroup", "nobody", "daemon"} {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			continue
+		}
+
+		n, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil || int(n) == os.Getgid() {
+			continue
+		}
+
+		gid = uint32(n)
+		return
+	}
+
+	return
+}
+
+func TestMountOwner(t *testing.T) {
+	// Changing the owner requires privileges, and is Linux only.
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		return
+	}
+
+	ctx := context.Background()
+
+	// Find a group other than our own.
+	gid := otherGroupID()
+	if gid == 0 {
+		return
+	}
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			GroupID: &gid,
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// The superblock options in mountinfo should reflect the owner.
+	contents, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != dir {
+			continue
+		}
+
+		superOpts := strings.Split(fields[len(fields)-1], ",")
+
+		want := fmt.Sprintf("group_id=%d", gid)
+		if !containsString(superOpts, want) {
+			t.Errorf("Superblock options %q lack %q", superOpts, want)
+		}
+
+		want = fmt.Sprintf("user_id=%d", os.Getuid())
+		if !containsString(superOpts, want) {
+			t.Errorf("Superblock options %q lack %q", superOpts, want)
+		}
+
+		return
+	}
+
+	t.Errorf("No mount found for %s in:\n%s", dir, contents)
+}
+
+func TestMountOwner_NonexistentGroup(t *testing.T) {
+	// Linux only.
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Attempt to mount with a group that surely doesn't exist.
+	gid := uint32(1<<31 - 17)
+
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			GroupID: &gid,
+		})
+
+	if err == nil {
+		fuse.Unmount(mfs.Dir())
+		mfs.Join(context.Background())
+		t.Fatal("fuse.Mount returned nil")
+	}
+
+	want := fmt.Sprintf("GroupID %d", gid)
+	if got := err.Error(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected error: %v", got)
+	}
+}
+
+func TestMountOwner_Unprivileged(t *testing.T) {
+	// Linux only, and root may change the group.
+	if runtime.GOOS != "linux" || os.Geteuid() == 0 {
+		return
+	}
+
+	// Find a group other than our own.
+	gid := otherGroupID()
+	if gid == 0 {
+		return
+	}
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Attempt to mount with that group, leaving the user alone.
+	fs := &minimalFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			GroupID: &gid,
+		})
+
+	if err == nil {
+		fuse.Unmount(mfs.Dir())
+		mfs.Join(context.Background())
+		t.Fatal("fuse.Mount returned nil")
+	}
+
+	want := fmt.Sprintf("GroupID %d: changing the mount's group requires root", gid)
+	if got := err.Error(); !strings.Contains(got, want) {
+		t.Errorf("Unexpected error: %v", got)
+	}
+}
+
+func TestDumpRecentOps(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	const ringSize = 8
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&eofFS{}),
+		&fuse.MountConfig{
+			TraceRingSize: ringSize,
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Read the file, then trigger an error.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, 4)
+	if _, err := f.Read(buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected stat error: %v", err)
+	}
+
+	// The failed look up should be the most recent op, and the read should
+	// precede it.
+	records := mfs.DumpRecentOps()
+	if len(records) == 0 || len(records) > ringSize {
+		t.Fatalf("Unexpected number of records: %d", len(records))
+	}
+
+	last := records[len(records)-1]
+	if last.Op != "LookUpInodeOp" ||
+		last.Inode != fuseops.RootInodeID ||
+		last.Err != fuse.ENOENT {
+		t.Errorf("Unexpected last record: %v", last)
+	}
+
+	var sawRead bool
+	for _, r := range records {
+		if r.Op == "ReadFileOp" && r.Inode == eofFileInode && r.Err == nil {
+			sawRead = true
+		}
+	}
+
+	if !sawRead {
+		t.Errorf("No read in records: %v", records)
+	}
+}
+
+func TestOpObserver(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, counting the ops observed of each type and result.
+	type key struct {
+		opType string
+		err    error
+	}
+
+	var mu sync.Mutex
+	counts := make(map[key]int)
+	var negative []time.Duration
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&eofFS{}),
+		&fuse.MountConfig{
+			OpObserver: func(opType string, d time.Duration, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				counts[key{opType, err}]++
+				if d < 0 {
+					negative = append(negative, d)
+				}
+			},
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Read the file, then trigger an error.
+	contents, err := ioutil.ReadFile(path.Join(dir, "foo"))
+	if err != nil || string(contents) != eofFileContents {
+		t.Fatalf("ReadFile: %q, %v", contents, err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("Unexpected stat error: %v", err)
+	}
+
+	// The observer is called after the kernel sees the reply, so wait until
+	// every op has been replied to before looking.
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if counts[key{"ReadFileOp", nil}] == 0 {
+		t.Errorf("No successful read observed: %v", counts)
+	}
+
+	if counts[key{"LookUpInodeOp", fuse.ENOENT}] == 0 {
+		t.Errorf("No failed look up observed: %v", counts)
+	}
+
+	if len(negative) != 0 {
+		t.Errorf("Negative durations: %v", negative)
+	}
+}
+
+// Wait for a file system to be mounted at dir, which was on the supplied
+// device beforehand.
+func waitForMount(t *testing.T, dir string, unmountedDev uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil && uint64(fi.Sys().(*syscall.Stat_t).Dev) != unmountedDev {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("File system was never mounted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMountAndServe_Signal(t *testing.T) {
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	unmountedDev := fi.Sys().(*syscall.Stat_t).Dev
+
+	// Serve in the background.
+	done := make(chan error, 1)
+	go func() {
+		done <- fuse.MountAndServe(
+			dir,
+			fuseutil.NewFileSystemServer(&eofFS{}),
+			&fuse.MountConfig{})
+	}()
+
+	// Wait for the file system to be mounted.
+	waitForMount(t, dir, uint64(unmountedDev))
+
+	// Send ourselves SIGTERM, which should result in a clean unmount rather
+	// than the test process dying.
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("MountAndServe: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		fuse.Unmount(dir)
+		t.Fatalf("Timed out waiting for MountAndServe to return")
+	}
+
+	// The mount point should be back to its original state.
+	fi, err = os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if fi.Sys().(*syscall.Stat_t).Dev != unmountedDev {
+		t.Errorf("File system is still mounted")
+	}
+}
+
+func TestMountAndServe_ShutdownContext(t *testing.T) {
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	unmountedDev := fi.Sys().(*syscall.Stat_t).Dev
+
+	// Serve in the background, with a shutdown context of our own.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fuse.MountAndServe(
+			dir,
+			fuseutil.NewFileSystemServer(&eofFS{}),
+			&fuse.MountConfig{
+				ShutdownContext: ctx,
+			})
+	}()
+
+	// Wait for the file system to be mounted.
+	waitForMount(t, dir, uint64(unmountedDev))
+
+	// Cancelling the context should result in a clean unmount.
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("MountAndServe: %v", err)
+		}
+
+	case <-time.After(5 * time.Second):
+		fuse.Unmount(dir)
+		t.Fatalf("Timed out waiting for MountAndServe to return")
+	}
+}
+
+// A file system containing files whose names are their preferred I/O sizes.
+type blksizeFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *blksizeFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink:   1,
+		Mode:    0444,
+		Blksize: uint32(inode),
+	}
+}
+
+func (fs *blksizeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	blksize, err := strconv.ParseUint(op.Name, 10, 32)
+	if op.Parent != fuseops.RootInodeID || err != nil {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = fuseops.InodeID(blksize)
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *blksizeFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func TestPerInodeBlksize(t *testing.T) {
+	// OS X doesn't appear to pass the size through.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&blksizeFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Each file should report its own size.
+	for _, blksize := range []int64{4096, 1 << 20} {
+		fi, err := os.Stat(path.Join(dir, strconv.FormatInt(blksize, 10)))
+		if err != nil {
+			t.Errorf("Stat: %v", err)
+			continue
+		}
+
+		if got := int64(fi.Sys().(*syscall.Stat_t).Blksize); got != blksize {
+			t.Errorf("Got blksize %d, want %d", got, blksize)
+		}
+	}
+}
+
+// A version of eofFS that keeps the contents for each open file in a
+// fuseutil.HandleMap, and reports the handles it allocates.
+type handleMapFS struct {
+	eofFS
+	handles *fuseutil.HandleMap
+	opened  chan fuseops.HandleID
+}
+
+func (fs *handleMapFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	op.Handle = fs.handles.Add(eofFileContents)
+	op.UseDirectIO = true
+	fs.opened <- op.Handle
+	return
+}
+
+func (fs *handleMapFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	v, err := fs.handles.Get(op.Handle)
+	if err != nil {
+		return
+	}
+
+	op.BytesRead, err = strings.NewReader(v.(string)).ReadAt(op.Dst, op.Offset)
+	return
+}
+
+func (fs *handleMapFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	_, err = fs.handles.Release(op.Handle)
+	return
+}
+
+func TestDeadHandle(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &handleMapFS{
+		handles: fuseutil.NewHandleMap(),
+		opened:  make(chan fuseops.HandleID, 1),
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Open the file and read from it.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+
+	handle := <-fs.opened
+
+	buf := make([]byte, 4)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	// Once the handle is dead, reads fail with EIO.
+	fs.handles.MarkDead(handle)
+
+	_, err = f.ReadAt(buf, 0)
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.EIO {
+		t.Errorf("ReadAt after MarkDead: got %v, want EIO", err)
+	}
+
+	// Closing still works, and releases the handle.
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	if n := fs.handles.Len(); n != 0 {
+		t.Errorf("%d handles remain after unmounting", n)
+	}
+}
+
+// A version of handleMapFS that allocates handles with TryAdd, so that opens
+// fail once its map is full.
+type boundedHandleFS struct {
+	handleMapFS
+}
+
+func (fs *boundedHandleFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	op.Handle, err = fs.handles.TryAdd(eofFileContents)
+	op.UseDirectIO = true
+	return
+}
+
+func TestBoundedHandleMap(t *testing.T) {
+	const limit = 3
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &boundedHandleFS{}
+	fs.handles = fuseutil.NewBoundedHandleMap(limit)
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Open the file up to the limit.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for i := 0; i < limit; i++ {
+		f, err := os.Open(path.Join(dir, "foo"))
+		if err != nil {
+			t.Fatalf("os.Open: %v", err)
+		}
+
+		files = append(files, f)
+	}
+
+	// The next open fails.
+	_, err = os.Open(path.Join(dir, "foo"))
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.ENFILE {
+		t.Fatalf("os.Open beyond limit: got %v, want ENFILE", err)
+	}
+
+	// Close one. The kernel sends the release asynchronously, so wait for it.
+	if err := files[0].Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	files = files[1:]
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fs.handles.Len() == limit {
+		if time.Now().After(deadline) {
+			t.Fatalf("Handle not released")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// Now there's room for another.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open after Close: %v", err)
+	}
+
+	files = append(files, f)
+}
+
+// A file system containing a single writable and always empty file named
+// "foo", which records the flags with which the file is opened.
+type openFlagsFS struct {
+	fuseutil.NotImplementedFileSystem
+	opened chan fuseops.OpenFlags
+}
+
+func (fs *openFlagsFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0666,
+	}
+}
+
+func (fs *openFlagsFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = fuseops.RootInodeID + 1
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *openFlagsFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *openFlagsFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *openFlagsFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	fs.opened <- op.Flags
+	return
+}
+
+func TestOpenFileFlags(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &openFlagsFS{
+		opened: make(chan fuseops.OpenFlags, 1),
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Open the file in various ways. O_TRUNC is handled by the kernel.
+	testCases := []struct {
+		flags      int
+		accessMode fuseops.OpenFlags
+		append     bool
+	}{
+		{syscall.O_RDONLY, syscall.O_RDONLY, false},
+		{syscall.O_WRONLY, syscall.O_WRONLY, false},
+		{syscall.O_RDWR | syscall.O_APPEND, syscall.O_RDWR, true},
+		{syscall.O_WRONLY | syscall.O_TRUNC, syscall.O_WRONLY, false},
+	}
+
+	for _, tc := range testCases {
+		f, err := os.OpenFile(path.Join(dir, "foo"), tc.flags, 0)
+		if err != nil {
+			t.Fatalf("OpenFile(%#x): %v", tc.flags, err)
+		}
+
+		f.Close()
+
+		got := <-fs.opened
+		if got.AccessMode() != tc.accessMode {
+			t.Errorf("OpenFile(%#x): got access mode %#x", tc.flags, got.AccessMode())
+		}
+
+		if (got&syscall.O_APPEND != 0) != tc.append {
+			t.Errorf("OpenFile(%#x): got flags %#x", tc.flags, got)
+		}
+
+		if got&syscall.O_TRUNC != 0 {
+			t.Errorf("OpenFile(%#x): got O_TRUNC in %#x", tc.flags, got)
+		}
+	}
+}
+
+func TestDoubleRelease(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, capturing both logs.
+	fs := &handleMapFS{
+		handles: fuseutil.NewHandleMap(),
+		opened:  make(chan fuseops.HandleID, 1),
+	}
+
+	var debugBuf, errorBuf bytes.Buffer
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			DebugLogger: log.New(&debugBuf, "", 0),
+			ErrorLogger: log.New(&errorBuf, "", 0),
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Open the file, then simulate a bug in the file system's accounting by
+	// releasing the handle before the kernel does.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+
+	handle := <-fs.opened
+	if _, err := fs.handles.Release(handle); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	// Closing the file causes the kernel to release the handle again, which
+	// must not bring down the file system.
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	// The failed release should appear in the debug log only.
+	want := fmt.Sprintf("-> Error: %q", syscall.EBADF.Error())
+	if !strings.Contains(debugBuf.String(), want) {
+		t.Errorf("Debug log doesn't contain %q:\n%s", want, debugBuf.String())
+	}
+
+	if strings.Contains(errorBuf.String(), "ReleaseFileHandleOp") {
+		t.Errorf("Release logged as an error:\n%s", errorBuf.String())
+	}
+}
+
+// A version of eofFS whose root directory lists many names. Each open of it
+// takes a snapshot of the listing, kept in a fuseutil.HandleMap and freed when
+// the handle is released.
+type dirHandleFS struct {
+	eofFS
+	handles *fuseutil.HandleMap
+
+	mu           sync.Mutex
+	useAfterFree int // GUARDED_BY(mu)
+}
+
+const dirHandleFSEntries = 200
+
+type dirListing struct {
+	mu sync.Mutex
+
+	// nil once freed.
+	//
+	// GUARDED_BY(mu)
+	entries []fuseutil.Dirent
+}
+
+func (fs *dirHandleFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	l := &dirListing{}
+	for i := 0; i < dirHandleFSEntries; i++ {
+		l.entries = append(l.entries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  eofFileInode,
+			Name:   fmt.Sprintf("file_%d", i),
+			Type:   fuseutil.DT_File,
+		})
+	}
+
+	op.Handle = fs.handles.Add(l)
+	return
+}
+
+func (fs *dirHandleFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	v, err := fs.handles.Borrow(op.Handle)
+	if err != nil {
+		return
+	}
+
+	defer fs.handles.Return(op.Handle)
+
+	l := v.(*dirListing)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.entries == nil {
+		fs.mu.Lock()
+		fs.useAfterFree++
+		fs.mu.Unlock()
+
+		err = fuse.EIO
+		return
+	}
+
+	for _, e := range l.entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *dirHandleFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	v, err := fs.handles.Release(op.Handle)
+	if err != nil {
+		return
+	}
+
+	l := v.(*dirListing)
+	l.mu.Lock()
+	l.entries = nil
+	l.mu.Unlock()
+
+	return
+}
+
+func TestConcurrentDirHandles(t *testing.T) {
+	const (
+		workers    = 8
+		iterations = 50
+	)
+
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &dirHandleFS{
+		handles: fuseutil.NewHandleMap(),
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Open, list, and close the directory from several goroutines at once. Run
+	// with -race to check the handle map.
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				f, err := os.Open(dir)
+				if err != nil {
+					t.Errorf("Open: %v", err)
+					return
+				}
+
+				names, err := f.Readdirnames(-1)
+				f.Close()
+
+				if err != nil {
+					t.Errorf("Readdirnames: %v", err)
+					return
+				}
+
+				if len(names) != dirHandleFSEntries {
+					t.Errorf("Got %d names, want %d", len(names), dirHandleFSEntries)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	// Every handle was released, and none was read after being freed.
+	if n := fs.handles.Len(); n != 0 {
+		t.Errorf("%d handles remain after unmounting", n)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.useAfterFree != 0 {
+		t.Errorf("%d reads of freed listings", fs.useAfterFree)
+	}
+}
+
+// A version of eofFS that records the callers that look up "foo".
+type callerFS struct {
+	eofFS
+
+	mu      sync.Mutex
+	callers []fuse.Caller // GUARDED_BY(mu)
+}
+
+func (fs *callerFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if c, ok := fuse.CallerFromContext(ctx); ok {
+		fs.mu.Lock()
+		fs.callers = append(fs.callers, c)
+		fs.mu.Unlock()
+	}
+
+	err = fs.eofFS.LookUpInode(ctx, op)
+	return
+}
+
+func TestAllowOther_CallerCredentials(t *testing.T) {
+	// Only root may use allow_other by default, or run as another user.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	const other = 65534
+
+	ctx := context.Background()
+
+	// Set up a temporary directory that the other user can reach.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	// Mount.
+	fs := &callerFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{AllowOther: true})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Read the file as the other user.
+	cmd := exec.Command("cat", path.Join(dir, "foo"))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: other, Gid: other},
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("cat: %v: %s", err, out)
+	}
+
+	if string(out) != eofFileContents {
+		t.Errorf("cat: got %q", out)
+	}
+
+	// The file system should have seen who was asking.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.callers) == 0 {
+		t.Fatalf("No lookups recorded")
+	}
+
+	for _, c := range fs.callers {
+		if c.Uid != other || c.Gid != other || c.Pid == 0 {
+			t.Errorf("Unexpected caller: %+v", c)
+		}
+	}
+}
+
+func TestInitNegotiationIsLogged(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount and unmount, capturing the debug log.
+	var buf bytes.Buffer
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{DebugLogger: log.New(&buf, "", 0)})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	// There should be a summary of the negotiation.
+	re := regexp.MustCompile(
+		`Init: protocol 7\.\d+ \(kernel 7\.\d+\); flags offered .*, ` +
+			`requested .*, granted .*; max_write \d+, max_readahead \d+`)
+
+	if !re.MatchString(buf.String()) {
+		t.Errorf("No init summary in debug log:\n%s", buf.String())
+	}
+}
+
+func TestMaxReadaheadAndMaxWrite(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount with sizes below the kernel's and the library's limits.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&eofFS{}),
+		&fuse.MountConfig{
+			MaxReadahead: 16 << 10,
+			MaxWrite:     8 << 10,
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	if got := mfs.MaxReadahead(); got != 16<<10 {
+		t.Errorf("MaxReadahead: got %d, want %d", got, 16<<10)
+	}
+
+	if got := mfs.MaxWrite(); got != 8<<10 {
+		t.Errorf("MaxWrite: got %d, want %d", got, 8<<10)
+	}
+
+	// The kernel reports the readahead in effect for the mount's device.
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	dev := fi.Sys().(*syscall.Stat_t).Dev
+	minor := dev&0xff | (dev>>12)&0xfff00
+
+	contents, err := ioutil.ReadFile(
+		fmt.Sprintf("/sys/class/bdi/0:%d/read_ahead_kb", minor))
+
+	if err != nil {
+		t.Logf("Not checking the kernel's view: %v", err)
+		return
+	}
+
+	if got := strings.TrimSpace(string(contents)); got != "16" {
+		t.Errorf("read_ahead_kb: got %s, want 16", got)
+	}
+}
+
+// An error type that isn't a syscall.Errno, as returned by a backend library.
+type backendError struct {
+	msg string
+}
+
+func (e *backendError) Error() string {
+	return e.msg
+}
+
+// A version of minimalFS whose lookups fail with a backendError.
+type backendErrorFS struct {
+	minimalFS
+}
+
+func (fs *backendErrorFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  os.ModeDir | 0777,
+	}
+
+	return
+}
+
+func (fs *backendErrorFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	err = &backendError{"connection reset by backend"}
+	return
+}
+
+func TestDefaultErrno(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, capturing the error log.
+	var buf bytes.Buffer
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&backendErrorFS{}),
+		&fuse.MountConfig{
+			ErrorLogger:  log.New(&buf, "", 0),
+			DefaultErrno: syscall.ETIMEDOUT,
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// The lookup should fail with the configured errno, not EIO.
+	_, err = os.Stat(path.Join(dir, "foo"))
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ETIMEDOUT {
+		t.Errorf("Stat: got %v, want ETIMEDOUT", err)
+	}
+
+	if err := fuse.Unmount(mfs.Dir()); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Joining: %v", err)
+	}
+
+	// The original error should have been logged, with its type.
+	want := fmt.Sprintf(
+		"*fuseops.LookUpInodeOp error: connection reset by backend "+
+			"(*fuse_test.backendError, replying with errno %d)",
+		syscall.ETIMEDOUT)
+
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("Error log doesn't contain %q:\n%s", want, buf.String())
+	}
+}
+
+// A file system that records the modes and umasks with which files and
+// directories are created.
+type umaskFS struct {
+	minimalFS
+
+	mu      sync.Mutex
+	created map[string][2]os.FileMode                   // Mode and Umask; GUARDED_BY(mu)
+	attrs   map[fuseops.InodeID]fuseops.InodeAttributes // GUARDED_BY(mu)
+}
+
+func (fs *umaskFS) record(
+	name string,
+	mode os.FileMode,
+	umask os.FileMode,
+	entry *fuseops.ChildInodeEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.created[name] = [2]os.FileMode{mode, umask}
+
+	entry.Child = fuseops.InodeID(fuseops.RootInodeID + len(fs.created))
+	entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  mode &^ umask,
+	}
+
+	fs.attrs[entry.Child] = entry.Attributes
+}
+
+func (fs *umaskFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	err = fuse.ENOENT
+	return
+}
+
+func (fs *umaskFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+
+		return
+	}
+
+	op.Attributes = fs.attrs[op.Inode]
+	return
+}
+
+func (fs *umaskFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	fs.record(op.Name, op.Mode, op.Umask, &op.Entry)
+	return
+}
+
+func (fs *umaskFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	fs.record(op.Name, op.Mode, op.Umask, &op.Entry)
+	return
+}
+
+func TestDontMask(t *testing.T) {
+	// DontMask is Linux only.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &umaskFS{
+		created: make(map[string][2]os.FileMode),
+		attrs:   make(map[fuseops.InodeID]fuseops.InodeAttributes),
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{DontMask: true})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Create a file and a directory with a umask in effect.
+	oldUmask := syscall.Umask(0027)
+	defer syscall.Umask(oldUmask)
+
+	f, err := os.OpenFile(path.Join(dir, "foo"), os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	f.Close()
+
+	if err := os.Mkdir(path.Join(dir, "bar"), 0777); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	// The file system should have received the unmasked modes and the umask.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	expected := map[string][2]os.FileMode{
+		"foo": {0666, 0027},
+		"bar": {os.ModeDir | 0777, 0027},
+	}
+
+	for name, want := range expected {
+		if got := fs.created[name]; got != want {
+			t.Errorf("%s: got mode and umask %v, want %v", name, got, want)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// MaxReadSize
+////////////////////////////////////////////////////////////////////////
+
+// A file system containing a single large file named "foo", read with direct
+// IO so that every read(2) reaches ReadFile. Records the size of the largest
+// read.
+type maxReadFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	largest int // GUARDED_BY(mu)
+}
+
+const maxReadFileSize = 1 << 22
+
+func (fs *maxReadFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  maxReadFileSize,
+	}
+}
+
+func (fs *maxReadFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = fuseops.RootInodeID + 1
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *maxReadFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *maxReadFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	op.UseDirectIO = true
+	return
+}
+
+func (fs *maxReadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	if len(op.Dst) > fs.largest {
+		fs.largest = len(op.Dst)
+	}
+	fs.mu.Unlock()
+
+	op.BytesRead = len(op.Dst)
+	return
+}
+
+func TestMaxReadSize(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options map[string]string
+	}{
+		{"default", nil},
+		{"max_read", map[string]string{"max_read": "16384"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testMaxReadSize(t, tc.options)
+		})
+	}
+}
+
+func testMaxReadSize(t *testing.T, options map[string]string) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &maxReadFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{Options: options})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	if max, ok := options["max_read"]; ok {
+		if got := strconv.Itoa(mfs.MaxReadSize()); got != max {
+			t.Errorf("MaxReadSize() = %s, want %s", got, max)
+		}
+	}
+
+	// Read the whole file at once, which the kernel must split into reads as
+	// large as it allows.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, maxReadFileSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+
+	fs.mu.Lock()
+	largest := fs.largest
+	fs.mu.Unlock()
+
+	if largest != mfs.MaxReadSize() {
+		t.Errorf("Largest read: %d, MaxReadSize(): %d", largest, mfs.MaxReadSize())
+	}
+}
+
+// A version of eofFS whose releases take a while, recording when they and
+// Destroy have happened.
+type slowReleaseFS struct {
+	eofFS
+
+	mu        sync.Mutex
+	released  bool // GUARDED_BY(mu)
+	destroyed bool // GUARDED_BY(mu)
+}
+
+func (fs *slowReleaseFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	time.Sleep(100 * time.Millisecond)
+
+	fs.mu.Lock()
+	fs.released = true
+	fs.mu.Unlock()
+
+	return
+}
+
+func (fs *slowReleaseFS) Destroy() {
+	fs.mu.Lock()
+	fs.destroyed = true
+	fs.mu.Unlock()
+}
+
+func TestMountedFileSystemUnmount(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs := &slowReleaseFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// While a file is open, the file system is busy and remains mounted.
+	f, err := os.Open(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("os.Open: %v", err)
+	}
+
+	if err := mfs.Unmount(ctx); err != fuse.EBUSY {
+		t.Errorf("Unmount while busy: got %v, want EBUSY", err)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "foo")); err != nil {
+		t.Errorf("Stat after failed unmount: %v", err)
+	}
+
+	// Closing the file sends a release, which the kernel doesn't wait for.
+	// Unmounting must wait for it, and for the file system to be destroyed.
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := mfs.Unmount(ctx); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	fs.mu.Lock()
+	released, destroyed := fs.released, fs.destroyed
+	fs.mu.Unlock()
+
+	if !released || !destroyed {
+		t.Errorf("Unmount returned early: released %v, destroyed %v", released, destroyed)
+	}
+
+	// Unmounting again returns the same result.
+	if err := mfs.Unmount(ctx); err != nil {
+		t.Errorf("Second Unmount: %v", err)
+	}
+}
+
+// A server that records the connection it is given before serving it.
+type connRecordingServer struct {
+	fuse.Server
+	conns chan *fuse.Connection
+}
+
+func (s *connRecordingServer) ServeOps(c *fuse.Connection) {
+	s.conns <- c
+	s.Server.ServeOps(c)
+}
+
+func TestNegotiatedCapabilities(t *testing.T) {
+	testCases := []struct {
+		cfg            fuse.MountConfig
+		writebackCache bool
+		readDirPlus    bool
+	}{
+		{fuse.MountConfig{}, true, false},
+		{fuse.MountConfig{DisableWritebackCaching: true}, false, false},
+		{fuse.MountConfig{EnableReadDirPlus: true}, true, true},
+	}
+
+	for i, tc := range testCases {
+		func() {
+			ctx := context.Background()
+
+			// Set up a temporary directory.
+			dir, err := ioutil.TempDir("", "mount_test")
+			if err != nil {
+				t.Fatalf("ioutil.TempDir: %v", err)
+			}
+
+			defer os.RemoveAll(dir)
+
+			// Mount.
+			server := &connRecordingServer{
+				Server: fuseutil.NewFileSystemServer(&minimalFS{}),
+				conns:  make(chan *fuse.Connection, 1),
+			}
+
+			mfs, err := fuse.Mount(dir, server, &tc.cfg)
+			if err != nil {
+				t.Fatalf("fuse.Mount: %v", err)
+			}
+
+			defer func() {
+				if err := mfs.Join(ctx); err != nil {
+					t.Errorf("Joining: %v", err)
+				}
+			}()
+
+			defer fuse.Unmount(mfs.Dir())
+
+			c := <-server.conns
+
+			if p := c.Protocol(); p.Major != 7 || p.Minor < 12 {
+				t.Errorf("Test case %d: unexpected protocol %v", i, p)
+			}
+
+			caps := c.Capabilities()
+			if !caps.BigWrites ||
+				caps.WritebackCache != tc.writebackCache ||
+				caps.ReadDirPlus != tc.readDirPlus {
+				t.Errorf("Test case %d: unexpected capabilities %+v", i, caps)
+			}
+		}()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// quotaFS
+////////////////////////////////////////////////////////////////////////
+
+// The most that quotaFS will store.
+const quotaFSLimit = 8
+
+// A file system containing a single writable file named "foo", which can hold
+// no more than quotaFSLimit bytes. The kernel is told to cache its attributes
+// for a long time, so that it relies on write replies to learn of growth.
+type quotaFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	contents []byte // GUARDED_BY(mu)
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *quotaFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0666,
+		Size:  uint64(len(fs.contents)),
+	}
+}
+
+func (fs *quotaFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = fuseops.RootInodeID + 1
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	return
+}
+
+func (fs *quotaFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+	return
+}
+
+func (fs *quotaFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *quotaFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Offset >= quotaFSLimit {
+		err = fuse.ENOSPC
+		return
+	}
+
+	// Store what fits, and report only that as written.
+	if room := quotaFSLimit - op.Offset; int64(len(op.Data)) > room {
+		op.Data = op.Data[:room]
+	}
+
+	end := op.Offset + int64(len(op.Data))
+	for int64(len(fs.contents)) < end {
+		fs.contents = append(fs.contents, 0)
+	}
+
+	copy(fs.contents[op.Offset:], op.Data)
+	return
+}
+
+func TestPartialWriteUpdatesCachedSize(t *testing.T) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount. Writeback caching would let the kernel accept the whole write
+	// itself.
+	fs := &quotaFS{}
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{DisableWritebackCaching: true})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	f, err := os.OpenFile(path.Join(dir, "foo"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	defer f.Close()
+
+	// The first write fits.
+	if _, err := f.Write([]byte("taco")); err != nil {
+		t.Fatalf("First Write: %v", err)
+	}
+
+	// The second goes past the quota. Its first half is written, and Go's
+	// retry of the second half fails.
+	n, err := f.Write([]byte("burrito!"))
+	if n != 4 {
+		t.Errorf("Second Write: wrote %d bytes, want 4", n)
+	}
+
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != fuse.ENOSPC {
+		t.Errorf("Second Write: got error %v, want ENOSPC", err)
+	}
+
+	// The size seen by stat(2) includes the part that was written.
+	fi, err := os.Stat(path.Join(dir, "foo"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if fi.Size() != quotaFSLimit {
+		t.Errorf("Stat: got size %d, want %d", fi.Size(), quotaFSLimit)
+	}
+
+	fs.mu.Lock()
+	contents := string(fs.contents)
+	fs.mu.Unlock()
+
+	if contents != "tacoburr" {
+		t.Errorf("Unexpected contents: %q", contents)
+	}
+}
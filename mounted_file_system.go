@@ -14,7 +14,12 @@
 
 package fuse
 
-import "golang.org/x/net/context"
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
 
 // MountedFileSystem represents the status of a mount operation, with a method
 // that waits for unmounting.
@@ -24,6 +29,31 @@ type MountedFileSystem struct {
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
 	joinStatusAvailable chan struct{}
+
+	// Non-nil if MountConfig.TraceRingSize is positive.
+	trace *opTraceRing
+
+	// Non-nil if MountConfig.CollectStats is set.
+	stats *opStatsCollector
+
+	// The max_readahead and max_write sent to the kernel.
+	maxReadahead uint32
+	maxWrite     uint32
+
+	// The largest ReadFileOp the kernel will send.
+	maxReadSize int
+
+	// What the kernel offered when mounting.
+	kernelFeatures KernelFeatures
+
+	// Held by unmountOnShutdown for each attempt to unmount.
+	mu sync.Mutex
+
+	// Whether unmountOnShutdown unmounted the file system, as opposed to it
+	// being unmounted by other means.
+	//
+	// GUARDED_BY(mu)
+	unmountedForShutdown bool
 }
 
 // Dir returns the directory on which the file system is mounted (or where we
@@ -37,8 +67,12 @@ func (mfs *MountedFileSystem) Dir() string {
 // responded to (i.e. the file system server has finished processing all
 // in-flight ops).
 //
-// The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// The return value is nil after a clean unmount. If the connection was
+// aborted or reading from the device failed, it is an *ErrConnectionClosed
+// saying which. It is also non-nil if anything else unexpected happened while
+// serving, or if the file system was unmounted because
+// MountConfig.ShutdownContext was cancelled (but not if it was unmounted by
+// other means first). May be called multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -47,3 +81,83 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 		return ctx.Err()
 	}
 }
+
+// Unmount unmounts the file system, then waits until the server has finished
+// responding to the ops it has read and the connection has been closed, as
+// Join does. Once the kernel has agreed to the unmount no new ops arrive, so a
+// file system that needs to flush state on exit can do so in
+// FileSystem.Destroy knowing that nothing else is going on.
+//
+// The kernel refuses to unmount a file system that is in use, for example
+// because a process has a file on it open or its working directory within
+// it. In that case Unmount returns EBUSY, and the file system remains mounted
+// and served. Otherwise the result is that of Join: nil after a clean
+// shutdown, or ctx.Err() if ctx is done before the server has finished, in
+// which case it carries on in the background and Join may be called later.
+func (mfs *MountedFileSystem) Unmount(ctx context.Context) (err error) {
+	err = Unmount(mfs.dir)
+	if err != nil {
+		// If the file system has already gone away, e.g. because it was
+		// unmounted by other means, there is nothing left to wait for.
+		select {
+		case <-mfs.joinStatusAvailable:
+			err = mfs.joinStatus
+			return
+
+		default:
+		}
+
+		if isBusy(err) {
+			err = EBUSY
+		} else {
+			err = fmt.Errorf("Unmount: %v", err)
+		}
+
+		return
+	}
+
+	err = mfs.Join(ctx)
+	return
+}
+
+// DumpRecentOps returns records of the most recent ops that the file system
+// replied to, oldest first, if MountConfig.TraceRingSize was set. Otherwise it
+// returns nil. It may be called at any time, including after the file system
+// has been unmounted.
+func (mfs *MountedFileSystem) DumpRecentOps() []OpRecord {
+	if mfs.trace == nil {
+		return nil
+	}
+
+	return mfs.trace.snapshot()
+}
+
+// Stats returns a summary of the ops that the file system has served, if
+// MountConfig.CollectStats was set. Otherwise it returns the zero value. Like
+// DumpRecentOps, it may be called at any time.
+func (mfs *MountedFileSystem) Stats() MountStats {
+	if mfs.stats == nil {
+		return MountStats{}
+	}
+
+	return mfs.stats.snapshot()
+}
+
+// MaxReadahead returns the readahead limit sent to the kernel when mounting,
+// i.e. MountConfig.MaxReadahead after clamping to what the kernel supports.
+func (mfs *MountedFileSystem) MaxReadahead() uint32 {
+	return mfs.maxReadahead
+}
+
+// MaxWrite returns the largest WriteFileOp that the kernel will send, i.e.
+// MountConfig.MaxWrite after clamping to what the library supports.
+func (mfs *MountedFileSystem) MaxWrite() uint32 {
+	return mfs.maxWrite
+}
+
+// MaxReadSize returns the largest read the kernel will ask for, as negotiated
+// when mounting. The length of ReadFileOp.Dst never exceeds it, so file
+// systems may use it to size buffers for reading from their backing store.
+func (mfs *MountedFileSystem) MaxReadSize() int {
+	return mfs.maxReadSize
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// Return the directory in /sys/fs/fuse/connections for the file system
+// mounted on the supplied directory.
+//
+// The device number comes from /proc/self/mountinfo rather than stat(2), which
+// would need the file system to serve the root's attributes.
+func fuseConnectionDir(t *testing.T, dir string) string {
+	contents, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	// The third field is the device number and the fifth the mount point.
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != dir {
+			continue
+		}
+
+		var major, minor uint64
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+			t.Fatalf("Malformed mountinfo line %q: %v", line, err)
+		}
+
+		// The directory is named for the kernel's internal encoding of the
+		// device number, in which the minor number takes the low 20 bits.
+		return fmt.Sprintf("/sys/fs/fuse/connections/%d", major<<20|minor)
+	}
+
+	t.Fatalf("No mountinfo line for %s", dir)
+	return ""
+}
+
+func TestJoin_ConnectionAborted(t *testing.T) {
+	// Only root may abort connections, and only if the fusectl file system is
+	// mounted.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	if _, err := os.Stat("/sys/fs/fuse/connections"); err != nil {
+		return
+	}
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mounted_file_system_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// The mount point stays in place after the connection is aborted, so it
+	// must still be unmounted.
+	defer fuse.Unmount(mfs.Dir())
+
+	// Abort the connection.
+	abortPath := fuseConnectionDir(t, dir) + "/abort"
+	if err := ioutil.WriteFile(abortPath, []byte("1"), 0); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// Join should report the abort, without waiting for an unmount.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = mfs.Join(ctx)
+	closedErr, ok := err.(*fuse.ErrConnectionClosed)
+	if !ok {
+		t.Fatalf("Join: got %v, want *ErrConnectionClosed", err)
+	}
+
+	if closedErr.Reason != fuse.ConnectionAborted {
+		t.Errorf("Join: got reason %v, want %v", closedErr.Reason, fuse.ConnectionAborted)
+	}
+}
+
+// An io.Writer for an error logger that signals each failure to unmount for
+// shutdown on a channel, without blocking.
+type unmountFailureWriter chan struct{}
+
+func (w unmountFailureWriter) Write(p []byte) (n int, err error) {
+	if strings.Contains(string(p), "for shutdown") {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+
+	n = len(p)
+	return
+}
+
+func TestJoin_ShutdownContextUnmountedElsewhere(t *testing.T) {
+	// Only root may detach mounts.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "mounted_file_system_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount with a shutdown context, noticing failures to unmount.
+	fs, err := fuseutil.ReadManifestFS(
+		strings.NewReader("dir 0755 foo"),
+		uint32(os.Getuid()),
+		uint32(os.Getgid()))
+
+	if err != nil {
+		t.Fatalf("ReadManifestFS: %v", err)
+	}
+
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failures := make(unmountFailureWriter, 1)
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			ShutdownContext: shutdownCtx,
+			ErrorLogger:     log.New(failures, "", 0),
+		})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Keep the file system busy by working within it, so that unmounting for
+	// shutdown fails. (An open file would do too, but its release might still
+	// be in flight when the file system goes away.)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		fuse.Unmount(dir)
+		t.Fatalf("Chdir: %v", err)
+	}
+
+	defer os.Chdir(wd)
+
+	cancel()
+
+	select {
+	case <-failures:
+	case <-time.After(10 * time.Second):
+		os.Chdir(wd)
+		fuse.Unmount(dir)
+		t.Fatalf("Unmounting for shutdown didn't fail")
+	}
+
+	// Detach the mount ourselves, which succeeds despite it being busy, then
+	// let the file system go away by leaving it. Join should report a clean
+	// unmount.
+	if err := syscall.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := os.Chdir(wd); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+
+	ctx, joinCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer joinCancel()
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"unsafe"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/buffer"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// InvalidateInode asks the kernel to drop its cached attributes for the
+// supplied inode, along with any cached page contents in the byte range
+// [off, off+length). A negative offset means that only the attributes should
+// be invalidated, and a non-positive length means "through the end of the
+// file".
+//
+// The result is ENOSYS if the kernel speaks a protocol version too old to
+// support invalidation. If the kernel doesn't currently know about the inode,
+// the result is syscall.ENOENT; callers that are merely trying to make sure
+// nothing stale is cached may treat that as success.
+//
+// Bind mounts of the file system or of directories within it (e.g. made with
+// mount --bind) share the kernel's caches with the original mount point, so
+// an invalidation sent through the connection is seen through all of them.
+// This is not true of a second mount of the same server, which has its own
+// connection and caches; see fuseutil.NewFileSystemServer.
+//
+// Unless writeback caching is disabled (see MountConfig), the kernel writes
+// back any dirty pages in the range before dropping them, and this call
+// doesn't return until it has done so. The file system will therefore receive
+// WriteFileOps for the inode while the call is in progress, so it must not
+// hold any lock that its WriteFile handler needs.
+//
+// This also matters when changing a file's size behind the kernel's back.
+// Truncating the file in the backing store and then invalidating it would
+// cause dirty pages beyond the new size to be written back, un-truncating the
+// file. Instead, use this sequence:
+//
+//  1. Call InvalidateInode for the whole file (offset and length zero). Dirty
+//     pages are written back and dropped.
+//
+//  2. Truncate the file in the backing store.
+//
+//  3. Call InvalidateInode for the whole file again, so that the new size and
+//     any pages read since step 1 are refetched.
+//
+// A write(2) that races with steps 1 and 2 can still dirty pages that are then
+// written back beyond the new size; file systems for which that matters must
+// coordinate with their writers in some other way.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) (err error) {
+	if !c.protocol.HasInvalidate() {
+		err = ENOSYS
+		return
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(m.Grow(
+		int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = length
+
+	err = c.sendNotification(m, fusekernel.NotifyCodeInvalInode)
+	return
+}
+
+// InvalidateEntry asks the kernel to drop any cached directory entry for the
+// supplied name within the supplied parent, causing the next access to the
+// name to result in a fresh LookUpInodeOp.
+//
+// The kernel holds the parent directory's lock while processing this
+// notification, so it must not be called from within the handler for an op
+// that the kernel may be issuing with that lock held (for example a
+// LookUpInodeOp or CreateFileOp for the same parent); doing so can deadlock.
+//
+// As with InvalidateInode, the result is ENOSYS for kernels too old to support
+// this and syscall.ENOENT if the entry isn't cached.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	if !c.protocol.HasInvalidate() {
+		err = ENOSYS
+		return
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(
+		int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+
+	m.AppendString(name)
+	m.AppendString("\x00")
+
+	err = c.sendNotification(m, fusekernel.NotifyCodeInvalEntry)
+	return
+}
+
+// NotifyPollWakeup tells the kernel that an event may have become ready on the
+// open file for which a PollOp with ScheduleNotify set carried the supplied
+// kernel handle (see fuseops.PollOp.KernelHandle). The kernel wakes up anyone
+// waiting in poll(2) or similar on the file, and they poll it again.
+//
+// Waking up a handle that nobody is waiting on is harmless, and so is
+// waking up one whose file has since been closed: the kernel ignores handles
+// it doesn't know. The result is ENOSYS if the kernel speaks a protocol
+// version too old to support polling.
+//
+// Unlike the invalidation calls, this doesn't wait for anything, so it is
+// safe to call while holding locks that the file system's op handlers need.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) NotifyPollWakeup(kh uint64) (err error) {
+	if !c.protocol.HasPoll() {
+		err = ENOSYS
+		return
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyPollWakeupOut)(m.Grow(
+		int(unsafe.Sizeof(fusekernel.NotifyPollWakeupOut{}))))
+
+	out.Kh = kh
+
+	err = c.sendNotification(m, fusekernel.NotifyCodePoll)
+	return
+}
+
+// Fill in the header for an unsolicited notification message whose payload
+// has already been written, then send it to the kernel. Notifications are
+// distinguished from replies by a zero unique ID, with the notification code
+// carried in the error field.
+func (c *Connection) sendNotification(
+	m *buffer.OutMessage,
+	code int32) (err error) {
+	h := m.OutHeader()
+	h.Unique = 0
+	h.Error = code
+	h.Len = uint32(m.Len())
+
+	err = c.writeMessage(m.Bytes())
+	return
+}
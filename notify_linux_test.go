@@ -0,0 +1,208 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+const (
+	bindDirInode  = fuseops.RootInodeID + 1
+	bindFileInode = fuseops.RootInodeID + 2
+)
+
+// A file system containing a directory named "sub" that contains a file named
+// "foo", whose size may be changed out of band. Attributes are cached by the
+// kernel until invalidated.
+type bindFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	size uint64 // GUARDED_BY(mu)
+}
+
+// Change the size of the file behind the kernel's back.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *bindFS) setSize(size uint64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.size = size
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *bindFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == bindFileInode {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0666,
+			Size:  fs.size,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  os.ModeDir | 0777,
+	}
+}
+
+func (fs *bindFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	switch {
+	case op.Parent == fuseops.RootInodeID && op.Name == "sub":
+		op.Entry.Child = bindDirInode
+
+	case op.Parent == bindDirInode && op.Name == "foo":
+		op.Entry.Child = bindFileInode
+
+	default:
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	return
+}
+
+func (fs *bindFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+	return
+}
+
+func TestInvalidateInode_BindMount(t *testing.T) {
+	// Only root may bind mount.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	ctx := context.Background()
+
+	// Set up temporary directories for the mount and the bind mount.
+	dir, err := ioutil.TempDir("", "notify_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	bindDir, err := ioutil.TempDir("", "notify_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(bindDir)
+
+	// Mount.
+	fs := &bindFS{size: 4}
+	server := &connCapturingServer{
+		wrapped: fuseutil.NewFileSystemServer(fs),
+		conns:   make(chan *fuse.Connection, 1),
+	}
+
+	// With writeback caching the kernel trusts its own idea of the file's size
+	// over the one we report, so disable it.
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		DisableWritebackCaching: true,
+	})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	conn := <-server.conns
+
+	// Bind mount the subdirectory. The file system stays alive until this is
+	// unmounted too, so it must happen before joining.
+	err = syscall.Mount(path.Join(dir, "sub"), bindDir, "", syscall.MS_BIND, "")
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := syscall.Unmount(bindDir, 0); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+	}()
+
+	// The file looks the same through both paths.
+	stat := func(p string) *syscall.Stat_t {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+
+		return fi.Sys().(*syscall.Stat_t)
+	}
+
+	orig := stat(path.Join(dir, "sub/foo"))
+	bound := stat(path.Join(bindDir, "foo"))
+
+	if orig.Ino != bound.Ino || orig.Dev != bound.Dev || bound.Size != 4 {
+		t.Errorf("Inconsistent stat: %+v vs. %+v", orig, bound)
+	}
+
+	// Change the size behind the kernel's back. The old size stays cached.
+	fs.setSize(11)
+
+	if got := stat(path.Join(bindDir, "foo")).Size; got != 4 {
+		t.Fatalf("Size before invalidation: %d", got)
+	}
+
+	// Invalidating through the connection reaches the bind mount.
+	if err := conn.InvalidateInode(bindFileInode, -1, 0); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	if got := stat(path.Join(bindDir, "foo")).Size; got != 11 {
+		t.Errorf("Size through bind mount after invalidation: %d", got)
+	}
+
+	if got := stat(path.Join(dir, "sub/foo")).Size; got != 11 {
+		t.Errorf("Size through mount after invalidation: %d", got)
+	}
+}
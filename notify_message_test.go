@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/sbg/fuse/internal/buffer"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+func TestInvalidate_OldProtocol(t *testing.T) {
+	// No device is needed, since nothing should be written.
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 11}}
+
+	if err := c.InvalidateInode(17, 0, 0); err != ENOSYS {
+		t.Errorf("InvalidateInode: got %v, want ENOSYS", err)
+	}
+
+	if err := c.InvalidateEntry(17, "foo"); err != ENOSYS {
+		t.Errorf("InvalidateEntry: got %v, want ENOSYS", err)
+	}
+}
+
+func TestNotifyPollWakeup(t *testing.T) {
+	c := &Connection{protocol: fusekernel.Protocol{Major: 7, Minor: 10}}
+	if err := c.NotifyPollWakeup(17); err != ENOSYS {
+		t.Errorf("Old protocol: got %v, want ENOSYS", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+
+	defer r.Close()
+	defer w.Close()
+
+	c = &Connection{
+		dev:      w,
+		protocol: fusekernel.Protocol{Major: 7, Minor: 11},
+	}
+
+	if err := c.NotifyPollWakeup(17); err != nil {
+		t.Fatalf("NotifyPollWakeup: %v", err)
+	}
+
+	buf := make([]byte, buffer.OutMessageHeaderSize+
+		int(unsafe.Sizeof(fusekernel.NotifyPollWakeupOut{})))
+	if _, err := readFull(r, buf); err != nil {
+		t.Fatalf("Reading: %v", err)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&buf[0]))
+	if h.Unique != 0 || h.Error != fusekernel.NotifyCodePoll || int(h.Len) != len(buf) {
+		t.Errorf("Unexpected header: %+v", *h)
+	}
+
+	out := (*fusekernel.NotifyPollWakeupOut)(unsafe.Pointer(&buf[buffer.OutMessageHeaderSize]))
+	if out.Kh != 17 {
+		t.Errorf("Kh: got %d, want 17", out.Kh)
+	}
+}
+
+func TestInvalidate_Concurrent(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+
+	defer r.Close()
+	defer w.Close()
+
+	c := &Connection{
+		dev:      w,
+		protocol: fusekernel.Protocol{Major: 7, Minor: 12},
+	}
+
+	// Send notifications from many goroutines at once. Each must arrive as a
+	// single message.
+	const n = 100
+	inodeSize := buffer.OutMessageHeaderSize +
+		int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))
+
+	entrySize := buffer.OutMessageHeaderSize +
+		int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{})) +
+		len("foo\x00")
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			if err := c.InvalidateInode(17, -1, 0); err != nil {
+				t.Errorf("InvalidateInode: %v", err)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			if err := c.InvalidateEntry(17, "foo"); err != nil {
+				t.Errorf("InvalidateEntry: %v", err)
+			}
+		}()
+	}
+
+	// Read them back, checking that messages aren't interleaved.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		w.Close()
+		close(done)
+	}()
+
+	var inodes, entries int
+	buf := make([]byte, inodeSize+entrySize)
+	for {
+		header := buf[:buffer.OutMessageHeaderSize]
+		if _, err := readFull(r, header); err != nil {
+			break
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&header[0]))
+		if h.Unique != 0 {
+			t.Fatalf("Non-zero unique ID: %d", h.Unique)
+		}
+
+		payload := buf[buffer.OutMessageHeaderSize:h.Len]
+		if _, err := readFull(r, payload); err != nil {
+			t.Fatalf("Reading payload: %v", err)
+		}
+
+		switch {
+		case h.Error == fusekernel.NotifyCodeInvalInode && int(h.Len) == inodeSize:
+			inodes++
+
+		case h.Error == fusekernel.NotifyCodeInvalEntry && int(h.Len) == entrySize:
+			entries++
+
+		default:
+			t.Fatalf("Unexpected message: %+v", *h)
+		}
+	}
+
+	<-done
+	if inodes != n || entries != n {
+		t.Errorf("Got %d inode and %d entry notifications, want %d each", inodes, entries, n)
+	}
+}
+
+func readFull(f *os.File, b []byte) (n int, err error) {
+	for n < len(b) && err == nil {
+		var nn int
+		nn, err = f.Read(b[n:])
+		n += nn
+	}
+
+	return
+}
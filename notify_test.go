@@ -0,0 +1,255 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A server that makes the connection it is serving available to the test.
+type connCapturingServer struct {
+	wrapped fuse.Server
+	conns   chan *fuse.Connection
+}
+
+func (s *connCapturingServer) ServeOps(c *fuse.Connection) {
+	s.conns <- c
+	s.wrapped.ServeOps(c)
+}
+
+const truncFileInode = fuseops.RootInodeID + 1
+
+// A file system containing a single file named "foo", whose contents may be
+// truncated out of band.
+type truncFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	contents []byte // GUARDED_BY(mu)
+}
+
+// Truncate the file behind the kernel's back.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *truncFS) truncate(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.contents = fs.contents[:n]
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *truncFS) Contents() string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return string(fs.contents)
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *truncFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0666,
+		Size:  uint64(len(fs.contents)),
+	}
+}
+
+func (fs *truncFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = truncFileInode
+	op.Entry.Attributes = fs.attributes(truncFileInode)
+	return
+}
+
+func (fs *truncFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *truncFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Size != nil {
+		n := int(*op.Size)
+		if n <= len(fs.contents) {
+			fs.contents = fs.contents[:n]
+		} else {
+			fs.contents = append(fs.contents, make([]byte, n-len(fs.contents))...)
+		}
+	}
+
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *truncFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *truncFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Offset < int64(len(fs.contents)) {
+		op.BytesRead = copy(op.Dst, fs.contents[op.Offset:])
+	}
+
+	return
+}
+
+func (fs *truncFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	end := int(op.Offset) + len(op.Data)
+	if end > len(fs.contents) {
+		fs.contents = append(fs.contents, make([]byte, end-len(fs.contents))...)
+	}
+
+	copy(fs.contents[op.Offset:], op.Data)
+	return
+}
+
+func (fs *truncFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestInvalidateInode_TruncateBehindKernel(t *testing.T) {
+	// Writeback caching is Linux only.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "notify_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, with writeback caching enabled.
+	fs := &truncFS{}
+	server := &connCapturingServer{
+		wrapped: fuseutil.NewFileSystemServer(fs),
+		conns:   make(chan *fuse.Connection, 1),
+	}
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	conn := <-server.conns
+
+	// Write some data through the mount, leaving dirty pages in the kernel's
+	// cache.
+	f, err := os.OpenFile(path.Join(dir, "foo"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write([]byte("tacoburrito")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// Truncate behind the kernel's back, following the documented sequence.
+	if err := conn.InvalidateInode(truncFileInode, 0, 0); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	if got := fs.Contents(); got != "tacoburrito" {
+		t.Fatalf("Contents after first invalidation: %q", got)
+	}
+
+	fs.truncate(4)
+
+	if err := conn.InvalidateInode(truncFileInode, 0, 0); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	// Closing the file must not write back anything stale.
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if got := fs.Contents(); got != "taco" {
+		t.Errorf("Contents after close: %q; want %q", got, "taco")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"reflect"
+	"syscall"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// OpErrorInfo describes an op to which the file system replied with an error.
+// See MountConfig.OnOpError.
+//
+// It deliberately contains only the identifying arguments of the op, never
+// its payload (e.g. the data for a WriteFileOp or the value for a
+// SetXattrOp).
+type OpErrorInfo struct {
+	// The name of the op type, e.g. "LookUpInodeOp".
+	Op string
+
+	// The inode that the op concerns. For ops that name a directory entry
+	// (e.g. LookUpInodeOp, UnlinkOp) this is the parent directory; for RenameOp
+	// it is the old parent. Zero for ops that concern no inode.
+	Inode fuseops.InodeID
+
+	// The name that the op concerns, if any: the directory entry for ops that
+	// name one (the old name for RenameOp), or the attribute name for extended
+	// attribute ops.
+	Name string
+
+	// The credentials and process of the caller, as reported by the kernel.
+	// On Linux the process ID is that of the calling thread. These are zero
+	// for ops that the kernel issues on its own behalf, e.g. writeback.
+	Uid uint32
+	Gid uint32
+	Pid uint32
+
+	// The error returned by the file system, exactly as returned (including any
+	// wrapping), and the errno that the kernel received in its place
+	// (MountConfig.DefaultErrno for errors that aren't a syscall.Errno).
+	Err   error
+	Errno syscall.Errno
+}
+
+// Assemble the information for MountConfig.OnOpError.
+func newOpErrorInfo(
+	op interface{},
+	h *fusekernel.InHeader,
+	opErr error,
+	errno syscall.Errno) (info OpErrorInfo) {
+	info = OpErrorInfo{
+		Uid:   h.Uid,
+		Gid:   h.Gid,
+		Pid:   h.Pid,
+		Err:   opErr,
+		Errno: errno,
+	}
+
+	info.Op = opTypeName(op)
+	info.Inode, info.Name = opTarget(op)
+	return
+}
+
+// Return the name of the supplied op's type, e.g. "LookUpInodeOp".
+func opTypeName(op interface{}) string {
+	t := reflect.TypeOf(op)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Name()
+}
+
+// Return the inode and name that the supplied op concerns, as documented on
+// OpErrorInfo.
+func opTarget(op interface{}) (inode fuseops.InodeID, name string) {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return o.Parent, o.Name
+
+	case *fuseops.GetInodeAttributesOp:
+		return o.Inode, ""
+
+	case *fuseops.SetInodeAttributesOp:
+		return o.Inode, ""
+
+	case *fuseops.ForgetInodeOp:
+		return o.Inode, ""
+
+	case *fuseops.MkDirOp:
+		return o.Parent, o.Name
+
+	case *fuseops.MkNodeOp:
+		return o.Parent, o.Name
+
+	case *fuseops.CreateFileOp:
+		return o.Parent, o.Name
+
+	case *fuseops.CreateSymlinkOp:
+		return o.Parent, o.Name
+
+	case *fuseops.CreateLinkOp:
+		return o.Parent, o.Name
+
+	case *fuseops.RenameOp:
+		return o.OldParent, o.OldName
+
+	case *fuseops.RmDirOp:
+		return o.Parent, o.Name
+
+	case *fuseops.UnlinkOp:
+		return o.Parent, o.Name
+
+	case *fuseops.OpenDirOp:
+		return o.Inode, ""
+
+	case *fuseops.ReadDirOp:
+		return o.Inode, ""
+
+	case *fuseops.ReadDirPlusOp:
+		return o.Inode, ""
+
+	case *fuseops.OpenFileOp:
+		return o.Inode, ""
+
+	case *fuseops.ReadFileOp:
+		return o.Inode, ""
+
+	case *fuseops.WriteFileOp:
+		return o.Inode, ""
+
+	case *fuseops.FallocateOp:
+		return o.Inode, ""
+
+	case *fuseops.IoctlOp:
+		return o.Inode, ""
+
+	case *fuseops.PollOp:
+		return o.Inode, ""
+
+	case *fuseops.CopyFileRangeOp:
+		return o.SrcInode, ""
+
+	case *fuseops.SyncFileOp:
+		return o.Inode, ""
+
+	case *fuseops.FlushFileOp:
+		return o.Inode, ""
+
+	case *fuseops.ReadSymlinkOp:
+		return o.Inode, ""
+
+	case *fuseops.RemoveXattrOp:
+		return o.Inode, o.Name
+
+	case *fuseops.GetXattrOp:
+		return o.Inode, o.Name
+
+	case *fuseops.ListXattrOp:
+		return o.Inode, ""
+
+	case *fuseops.SetXattrOp:
+		return o.Inode, o.Name
+
+	case *fuseops.GetLockOp:
+		return o.Inode, ""
+
+	case *fuseops.SetLockOp:
+		return o.Inode, ""
+
+	case *fuseops.SetLockWaitOp:
+		return o.Inode, ""
+	}
+
+	return
+}
+
+// Is the supplied error one that the kernel doesn't see as a failure? An
+// ERANGE from a GetXattrOp or ListXattrOp answers the kernel's question about
+// the size of the buffer required (see Connection.kernelResponse).
+func isSizeProbeResult(op interface{}, opErr error) bool {
+	if opErr != syscall.ERANGE {
+		return false
+	}
+
+	switch op.(type) {
+	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
+		return true
+	}
+
+	return false
+}
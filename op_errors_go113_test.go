@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build go1.13
+
+package fuse_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+var errBackend = errors.New("backend unavailable")
+
+// A file system whose lookups fail with an error wrapping errBackend, as
+// returned by a typical client library.
+type wrappedErrorFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *wrappedErrorFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  os.ModeDir | 0777,
+	}
+
+	return
+}
+
+func (fs *wrappedErrorFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	err = fmt.Errorf("fetching %q: %w", op.Name, errBackend)
+	return
+}
+
+func TestOnOpError_WrappedError(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "op_errors_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount, recording errors.
+	infos := make(chan fuse.OpErrorInfo, 10)
+	cfg := &fuse.MountConfig{
+		OnOpError: func(info fuse.OpErrorInfo) {
+			infos <- info
+		},
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&wrappedErrorFS{}),
+		cfg)
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Look up a name. The kernel sees the default errno.
+	_, err = os.Stat(path.Join(dir, "foo"))
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// The callback receives the original error, not a string.
+	info := <-infos
+	if info.Op != "LookUpInodeOp" || info.Name != "foo" {
+		t.Errorf("Unexpected op: %+v", info)
+	}
+
+	if !errors.Is(info.Err, errBackend) {
+		t.Errorf("Err %v (%T) doesn't wrap errBackend", info.Err, info.Err)
+	}
+
+	if info.Errno != syscall.EIO {
+		t.Errorf("Errno: %v", info.Errno)
+	}
+}
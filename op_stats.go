@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// OpTypeStats summarizes the ops of one type that the file system has replied
+// to. See MountedFileSystem.Stats.
+type OpTypeStats struct {
+	// The number of ops replied to, and how many of those were errors.
+	Count  uint64
+	Errors uint64
+
+	// The total and longest time from reading an op to replying to it.
+	TotalDuration time.Duration
+	MaxDuration   time.Duration
+}
+
+// MountStats summarizes the ops that the file system has served since it was
+// mounted. See MountConfig.CollectStats.
+type MountStats struct {
+	// Stats for each op type replied to, keyed by the name of the type, e.g.
+	// "LookUpInodeOp".
+	Ops map[string]OpTypeStats
+
+	// The number of ops that have been read from the kernel but not yet
+	// replied to.
+	InFlight int
+
+	// The file data returned by successful ReadFileOps and accepted by
+	// successful WriteFileOps, in bytes.
+	BytesRead    uint64
+	BytesWritten uint64
+}
+
+// Counters behind MountStats.
+type opStatsCollector struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	stats MountStats
+}
+
+func newOpStatsCollector() *opStatsCollector {
+	return &opStatsCollector{
+		stats: MountStats{
+			Ops: make(map[string]OpTypeStats),
+		},
+	}
+}
+
+// Record that an op has been read.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *opStatsCollector) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.InFlight++
+}
+
+// Record that the supplied op, read after a call to begin, has been replied
+// to.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *opStatsCollector) end(
+	op interface{},
+	duration time.Duration,
+	opErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.InFlight--
+
+	name := opTypeName(op)
+	t := s.stats.Ops[name]
+	t.Count++
+	t.TotalDuration += duration
+	if duration > t.MaxDuration {
+		t.MaxDuration = duration
+	}
+
+	if opErr != nil {
+		t.Errors++
+	}
+
+	s.stats.Ops[name] = t
+
+	if opErr != nil {
+		return
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.ReadFileOp:
+		s.stats.BytesRead += uint64(typed.BytesRead)
+
+	case *fuseops.WriteFileOp:
+		s.stats.BytesWritten += uint64(len(typed.Data))
+	}
+}
+
+// Return a copy of the stats.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *opStatsCollector) snapshot() (stats MountStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats = s.stats
+	stats.Ops = make(map[string]OpTypeStats, len(s.stats.Ops))
+	for name, t := range s.stats.Ops {
+		stats.Ops[name] = t
+	}
+
+	return
+}
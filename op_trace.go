@@ -0,0 +1,109 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// OpRecord describes an op that the file system has replied to. See
+// MountConfig.TraceRingSize.
+type OpRecord struct {
+	// The name of the op type, e.g. "LookUpInodeOp".
+	Op string
+
+	// The inode that the op concerns, as for OpErrorInfo.Inode.
+	Inode fuseops.InodeID
+
+	// When the op was read from the kernel, and how long it took the file
+	// system to reply.
+	Start    time.Time
+	Duration time.Duration
+
+	// The error with which the file system replied, or nil.
+	Err error
+}
+
+func (r OpRecord) String() string {
+	result := "OK"
+	if r.Err != nil {
+		result = r.Err.Error()
+	}
+
+	return fmt.Sprintf(
+		"%s %s inode %v: %v (%v)",
+		r.Start.Format("15:04:05.000000"),
+		r.Op,
+		r.Inode,
+		result,
+		r.Duration)
+}
+
+// A fixed-size circular buffer of the most recent op records.
+type opTraceRing struct {
+	mu sync.Mutex
+
+	// The records, with the oldest at index next once the ring has wrapped.
+	//
+	// INVARIANT: 0 <= next < cap(records)
+	// INVARIANT: len(records) < cap(records) implies next == len(records)
+	//
+	// GUARDED_BY(mu)
+	records []OpRecord
+	next    int
+}
+
+// REQUIRES: size > 0
+func newOpTraceRing(size int) *opTraceRing {
+	return &opTraceRing{
+		records: make([]OpRecord, 0, size),
+	}
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *opTraceRing) add(rec OpRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.records) < cap(r.records) {
+		r.records = append(r.records, rec)
+	} else {
+		r.records[r.next] = rec
+	}
+
+	r.next = (r.next + 1) % cap(r.records)
+}
+
+// Return a copy of the records, oldest first.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *opTraceRing) snapshot() (records []OpRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records = make([]OpRecord, 0, len(r.records))
+	if len(r.records) == cap(r.records) {
+		records = append(records, r.records[r.next:]...)
+		records = append(records, r.records[:r.next]...)
+	} else {
+		records = append(records, r.records...)
+	}
+
+	return
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+func TestOpTraceRing(t *testing.T) {
+	r := newOpTraceRing(3)
+
+	inodes := func() (result []fuseops.InodeID) {
+		for _, rec := range r.snapshot() {
+			result = append(result, rec.Inode)
+		}
+
+		return
+	}
+
+	if got := inodes(); len(got) != 0 {
+		t.Errorf("Empty ring: got %v", got)
+	}
+
+	// Partially full.
+	r.add(OpRecord{Inode: 1})
+	r.add(OpRecord{Inode: 2})
+	if got, want := inodes(), []fuseops.InodeID{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Partially full: got %v, want %v", got, want)
+	}
+
+	// Wrapped around.
+	for i := 3; i <= 7; i++ {
+		r.add(OpRecord{Inode: fuseops.InodeID(i)})
+	}
+
+	if got, want := inodes(), []fuseops.InodeID{5, 6, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrapped: got %v, want %v", got, want)
+	}
+}
@@ -31,6 +31,13 @@ type interruptOp struct {
 	FuseID uint64
 }
 
+// Sent by the kernel as the last op when a mount is torn down, for those kinds
+// of mount for which it waits for a reply. The connection replies itself;
+// the file system hears about it through fuseutil.FileSystem.Destroy once
+// ReadOp returns io.EOF.
+type destroyOp struct {
+}
+
 // Required in order to mount on Linux and OS X.
 type initOp struct {
 	// In
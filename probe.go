@@ -0,0 +1,146 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// KernelFeatures describes what the running kernel's fuse implementation
+// offers. Each feature corresponds to a MountConfig field that has no effect
+// if the kernel doesn't offer it.
+type KernelFeatures struct {
+	// The version of the fuse protocol spoken by the kernel.
+	Major uint32
+	Minor uint32
+
+	// The most the kernel is willing to read ahead, in bytes. See
+	// MountConfig.MaxReadahead.
+	MaxReadahead uint32
+
+	// See MountConfig.DisableWritebackCaching.
+	WritebackCache bool
+
+	// See MountConfig.EnableReadDirPlus.
+	ReadDirPlus bool
+
+	// See MountConfig.EnableAsyncDirectIO.
+	AsyncDirectIO bool
+
+	// POSIX and flock(2) locks respectively. See MountConfig.HandleLocks.
+	PosixLocks bool
+	FlockLocks bool
+
+	// See MountConfig.HandleKillPrivileges.
+	KillPrivileges bool
+
+	// See MountConfig.ApplyUmask and MountConfig.DontMask.
+	DontMask bool
+
+	// Whether the kernel distinguishes an aborted connection from an unmount.
+	// See ErrConnectionClosed.
+	AbortError bool
+}
+
+// Return the features offered by the kernel in the supplied init op, before
+// it is replied to.
+func kernelFeatures(op *initOp) (f KernelFeatures) {
+	f = KernelFeatures{
+		Major:          op.Kernel.Major,
+		Minor:          op.Kernel.Minor,
+		MaxReadahead:   op.MaxReadahead,
+		WritebackCache: op.Flags&fusekernel.InitWritebackCache != 0,
+		ReadDirPlus:    op.Flags&fusekernel.InitDoReaddirplus != 0,
+		AsyncDirectIO:  op.Flags&fusekernel.InitAsyncDIO != 0,
+		PosixLocks:     op.Flags&fusekernel.InitPosixLocks != 0,
+		FlockLocks:     op.Flags&fusekernel.InitFlockLocks != 0,
+		KillPrivileges: op.Flags&fusekernel.InitKillPrivV2 != 0,
+		DontMask:       op.Flags&fusekernel.InitDontMask != 0,
+		AbortError:     op.Flags&fusekernel.InitAbortError != 0,
+	}
+
+	return
+}
+
+// ProbeKernelFeatures finds out what the running kernel's fuse implementation
+// offers, so that a file system can adjust its MountConfig before mounting,
+// e.g. to do without writeback caching on an old kernel rather than having it
+// silently ignored.
+//
+// The kernel reveals this only when a file system is mounted, so
+// ProbeKernelFeatures briefly mounts an empty file system on a temporary
+// directory. It therefore needs the same privileges as Mount.
+func ProbeKernelFeatures() (features KernelFeatures, err error) {
+	dir, err := ioutil.TempDir("", "fuse_probe")
+	if err != nil {
+		err = fmt.Errorf("TempDir: %v", err)
+		return
+	}
+
+	defer os.Remove(dir)
+
+	mfs, err := Mount(dir, probeServer{}, &MountConfig{FSName: "fuse_probe"})
+	if err != nil {
+		err = fmt.Errorf("Mount: %v", err)
+		return
+	}
+
+	features = mfs.kernelFeatures
+
+	err = mfs.Unmount(context.Background())
+	if err != nil {
+		err = fmt.Errorf("Unmount: %v", err)
+		return
+	}
+
+	return
+}
+
+// The server for the file system mounted by ProbeKernelFeatures, which has
+// an empty root directory and supports nothing else.
+type probeServer struct{}
+
+func (s probeServer) ServeOps(c *Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		switch typed := op.(type) {
+		case *fuseops.GetInodeAttributesOp:
+			typed.Attributes = fuseops.InodeAttributes{
+				Nlink: 1,
+				Mode:  os.ModeDir | 0500,
+			}
+
+			c.Reply(ctx, nil)
+
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp, *fuseops.StatFSOp:
+			c.Reply(ctx, nil)
+
+		default:
+			c.Reply(ctx, syscall.ENOSYS)
+		}
+	}
+}
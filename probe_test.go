@@ -0,0 +1,54 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/sbg/fuse"
+)
+
+func TestProbeKernelFeatures(t *testing.T) {
+	f, err := fuse.ProbeKernelFeatures()
+	if err != nil {
+		t.Fatalf("ProbeKernelFeatures: %v", err)
+	}
+
+	t.Logf("Kernel features: %+v", f)
+
+	// Any kernel we can mount with speaks at least 7.12.
+	if f.Major != 7 || f.Minor < 12 {
+		t.Errorf("Unexpected protocol version %d.%d", f.Major, f.Minor)
+	}
+
+	if f.MaxReadahead == 0 {
+		t.Errorf("No readahead offered")
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	// Every Linux kernel since 3.15 offers these.
+	if !f.WritebackCache ||
+		!f.ReadDirPlus ||
+		!f.AsyncDirectIO ||
+		!f.PosixLocks ||
+		!f.FlockLocks ||
+		!f.DontMask {
+		t.Errorf("Missing baseline features: %+v", f)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+
+	"github.com/sbg/fuse/internal/fusekernel"
+)
+
+// A version of the FUSE kernel protocol, as exchanged with the kernel when
+// mounting. The kernel and the library each announce the newest version they
+// speak, and the older of the two determines the layout of messages.
+type ProtocolVersion struct {
+	Major uint32
+	Minor uint32
+}
+
+// The range of protocol versions that the library speaks. Mounting fails with
+// a kernel older than MinProtocolVersion. A kernel newer than
+// MaxProtocolVersion is spoken to using MaxProtocolVersion, but still honours
+// requests for features from later versions; see FeatureMinVersion.
+//
+// These must not be modified.
+var (
+	MinProtocolVersion = ProtocolVersion{
+		fusekernel.ProtoVersionMinMajor,
+		fusekernel.ProtoVersionMinMinor,
+	}
+
+	MaxProtocolVersion = ProtocolVersion{
+		fusekernel.ProtoVersionMaxMajor,
+		fusekernel.ProtoVersionMaxMinor,
+	}
+)
+
+func (v ProtocolVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// LT returns whether v is older than w.
+func (v ProtocolVersion) LT(w ProtocolVersion) bool {
+	return fusekernel.Protocol(v).LT(fusekernel.Protocol(w))
+}
+
+// GE returns whether v is the same as or newer than w.
+func (v ProtocolVersion) GE(w ProtocolVersion) bool {
+	return fusekernel.Protocol(v).GE(fusekernel.Protocol(w))
+}
+
+// A Feature is something the library supports only with kernels that speak a
+// recent enough version of the protocol. See FeatureMinVersion.
+type Feature int
+
+const (
+	// fcntl(2) byte range locks passed to the file system, with
+	// MountConfig.HandleLocks.
+	FeaturePosixLocks Feature = iota
+
+	// flock(2) locks passed to the file system, with MountConfig.HandleLocks.
+	FeatureFlockLocks
+
+	// Unmasked modes in create-style ops, needed by MountConfig.ApplyUmask and
+	// MountConfig.DontMask.
+	FeatureDontMask
+
+	// fuseops.PollOp and Connection.NotifyPollWakeup.
+	FeaturePoll
+
+	// Connection.InvalidateInode and Connection.InvalidateEntry.
+	FeatureInvalidate
+
+	// fuseops.ReadDirPlusOp, with MountConfig.EnableReadDirPlus.
+	FeatureReadDirPlus
+
+	// Parallel pieces of direct I/O, with MountConfig.EnableAsyncDirectIO.
+	FeatureAsyncDirectIO
+
+	// Writeback caching, unless MountConfig.DisableWritebackCaching is set.
+	FeatureWritebackCache
+
+	// Telling an aborted connection from an unmount; see ConnectionAborted.
+	FeatureAbortError
+
+	// Clearing set-user-ID bits in the file system, with
+	// MountConfig.HandleKillPrivileges.
+	FeatureKillPrivileges
+)
+
+// The init flags that the library requests for features that depend on them.
+var featureInitFlags = map[Feature]fusekernel.InitFlags{
+	FeaturePosixLocks:     fusekernel.InitPosixLocks,
+	FeatureFlockLocks:     fusekernel.InitFlockLocks,
+	FeatureDontMask:       fusekernel.InitDontMask,
+	FeatureReadDirPlus:    fusekernel.InitDoReaddirplus | fusekernel.InitReaddirplusAuto,
+	FeatureAsyncDirectIO:  fusekernel.InitAsyncDIO,
+	FeatureWritebackCache: fusekernel.InitWritebackCache,
+	FeatureAbortError:     fusekernel.InitAbortError,
+	FeatureKillPrivileges: fusekernel.InitKillPrivV2,
+}
+
+// Features that depend on messages introduced in a particular version rather
+// than on an init flag. Keep in sync with fusekernel.Protocol's HasFoo
+// methods.
+var featureVersions = map[Feature]ProtocolVersion{
+	FeaturePoll:       {7, 11},
+	FeatureInvalidate: {7, 12},
+}
+
+// FeatureMinVersion returns the oldest kernel protocol version with which the
+// supplied feature works. With older kernels the feature is silently
+// unavailable: the library doesn't request it, and notifications fail with
+// ENOSYS. ok is false for unknown features.
+//
+// Note that this is the version announced by the kernel, which may be newer
+// than MaxProtocolVersion.
+func FeatureMinVersion(f Feature) (v ProtocolVersion, ok bool) {
+	if flags, found := featureInitFlags[f]; found {
+		// The feature needs every one of its flags.
+		for bit := fusekernel.InitFlags(1); bit != 0; bit <<= 1 {
+			if flags&bit == 0 {
+				continue
+			}
+
+			min, _ := bit.MinProtocol()
+			if v.LT(ProtocolVersion(min)) {
+				v = ProtocolVersion(min)
+			}
+		}
+
+		ok = true
+		return
+	}
+
+	v, ok = featureVersions[f]
+	return
+}
+
+// Capabilities describes the optional behaviour agreed with the kernel when
+// mounting: the features that the kernel offered and the library asked for,
+// the latter according to MountConfig. See Connection.Capabilities.
+type Capabilities struct {
+	// The agreed init flags, as the FUSE_* bits of struct fuse_init_out in
+	// include/uapi/linux/fuse.h. On OS X these are osxfuse's bits.
+	Flags uint64
+
+	// Writes of more than a page at a time. Always requested.
+	BigWrites bool
+
+	// Writeback caching, unless MountConfig.DisableWritebackCaching is set.
+	WritebackCache bool
+
+	// fuseops.ReadDirPlusOp, with MountConfig.EnableReadDirPlus.
+	ReadDirPlus bool
+
+	// Parallel pieces of direct I/O, with MountConfig.EnableAsyncDirectIO.
+	AsyncDirectIO bool
+
+	// fcntl(2) and flock(2) locks respectively, with MountConfig.HandleLocks.
+	PosixLocks bool
+	FlockLocks bool
+
+	// Unmasked modes in create-style ops, with MountConfig.ApplyUmask or
+	// MountConfig.DontMask.
+	DontMask bool
+
+	// Clearing set-user-ID bits in the file system, with
+	// MountConfig.HandleKillPrivileges.
+	KillPrivileges bool
+
+	// Telling an aborted connection from an unmount; see ConnectionAborted.
+	AbortError bool
+
+	// Splicing data to and from the device, and passing O_TRUNC to the file
+	// system in OpenFileOp rather than a separate truncation. The library
+	// never asks for these, so they are never agreed.
+	Splice       bool
+	AtomicOTrunc bool
+}
+
+// Return the capabilities described by the supplied agreed init flags.
+func capabilities(flags fusekernel.InitFlags) (c Capabilities) {
+	has := func(f fusekernel.InitFlags) bool { return flags&f != 0 }
+
+	c = Capabilities{
+		Flags:          uint64(flags),
+		BigWrites:      has(fusekernel.InitBigWrites),
+		WritebackCache: has(fusekernel.InitWritebackCache),
+		ReadDirPlus:    has(fusekernel.InitDoReaddirplus),
+		AsyncDirectIO:  has(fusekernel.InitAsyncDIO),
+		PosixLocks:     has(fusekernel.InitPosixLocks),
+		FlockLocks:     has(fusekernel.InitFlockLocks),
+		DontMask:       has(fusekernel.InitDontMask),
+		KillPrivileges: has(fusekernel.InitKillPrivV2),
+		AbortError:     has(fusekernel.InitAbortError),
+		Splice: has(fusekernel.InitSpliceRead) ||
+			has(fusekernel.InitSpliceWrite) ||
+			has(fusekernel.InitSpliceMove),
+		AtomicOTrunc: has(fusekernel.InitAtomicTrunc),
+	}
+
+	return
+}
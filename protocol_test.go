@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/sbg/fuse/internal/fusekernel"
+	"golang.org/x/net/context"
+)
+
+// Play the kernel's part in the init handshake, announcing the supplied
+// protocol version. Return the error from newConnection, along with the
+// kernel's view of the reply.
+func initWithKernel(
+	t *testing.T,
+	kernel ProtocolVersion) (err error, out fusekernel.OutHeader, library ProtocolVersion) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair: %v", err)
+	}
+
+	dev := os.NewFile(uintptr(fds[0]), "dev")
+	kernelSide := os.NewFile(uintptr(fds[1]), "kernel")
+	defer kernelSide.Close()
+
+	// Send the init request.
+	var msg struct {
+		header fusekernel.InHeader
+		in     fusekernel.InitIn
+	}
+
+	msg.header.Len = uint32(unsafe.Sizeof(msg))
+	msg.header.Opcode = fusekernel.OpInit
+	msg.header.Unique = 1
+	msg.in.Major = kernel.Major
+	msg.in.Minor = kernel.Minor
+
+	_, err = kernelSide.Write((*[unsafe.Sizeof(msg)]byte)(unsafe.Pointer(&msg))[:])
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	cfg := MountConfig{OpContext: context.Background()}
+	c, err := newConnection(cfg, nil, nil, dev)
+	if err == nil {
+		defer c.close()
+	}
+
+	// Read the reply.
+	var reply struct {
+		header fusekernel.OutHeader
+		out    fusekernel.InitOut
+	}
+
+	buf := (*[unsafe.Sizeof(reply)]byte)(unsafe.Pointer(&reply))[:]
+	if _, readErr := kernelSide.Read(buf); readErr != nil {
+		t.Fatalf("Read: %v", readErr)
+	}
+
+	out = reply.header
+	library = ProtocolVersion{reply.out.Major, reply.out.Minor}
+	return
+}
+
+func TestProtocolVersion_Handshake(t *testing.T) {
+	older := ProtocolVersion{MinProtocolVersion.Major, MinProtocolVersion.Minor - 1}
+	newer := ProtocolVersion{MaxProtocolVersion.Major, MaxProtocolVersion.Minor + 1}
+
+	// A kernel older than the minimum is refused.
+	err, out, _ := initWithKernel(t, older)
+	if err == nil {
+		t.Errorf("Kernel %v: newConnection succeeded", older)
+	}
+
+	if out.Error != -int32(syscall.EPROTO) {
+		t.Errorf("Kernel %v: got error %d, want -EPROTO", older, out.Error)
+	}
+
+	// Anything from the minimum on is accepted, and spoken to using the older
+	// of its version and the maximum.
+	testCases := []struct {
+		kernel ProtocolVersion
+		want   ProtocolVersion
+	}{
+		{MinProtocolVersion, MinProtocolVersion},
+		{MaxProtocolVersion, MaxProtocolVersion},
+		{newer, MaxProtocolVersion},
+	}
+
+	for _, tc := range testCases {
+		err, out, library := initWithKernel(t, tc.kernel)
+		if err != nil {
+			t.Errorf("Kernel %v: newConnection: %v", tc.kernel, err)
+			continue
+		}
+
+		if out.Error != 0 {
+			t.Errorf("Kernel %v: got error %d", tc.kernel, out.Error)
+		}
+
+		if library != tc.want {
+			t.Errorf("Kernel %v: got version %v, want %v", tc.kernel, library, tc.want)
+		}
+	}
+}
+
+func TestFeatureMinVersion(t *testing.T) {
+	testCases := []struct {
+		feature Feature
+		want    ProtocolVersion
+	}{
+		{FeaturePosixLocks, ProtocolVersion{7, 7}},
+		{FeatureFlockLocks, ProtocolVersion{7, 17}},
+		{FeatureDontMask, ProtocolVersion{7, 12}},
+		{FeaturePoll, ProtocolVersion{7, 11}},
+		{FeatureInvalidate, ProtocolVersion{7, 12}},
+		{FeatureReadDirPlus, ProtocolVersion{7, 21}},
+		{FeatureAsyncDirectIO, ProtocolVersion{7, 22}},
+		{FeatureWritebackCache, ProtocolVersion{7, 23}},
+		{FeatureAbortError, ProtocolVersion{7, 27}},
+		{FeatureKillPrivileges, ProtocolVersion{7, 33}},
+	}
+
+	for _, tc := range testCases {
+		v, ok := FeatureMinVersion(tc.feature)
+		if !ok || v != tc.want {
+			t.Errorf("Feature %d: got (%v, %v), want %v", tc.feature, v, ok, tc.want)
+		}
+	}
+
+	if _, ok := FeatureMinVersion(Feature(-1)); ok {
+		t.Errorf("Unknown feature was found")
+	}
+}
+
+func TestFeatureMinVersion_Notifications(t *testing.T) {
+	// The versions must agree with the checks made when notifying.
+	testCases := []struct {
+		feature Feature
+		has     func(fusekernel.Protocol) bool
+	}{
+		{FeaturePoll, fusekernel.Protocol.HasPoll},
+		{FeatureInvalidate, fusekernel.Protocol.HasInvalidate},
+	}
+
+	for _, tc := range testCases {
+		v, _ := FeatureMinVersion(tc.feature)
+		before := fusekernel.Protocol{Major: v.Major, Minor: v.Minor - 1}
+
+		if !tc.has(fusekernel.Protocol(v)) || tc.has(before) {
+			t.Errorf("Feature %d: version %v disagrees with fusekernel", tc.feature, v)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+)
+
+// A server for an empty file system whose dispatch loop stalls briefly every
+// so often, as a real one might when contending for a lock or pausing for
+// garbage collection.
+type stallingServer struct {
+	stallEvery int
+	stall      time.Duration
+}
+
+func (s *stallingServer) ServeOps(c *fuse.Connection) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for i := 1; ; i++ {
+		ctx, op, err := c.ReadOp()
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		if i%s.stallEvery == 0 {
+			time.Sleep(s.stall)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Reply(ctx, s.handle(op))
+		}()
+	}
+}
+
+func (s *stallingServer) handle(op interface{}) (err error) {
+	switch typed := op.(type) {
+	case *fuseops.GetInodeAttributesOp:
+		typed.Attributes = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0777,
+		}
+
+	case *fuseops.StatFSOp:
+
+	default:
+		err = fuse.ENOSYS
+	}
+
+	return
+}
+
+// Stat the root of the file system from many goroutines at once, with
+// different read buffer depths.
+func BenchmarkReadBufferDepth(b *testing.B) {
+	for _, depth := range []int{0, 16, 64} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			benchmarkBurstyStat(b, depth)
+		})
+	}
+}
+
+func benchmarkBurstyStat(b *testing.B, depth int) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "read_buffer_test")
+	if err != nil {
+		b.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	server := &stallingServer{
+		stallEvery: 100,
+		stall:      time.Millisecond,
+	}
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		ReadBufferDepth: depth,
+	})
+
+	if err != nil {
+		b.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			b.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Each stat results in a GetInodeAttributesOp, since the file system
+	// doesn't allow attributes to be cached.
+	b.SetParallelism(16)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := os.Stat(dir); err != nil {
+				b.Errorf("Stat: %v", err)
+				return
+			}
+		}
+	})
+
+	b.StopTimer()
+}
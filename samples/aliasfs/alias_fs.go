@@ -0,0 +1,201 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aliasfs
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// Create a read-only file system consisting of a single directory containing
+// the supplied files, whose contents are given by the map values, and the
+// supplied aliases.
+//
+// An alias is a name that refers to another name in the directory, which may
+// itself be an alias. Unlike a symlink, an alias is resolved by the file
+// system: looking it up yields the inode of the file at the end of the chain,
+// so the kernel never sees the alias itself. Because of this the file system
+// has to detect cycles itself. Looking up an alias fails with ELOOP if
+// reaching a file takes more than maxDepth steps, and with ENOENT if the
+// chain ends at a name that doesn't exist.
+//
+// Only the files are listed by ReadDir.
+func NewAliasFS(
+	files map[string]string,
+	aliases map[string]string,
+	maxDepth int) fuse.Server {
+	fs := &aliasFS{
+		aliases:  aliases,
+		maxDepth: maxDepth,
+		inodes:   make(map[string]fuseops.InodeID),
+	}
+
+	// Assign inode IDs in name order.
+	for name := range files {
+		fs.names = append(fs.names, name)
+	}
+
+	sort.Strings(fs.names)
+
+	for i, name := range fs.names {
+		fs.inodes[name] = fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+		fs.contents = append(fs.contents, files[name])
+	}
+
+	return fuseutil.NewFileSystemServer(fs)
+}
+
+// All fields are immutable after construction.
+type aliasFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	aliases  map[string]string
+	maxDepth int
+
+	// The names of the files, in order, their contents, and the inode IDs
+	// assigned to them. The ith file has ID fuseops.RootInodeID + 1 + i.
+	names    []string
+	contents []string
+	inodes   map[string]fuseops.InodeID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the index of the file with the supplied inode ID.
+func (fs *aliasFS) index(id fuseops.InodeID) int {
+	return int(id - fuseops.RootInodeID - 1)
+}
+
+func (fs *aliasFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  os.ModeDir | 0555,
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  uint64(len(fs.contents[fs.index(id)])),
+	}
+}
+
+// Return the name that the supplied alias refers to, or ok == false if the
+// name isn't an alias.
+func (fs *aliasFS) resolveAlias(name string) (target string, ok bool, err error) {
+	target, ok = fs.aliases[name]
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *aliasFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *aliasFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Follow aliases to a file, giving up if there are too many of them.
+	name, err := fuseutil.FollowLinks(op.Name, fs.maxDepth, fs.resolveAlias)
+	if err != nil {
+		return
+	}
+
+	id, ok := fs.inodes[name]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.attributes(id)
+
+	return
+}
+
+func (fs *aliasFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *aliasFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	return
+}
+
+func (fs *aliasFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	for i := int(op.Offset); i < len(fs.names); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.inodes[fs.names[i]],
+			Name:   fs.names[i],
+			Type:   fuseutil.DT_File,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *aliasFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *aliasFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	reader := strings.NewReader(fs.contents[fs.index(op.Inode)])
+	op.BytesRead, err = reader.ReadAt(op.Dst, op.Offset)
+
+	// Special case: FUSE doesn't expect us to return io.EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aliasfs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/aliasfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestAliasFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const maxDepth = 5
+
+type AliasFSTest struct {
+	samples.SampleTest
+}
+
+func init() { RegisterTestSuite(&AliasFSTest{}) }
+
+func (t *AliasFSTest) SetUp(ti *TestInfo) {
+	aliases := map[string]string{
+		// A chain ending at a file.
+		"one": "two",
+		"two": "foo",
+
+		// A cycle.
+		"ping": "pong",
+		"pong": "ping",
+
+		// A loop of length one.
+		"self": "self",
+
+		// A chain that goes nowhere.
+		"dangling": "nonexistent",
+	}
+
+	// A chain of maxDepth aliases, which is just short enough, and one of
+	// maxDepth+1, which is just too long.
+	for i := 0; i < maxDepth; i++ {
+		aliases[fmt.Sprintf("short%d", i)] = fmt.Sprintf("short%d", i+1)
+		aliases[fmt.Sprintf("long%d", i)] = fmt.Sprintf("long%d", i+1)
+	}
+
+	aliases[fmt.Sprintf("short%d", maxDepth-1)] = "foo"
+	aliases[fmt.Sprintf("long%d", maxDepth)] = "foo"
+
+	t.Server = aliasfs.NewAliasFS(
+		map[string]string{"foo": "taco", "bar": "burrito"},
+		aliases,
+		maxDepth)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *AliasFSTest) expectErrno(name string, expected syscall.Errno) {
+	_, err := os.Stat(path.Join(t.Dir, name))
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "%s: unexpected error: %v", name, err)
+	ExpectEq(expected, pathErr.Err, "%s", name)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AliasFSTest) ReadDir() {
+	entries, err := ioutil.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+
+	ExpectEq("bar", entries[0].Name())
+	ExpectEq("foo", entries[1].Name())
+}
+
+func (t *AliasFSTest) Chain() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "one"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// The alias names the file's own inode.
+	fi, err := os.Stat(path.Join(t.Dir, "one"))
+	AssertEq(nil, err)
+
+	foo, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	ExpectTrue(os.SameFile(fi, foo))
+}
+
+func (t *AliasFSTest) Cycle() {
+	t.expectErrno("ping", syscall.ELOOP)
+	t.expectErrno("pong", syscall.ELOOP)
+	t.expectErrno("self", syscall.ELOOP)
+}
+
+func (t *AliasFSTest) MaxDepth() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "short0"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	t.expectErrno("long0", syscall.ELOOP)
+}
+
+func (t *AliasFSTest) Dangling() {
+	t.expectErrno("dangling", syscall.ENOENT)
+}
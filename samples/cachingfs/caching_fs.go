@@ -48,7 +48,8 @@ const (
 //
 // Each file responds to reads with random contents. SetKeepCache can be used
 // to control whether the response to OpenFileOp tells the kernel to keep the
-// file's data in the page cache or not.
+// file's data in the page cache or not, and SetDirectIO whether to bypass the
+// page cache altogether.
 type CachingFS interface {
 	fuseutil.FileSystem
 
@@ -67,6 +68,10 @@ type CachingFS interface {
 	// Instruct the file system whether or not to reply to OpenFileOp with
 	// FOPEN_KEEP_CACHE set.
 	SetKeepCache(keep bool)
+
+	// Instruct the file system whether or not to reply to OpenFileOp with
+	// FOPEN_DIRECT_IO set.
+	SetDirectIO(direct bool)
 }
 
 // Create a file system that issues cacheable responses according to the
@@ -129,6 +134,9 @@ type cachingFS struct {
 	// GUARDED_BY(mu)
 	keepPageCache bool
 
+	// GUARDED_BY(mu)
+	useDirectIO bool
+
 	// The current ID of the lowest numbered non-root inode.
 	//
 	// INVARIANT: baseID > fuseops.RootInodeID
@@ -257,6 +265,14 @@ func (fs *cachingFS) SetKeepCache(keep bool) {
 	fs.keepPageCache = keep
 }
 
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFS) SetDirectIO(direct bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.useDirectIO = direct
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
@@ -366,6 +382,7 @@ func (fs *cachingFS) OpenFile(
 	defer fs.mu.Unlock()
 
 	op.KeepPageCache = fs.keepPageCache
+	op.UseDirectIO = fs.useDirectIO
 
 	return
 }
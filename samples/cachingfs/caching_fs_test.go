@@ -723,3 +723,61 @@ func (t *PageCacheTest) TwoFileHandles_KeepCache() {
 
 	ExpectTrue(bytes.Equal(c1, c3))
 }
+
+func (t *PageCacheTest) SingleFileHandle_DirectIO() {
+	t.fs.SetDirectIO(true)
+
+	// Open the file.
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	defer f.Close()
+
+	// Read its contents once.
+	c1 := make([]byte, cachingfs.FooSize)
+	_, err = f.ReadAt(c1, 0)
+	AssertEq(nil, err)
+
+	// And again.
+	c2 := make([]byte, cachingfs.FooSize)
+	_, err = f.ReadAt(c2, 0)
+	AssertEq(nil, err)
+
+	// Both reads should have reached the file system, which returns random
+	// contents each time.
+	ExpectFalse(bytes.Equal(c1, c2))
+}
+
+func (t *PageCacheTest) DirectIOAndCachedHandles() {
+	// Open the file once with the page cache.
+	f1, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	defer f1.Close()
+
+	// And once bypassing it.
+	t.fs.SetDirectIO(true)
+
+	f2, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	defer f2.Close()
+
+	// Reads through the first handle are served from the page cache.
+	c1 := make([]byte, cachingfs.FooSize)
+	_, err = f1.ReadAt(c1, 0)
+	AssertEq(nil, err)
+
+	c2 := make([]byte, cachingfs.FooSize)
+	_, err = f1.ReadAt(c2, 0)
+	AssertEq(nil, err)
+
+	ExpectTrue(bytes.Equal(c1, c2))
+
+	// Reads through the second reach the file system.
+	c3 := make([]byte, cachingfs.FooSize)
+	_, err = f2.ReadAt(c3, 0)
+	AssertEq(nil, err)
+
+	ExpectFalse(bytes.Equal(c1, c3))
+}
@@ -0,0 +1,739 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedupfs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/jacobsa/syncutil"
+)
+
+// Create a file system consisting of a single directory of regular files,
+// kept in memory, in which files with identical contents are stored only once.
+//
+// Once a file has been written and the last handle open on it is flushed or
+// released, its contents are hashed. If some other inode already has the same
+// contents, every name that referred to the file is relinked to that inode, as
+// if with link(2), so that the names share an inode and its link count goes
+// up. The now unreferenced inode is freed once the kernel forgets it.
+//
+// Names that share an inode behave as hard links do: writing to the file
+// through one of them changes what all of them see, since the kernel never
+// tells the file system which name a file was opened through. The way to
+// change the contents behind one name only is to write a new file and rename
+// it over the old one, as editors and tools like `sed -i` do. That leaves the
+// other names with the old inode, with its link count reduced accordingly;
+// the new file is itself deduplicated when it is closed.
+//
+// Subdirectories, symlinks, and special files aren't supported.
+func NewDedupFS(uid uint32, gid uint32) (fs *DedupFS) {
+	impl := &dedupFS{
+		uid:         uid,
+		gid:         gid,
+		names:       make(map[string]fuseops.InodeID),
+		inodes:      make(map[fuseops.InodeID]*inode),
+		byHash:      make(map[[sha256.Size]byte]fuseops.InodeID),
+		handles:     make(map[fuseops.HandleID]fuseops.InodeID),
+		nextInodeID: fuseops.RootInodeID + 1,
+	}
+
+	impl.mu = syncutil.NewInvariantMutex(impl.checkInvariants)
+
+	fs = &DedupFS{
+		impl:   impl,
+		server: fuseutil.NewFileSystemServer(impl),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// DedupFS
+////////////////////////////////////////////////////////////////////////
+
+type DedupFS struct {
+	impl   *dedupFS
+	server fuse.Server
+}
+
+func (fs *DedupFS) ServeOps(c *fuse.Connection) {
+	fs.impl.mu.Lock()
+	fs.impl.conn = c
+	fs.impl.mu.Unlock()
+
+	fs.server.ServeOps(c)
+}
+
+// Return the number of file inodes currently allocated, including those that
+// have been unlinked or deduplicated away but not yet forgotten by the
+// kernel. After unmounting, this is the number of distinct contents stored.
+func (fs *DedupFS) InodeCount() int {
+	fs.impl.mu.Lock()
+	defer fs.impl.mu.Unlock()
+
+	return len(fs.impl.inodes)
+}
+
+////////////////////////////////////////////////////////////////////////
+// inode
+////////////////////////////////////////////////////////////////////////
+
+type inode struct {
+	attrs    fuseops.InodeAttributes
+	contents []byte
+
+	// The number of outstanding lookups by the kernel.
+	lookupCount uint64
+
+	// The number of open file handles.
+	openHandles int
+
+	// Whether the contents have changed since they were last hashed. An inode
+	// that isn't dirty and has a non-zero link count is in byHash under the
+	// hash of its contents.
+	dirty bool
+	hash  [sha256.Size]byte
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type dedupFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The owner of the root directory and every file.
+	uid uint32
+	gid uint32
+
+	mu syncutil.InvariantMutex
+
+	// The connection on which we're serving, for invalidating the kernel's
+	// cached entries for names that we relink.
+	//
+	// GUARDED_BY(mu)
+	conn *fuse.Connection
+
+	// The contents of the root directory.
+	//
+	// INVARIANT: For each v, inodes[v] != nil
+	//
+	// GUARDED_BY(mu)
+	names map[string]fuseops.InodeID
+
+	// Every allocated file inode. The root isn't included.
+	//
+	// INVARIANT: For each v, v.attrs.Nlink is the number of names referring to
+	// it
+	// INVARIANT: For each k, k < nextInodeID
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inode
+
+	// An index of linked, clean inodes by the hash of their contents.
+	//
+	// INVARIANT: For each k and v, !inodes[v].dirty && inodes[v].hash == k
+	// INVARIANT: For each k and v, inodes[v].attrs.Nlink > 0
+	//
+	// GUARDED_BY(mu)
+	byHash map[[sha256.Size]byte]fuseops.InodeID
+
+	// The inode for which each file handle was opened.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	nextInodeID  fuseops.InodeID
+	nextHandleID fuseops.HandleID
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) checkInvariants() {
+	// INVARIANT: For each v, inodes[v] != nil
+	links := make(map[fuseops.InodeID]uint32)
+	for name, id := range fs.names {
+		if fs.inodes[id] == nil {
+			panic(fmt.Sprintf("Name %q refers to unknown inode %v", name, id))
+		}
+
+		links[id]++
+	}
+
+	for id, in := range fs.inodes {
+		// INVARIANT: For each v, v.attrs.Nlink is the number of names referring
+		// to it
+		if in.attrs.Nlink != links[id] {
+			panic(fmt.Sprintf(
+				"Inode %v has link count %d but %d names",
+				id,
+				in.attrs.Nlink,
+				links[id]))
+		}
+
+		// INVARIANT: For each k, k < nextInodeID
+		if !(id < fs.nextInodeID) {
+			panic(fmt.Sprintf("Unexpectedly large inode ID: %v", id))
+		}
+	}
+
+	for h, id := range fs.byHash {
+		in := fs.inodes[id]
+
+		// INVARIANT: For each k and v, !inodes[v].dirty && inodes[v].hash == k
+		if in == nil || in.dirty || in.hash != h {
+			panic(fmt.Sprintf("Stale hash index entry for inode %v", id))
+		}
+
+		// INVARIANT: For each k and v, inodes[v].attrs.Nlink > 0
+		if in.attrs.Nlink == 0 {
+			panic(fmt.Sprintf("Unlinked inode %v in hash index", id))
+		}
+	}
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) getInodeOrDie(id fuseops.InodeID) (in *inode) {
+	in = fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) rootAttributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: 2,
+		Mode:  os.ModeDir | 0777,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	}
+}
+
+// Fill in an entry for the supplied inode, which the kernel will hold a
+// reference to.
+//
+// We allow no caching of entries or attributes, since relinking changes both
+// behind the kernel's back.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) fillEntry(
+	id fuseops.InodeID,
+	e *fuseops.ChildInodeEntry) {
+	in := fs.getInodeOrDie(id)
+	in.lookupCount++
+
+	e.Child = id
+	e.Attributes = in.attrs
+}
+
+// Note that the contents of the inode are changing.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) markDirty(id fuseops.InodeID, in *inode) {
+	if !in.dirty && fs.byHash[in.hash] == id {
+		delete(fs.byHash, in.hash)
+	}
+
+	in.dirty = true
+	in.attrs.Mtime = time.Now()
+	in.attrs.Ctime = in.attrs.Mtime
+}
+
+// Remove a name from the directory, freeing its inode if nothing else refers
+// to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) unlink(name string) {
+	id := fs.names[name]
+	in := fs.getInodeOrDie(id)
+
+	delete(fs.names, name)
+	in.attrs.Nlink--
+
+	if in.attrs.Nlink == 0 && !in.dirty && fs.byHash[in.hash] == id {
+		delete(fs.byHash, in.hash)
+	}
+
+	fs.maybeFree(id, in)
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) maybeFree(id fuseops.InodeID, in *inode) {
+	if in.attrs.Nlink == 0 && in.lookupCount == 0 && in.openHandles == 0 {
+		delete(fs.inodes, id)
+	}
+}
+
+// If the supplied inode's contents have changed, hash them and relink its
+// names to an existing inode with the same contents, if any. Return the names
+// that were relinked, for which the kernel's cached entries must be
+// invalidated once fs.mu is released.
+//
+// The caller must ensure that nobody else has a handle open on the inode, as
+// they could otherwise go on modifying it after we've hashed it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *dedupFS) dedup(id fuseops.InodeID) (relinked []string) {
+	in := fs.getInodeOrDie(id)
+	if !in.dirty {
+		return
+	}
+
+	in.dirty = false
+	in.hash = sha256.Sum256(in.contents)
+
+	// Unlinked inodes aren't worth indexing.
+	if in.attrs.Nlink == 0 {
+		return
+	}
+
+	// If these contents are new, remember them.
+	existingID, ok := fs.byHash[in.hash]
+	if !ok {
+		fs.byHash[in.hash] = id
+		return
+	}
+
+	// Otherwise move each of our names to the existing inode.
+	existing := fs.getInodeOrDie(existingID)
+	for name, target := range fs.names {
+		if target != id {
+			continue
+		}
+
+		fs.names[name] = existingID
+		existing.attrs.Nlink++
+		in.attrs.Nlink--
+		relinked = append(relinked, name)
+	}
+
+	existing.attrs.Ctime = time.Now()
+	fs.maybeFree(id, in)
+
+	return
+}
+
+// Tell the kernel to forget what it knows about the supplied names.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *dedupFS) invalidate(conn *fuse.Connection, names []string) {
+	for _, name := range names {
+		// ENOENT just means the kernel had nothing cached.
+		_ = conn.InvalidateEntry(fuseops.RootInodeID, name)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *dedupFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *dedupFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	id, ok := fs.names[op.Name]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	fs.fillEntry(id, &op.Entry)
+	return
+}
+
+func (fs *dedupFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode == fuseops.RootInodeID {
+		op.Attributes = fs.rootAttributes()
+		return
+	}
+
+	op.Attributes = fs.getInodeOrDie(op.Inode).attrs
+	return
+}
+
+func (fs *dedupFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode == fuseops.RootInodeID {
+		err = fuse.ENOSYS
+		return
+	}
+
+	in := fs.getInodeOrDie(op.Inode)
+
+	if op.Size != nil {
+		fs.markDirty(op.Inode, in)
+
+		newSize := int(*op.Size)
+		if newSize <= len(in.contents) {
+			in.contents = in.contents[:newSize]
+		} else {
+			in.contents = append(
+				in.contents,
+				make([]byte, newSize-len(in.contents))...)
+		}
+
+		in.attrs.Size = uint64(newSize)
+	}
+
+	if op.Mode != nil {
+		in.attrs.Mode = *op.Mode
+	}
+
+	if op.Atime != nil {
+		in.attrs.Atime = *op.Atime
+	}
+
+	if op.Mtime != nil {
+		in.attrs.Mtime = *op.Mtime
+	}
+
+	op.Attributes = in.attrs
+	return
+}
+
+func (fs *dedupFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Inode == fuseops.RootInodeID {
+		return
+	}
+
+	in := fs.getInodeOrDie(op.Inode)
+	if in.lookupCount < op.N {
+		panic(fmt.Sprintf(
+			"Overly large decrement for inode %v: %v, %v",
+			op.Inode,
+			in.lookupCount,
+			op.N))
+	}
+
+	in.lookupCount -= op.N
+	fs.maybeFree(op.Inode, in)
+
+	return
+}
+
+func (fs *dedupFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	if _, ok := fs.names[op.Name]; ok {
+		err = fuse.EEXIST
+		return
+	}
+
+	// Allocate an inode. It starts out dirty, so that it is indexed once it is
+	// closed.
+	now := time.Now()
+	id := fs.nextInodeID
+	fs.nextInodeID++
+
+	fs.inodes[id] = &inode{
+		attrs: fuseops.InodeAttributes{
+			Nlink:  1,
+			Mode:   op.Mode,
+			Atime:  now,
+			Mtime:  now,
+			Ctime:  now,
+			Crtime: now,
+			Uid:    fs.uid,
+			Gid:    fs.gid,
+		},
+		openHandles: 1,
+		dirty:       true,
+	}
+
+	fs.names[op.Name] = id
+	fs.fillEntry(id, &op.Entry)
+
+	// Mint a handle.
+	op.Handle = fs.nextHandleID
+	fs.nextHandleID++
+	fs.handles[op.Handle] = id
+
+	return
+}
+
+func (fs *dedupFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	if _, ok := fs.names[op.Name]; ok {
+		err = fuse.EEXIST
+		return
+	}
+
+	in := fs.getInodeOrDie(op.Target)
+	in.attrs.Nlink++
+	in.attrs.Ctime = time.Now()
+
+	fs.names[op.Name] = op.Target
+	fs.fillEntry(op.Target, &op.Entry)
+
+	return
+}
+
+func (fs *dedupFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.OldParent != fuseops.RootInodeID ||
+		op.NewParent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	id, ok := fs.names[op.OldName]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Replace the target, if any. This is how the contents behind one of
+	// several names sharing an inode are changed. If the names already refer to
+	// the same inode, POSIX says to do nothing.
+	if target, ok := fs.names[op.NewName]; ok {
+		if target == id {
+			return
+		}
+
+		fs.unlink(op.NewName)
+	}
+
+	delete(fs.names, op.OldName)
+	fs.names[op.NewName] = id
+
+	return
+}
+
+func (fs *dedupFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	if _, ok := fs.names[op.Name]; !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	fs.unlink(op.Name)
+	return
+}
+
+func (fs *dedupFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if op.Inode != fuseops.RootInodeID {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	return
+}
+
+func (fs *dedupFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Serve entries in name order, so that offsets are stable as long as the
+	// directory isn't modified.
+	var names []string
+	for name := range fs.names {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for i := int(op.Offset); i < len(names); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fs.names[names[i]],
+			Name:   names[i],
+			Type:   fuseutil.DT_File,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *dedupFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+	in.openHandles++
+
+	op.Handle = fs.nextHandleID
+	fs.nextHandleID++
+	fs.handles[op.Handle] = op.Inode
+
+	return
+}
+
+func (fs *dedupFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+	if op.Offset > int64(len(in.contents)) {
+		return
+	}
+
+	op.BytesRead = copy(op.Dst, in.contents[op.Offset:])
+	return
+}
+
+func (fs *dedupFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+	fs.markDirty(op.Inode, in)
+
+	newLen := int(op.Offset) + len(op.Data)
+	if len(in.contents) < newLen {
+		in.contents = append(
+			in.contents,
+			make([]byte, newLen-len(in.contents))...)
+
+		in.attrs.Size = uint64(newLen)
+	}
+
+	copy(in.contents[op.Offset:], op.Data)
+	return
+}
+
+func (fs *dedupFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	fs.mu.Lock()
+
+	// close(2) doesn't wait for the handle to be released, so deduplicate here
+	// if this is the only handle open, in order that the result is visible
+	// as soon as close returns.
+	var relinked []string
+	if fs.getInodeOrDie(op.Inode).openHandles == 1 {
+		relinked = fs.dedup(op.Inode)
+	}
+
+	conn := fs.conn
+	fs.mu.Unlock()
+
+	fs.invalidate(conn, relinked)
+	return
+}
+
+func (fs *dedupFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.mu.Lock()
+
+	id, ok := fs.handles[op.Handle]
+	if !ok {
+		fs.mu.Unlock()
+		panic(fmt.Sprintf("Unknown handle: %v", op.Handle))
+	}
+
+	delete(fs.handles, op.Handle)
+
+	in := fs.getInodeOrDie(id)
+	in.openHandles--
+
+	var relinked []string
+	if in.openHandles == 0 {
+		relinked = fs.dedup(id)
+	}
+
+	fs.maybeFree(id, in)
+
+	conn := fs.conn
+	fs.mu.Unlock()
+
+	fs.invalidate(conn, relinked)
+	return
+}
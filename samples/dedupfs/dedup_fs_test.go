@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dedupfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/dedupfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDedupFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DedupFSTest struct {
+	samples.SampleTest
+	fs *dedupfs.DedupFS
+
+	// The number of inodes we expect to remain after unmounting.
+	expectedInodes int
+}
+
+func init() { RegisterTestSuite(&DedupFSTest{}) }
+
+func (t *DedupFSTest) SetUp(ti *TestInfo) {
+	t.fs = dedupfs.NewDedupFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	t.Server = t.fs
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *DedupFSTest) TearDown() {
+	// Unmount, after which the kernel has forgotten everything.
+	t.SampleTest.TearDown()
+
+	// Only inodes with names should be left.
+	ExpectEq(t.expectedInodes, t.fs.InodeCount())
+}
+
+func (t *DedupFSTest) stat(name string) (st *syscall.Stat_t) {
+	fi, err := os.Stat(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+
+	st = fi.Sys().(*syscall.Stat_t)
+	return
+}
+
+func (t *DedupFSTest) contents(name string) string {
+	b, err := ioutil.ReadFile(path.Join(t.Dir, name))
+	AssertEq(nil, err)
+
+	return string(b)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DedupFSTest) DifferentContents() {
+	var err error
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "b"), []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	a := t.stat("a")
+	b := t.stat("b")
+	ExpectNe(a.Ino, b.Ino)
+	ExpectEq(1, a.Nlink)
+	ExpectEq(1, b.Nlink)
+
+	t.expectedInodes = 2
+}
+
+func (t *DedupFSTest) IdenticalContentsShareInode() {
+	var err error
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "b"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "c"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	a := t.stat("a")
+	b := t.stat("b")
+	c := t.stat("c")
+	ExpectEq(a.Ino, b.Ino)
+	ExpectEq(a.Ino, c.Ino)
+	ExpectEq(3, a.Nlink)
+
+	ExpectEq("taco", t.contents("a"))
+	ExpectEq("taco", t.contents("b"))
+	ExpectEq("taco", t.contents("c"))
+
+	// The inodes that were deduplicated away are freed once forgotten.
+	t.expectedInodes = 1
+}
+
+func (t *DedupFSTest) ReplacingOneNameDiverges() {
+	var err error
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "b"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	shared := t.stat("a")
+	AssertEq(shared.Ino, t.stat("b").Ino)
+	AssertEq(2, shared.Nlink)
+
+	// Write new contents for b and rename them into place.
+	err = ioutil.WriteFile(path.Join(t.Dir, "b.tmp"), []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "b.tmp"), path.Join(t.Dir, "b"))
+	AssertEq(nil, err)
+
+	// a keeps the original inode, which has lost a link, and b has a new one.
+	a := t.stat("a")
+	b := t.stat("b")
+	ExpectEq(shared.Ino, a.Ino)
+	ExpectNe(a.Ino, b.Ino)
+	ExpectEq(1, a.Nlink)
+	ExpectEq(1, b.Nlink)
+
+	ExpectEq("taco", t.contents("a"))
+	ExpectEq("burrito", t.contents("b"))
+
+	// Making the contents identical again shares the inode again.
+	err = ioutil.WriteFile(path.Join(t.Dir, "b.tmp"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "b.tmp"), path.Join(t.Dir, "b"))
+	AssertEq(nil, err)
+
+	ExpectEq(shared.Ino, t.stat("b").Ino)
+	ExpectEq(2, t.stat("a").Nlink)
+
+	t.expectedInodes = 1
+}
+
+func (t *DedupFSTest) WritingThroughSharedInodeAffectsAllNames() {
+	var err error
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "b"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Modify the file in place, as with any hard link.
+	f, err := os.OpenFile(path.Join(t.Dir, "a"), os.O_WRONLY, 0)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("T"), 0)
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	ExpectEq("Taco", t.contents("a"))
+	ExpectEq("Taco", t.contents("b"))
+	ExpectEq(2, t.stat("b").Nlink)
+
+	t.expectedInodes = 1
+}
+
+func (t *DedupFSTest) UnlinkedInodesAreFreed() {
+	var err error
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "a"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "b"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Remove(path.Join(t.Dir, "a"))
+	AssertEq(nil, err)
+
+	ExpectEq(1, t.stat("b").Nlink)
+
+	err = os.Remove(path.Join(t.Dir, "b"))
+	AssertEq(nil, err)
+
+	t.expectedInodes = 0
+}
@@ -34,6 +34,9 @@ import (
 // This implementation depends on direct IO in fuse. Without it, all read
 // operations are suppressed because the kernel detects that they read beyond
 // the end of the files.
+//
+// The `weekday` file is additionally presented as a non-seekable stream, as a
+// file whose contents are produced by a pipe or device would be.
 func NewDynamicFS(clock timeutil.Clock) (server fuse.Server, err error) {
 	createTime := clock.Now()
 	fs := &dynamicFS{
@@ -240,6 +243,7 @@ func (fs *dynamicFS) OpenFile(
 	handle := fs.findUnusedHandle()
 	fs.fileHandles[handle] = contents
 	op.UseDirectIO = true
+	op.NonSeekable = op.Inode == weekdayInode
 	op.Handle = handle
 	return
 }
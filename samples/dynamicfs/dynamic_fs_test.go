@@ -9,9 +9,11 @@ import (
 
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"syscall"
 	"time"
 
@@ -129,6 +131,42 @@ func (t *DynamicFSTest) ReadFile_WeekdayCreateTime() {
 	ExpectEq(fmt.Sprintf("Today is %s.", gCreateTime.Weekday().String()), string(slice))
 }
 
+func (t *DynamicFSTest) ReadFile_WeekdayIsStream() {
+	// OS X doesn't support non-seekable files.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	t.Clock.SetTime(gCreateTime)
+	f, err := os.Open(path.Join(t.Dir, "weekday"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	// Seeking and positional reads are refused.
+	_, err = f.Seek(0, 0)
+	ExpectThat(err, Error(HasSubstr("illegal seek")))
+
+	buf := make([]byte, 4)
+	_, err = f.ReadAt(buf, 0)
+	ExpectThat(err, Error(HasSubstr("illegal seek")))
+
+	// Sequential reads work through to EOF.
+	var contents bytes.Buffer
+	for {
+		n, err := f.Read(buf)
+		contents.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+
+		AssertEq(nil, err)
+	}
+
+	ExpectEq(
+		fmt.Sprintf("Today is %s.", gCreateTime.Weekday().String()),
+		contents.String())
+}
+
 func (t *DynamicFSTest) ReadFile_AgeUnchangedForHandle() {
 	t.Clock.SetTime(gCreateTime.Add(100 * time.Second))
 	var err error
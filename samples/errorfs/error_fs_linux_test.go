@@ -0,0 +1,50 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errorfs_test
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/samples/errorfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func (t *ErrorFSTest) OPathDoesntOpen() {
+	// Have the file system refuse to open the file, as it would if the caller
+	// didn't have permission to read it.
+	t.fs.SetError(reflect.TypeOf(&fuseops.OpenFileOp{}), syscall.EACCES)
+
+	// An ordinary open fails.
+	_, err := os.Open(path.Join(t.Dir, "foo"))
+	AssertNe(nil, err)
+	ExpectEq(syscall.EACCES, err.(*os.PathError).Err)
+
+	// But O_PATH doesn't need the file system to open anything.
+	fd, err := unix.Open(path.Join(t.Dir, "foo"), unix.O_PATH, 0)
+	AssertEq(nil, err)
+	defer unix.Close(fd)
+
+	// The descriptor can be used to stat the file.
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	AssertEq(nil, err)
+	ExpectEq(len(errorfs.FooContents), stat.Size)
+}
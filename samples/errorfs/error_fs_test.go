@@ -15,13 +15,18 @@
 package errorfs_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"runtime"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/sbg/fuse"
 	"github.com/sbg/fuse/fuseops"
 	"github.com/sbg/fuse/fuseutil"
 	"github.com/sbg/fuse/samples"
@@ -104,3 +109,116 @@ func (t *ErrorFSTest) ReadDir() {
 	_, err = f.Readdirnames(1)
 	ExpectThat(err, Error(MatchesRegexp("read.*: .*owner died")))
 }
+
+////////////////////////////////////////////////////////////////////////
+// OnOpError
+////////////////////////////////////////////////////////////////////////
+
+type OnOpErrorTest struct {
+	samples.SampleTest
+	fs errorfs.FS
+
+	mu     sync.Mutex
+	errors []fuse.OpErrorInfo // GUARDED_BY(mu)
+}
+
+func init() { RegisterTestSuite(&OnOpErrorTest{}) }
+
+var _ SetUpInterface = &OnOpErrorTest{}
+var _ TearDownInterface = &OnOpErrorTest{}
+
+func (t *OnOpErrorTest) SetUp(ti *TestInfo) {
+	var err error
+
+	// Create the file system.
+	t.fs, err = errorfs.New()
+	AssertEq(nil, err)
+
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+
+	// Record errors.
+	t.MountConfig.OnOpError = func(info fuse.OpErrorInfo) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.errors = append(t.errors, info)
+	}
+
+	// Mount it.
+	t.SampleTest.SetUp(ti)
+}
+
+// Return the recorded errors for ops of the given type. The callback runs
+// after the reply has been sent, so it may not yet have been called when the
+// system call that caused the error returns; wait a little while for at least
+// one error.
+func (t *OnOpErrorTest) errorsFor(op string) (infos []fuse.OpErrorInfo) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		t.mu.Lock()
+		for _, info := range t.errors {
+			if info.Op == op {
+				infos = append(infos, info)
+			}
+		}
+		t.mu.Unlock()
+
+		if len(infos) > 0 || time.Now().After(deadline) {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Check that the supplied info identifies this process as the caller.
+func (t *OnOpErrorTest) checkCaller(info fuse.OpErrorInfo) {
+	ExpectEq(os.Getuid(), info.Uid)
+	ExpectEq(os.Getgid(), info.Gid)
+
+	// On Linux the kernel reports the calling thread.
+	if runtime.GOOS == "linux" {
+		_, err := os.Stat(fmt.Sprintf("/proc/self/task/%d", info.Pid))
+		ExpectEq(nil, err)
+	} else {
+		ExpectEq(os.Getpid(), info.Pid)
+	}
+}
+
+func (t *OnOpErrorTest) PermissionDenied() {
+	t.fs.SetError(reflect.TypeOf(&fuseops.OpenFileOp{}), syscall.EACCES)
+
+	// Find the file's inode ID.
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	inode := fuseops.InodeID(fi.Sys().(*syscall.Stat_t).Ino)
+
+	// Attempt to open it.
+	_, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertNe(nil, err)
+
+	// The callback should have heard about it.
+	infos := t.errorsFor("OpenFileOp")
+	AssertEq(1, len(infos))
+	info := infos[0]
+
+	ExpectEq(inode, info.Inode)
+	ExpectEq("", info.Name)
+	ExpectEq(syscall.EACCES, info.Err)
+	ExpectEq(syscall.EACCES, info.Errno)
+	t.checkCaller(info)
+}
+
+func (t *OnOpErrorTest) NonexistentName() {
+	_, err := os.Stat(path.Join(t.Dir, "bar"))
+	AssertTrue(os.IsNotExist(err), "err: %v", err)
+
+	infos := t.errorsFor("LookUpInodeOp")
+	AssertEq(1, len(infos))
+	info := infos[0]
+
+	ExpectEq(fuseops.RootInodeID, info.Inode)
+	ExpectEq("bar", info.Name)
+	ExpectEq(syscall.ENOENT, info.Errno)
+	t.checkCaller(info)
+}
@@ -41,6 +41,10 @@ func init() { RegisterTestSuite(&ForgetFSTest{}) }
 func (t *ForgetFSTest) SetUp(ti *TestInfo) {
 	t.fs = forgetfs.NewFileSystem()
 	t.Server = t.fs
+
+	// Have the library check the kernel's accounting as well as the file
+	// system's.
+	t.MountConfig.CheckLookupCounts = true
 	t.SampleTest.SetUp(ti)
 }
 
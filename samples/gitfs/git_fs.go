@@ -0,0 +1,584 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// Create a read-only file system presenting the tree of the commit that ref
+// names in the git repository at repoDir, as checked out, with every inode
+// modified at the time of the commit.
+//
+// Objects are read from the repository lazily using the git command, which
+// must be on the PATH: a directory's tree when it is first looked in, and a
+// file's blob when it is first read. Git's modes are presented as follows:
+//
+//     040000 (tree)          directory, 0555
+//     100644 (regular file)  file, 0444
+//     100755 (executable)    file, 0555
+//     120000 (symlink)       symlink whose target is the blob's contents
+//     160000 (submodule)     empty directory, 0555
+//
+// Because objects are immutable, the file system keeps everything it has read
+// for as long as it is mounted.
+func NewGitFS(repoDir string, ref string) (server fuse.Server, err error) {
+	fs := &gitFS{
+		repoDir:  repoDir,
+		inodes:   make(map[fuseops.InodeID]*inode),
+		children: make(map[childKey]fuseops.InodeID),
+		trees:    make(map[string][]treeEntry),
+		blobs:    make(map[string][]byte),
+	}
+
+	// Resolve the ref to the commit's tree and time.
+	out, err := fs.git("show", "-s", "--format=%T %ct", ref+"^{commit}", "--")
+	if err != nil {
+		return
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		err = fmt.Errorf("Unexpected commit description: %q", out)
+		return
+	}
+
+	secs, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		err = fmt.Errorf("ParseInt: %v", err)
+		return
+	}
+
+	fs.mtime = time.Unix(secs, 0)
+	fs.inodes[fuseops.RootInodeID] = &inode{
+		entry: treeEntry{
+			mode: modeTree,
+			hash: fields[0],
+		},
+	}
+
+	fs.nextInode = fuseops.RootInodeID + 1
+	server = fuseutil.NewFileSystemServer(fs)
+	return
+}
+
+// Git's modes for tree entries.
+const (
+	modeTree       = 0040000
+	modeFile       = 0100644
+	modeExecutable = 0100755
+	modeSymlink    = 0120000
+	modeSubmodule  = 0160000
+)
+
+// The inode number reported by readdir(3) for entries not yet looked up, as
+// with libfuse's FUSE_UNKNOWN_INO.
+const unknownInode fuseops.InodeID = 0xffffffff
+
+// An entry in a git tree object.
+type treeEntry struct {
+	name string
+	mode uint32
+	hash string
+
+	// The size of the object, for blobs.
+	size uint64
+}
+
+type inode struct {
+	entry treeEntry
+
+	// The number of lookups of the inode not yet forgotten by the kernel. The
+	// root is never forgotten.
+	lookupCount uint64
+
+	// The inode's key in gitFS.children, for all but the root.
+	key childKey
+}
+
+type childKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+type gitFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	repoDir string
+	mtime   time.Time
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The inodes the kernel knows about, and the inodes of the children it
+	// has looked up by parent and name.
+	//
+	// GUARDED_BY(mu)
+	inodes    map[fuseops.InodeID]*inode
+	children  map[childKey]fuseops.InodeID
+	nextInode fuseops.InodeID
+
+	// The trees and blobs read so far, by hash.
+	//
+	// GUARDED_BY(mu)
+	trees map[string][]treeEntry
+	blobs map[string][]byte
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Run git in the repository with the supplied arguments, returning its
+// standard output.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *gitFS) git(args ...string) (out []byte, err error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", fs.repoDir}, args...)...)
+	cmd.Stderr = &stderr
+
+	out, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf(
+			"git %s: %v (stderr: %q)",
+			strings.Join(args, " "),
+			err,
+			stderr.String())
+		return
+	}
+
+	return
+}
+
+// Parse the output of git ls-tree -l -z, in which each entry looks like
+//
+//     <mode> SP <type> SP <hash> SP+ <size> TAB <name> NUL
+//
+// with a size of "-" for objects other than blobs.
+func parseTree(out []byte) (entries []treeEntry, err error) {
+	for _, line := range strings.Split(string(out), "\x00") {
+		if line == "" {
+			continue
+		}
+
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			err = fmt.Errorf("Malformed tree entry: %q", line)
+			return
+		}
+
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 4 {
+			err = fmt.Errorf("Malformed tree entry: %q", line)
+			return
+		}
+
+		var mode uint64
+		mode, err = strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			err = fmt.Errorf("Malformed mode in tree entry %q: %v", line, err)
+			return
+		}
+
+		e := treeEntry{
+			name: line[tab+1:],
+			mode: uint32(mode),
+			hash: fields[2],
+		}
+
+		if fields[3] != "-" {
+			e.size, err = strconv.ParseUint(fields[3], 10, 64)
+			if err != nil {
+				err = fmt.Errorf("Malformed size in tree entry %q: %v", line, err)
+				return
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+// Return the entries of the tree with the supplied hash, reading it if
+// necessary.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *gitFS) readTree(hash string) (entries []treeEntry, err error) {
+	fs.mu.Lock()
+	entries, ok := fs.trees[hash]
+	fs.mu.Unlock()
+
+	if ok {
+		return
+	}
+
+	out, err := fs.git("ls-tree", "-l", "-z", hash)
+	if err != nil {
+		return
+	}
+
+	entries, err = parseTree(out)
+	if err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	fs.trees[hash] = entries
+	fs.mu.Unlock()
+
+	return
+}
+
+// Return the contents of the blob with the supplied hash, reading it if
+// necessary.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *gitFS) readBlob(hash string) (contents []byte, err error) {
+	fs.mu.Lock()
+	contents, ok := fs.blobs[hash]
+	fs.mu.Unlock()
+
+	if ok {
+		return
+	}
+
+	contents, err = fs.git("cat-file", "blob", hash)
+	if err != nil {
+		return
+	}
+
+	fs.mu.Lock()
+	fs.blobs[hash] = contents
+	fs.mu.Unlock()
+
+	return
+}
+
+// Return the entries of the tree for the supplied directory inode. A
+// submodule has none.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *gitFS) readDirInode(
+	id fuseops.InodeID) (entries []treeEntry, err error) {
+	fs.mu.Lock()
+	in, ok := fs.inodes[id]
+	fs.mu.Unlock()
+
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	switch in.entry.mode {
+	case modeTree:
+		entries, err = fs.readTree(in.entry.hash)
+
+	case modeSubmodule:
+
+	default:
+		err = fuse.ENOTDIR
+	}
+
+	return
+}
+
+// Return the blob entry for the supplied inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *gitFS) blobEntry(id fuseops.InodeID) (e treeEntry, err error) {
+	fs.mu.Lock()
+	in, ok := fs.inodes[id]
+	fs.mu.Unlock()
+
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	e = in.entry
+	if e.mode == modeTree || e.mode == modeSubmodule {
+		err = fuse.EISDIR
+		return
+	}
+
+	return
+}
+
+func (fs *gitFS) attributes(e treeEntry) (attrs fuseops.InodeAttributes) {
+	attrs = fuseops.InodeAttributes{
+		Nlink:  1,
+		Atime:  fs.mtime,
+		Mtime:  fs.mtime,
+		Ctime:  fs.mtime,
+		Crtime: fs.mtime,
+	}
+
+	switch e.mode {
+	case modeTree, modeSubmodule:
+		attrs.Mode = os.ModeDir | 0555
+
+	case modeExecutable:
+		attrs.Mode = 0555
+		attrs.Size = e.size
+
+	case modeSymlink:
+		attrs.Mode = os.ModeSymlink | 0777
+		attrs.Size = e.size
+
+	default:
+		attrs.Mode = 0444
+		attrs.Size = e.size
+	}
+
+	return
+}
+
+func direntType(e treeEntry) fuseutil.DirentType {
+	switch e.mode {
+	case modeTree, modeSubmodule:
+		return fuseutil.DT_Directory
+
+	case modeSymlink:
+		return fuseutil.DT_Link
+
+	default:
+		return fuseutil.DT_File
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *gitFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *gitFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	entries, err := fs.readDirInode(op.Parent)
+	if err != nil {
+		return
+	}
+
+	var e treeEntry
+	found := false
+	for _, e = range entries {
+		if e.name == op.Name {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Find or allocate the child's inode.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	key := childKey{op.Parent, op.Name}
+	id, ok := fs.children[key]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+
+		fs.children[key] = id
+		fs.inodes[id] = &inode{
+			entry: e,
+			key:   key,
+		}
+	}
+
+	fs.inodes[id].lookupCount++
+
+	op.Entry.Child = id
+	op.Entry.Attributes = fs.attributes(e)
+
+	// Nothing ever changes.
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+
+	return
+}
+
+func (fs *gitFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Attributes = fs.attributes(in.entry)
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+
+	return
+}
+
+func (fs *gitFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok || op.Inode == fuseops.RootInodeID {
+		return
+	}
+
+	if op.N >= in.lookupCount {
+		delete(fs.inodes, op.Inode)
+		delete(fs.children, in.key)
+		return
+	}
+
+	in.lookupCount -= op.N
+	return
+}
+
+func (fs *gitFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	_, err = fs.readDirInode(op.Inode)
+	return
+}
+
+func (fs *gitFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	entries, err := fs.readDirInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		err = fuse.EINVAL
+		return
+	}
+
+	// The kernel finds the inode of an entry by looking it up, so there's no
+	// need to allocate inodes here.
+	for i := int(op.Offset); i < len(entries); i++ {
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  unknownInode,
+			Name:   entries[i].name,
+			Type:   direntType(entries[i]),
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *gitFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	_, err = fs.blobEntry(op.Inode)
+	if err != nil {
+		return
+	}
+
+	if op.Flags.AccessMode() != syscall.O_RDONLY {
+		err = syscall.EROFS
+		return
+	}
+
+	// The contents never change, so the page cache may be kept across opens.
+	op.KeepPageCache = true
+
+	return
+}
+
+func (fs *gitFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	e, err := fs.blobEntry(op.Inode)
+	if err != nil {
+		return
+	}
+
+	contents, err := fs.readBlob(e.hash)
+	if err != nil {
+		return
+	}
+
+	if op.Offset < int64(len(contents)) {
+		op.BytesRead = copy(op.Dst, contents[op.Offset:])
+	}
+
+	return
+}
+
+func (fs *gitFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	e, err := fs.blobEntry(op.Inode)
+	if err != nil {
+		return
+	}
+
+	if e.mode != modeSymlink {
+		err = fuse.EINVAL
+		return
+	}
+
+	contents, err := fs.readBlob(e.hash)
+	if err != nil {
+		return
+	}
+
+	op.Target = string(contents)
+	return
+}
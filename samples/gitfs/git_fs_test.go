@@ -0,0 +1,199 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sbg/fuse/fusetesting"
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/gitfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestGitFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The time of the commits in the fixture repository.
+var commitTime = time.Date(2015, 3, 4, 5, 6, 7, 0, time.UTC)
+
+type GitFSTest struct {
+	samples.SampleTest
+
+	// A repository whose tag v1 looks like this:
+	//
+	//     hello      "Hello, world!\n"
+	//     run.sh     executable
+	//     link       symlink to hello
+	//     dir/
+	//         nested "taco\n"
+	//
+	// It has a later commit, at its HEAD, that changes hello.
+	repoDir string
+}
+
+func init() { RegisterTestSuite(&GitFSTest{}) }
+
+func (t *GitFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.repoDir, err = ioutil.TempDir("", "gitfs_test")
+	AssertEq(nil, err)
+
+	t.writeFile("hello", "Hello, world!\n", 0644)
+	t.writeFile("run.sh", "#!/bin/sh\necho hi\n", 0755)
+	t.writeFile("dir/nested", "taco\n", 0644)
+	AssertEq(nil, os.Symlink("hello", path.Join(t.repoDir, "link")))
+
+	t.git("init", "-q")
+	t.git("add", "-A")
+	t.git("commit", "-q", "-m", "First")
+	t.git("tag", "v1")
+
+	t.writeFile("hello", "Goodbye\n", 0644)
+	t.git("commit", "-q", "-a", "-m", "Second")
+
+	t.Server, err = gitfs.NewGitFS(t.repoDir, "v1")
+	AssertEq(nil, err)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *GitFSTest) TearDown() {
+	t.SampleTest.TearDown()
+	ExpectEq(nil, os.RemoveAll(t.repoDir))
+}
+
+func (t *GitFSTest) writeFile(name string, contents string, mode os.FileMode) {
+	p := path.Join(t.repoDir, name)
+	AssertEq(nil, os.MkdirAll(path.Dir(p), 0755))
+	AssertEq(nil, ioutil.WriteFile(p, []byte(contents), mode))
+
+	// Make sure the mode is as requested, whatever the umask.
+	AssertEq(nil, os.Chmod(p, mode))
+}
+
+func (t *GitFSTest) git(args ...string) {
+	cmd := exec.Command("git", append([]string{"-C", t.repoDir}, args...)...)
+	cmd.Env = append(
+		os.Environ(),
+		"GIT_AUTHOR_NAME=Test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_AUTHOR_DATE="+commitTime.Format(time.RFC3339),
+		"GIT_COMMITTER_NAME=Test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_COMMITTER_DATE="+commitTime.Format(time.RFC3339),
+	)
+
+	out, err := cmd.CombinedOutput()
+	AssertEq(nil, err, "git %v: %s", args, out)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GitFSTest) ReadDir_Root() {
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(4, len(entries))
+
+	ExpectEq("dir", entries[0].Name())
+	ExpectEq(os.ModeDir|0555, entries[0].Mode())
+
+	ExpectEq("hello", entries[1].Name())
+	ExpectEq(0444, entries[1].Mode())
+	ExpectEq(len("Hello, world!\n"), entries[1].Size())
+
+	ExpectEq("link", entries[2].Name())
+	ExpectEq(os.ModeSymlink|0777, entries[2].Mode())
+
+	ExpectEq("run.sh", entries[3].Name())
+	ExpectEq(0555, entries[3].Mode())
+
+	for _, fi := range entries {
+		ExpectTrue(commitTime.Equal(fi.ModTime()), "%s: %v", fi.Name(), fi.ModTime())
+	}
+}
+
+func (t *GitFSTest) ReadDir_Subdirectory() {
+	entries, err := fusetesting.ReadDirPicky(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+
+	ExpectEq("nested", entries[0].Name())
+	ExpectEq(0444, entries[0].Mode())
+}
+
+func (t *GitFSTest) ReadFile() {
+	b, err := ioutil.ReadFile(path.Join(t.Dir, "hello"))
+	AssertEq(nil, err)
+	ExpectEq("Hello, world!\n", string(b))
+
+	b, err = ioutil.ReadFile(path.Join(t.Dir, "dir/nested"))
+	AssertEq(nil, err)
+	ExpectEq("taco\n", string(b))
+}
+
+func (t *GitFSTest) ExecutableBit() {
+	fi, err := os.Stat(path.Join(t.Dir, "run.sh"))
+	AssertEq(nil, err)
+	ExpectEq(0555, fi.Mode())
+
+	fi, err = os.Stat(path.Join(t.Dir, "hello"))
+	AssertEq(nil, err)
+	ExpectEq(0444, fi.Mode())
+
+	out, err := exec.Command(path.Join(t.Dir, "run.sh")).Output()
+	AssertEq(nil, err)
+	ExpectEq("hi\n", string(out))
+}
+
+func (t *GitFSTest) Symlink() {
+	target, err := os.Readlink(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("hello", target)
+
+	b, err := ioutil.ReadFile(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("Hello, world!\n", string(b))
+}
+
+func (t *GitFSTest) NonExistent() {
+	_, err := os.Stat(path.Join(t.Dir, "taco"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	_, err = os.Stat(path.Join(t.Dir, "hello/taco"))
+	ExpectThat(err, Error(HasSubstr("not a directory")))
+}
+
+func (t *GitFSTest) ReadOnly() {
+	err := ioutil.WriteFile(path.Join(t.Dir, "hello"), []byte("foo"), 0644)
+	ExpectThat(err, Error(HasSubstr("read-only file system")))
+}
+
+func (t *GitFSTest) UnknownRef() {
+	_, err := gitfs.NewGitFS(t.repoDir, "v2")
+	ExpectThat(err, Error(HasSubstr("git show")))
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -43,6 +44,10 @@ var fooAttrs = fuseops.InodeAttributes{
 // FlushFile ops can be made to hang until interrupted. Exposes a method for
 // synchronizing with the arrival of a read or a flush.
 //
+// WriteFileOp stands in for a multi-part upload to a slow backend, and can be
+// made to upload parts until interrupted. When interrupted it aborts the
+// upload rather than leaking it, which can be waited for.
+//
 // Must be created with New.
 type InterruptFS struct {
 	fuseutil.NotImplementedFileSystem
@@ -51,16 +56,21 @@ type InterruptFS struct {
 
 	blockForReads   bool // GUARDED_BY(mu)
 	blockForFlushes bool // GUARDED_BY(mu)
+	blockForWrites  bool // GUARDED_BY(mu)
 
 	// Must hold the mutex when closing these.
 	readReceived  chan struct{}
 	flushReceived chan struct{}
+	writeReceived chan struct{}
+	writeAborted  chan struct{}
 }
 
 func New() (fs *InterruptFS) {
 	fs = &InterruptFS{
 		readReceived:  make(chan struct{}),
 		flushReceived: make(chan struct{}),
+		writeReceived: make(chan struct{}),
+		writeAborted:  make(chan struct{}),
 	}
 
 	return
@@ -80,6 +90,16 @@ func (fs *InterruptFS) WaitForFirstFlush() {
 	<-fs.flushReceived
 }
 
+// Block until the first write is received.
+func (fs *InterruptFS) WaitForFirstWrite() {
+	<-fs.writeReceived
+}
+
+// Block until an interrupted write has aborted its upload.
+func (fs *InterruptFS) WaitForAbortedWrite() {
+	<-fs.writeAborted
+}
+
 // Enable blocking until interrupted for the next (and subsequent) read ops.
 func (fs *InterruptFS) EnableReadBlocking() {
 	fs.mu.Lock()
@@ -96,6 +116,14 @@ func (fs *InterruptFS) EnableFlushBlocking() {
 	fs.blockForFlushes = true
 }
 
+// Enable uploading until interrupted for the next (and subsequent) write ops.
+func (fs *InterruptFS) EnableWriteBlocking() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.blockForWrites = true
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
@@ -207,3 +235,43 @@ func (fs *InterruptFS) FlushFile(
 
 	return
 }
+
+func (fs *InterruptFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	fs.mu.Lock()
+	shouldBlock := fs.blockForWrites
+
+	// Signal that a write has been received, if this is the first.
+	select {
+	case <-fs.writeReceived:
+	default:
+		close(fs.writeReceived)
+	}
+	fs.mu.Unlock()
+
+	if !shouldBlock {
+		return
+	}
+
+	// Upload parts to the slow backend until interrupted, then abort the
+	// upload so that the backend can discard the parts.
+	for {
+		select {
+		case <-time.After(time.Millisecond):
+			// Another part uploaded.
+
+		case <-ctx.Done():
+			fs.mu.Lock()
+			select {
+			case <-fs.writeAborted:
+			default:
+				close(fs.writeAborted)
+			}
+			fs.mu.Unlock()
+
+			err = ctx.Err()
+			return
+		}
+	}
+}
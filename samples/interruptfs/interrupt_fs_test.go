@@ -154,3 +154,56 @@ func (t *InterruptFSTest) InterruptedDuringFlush() {
 	ExpectThat(err, Error(HasSubstr("signal")))
 	ExpectThat(err, Error(HasSubstr("interrupt")))
 }
+
+func (t *InterruptFSTest) InterruptedDuringWrite() {
+	var err error
+	t.fs.EnableWriteBlocking()
+
+	// Start a sub-process that attempts to write a lot of data to the file.
+	// Bypass the page cache so that it waits for the file system, rather than
+	// the data being written back later.
+	cmd := exec.Command(
+		"dd",
+		"if=/dev/zero",
+		"of="+path.Join(t.Dir, "foo"),
+		"bs=1M",
+		"count=64",
+		"oflag=direct",
+		"conv=notrunc")
+
+	var cmdOutput bytes.Buffer
+	cmd.Stdout = &cmdOutput
+	cmd.Stderr = &cmdOutput
+
+	err = cmd.Start()
+	AssertEq(nil, err)
+
+	// Wait for the command in the background, writing to a channel when it is
+	// finished.
+	cmdErr := make(chan error)
+	go func() {
+		cmdErr <- cmd.Wait()
+	}()
+
+	// Wait for the write to make it to the file system.
+	t.fs.WaitForFirstWrite()
+
+	// The command should be hanging on the write, and not yet have returned.
+	select {
+	case err = <-cmdErr:
+		AddFailure("Command returned early with error: %v", err)
+		AbortTest()
+
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Send SIGINT.
+	cmd.Process.Signal(os.Interrupt)
+
+	// The file system should abort its upload, and the command should fail.
+	// (dd catches the signal, so how it fails depends on what it does next.)
+	t.fs.WaitForAbortedWrite()
+
+	err = <-cmdErr
+	ExpectNe(nil, err)
+}
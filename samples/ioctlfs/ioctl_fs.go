@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ioctlfs
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+const deviceID = fuseops.RootInodeID + 1
+
+// The size of the value held by the device file, in bytes.
+const ValueSize = 8
+
+// The commands understood by the device file. Their encoding follows the
+// _IOR and _IOW macros of <asm-generic/ioctl.h>, from which the kernel learns
+// that each takes a pointer to a ValueSize-byte buffer, and in which direction
+// the buffer's contents travel.
+const (
+	// Copy the device's value into the caller's buffer. Equivalent to
+	// _IOR('V', 1, uint64_t).
+	IoctlGetValue = 2<<30 | ValueSize<<16 | 'V'<<8 | 1
+
+	// Set the device's value from the caller's buffer. Equivalent to
+	// _IOW('V', 2, uint64_t).
+	IoctlSetValue = 1<<30 | ValueSize<<16 | 'V'<<8 | 2
+)
+
+// Create a file system whose root contains a single empty file named
+// "device", which holds a value of ValueSize bytes that can be read and
+// written only with the ioctls IoctlGetValue and IoctlSetValue. The value's
+// bytes are stored verbatim, and are initially zero. Other ioctls fail with
+// ENOTTY.
+func NewIoctlFS() (server fuse.Server) {
+	fs := &ioctlFS{}
+	server = fuseutil.NewFileSystemServer(fs)
+	return
+}
+
+type ioctlFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	value [ValueSize]byte
+}
+
+func (fs *ioctlFS) attributes(inode fuseops.InodeID) (
+	attrs fuseops.InodeAttributes,
+	err error) {
+	switch inode {
+	case fuseops.RootInodeID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0555 | os.ModeDir,
+		}
+
+	case deviceID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0666,
+		}
+
+	default:
+		err = fuse.ENOENT
+	}
+
+	return
+}
+
+func (fs *ioctlFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *ioctlFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "device" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = deviceID
+	op.Entry.Attributes, err = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *ioctlFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes, err = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *ioctlFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *ioctlFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The kernel has sized the buffers according to the command, so we needn't
+	// check their lengths.
+	switch op.Cmd {
+	case IoctlGetValue:
+		op.BytesRead = copy(op.Dst, fs.value[:])
+
+	case IoctlSetValue:
+		copy(fs.value[:], op.Input)
+
+	default:
+		err = fuse.ENOTTY
+	}
+
+	return
+}
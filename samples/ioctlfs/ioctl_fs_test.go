@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ioctlfs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/ioctlfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestIoctlFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type IoctlFSTest struct {
+	samples.SampleTest
+	f *os.File
+}
+
+func init() { RegisterTestSuite(&IoctlFSTest{}) }
+
+func (t *IoctlFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.Server = ioctlfs.NewIoctlFS()
+	t.SampleTest.SetUp(ti)
+
+	t.f, err = os.OpenFile(path.Join(t.Dir, "device"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+}
+
+func (t *IoctlFSTest) TearDown() {
+	t.f.Close()
+	t.SampleTest.TearDown()
+}
+
+// Issue an ioctl on the device file with a pointer to the supplied buffer.
+func (t *IoctlFSTest) ioctl(cmd uintptr, buf []byte) (err error) {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		t.f.Fd(),
+		cmd,
+		uintptr(unsafe.Pointer(&buf[0])))
+
+	if errno != 0 {
+		err = errno
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *IoctlFSTest) InitialValue() {
+	buf := []byte("garbage!")
+	AssertEq(nil, t.ioctl(ioctlfs.IoctlGetValue, buf))
+	ExpectEq(string(make([]byte, ioctlfs.ValueSize)), string(buf))
+}
+
+func (t *IoctlFSTest) SetThenGet() {
+	AssertEq(nil, t.ioctl(ioctlfs.IoctlSetValue, []byte("taco bar")))
+
+	buf := make([]byte, ioctlfs.ValueSize)
+	AssertEq(nil, t.ioctl(ioctlfs.IoctlGetValue, buf))
+	ExpectEq("taco bar", string(buf))
+
+	// The value lives in the file system, not in the open file.
+	f, err := os.Open(path.Join(t.Dir, "device"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	buf = make([]byte, ioctlfs.ValueSize)
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		f.Fd(),
+		ioctlfs.IoctlGetValue,
+		uintptr(unsafe.Pointer(&buf[0])))
+
+	AssertEq(0, errno)
+	ExpectEq("taco bar", string(buf))
+}
+
+func (t *IoctlFSTest) SetDoesntWriteToCaller() {
+	// The kernel copies nothing back for a command that only writes.
+	buf := []byte("taco bar")
+	AssertEq(nil, t.ioctl(ioctlfs.IoctlSetValue, buf))
+	ExpectEq("taco bar", string(buf))
+}
+
+func (t *IoctlFSTest) UnknownCommand() {
+	// The same size and direction as IoctlGetValue, but a different number.
+	buf := make([]byte, ioctlfs.ValueSize)
+	err := t.ioctl(ioctlfs.IoctlGetValue+16, buf)
+	ExpectEq(syscall.ENOTTY, err)
+}
@@ -18,12 +18,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/sbg/fuse/fuseops"
 	"github.com/sbg/fuse/fuseutil"
 )
 
+// The mode bits beyond the permissions that we store for the kernel to
+// interpret.
+const specialModeBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
 // Common attributes for files and directories.
 //
 // External synchronization is required.
@@ -34,7 +39,7 @@ type inode struct {
 
 	// The current attributes of this inode.
 	//
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
+	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink|specialModeBits) == 0
 	// INVARIANT: !(isDir() && isSymlink())
 	// INVARIANT: attrs.Size == len(contents)
 	attrs fuseops.InodeAttributes
@@ -64,6 +69,11 @@ type inode struct {
 
 	// extended attributes and values
 	xattrs map[string][]byte
+
+	// The number of lookups of the inode that the kernel holds, taken by
+	// replies that name it and dropped by ForgetInodeOp. An inode is
+	// reclaimed once both this and its link count are zero.
+	lookupCount uint64
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -77,6 +87,7 @@ func newInode(
 	// Update time info.
 	now := time.Now()
 	attrs.Mtime = now
+	attrs.Ctime = now
 	attrs.Crtime = now
 
 	// Create the object.
@@ -89,8 +100,8 @@ func newInode(
 }
 
 func (in *inode) CheckInvariants() {
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
-	if !(in.attrs.Mode&^(os.ModePerm|os.ModeDir|os.ModeSymlink) == 0) {
+	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink|specialModeBits) == 0
+	if !(in.attrs.Mode&^(os.ModePerm|os.ModeDir|os.ModeSymlink|specialModeBits) == 0) {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
@@ -179,6 +190,17 @@ func (in *inode) findChild(name string) (i int, ok bool) {
 // Public methods
 ////////////////////////////////////////////////////////////////////////
 
+// Return the time until which the kernel may cache the inode's attributes.
+// See NoCacheXattr.
+func (in *inode) AttributesExpiration() (t time.Time) {
+	if _, ok := in.xattrs[NoCacheXattr]; ok {
+		return
+	}
+
+	t = time.Now().Add(365 * 24 * time.Hour)
+	return
+}
+
 // Return the number of children of the directory.
 //
 // REQUIRES: in.isDir()
@@ -218,8 +240,10 @@ func (in *inode) AddChild(
 	dt fuseutil.DirentType) {
 	var index int
 
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	// Update the modification and change times.
+	now := time.Now()
+	in.attrs.Mtime = now
+	in.attrs.Ctime = now
 
 	// No matter where we place the entry, make sure it has the correct Offset
 	// field.
@@ -252,8 +276,10 @@ func (in *inode) AddChild(
 // REQUIRES: in.isDir()
 // REQUIRES: An entry for the given name exists.
 func (in *inode) RemoveChild(name string) {
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	// Update the modification and change times.
+	now := time.Now()
+	in.attrs.Mtime = now
+	in.attrs.Ctime = now
 
 	// Find the entry.
 	i, ok := in.findChild(name)
@@ -295,6 +321,19 @@ func (in *inode) ReadDir(p []byte, offset int) (n int) {
 	return
 }
 
+// Truncate or extend the file's contents to the given size, filling any
+// extension with zeroes, and update the size attribute to match.
+func (in *inode) resize(size uint64) {
+	if size <= uint64(len(in.contents)) {
+		in.contents = in.contents[:size]
+	} else {
+		padding := make([]byte, size-uint64(len(in.contents)))
+		in.contents = append(in.contents, padding...)
+	}
+
+	in.attrs.Size = size
+}
+
 // Read from the file's contents. See documentation for ioutil.ReaderAt.
 //
 // REQUIRES: in.isFile()
@@ -326,15 +365,21 @@ func (in *inode) WriteAt(p []byte, off int64) (n int, err error) {
 		panic("WriteAt called on non-file.")
 	}
 
+	// Writing nothing changes nothing, even past the end of the file.
+	if len(p) == 0 {
+		return
+	}
+
 	// Update the modification time.
 	in.attrs.Mtime = time.Now()
 
-	// Ensure that the contents slice is long enough.
-	newLen := int(off) + len(p)
-	if len(in.contents) < newLen {
-		padding := make([]byte, newLen-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = uint64(newLen)
+	// Ensure that the contents slice is long enough. With writeback caching
+	// the kernel coalesces writes and flushes them in whatever order it likes,
+	// so a write may land well beyond the current end of the file, with the
+	// gap to be filled by a later write or left as a hole.
+	newLen := uint64(off) + uint64(len(p))
+	if uint64(len(in.contents)) < newLen {
+		in.resize(newLen)
 	}
 
 	// Copy in the data.
@@ -348,6 +393,61 @@ func (in *inode) WriteAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+// Allocate or deallocate a range of the file. See fuseops.FallocateOp.
+func (in *inode) Fallocate(
+	mode fuseops.FallocateMode,
+	off uint64,
+	length uint64) (err error) {
+	if !in.isFile() {
+		panic("Fallocate called on non-file.")
+	}
+
+	end := off + length
+	switch mode {
+	case 0:
+		// Extend the file with zeroes if necessary. Everything else is already
+		// backed by memory.
+		if end > uint64(len(in.contents)) {
+			in.resize(end)
+			in.attrs.Mtime = time.Now()
+		}
+
+	case fuseops.FallocKeepSize:
+		// There is nothing to allocate.
+
+	case fuseops.FallocKeepSize | fuseops.FallocPunchHole:
+		// Zero the part of the range that lies within the file.
+		if end > uint64(len(in.contents)) {
+			end = uint64(len(in.contents))
+		}
+
+		if off < end {
+			hole := in.contents[off:end]
+			for i := range hole {
+				hole[i] = 0
+			}
+
+			in.attrs.Mtime = time.Now()
+		}
+
+	default:
+		err = syscall.EOPNOTSUPP
+	}
+
+	return
+}
+
+// Clear the set-user-ID bit, and the set-group-ID bit if it applies to
+// execution, as happens when an unprivileged user modifies the file.
+func (in *inode) KillPrivileges() {
+	in.attrs.Mode &^= os.ModeSetuid
+	if in.attrs.Mode&0010 != 0 {
+		in.attrs.Mode &^= os.ModeSetgid
+	}
+
+	in.attrs.Ctime = time.Now()
+}
+
 // Update attributes from non-nil parameters.
 func (in *inode) SetAttributes(
 	size *uint64,
@@ -358,18 +458,7 @@ func (in *inode) SetAttributes(
 
 	// Truncate?
 	if size != nil {
-		intSize := int(*size)
-
-		// Update contents.
-		if intSize <= len(in.contents) {
-			in.contents = in.contents[:intSize]
-		} else {
-			padding := make([]byte, intSize-len(in.contents))
-			in.contents = append(in.contents, padding...)
-		}
-
-		// Update attributes.
-		in.attrs.Size = *size
+		in.resize(*size)
 	}
 
 	// Change mode?
@@ -32,10 +32,15 @@ import (
 type memFS struct {
 	fuseutil.NotImplementedFileSystem
 
-	// The UID and GID that every inode receives.
+	// The UID and GID that own the root inode, and that new inodes receive when
+	// the caller's credentials aren't known.
 	uid uint32
 	gid uint32
 
+	// The maximum number of live inodes, including the root, or zero for no
+	// limit.
+	maxInodes int
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -61,32 +66,68 @@ type memFS struct {
 	// INVARIANT: This is all and only indices i of 'inodes' such that i >
 	// fuseops.RootInodeID and inodes[i] == nil
 	freeInodes []fuseops.InodeID // GUARDED_BY(mu)
+
+	// The inode for each open file handle. Ops that carry a handle find the
+	// file through it.
+	//
+	// INVARIANT: For each v in handles, inodes[v] is a file
+	handles map[fuseops.HandleID]fuseops.InodeID // GUARDED_BY(mu)
+
+	// The next handle ID to hand out.
+	nextHandle fuseops.HandleID // GUARDED_BY(mu)
 }
 
+// An extended attribute marking an inode whose attributes the kernel must not
+// cache, as for a file standing in for a live clock or counter whose
+// attributes change without the kernel's knowledge. Its value is ignored.
+// The attributes of such an inode are reported with a zero expiration time,
+// so that the kernel fetches them afresh for every stat(2), while those of
+// other inodes may be cached for a year.
+const NoCacheXattr = "user.memfs.no_cache"
+
 // Create a file system that stores data and metadata in memory.
 //
-// The supplied UID/GID pair will own the root inode. This file system does no
-// permissions checking, and should therefore be mounted with the
-// default_permissions option.
+// The supplied UID/GID pair will own the root inode. New inodes are owned by
+// the caller that creates them. Apart from enforcing the sticky bit on
+// directories, this file system does no permissions checking, and should
+// therefore be mounted with the default_permissions option.
 func NewMemFS(
 	uid uint32,
 	gid uint32) fuse.Server {
+	return NewMemFSWithInodeLimit(uid, gid, 0)
+}
+
+// Like NewMemFS, but the file system holds at most maxInodes live inodes,
+// including the root, and reports its inode usage through statfs(2). Creating
+// a file, directory, or symlink fails with ENOSPC once the limit is reached.
+// An unlinked inode keeps counting against the limit until the kernel has
+// forgotten it too, at which point its slot is freed for reuse.
+func NewMemFSWithInodeLimit(
+	uid uint32,
+	gid uint32,
+	maxInodes int) fuse.Server {
 	// Set up the basic struct.
 	fs := &memFS{
-		inodes: make([]*inode, fuseops.RootInodeID+1),
-		uid:    uid,
-		gid:    gid,
+		inodes:    make([]*inode, fuseops.RootInodeID+1),
+		handles:   make(map[fuseops.HandleID]fuseops.InodeID),
+		uid:       uid,
+		gid:       gid,
+		maxInodes: maxInodes,
 	}
 
 	// Set up the root inode.
 	rootAttrs := fuseops.InodeAttributes{
-		Mode: 0700 | os.ModeDir,
-		Uid:  uid,
-		Gid:  gid,
+		Nlink: 2,
+		Mode:  0700 | os.ModeDir,
+		Uid:   uid,
+		Gid:   gid,
 	}
 
 	fs.inodes[fuseops.RootInodeID] = newInode(rootAttrs)
 
+	// The kernel holds an implicit lookup of the root, which it never forgets.
+	fs.inodes[fuseops.RootInodeID].lookupCount = 1
+
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
@@ -136,8 +177,24 @@ func (fs *memFS) checkInvariants() {
 	}
 
 	// INVARIANT: For each inode in, in.CheckInvariants() does not panic.
-	for _, in := range fs.inodes {
+	// INVARIANT: For each inode in, in.attrs.Nlink > 0 || in.lookupCount > 0
+	for id, in := range fs.inodes {
+		if in == nil {
+			continue
+		}
+
 		in.CheckInvariants()
+
+		if in.attrs.Nlink == 0 && in.lookupCount == 0 {
+			panic(fmt.Sprintf("Unreclaimed inode: %v", id))
+		}
+	}
+
+	// INVARIANT: For each v in handles, inodes[v] is a file
+	for h, id := range fs.handles {
+		if !fs.getInodeOrDie(id).isFile() {
+			panic(fmt.Sprintf("Handle %v refers to non-file %v", h, id))
+		}
 	}
 }
 
@@ -153,11 +210,35 @@ func (fs *memFS) getInodeOrDie(id fuseops.InodeID) (inode *inode) {
 	return
 }
 
-// Allocate a new inode, assigning it an ID that is not in use.
+// Allocate a handle for the supplied file.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) allocateHandle(id fuseops.InodeID) (h fuseops.HandleID) {
+	h = fs.nextHandle
+	fs.nextHandle++
+
+	fs.handles[h] = id
+	return
+}
+
+// Return the number of live inodes, including the root.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) liveInodes() int {
+	return len(fs.inodes) - fuseops.RootInodeID - len(fs.freeInodes)
+}
+
+// Allocate a new inode, assigning it an ID that is not in use. Returns ENOSPC
+// if the file system is at its inode limit.
 //
 // LOCKS_REQUIRED(fs.mu)
 func (fs *memFS) allocateInode(
-	attrs fuseops.InodeAttributes) (id fuseops.InodeID, inode *inode) {
+	attrs fuseops.InodeAttributes) (id fuseops.InodeID, inode *inode, err error) {
+	if fs.maxInodes != 0 && fs.liveInodes() >= fs.maxInodes {
+		err = fuse.ENOSPC
+		return
+	}
+
 	// Create the inode.
 	inode = newInode(attrs)
 
@@ -181,6 +262,50 @@ func (fs *memFS) deallocateInode(id fuseops.InodeID) {
 	fs.inodes[id] = nil
 }
 
+// Deallocate the supplied inode if it has no links left and the kernel has
+// forgotten it. Call this after dropping either.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) deallocateIfUnused(id fuseops.InodeID) {
+	in := fs.getInodeOrDie(id)
+	if in.attrs.Nlink == 0 && in.lookupCount == 0 {
+		fs.deallocateInode(id)
+	}
+}
+
+// Return the owner for an inode created by the op associated with the
+// supplied context.
+func (fs *memFS) newInodeOwner(ctx context.Context) (uid uint32, gid uint32) {
+	uid, gid = fs.uid, fs.gid
+	if caller, ok := fuse.CallerFromContext(ctx); ok {
+		uid, gid = caller.Uid, caller.Gid
+	}
+
+	return
+}
+
+// Return fuse.EPERM if the caller for the op associated with the supplied
+// context may not remove the child from the parent because of the parent's
+// sticky bit.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) checkSticky(
+	ctx context.Context,
+	parent *inode,
+	child *inode) (err error) {
+	caller, ok := fuse.CallerFromContext(ctx)
+	if !ok {
+		return
+	}
+
+	if !fuseutil.StickyDirAllowsRemoval(parent.attrs, child.attrs, caller.Uid) {
+		err = fuse.EPERM
+		return
+	}
+
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
@@ -188,6 +313,14 @@ func (fs *memFS) deallocateInode(id fuseops.InodeID) {
 func (fs *memFS) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.maxInodes != 0 {
+		op.Inodes = uint64(fs.maxInodes)
+		op.InodesFree = uint64(fs.maxInodes - fs.liveInodes())
+	}
+
 	return
 }
 
@@ -209,14 +342,15 @@ func (fs *memFS) LookUpInode(
 
 	// Grab the child.
 	child := fs.getInodeOrDie(childID)
+	child.lookupCount++
 
 	// Fill in the response.
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	// (since it also handles invalidation), unless asked not to.
+	op.Entry.AttributesExpiration = child.AttributesExpiration()
 	op.Entry.EntryExpiration = op.Entry.EntryExpiration
 
 	return
@@ -228,15 +362,24 @@ func (fs *memFS) GetInodeAttributes(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	// Grab the inode.
-	inode := fs.getInodeOrDie(op.Inode)
+	// Grab the inode, through the handle if the kernel supplied one.
+	id := op.Inode
+	if op.Handle != nil {
+		var ok bool
+		id, ok = fs.handles[*op.Handle]
+		if !ok || id != op.Inode {
+			panic(fmt.Sprintf("Handle %v is not open for %v", *op.Handle, op.Inode))
+		}
+	}
+
+	inode := fs.getInodeOrDie(id)
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	// (since it also handles invalidation), unless asked not to.
+	op.AttributesExpiration = inode.AttributesExpiration()
 
 	return
 }
@@ -252,13 +395,16 @@ func (fs *memFS) SetInodeAttributes(
 
 	// Handle the request.
 	inode.SetAttributes(op.Size, op.Mode, op.Mtime)
+	if op.KillPrivileges {
+		inode.KillPrivileges()
+	}
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	// (since it also handles invalidation), unless asked not to.
+	op.AttributesExpiration = inode.AttributesExpiration()
 
 	return
 }
@@ -280,21 +426,30 @@ func (fs *memFS) MkDir(
 		return
 	}
 
-	// Set up attributes from the child.
+	// Set up attributes from the child, applying the caller's umask if the
+	// kernel left it to us. A directory is linked to by its entry in the
+	// parent and by its own "." entry.
+	uid, gid := fs.newInodeOwner(ctx)
 	childAttrs := fuseops.InodeAttributes{
-		Nlink: 1,
-		Mode:  op.Mode,
-		Uid:   fs.uid,
-		Gid:   fs.gid,
+		Nlink: 2,
+		Mode:  op.Mode &^ op.Umask,
+		Uid:   uid,
+		Gid:   gid,
 	}
 
 	// Allocate a child.
-	childID, child := fs.allocateInode(childAttrs)
+	childID, child, err := fs.allocateInode(childAttrs)
+	if err != nil {
+		return
+	}
 
-	// Add an entry in the parent.
+	// Add an entry in the parent, which is also linked to by the child's ".."
+	// entry.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Directory)
+	parent.attrs.Nlink++
 
-	// Fill in the response.
+	// Fill in the response, which gives the kernel a lookup.
+	child.lookupCount++
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
@@ -312,12 +467,13 @@ func (fs *memFS) MkNode(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(ctx, op.Parent, op.Name, op.Mode&^op.Umask)
 	return
 }
 
 // LOCKS_REQUIRED(fs.mu)
 func (fs *memFS) createFile(
+	ctx context.Context,
 	parentID fuseops.InodeID,
 	name string,
 	mode os.FileMode) (entry fuseops.ChildInodeEntry, err error) {
@@ -334,6 +490,7 @@ func (fs *memFS) createFile(
 
 	// Set up attributes for the child.
 	now := time.Now()
+	uid, gid := fs.newInodeOwner(ctx)
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   mode,
@@ -341,17 +498,21 @@ func (fs *memFS) createFile(
 		Mtime:  now,
 		Ctime:  now,
 		Crtime: now,
-		Uid:    fs.uid,
-		Gid:    fs.gid,
+		Uid:    uid,
+		Gid:    gid,
 	}
 
 	// Allocate a child.
-	childID, child := fs.allocateInode(childAttrs)
+	childID, child, err := fs.allocateInode(childAttrs)
+	if err != nil {
+		return
+	}
 
 	// Add an entry in the parent.
 	parent.AddChild(childID, name, fuseutil.DT_File)
 
-	// Fill in the response entry.
+	// Fill in the response entry, which gives the kernel a lookup.
+	child.lookupCount++
 	entry.Child = childID
 	entry.Attributes = child.attrs
 
@@ -369,7 +530,12 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(ctx, op.Parent, op.Name, op.Mode&^op.Umask)
+	if err != nil {
+		return
+	}
+
+	op.Handle = fs.allocateHandle(op.Entry.Child)
 	return
 }
 
@@ -392,6 +558,7 @@ func (fs *memFS) CreateSymlink(
 
 	// Set up attributes from the child.
 	now := time.Now()
+	uid, gid := fs.newInodeOwner(ctx)
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   0444 | os.ModeSymlink,
@@ -399,12 +566,15 @@ func (fs *memFS) CreateSymlink(
 		Mtime:  now,
 		Ctime:  now,
 		Crtime: now,
-		Uid:    fs.uid,
-		Gid:    fs.gid,
+		Uid:    uid,
+		Gid:    gid,
 	}
 
 	// Allocate a child.
-	childID, child := fs.allocateInode(childAttrs)
+	childID, child, err := fs.allocateInode(childAttrs)
+	if err != nil {
+		return
+	}
 
 	// Set up its target.
 	child.target = op.Target
@@ -412,7 +582,8 @@ func (fs *memFS) CreateSymlink(
 	// Add an entry in the parent.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Link)
 
-	// Fill in the response entry.
+	// Fill in the response entry, which gives the kernel a lookup.
+	child.lookupCount++
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
@@ -449,16 +620,22 @@ func (fs *memFS) CreateLink(
 	target.attrs.Nlink++
 	target.attrs.Ctime = now
 
-	// Add an entry in the parent.
-	parent.AddChild(op.Target, op.Name, fuseutil.DT_File)
+	// Add an entry in the parent, of the same type as the target's others.
+	childType := fuseutil.DT_File
+	if target.isSymlink() {
+		childType = fuseutil.DT_Link
+	}
 
-	// Return the response.
+	parent.AddChild(op.Target, op.Name, childType)
+
+	// Return the response, which gives the kernel a lookup.
+	target.lookupCount++
 	op.Entry.Child = op.Target
 	op.Entry.Attributes = target.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	// (since it also handles invalidation), unless asked not to.
+	op.Entry.AttributesExpiration = target.AttributesExpiration()
 	op.Entry.EntryExpiration = op.Entry.EntryExpiration
 
 	return
@@ -479,13 +656,23 @@ func (fs *memFS) Rename(
 		return
 	}
 
+	err = fs.checkSticky(ctx, oldParent, fs.getInodeOrDie(childID))
+	if err != nil {
+		return
+	}
+
 	// If the new name exists already in the new parent, make sure it's not a
-	// non-empty directory, then delete it.
+	// non-empty directory and that we're allowed to replace it, then delete it.
 	newParent := fs.getInodeOrDie(op.NewParent)
 	existingID, _, ok := newParent.LookUpChild(op.NewName)
 	if ok {
 		existing := fs.getInodeOrDie(existingID)
 
+		err = fs.checkSticky(ctx, newParent, existing)
+		if err != nil {
+			return
+		}
+
 		var buf [4096]byte
 		if existing.isDir() && existing.ReadDir(buf[:], 0) > 0 {
 			err = fuse.ENOTEMPTY
@@ -493,6 +680,17 @@ func (fs *memFS) Rename(
 		}
 
 		newParent.RemoveChild(op.NewName)
+
+		// A replaced directory is gone entirely, taking its ".." entry with it.
+		// Anything else loses one of its links.
+		if existing.isDir() {
+			existing.attrs.Nlink = 0
+			newParent.attrs.Nlink--
+		} else {
+			existing.attrs.Nlink--
+		}
+
+		fs.deallocateIfUnused(existingID)
 	}
 
 	// Link the new name.
@@ -504,6 +702,15 @@ func (fs *memFS) Rename(
 	// Finally, remove the old name from the old parent.
 	oldParent.RemoveChild(op.OldName)
 
+	// A directory's ".." entry moves with it.
+	if childType == fuseutil.DT_Directory {
+		oldParent.attrs.Nlink--
+		newParent.attrs.Nlink++
+	}
+
+	// Renaming counts as a change to the child itself, too.
+	fs.getInodeOrDie(childID).attrs.Ctime = time.Now()
+
 	return
 }
 
@@ -526,17 +733,25 @@ func (fs *memFS) RmDir(
 	// Grab the child.
 	child := fs.getInodeOrDie(childID)
 
+	err = fs.checkSticky(ctx, parent, child)
+	if err != nil {
+		return
+	}
+
 	// Make sure the child is empty.
 	if child.Len() != 0 {
 		err = fuse.ENOTEMPTY
 		return
 	}
 
-	// Remove the entry within the parent.
+	// Remove the entry within the parent, which also loses the link from the
+	// child's ".." entry.
 	parent.RemoveChild(op.Name)
+	parent.attrs.Nlink--
 
 	// Mark the child as unlinked.
-	child.attrs.Nlink--
+	child.attrs.Nlink = 0
+	fs.deallocateIfUnused(childID)
 
 	return
 }
@@ -560,11 +775,38 @@ func (fs *memFS) Unlink(
 	// Grab the child.
 	child := fs.getInodeOrDie(childID)
 
+	err = fs.checkSticky(ctx, parent, child)
+	if err != nil {
+		return
+	}
+
 	// Remove the entry within the parent.
 	parent.RemoveChild(op.Name)
 
 	// Mark the child as unlinked.
 	child.attrs.Nlink--
+	fs.deallocateIfUnused(childID)
+
+	return
+}
+
+func (fs *memFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode := fs.getInodeOrDie(op.Inode)
+	if op.N > inode.lookupCount {
+		panic(fmt.Sprintf(
+			"Forgetting %d lookups of inode %v, which has %d",
+			op.N,
+			op.Inode,
+			inode.lookupCount))
+	}
+
+	inode.lookupCount -= op.N
+	fs.deallocateIfUnused(op.Inode)
 
 	return
 }
@@ -580,8 +822,10 @@ func (fs *memFS) OpenDir(
 	// cache invalidation, etc.).
 	inode := fs.getInodeOrDie(op.Inode)
 
+	// The kernel sends OpenDirOp only for directories, but enforce it anyway.
 	if !inode.isDir() {
-		panic("Found non-dir.")
+		err = fuse.ENOTDIR
+		return
 	}
 
 	return
@@ -613,10 +857,23 @@ func (fs *memFS) OpenFile(
 	// cache invalidation, etc.).
 	inode := fs.getInodeOrDie(op.Inode)
 
+	// The kernel sends OpenFileOp only for non-directories, and itself fails
+	// opens with O_DIRECTORY for them, but enforce both anyway.
+	if inode.isDir() {
+		err = fuse.EISDIR
+		return
+	}
+
+	if op.Flags.Directory() {
+		err = fuse.ENOTDIR
+		return
+	}
+
 	if !inode.isFile() {
 		panic("Found non-file.")
 	}
 
+	op.Handle = fs.allocateHandle(op.Inode)
 	return
 }
 
@@ -651,7 +908,79 @@ func (fs *memFS) WriteFile(
 
 	// Serve the request.
 	_, err = inode.WriteAt(op.Data, op.Offset)
+	if err != nil {
+		return
+	}
+
+	if op.KillPrivileges {
+		inode.KillPrivileges()
+	}
+
+	return
+}
+
+func (fs *memFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Find the inode in question.
+	inode := fs.getInodeOrDie(op.Inode)
+
+	// Serve the request.
+	err = inode.Fallocate(op.Mode, op.Offset, op.Length)
+	return
+}
+
+func (fs *memFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Find the inodes in question.
+	src := fs.getInodeOrDie(op.SrcInode)
+	dst := fs.getInodeOrDie(op.DstInode)
+
+	// Read what we can from the source. The buffer is separate from the
+	// source's contents, so the ranges may overlap.
+	if op.SrcOffset >= src.attrs.Size {
+		return
+	}
+
+	length := op.Length
+	if remaining := src.attrs.Size - op.SrcOffset; length > remaining {
+		length = remaining
+	}
+
+	buf := make([]byte, length)
+	n, err := src.ReadAt(buf, int64(op.SrcOffset))
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Write it to the destination.
+	_, err = dst.WriteAt(buf[:n], int64(op.DstOffset))
+	if err != nil {
+		return
+	}
+
+	op.BytesCopied = uint64(n)
+	return
+}
+
+func (fs *memFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
+	delete(fs.handles, op.Handle)
 	return
 }
 
@@ -703,6 +1032,7 @@ func (fs *memFS) ListXattr(ctx context.Context,
 
 		if err == nil && len(dst) >= keyLen {
 			copy(dst, key)
+			dst[keyLen-1] = 0
 			dst = dst[keyLen:]
 		} else {
 			err = syscall.ERANGE
@@ -736,11 +1066,11 @@ func (fs *memFS) SetXattr(ctx context.Context,
 	_, ok := inode.xattrs[op.Name]
 
 	switch op.Flags {
-	case 0x1:
+	case fuseops.SetXattrCreate:
 		if ok {
 			err = fuse.EEXIST
 		}
-	case 0x2:
+	case fuseops.SetXattrReplace:
 		if !ok {
 			err = fuse.ENOATTR
 		}
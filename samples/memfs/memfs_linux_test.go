@@ -0,0 +1,539 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/sbg/fuse/samples/memfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+////////////////////////////////////////////////////////////////////////
+// fallocate
+////////////////////////////////////////////////////////////////////////
+
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+type FallocateTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&FallocateTest{}) }
+
+func (t *FallocateTest) ExtendSize() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Open it for modification.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Allocate a range that extends past the end of the file.
+	err = syscall.Fallocate(int(f.Fd()), 0, 2, 6)
+	AssertEq(nil, err)
+
+	// Stat it.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(8, fi.Size())
+
+	// The existing contents are untouched and the rest is zeroes.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("taco\x00\x00\x00\x00", string(contents))
+}
+
+func (t *FallocateTest) KeepSize() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Open it for modification.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Allocate past the end of the file without changing its size.
+	err = syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, 100)
+	AssertEq(nil, err)
+
+	// Nothing has changed.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *FallocateTest) PunchHole() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	// Open it for modification.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Punch a hole in the middle, and another one running off the end.
+	err = syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, 2, 3)
+	AssertEq(nil, err)
+
+	err = syscall.Fallocate(int(f.Fd()), fallocKeepSize|fallocPunchHole, 6, 10)
+	AssertEq(nil, err)
+
+	// The size is unchanged.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(7, fi.Size())
+
+	// The holes read as zeroes.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("bu\x00\x00\x00t\x00", string(contents))
+}
+
+func (t *FallocateTest) UnsupportedMode() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Open it for modification.
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Punching a hole without keeping the size is invalid, and rejected by the
+	// kernel before it gets to us.
+	err = syscall.Fallocate(int(f.Fd()), fallocPunchHole, 0, 2)
+	ExpectEq(syscall.EOPNOTSUPP, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// copy_file_range
+////////////////////////////////////////////////////////////////////////
+
+type CopyFileRangeTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&CopyFileRangeTest{}) }
+
+func (t *CopyFileRangeTest) BetweenFiles() {
+	var err error
+
+	// Create a source and a destination file.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// Open them.
+	src, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, src)
+	AssertEq(nil, err)
+
+	dst, err := os.OpenFile(path.Join(t.Dir, "bar"), os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, dst)
+	AssertEq(nil, err)
+
+	// Copy part of the source over the end of the destination, extending it.
+	srcOff := int64(2)
+	dstOff := int64(2)
+	n, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, 4, 0)
+	AssertEq(nil, err)
+	ExpectEq(4, n)
+	ExpectEq(6, srcOff)
+	ExpectEq(6, dstOff)
+
+	// Check the result.
+	fi, err := dst.Stat()
+	AssertEq(nil, err)
+	ExpectEq(6, fi.Size())
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+	ExpectEq("tarrit", string(contents))
+}
+
+func (t *CopyFileRangeTest) PastEndOfSource() {
+	var err error
+
+	// Create a source and a destination file.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "bar"), []byte(""), 0600)
+	AssertEq(nil, err)
+
+	// Open them.
+	src, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, src)
+	AssertEq(nil, err)
+
+	dst, err := os.OpenFile(path.Join(t.Dir, "bar"), os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, dst)
+	AssertEq(nil, err)
+
+	// Ask for more than there is. Only what exists should be copied.
+	srcOff := int64(1)
+	dstOff := int64(0)
+	n, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, 100, 0)
+	AssertEq(nil, err)
+	ExpectEq(3, n)
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+	ExpectEq("aco", string(contents))
+
+	// Starting at the end copies nothing.
+	srcOff = 4
+	n, err = unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, 100, 0)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+}
+
+func (t *CopyFileRangeTest) WithinFile() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	// Open it twice.
+	src, err := os.Open(fileName)
+	t.ToClose = append(t.ToClose, src)
+	AssertEq(nil, err)
+
+	dst, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	t.ToClose = append(t.ToClose, dst)
+	AssertEq(nil, err)
+
+	// Copy the start of the file to beyond its end.
+	srcOff := int64(0)
+	dstOff := int64(7)
+	n, err := unix.CopyFileRange(int(src.Fd()), &srcOff, int(dst.Fd()), &dstOff, 3, 0)
+	AssertEq(nil, err)
+	ExpectEq(3, n)
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("burritobur", string(contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Writeback caching
+////////////////////////////////////////////////////////////////////////
+
+// Writeback caching is enabled by default, so writes reach the file system
+// coalesced, out of order, and interleaved with truncations. Each test
+// checks the contents after closing the file, which flushes dirty pages,
+// and opening it again, which drops the page cache, so that what is read
+// comes from the file system.
+type WritebackCacheTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&WritebackCacheTest{}) }
+
+// Return n bytes of data in which no short run repeats.
+func writebackData(n int) (p []byte) {
+	p = make([]byte, n)
+	for i := range p {
+		p[i] = byte(i*7 + i/251)
+	}
+
+	return
+}
+
+func (t *WritebackCacheTest) LargeStreamingWrite() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+	data := writebackData(4<<20 + 17)
+
+	// Write the data in chunks that don't line up with pages.
+	f, err := os.Create(fileName)
+	AssertEq(nil, err)
+
+	for off := 0; off < len(data); off += 4097 {
+		end := off + 4097
+		if end > len(data) {
+			end = len(data)
+		}
+
+		_, err = f.Write(data[off:end])
+		AssertEq(nil, err)
+	}
+
+	err = f.Close()
+	AssertEq(nil, err)
+
+	// Read it back.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	AssertEq(len(data), len(contents))
+	ExpectTrue(bytes.Equal(data, contents))
+}
+
+func (t *WritebackCacheTest) WritesPastEndOfFile() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Write far beyond the end of an empty file, then at its start.
+	f, err := os.Create(fileName)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("taco"), 1<<20)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	err = f.Close()
+	AssertEq(nil, err)
+
+	// The gap reads as zeroes.
+	expected := make([]byte, 1<<20+4)
+	copy(expected, "burrito")
+	copy(expected[1<<20:], "taco")
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	AssertEq(len(expected), len(contents))
+	ExpectTrue(bytes.Equal(expected, contents))
+}
+
+func (t *WritebackCacheTest) TruncateBetweenBufferedWrites() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+	data := writebackData(1 << 16)
+
+	// Write some data, truncate it away while it may still be buffered, then
+	// write again past the new end of the file.
+	f, err := os.Create(fileName)
+	AssertEq(nil, err)
+
+	_, err = f.Write(data)
+	AssertEq(nil, err)
+
+	err = f.Truncate(10)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("taco"), 100)
+	AssertEq(nil, err)
+
+	err = f.Close()
+	AssertEq(nil, err)
+
+	// None of the truncated data reappears.
+	expected := make([]byte, 104)
+	copy(expected, data[:10])
+	copy(expected[100:], "taco")
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	AssertEq(len(expected), len(contents))
+	ExpectTrue(bytes.Equal(expected, contents))
+}
+
+func (t *WritebackCacheTest) MmapWrite() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+	data := writebackData(3*os.Getpagesize() + 17)
+
+	// Size the file, then fill it through a shared mapping.
+	f, err := os.Create(fileName)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = f.Truncate(int64(len(data)))
+	AssertEq(nil, err)
+
+	m, err := syscall.Mmap(
+		int(f.Fd()),
+		0,
+		len(data),
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+
+	AssertEq(nil, err)
+
+	copy(m, data)
+
+	err = syscall.Munmap(m)
+	AssertEq(nil, err)
+
+	err = f.Close()
+	AssertEq(nil, err)
+
+	// Read it back.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	AssertEq(len(data), len(contents))
+	ExpectTrue(bytes.Equal(data, contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+func (t *MemFSTest) XAttrBufferSizes() {
+	var err error
+
+	// Create a file with two xattrs.
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = syscall.Setxattr(filePath, "user.foo", []byte("hello world"), 0)
+	AssertEq(nil, err)
+
+	err = syscall.Setxattr(filePath, "user.bar", []byte("baz"), 0)
+	AssertEq(nil, err)
+
+	// Ask for the size of a value, then read it into a buffer of that size.
+	n, err := syscall.Getxattr(filePath, "user.foo", nil)
+	AssertEq(nil, err)
+	ExpectEq(len("hello world"), n)
+
+	buf := make([]byte, n)
+	n, err = syscall.Getxattr(filePath, "user.foo", buf)
+	AssertEq(nil, err)
+	ExpectEq("hello world", string(buf[:n]))
+
+	// A buffer that is too small.
+	_, err = syscall.Getxattr(filePath, "user.foo", make([]byte, 4))
+	ExpectEq(syscall.ERANGE, err)
+
+	// The same for the list of names, each of which is NUL-terminated.
+	n, err = syscall.Listxattr(filePath, nil)
+	AssertEq(nil, err)
+	ExpectEq(len("user.foo\x00user.bar\x00"), n)
+
+	buf = make([]byte, n)
+	n, err = syscall.Listxattr(filePath, buf)
+	AssertEq(nil, err)
+	names := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	sort.Strings(names)
+	ExpectThat(names, ElementsAre("user.bar", "user.foo"))
+
+	_, err = syscall.Listxattr(filePath, make([]byte, 4))
+	ExpectEq(syscall.ERANGE, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inodes whose attributes aren't cached
+////////////////////////////////////////////////////////////////////////
+
+type NoCacheTest struct {
+	memFSTest
+
+	// The file system's debug log.
+	log lockedBuffer
+}
+
+func init() { RegisterTestSuite(&NoCacheTest{}) }
+
+func (t *NoCacheTest) SetUp(ti *TestInfo) {
+	t.MountConfig.DebugLogger = log.New(&t.log, "", 0)
+	t.memFSTest.SetUp(ti)
+}
+
+// Return the number of GetInodeAttributesOps that the file system has
+// received for the supplied inode.
+func (t *NoCacheTest) getattrCount(ino uint64) int {
+	re := regexp.MustCompile(fmt.Sprintf(
+		`<- GetInodeAttributes \(inode %d[,)]`,
+		ino))
+
+	return len(re.FindAllString(t.log.String(), -1))
+}
+
+func (t *NoCacheTest) StatFetchesAttributesEveryTime() {
+	const n = 5
+	var err error
+
+	// Create a file marked as not to be cached, and an ordinary one.
+	clockPath := path.Join(t.Dir, "clock")
+	err = ioutil.WriteFile(clockPath, []byte("taco"), 0400)
+	AssertEq(nil, err)
+
+	err = syscall.Setxattr(clockPath, memfs.NoCacheXattr, nil, 0)
+	AssertEq(nil, err)
+
+	plainPath := path.Join(t.Dir, "plain")
+	err = ioutil.WriteFile(plainPath, []byte("burrito"), 0400)
+	AssertEq(nil, err)
+
+	// Stat each once, so that the kernel has whatever it will cache.
+	fi, err := os.Stat(clockPath)
+	AssertEq(nil, err)
+	clockIno := fi.Sys().(*syscall.Stat_t).Ino
+
+	fi, err = os.Stat(plainPath)
+	AssertEq(nil, err)
+	plainIno := fi.Sys().(*syscall.Stat_t).Ino
+
+	clockBefore := t.getattrCount(clockIno)
+	plainBefore := t.getattrCount(plainIno)
+
+	// Stat each repeatedly. Every stat of the uncached file should reach the
+	// file system, and none of those of the other.
+	for i := 0; i < n; i++ {
+		fi, err = os.Stat(clockPath)
+		AssertEq(nil, err)
+		ExpectEq(len("taco"), fi.Size())
+
+		fi, err = os.Stat(plainPath)
+		AssertEq(nil, err)
+		ExpectEq(len("burrito"), fi.Size())
+	}
+
+	ExpectEq(n, t.getattrCount(clockIno)-clockBefore, "Debug log:\n%s", t.log.String())
+	ExpectEq(0, t.getattrCount(plainIno)-plainBefore, "Debug log:\n%s", t.log.String())
+}
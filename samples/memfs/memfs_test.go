@@ -16,14 +16,20 @@ package memfs_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"reflect"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -143,7 +149,7 @@ func (t *MemFSTest) Mkdir_OneLevel() {
 	ExpectTrue(fi.IsDir())
 
 	ExpectNe(0, stat.Ino)
-	ExpectEq(1, stat.Nlink)
+	ExpectEq(2, stat.Nlink)
 	ExpectEq(currentUid(), stat.Uid)
 	ExpectEq(currentGid(), stat.Gid)
 	ExpectEq(0, stat.Size)
@@ -199,7 +205,7 @@ func (t *MemFSTest) Mkdir_TwoLevels() {
 	ExpectTrue(fi.IsDir())
 
 	ExpectNe(0, stat.Ino)
-	ExpectEq(1, stat.Nlink)
+	ExpectEq(2, stat.Nlink)
 	ExpectEq(currentUid(), stat.Uid)
 	ExpectEq(currentGid(), stat.Gid)
 	ExpectEq(0, stat.Size)
@@ -282,6 +288,91 @@ func (t *MemFSTest) Mkdir_PermissionDenied() {
 	ExpectThat(err, Error(HasSubstr("permission denied")))
 }
 
+func (t *MemFSTest) Mkdir_ParentLinkCount() {
+	var err error
+	const n = 5
+
+	nlink := func(p string) uint64 {
+		fi, err := os.Stat(p)
+		AssertEq(nil, err)
+		return uint64(fi.Sys().(*syscall.Stat_t).Nlink)
+	}
+
+	parent := path.Join(t.Dir, "parent")
+	err = os.Mkdir(parent, 0700)
+	AssertEq(nil, err)
+	ExpectEq(2, nlink(parent))
+
+	// Files don't count.
+	err = ioutil.WriteFile(path.Join(parent, "foo"), []byte{}, 0600)
+	AssertEq(nil, err)
+	ExpectEq(2, nlink(parent))
+
+	// Each subdirectory does.
+	for i := 0; i < n; i++ {
+		err = os.Mkdir(path.Join(parent, fmt.Sprintf("dir%d", i)), 0700)
+		AssertEq(nil, err)
+	}
+
+	ExpectEq(n+2, nlink(parent))
+	ExpectEq(3, nlink(t.Dir))
+
+	// Removing one, or moving it elsewhere, updates the count.
+	err = os.Remove(path.Join(parent, "dir0"))
+	AssertEq(nil, err)
+	ExpectEq(n+1, nlink(parent))
+
+	err = os.Rename(path.Join(parent, "dir1"), path.Join(t.Dir, "dir1"))
+	AssertEq(nil, err)
+	ExpectEq(n, nlink(parent))
+	ExpectEq(4, nlink(t.Dir))
+}
+
+func (t *MemFSTest) DirectoryTimesTrackEntryChanges() {
+	var err error
+	dir := path.Join(t.Dir, "dir")
+
+	err = os.Mkdir(dir, 0700)
+	AssertEq(nil, err)
+
+	// Each kind of change to the directory's entries should bump both its mtime
+	// and its ctime.
+	changes := []struct {
+		name string
+		f    func() error
+	}{
+		{"create", func() error {
+			return ioutil.WriteFile(path.Join(dir, "foo"), []byte{}, 0600)
+		}},
+		{"mkdir", func() error { return os.Mkdir(path.Join(dir, "sub"), 0700) }},
+		{"rename", func() error {
+			return os.Rename(path.Join(dir, "foo"), path.Join(dir, "bar"))
+		}},
+		{"unlink", func() error { return os.Remove(path.Join(dir, "bar")) }},
+		{"rmdir", func() error { return os.Remove(path.Join(dir, "sub")) }},
+	}
+
+	for _, c := range changes {
+		// Make sure the times would visibly move.
+		time.Sleep(2 * timeSlop)
+
+		changeTime := time.Now()
+		err = c.f()
+		AssertEq(nil, err, "%s", c.name)
+
+		fi, err := os.Stat(dir)
+		AssertEq(nil, err)
+
+		ExpectThat(fi, fusetesting.MtimeIsWithin(changeTime, timeSlop), "%s", c.name)
+
+		_, ctime, _ := fusetesting.GetTimes(fi)
+		ExpectThat(
+			ctime.Sub(changeTime),
+			AllOf(GreaterThan(-timeSlop), LessThan(timeSlop)),
+			"%s", c.name)
+	}
+}
+
 func (t *MemFSTest) CreateNewFile_InRoot() {
 	var err error
 	var fi os.FileInfo
@@ -910,6 +1001,72 @@ func (t *MemFSTest) ReadsPastEndOfFile() {
 	ExpectEq("", string(buf[:n]))
 }
 
+func (t *MemFSTest) ZeroLengthReadsAndWrites() {
+	var err error
+	var n int
+
+	// Create a file.
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	_, err = f.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// Use the system calls directly, so that nothing skips them on our behalf.
+	fd := int(f.Fd())
+
+	n, err = syscall.Pread(fd, []byte{}, 0)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	n, err = syscall.Pwrite(fd, []byte{}, 0)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	// Even past the end of the file, an empty write doesn't extend it.
+	n, err = syscall.Pwrite(fd, []byte{}, 100)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+
+	contents, err := ioutil.ReadFile(f.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *MemFSTest) PreadsAtAndPastEndOfFile() {
+	var err error
+	var n int
+	buf := make([]byte, 4)
+
+	// Create a file with some contents.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// pread(2) doesn't treat EOF as an error, so neither should memfs. A read
+	// straddling EOF returns the valid bytes only.
+	n, err = syscall.Pread(int(f.Fd()), buf, 2)
+	AssertEq(nil, err)
+	ExpectEq("co", string(buf[:n]))
+
+	// Reads starting at and past EOF return nothing.
+	n, err = syscall.Pread(int(f.Fd()), buf, 4)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+
+	n, err = syscall.Pread(int(f.Fd()), buf, 100)
+	AssertEq(nil, err)
+	ExpectEq(0, n)
+}
+
 func (t *MemFSTest) Truncate_Smaller() {
 	var err error
 	fileName := path.Join(t.Dir, "foo")
@@ -1152,6 +1309,29 @@ func (t *MemFSTest) CreateSymlink_AlreadyExists() {
 	}
 }
 
+func (t *MemFSTest) OpenFileWithODirectory() {
+	fileName := path.Join(t.Dir, "foo")
+	err := ioutil.WriteFile(fileName, []byte("taco"), 0400)
+	AssertEq(nil, err)
+
+	_, err = syscall.Open(fileName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	ExpectEq(syscall.ENOTDIR, err)
+}
+
+func (t *MemFSTest) ReadDirectoryAsFile() {
+	dirName := path.Join(t.Dir, "foo")
+	err := os.Mkdir(dirName, 0700)
+	AssertEq(nil, err)
+
+	// Opening without O_DIRECTORY succeeds, but reading doesn't.
+	fd, err := syscall.Open(dirName, syscall.O_RDONLY, 0)
+	AssertEq(nil, err)
+	defer syscall.Close(fd)
+
+	_, err = syscall.Read(fd, make([]byte, 16))
+	ExpectEq(syscall.EISDIR, err)
+}
+
 func (t *MemFSTest) ReadLink_NonExistent() {
 	_, err := os.Readlink(path.Join(t.Dir, "foo"))
 	ExpectTrue(os.IsNotExist(err), "err: %v", err)
@@ -1365,6 +1545,68 @@ func (t *MemFSTest) DeleteHardlink() {
 	AssertEq(nil, err)
 }
 
+func (t *MemFSTest) Hardlink_LinkCounts() {
+	var err error
+
+	// Create a file, and a link to it in a subdirectory.
+	fileName := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	linkName := path.Join(t.Dir, "dir/bar")
+	err = os.Link(fileName, linkName)
+	AssertEq(nil, err)
+
+	// Both names refer to the same inode, with two links.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectEq(2, fi.Sys().(*syscall.Stat_t).Nlink)
+
+	linkFi, err := os.Stat(linkName)
+	AssertEq(nil, err)
+	ExpectEq(2, linkFi.Sys().(*syscall.Stat_t).Nlink)
+	ExpectTrue(os.SameFile(fi, linkFi))
+
+	// Writes through one name are seen through the other.
+	err = ioutil.WriteFile(linkName, []byte("burrito"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Removing the original leaves the link working, with one link.
+	err = os.Remove(fileName)
+	AssertEq(nil, err)
+
+	fi, err = os.Stat(linkName)
+	AssertEq(nil, err)
+	ExpectEq(1, fi.Sys().(*syscall.Stat_t).Nlink)
+
+	contents, err = ioutil.ReadFile(linkName)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Replacing the link by renaming over it removes it too.
+	otherName := path.Join(t.Dir, "baz")
+	err = ioutil.WriteFile(otherName, []byte("enchilada"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.Open(linkName)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = os.Rename(otherName, linkName)
+	AssertEq(nil, err)
+
+	fi, err = f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(0, fi.Sys().(*syscall.Stat_t).Nlink)
+}
+
 func (t *MemFSTest) ReadHardlink() {
 	var err error
 
@@ -1960,3 +2202,609 @@ func (t *MknodTest) NonExistentParent() {
 	err = syscall.Mknod(p, syscall.S_IFREG|0600, 0)
 	ExpectEq(syscall.ENOENT, err)
 }
+
+////////////////////////////////////////////////////////////////////////
+// Fixed umask
+////////////////////////////////////////////////////////////////////////
+
+type FixedUmaskTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&FixedUmaskTest{}) }
+
+func (t *FixedUmaskTest) SetUp(ti *TestInfo) {
+	umask := os.FileMode(0027)
+	t.MountConfig.ApplyUmask = true
+	t.MountConfig.Umask = &umask
+
+	t.memFSTest.SetUp(ti)
+}
+
+func (t *FixedUmaskTest) IgnoresCallerUmask() {
+	// The umask is applied by the kernel on OS X.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	var err error
+	var fi os.FileInfo
+
+	// Try a few different caller umasks, none of which should matter.
+	for i, callerUmask := range []int{0, 0022, 0077} {
+		oldUmask := syscall.Umask(callerUmask)
+
+		// File
+		p := path.Join(t.Dir, fmt.Sprintf("file%d", i))
+		err = ioutil.WriteFile(p, []byte{}, 0666)
+		AssertEq(nil, err)
+
+		fi, err = os.Stat(p)
+		AssertEq(nil, err)
+		ExpectEq(os.FileMode(0640), fi.Mode(), "caller umask %04o", callerUmask)
+
+		// Directory
+		p = path.Join(t.Dir, fmt.Sprintf("dir%d", i))
+		err = os.Mkdir(p, 0777)
+		AssertEq(nil, err)
+
+		fi, err = os.Stat(p)
+		AssertEq(nil, err)
+		ExpectEq(os.ModeDir|0750, fi.Mode(), "caller umask %04o", callerUmask)
+
+		syscall.Umask(oldUmask)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// noexec
+////////////////////////////////////////////////////////////////////////
+
+type NoExecTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&NoExecTest{}) }
+
+func (t *NoExecTest) SetUp(ti *TestInfo) {
+	t.MountConfig.NoExec = true
+	t.memFSTest.SetUp(ti)
+}
+
+func (t *NoExecTest) ExecuteFails() {
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	// Create a script that would happily run anywhere else.
+	err = ioutil.WriteFile(p, []byte("#!/bin/sh\nexit 0\n"), 0755)
+	AssertEq(nil, err)
+
+	// The permission bits say it's executable.
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(applyUmask(0755), fi.Mode())
+
+	// But the kernel refuses to execute it.
+	err = exec.Command(p).Run()
+	AssertNe(nil, err)
+
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "Unexpected error: %v", err)
+	ExpectEq(syscall.EACCES, pathErr.Err)
+
+	// Reading it is still fine.
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("#!/bin/sh\nexit 0\n", string(contents))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Maximum file size
+////////////////////////////////////////////////////////////////////////
+
+const maxFileSize = 1024
+
+type MaxFileSizeTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&MaxFileSizeTest{}) }
+
+func (t *MaxFileSizeTest) SetUp(ti *TestInfo) {
+	t.MountConfig.MaxFileSize = maxFileSize
+
+	// Otherwise writes land in the page cache, and the error is seen only when
+	// they're written back.
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.memFSTest.SetUp(ti)
+}
+
+func (t *MaxFileSizeTest) WriteUpToLimit() {
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	err = ioutil.WriteFile(p, bytes.Repeat([]byte("a"), maxFileSize), 0600)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(maxFileSize, fi.Size())
+}
+
+func (t *MaxFileSizeTest) WriteBeyondLimit() {
+	var err error
+	var n int
+
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	// Starting at the limit.
+	n, err = f.WriteAt([]byte("taco"), maxFileSize)
+	ExpectEq(0, n)
+
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "Unexpected error: %v", err)
+	ExpectEq(syscall.EFBIG, pathErr.Err)
+
+	// Straddling the limit. The kernel is given a short write, and Go retries
+	// the remainder at the limit. (Use Write rather than WriteAt, which with
+	// some versions of Go drops the count of bytes written before an error.)
+	_, err = f.Seek(maxFileSize-2, 0)
+	AssertEq(nil, err)
+
+	n, err = f.Write([]byte("taco"))
+	ExpectEq(2, n)
+
+	pathErr, ok = err.(*os.PathError)
+	AssertTrue(ok, "Unexpected error: %v", err)
+	ExpectEq(syscall.EFBIG, pathErr.Err)
+
+	// The part that fit was written.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(maxFileSize, fi.Size())
+
+	buf := make([]byte, 2)
+	_, err = f.ReadAt(buf, maxFileSize-2)
+	AssertEq(nil, err)
+	ExpectEq("ta", string(buf))
+}
+
+func (t *MaxFileSizeTest) TruncateBeyondLimit() {
+	var err error
+
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = f.Truncate(maxFileSize + 1)
+	pathErr, ok := err.(*os.PathError)
+	AssertTrue(ok, "Unexpected error: %v", err)
+	ExpectEq(syscall.EFBIG, pathErr.Err)
+
+	// Truncating to the limit itself is fine.
+	err = f.Truncate(maxFileSize)
+	AssertEq(nil, err)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(maxFileSize, fi.Size())
+}
+
+////////////////////////////////////////////////////////////////////////
+// Sticky bit
+////////////////////////////////////////////////////////////////////////
+
+type StickyBitTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&StickyBitTest{}) }
+
+func (t *StickyBitTest) SetUp(ti *TestInfo) {
+	// Other users need to be able to reach the file system.
+	if os.Getuid() == 0 {
+		t.MountConfig.AllowOther = true
+	}
+
+	t.memFSTest.SetUp(ti)
+}
+
+// Run the supplied command as the supplied user.
+func runAs(uid uint32, name string, args ...string) (err error) {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uid, Gid: uid},
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%v: %s", err, out)
+		return
+	}
+
+	return
+}
+
+func (t *StickyBitTest) ModeIsReported() {
+	var err error
+	dirName := path.Join(t.Dir, "dir")
+
+	err = os.Mkdir(dirName, 0700)
+	AssertEq(nil, err)
+
+	err = os.Chmod(dirName, os.ModeSticky|0777)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(dirName)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeDir|os.ModeSticky|0777, fi.Mode())
+}
+
+func (t *StickyBitTest) OtherUsersCantDelete() {
+	// Switching users requires root.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	const owner = 1001
+	const other = 1002
+
+	var err error
+	dirName := path.Join(t.Dir, "tmp")
+	fileName := path.Join(dirName, "foo")
+
+	// Set up a world-writable sticky directory, like /tmp.
+	err = os.Chmod(t.Dir, 0755)
+	AssertEq(nil, err)
+
+	err = os.Mkdir(dirName, 0700)
+	AssertEq(nil, err)
+
+	err = os.Chmod(dirName, os.ModeSticky|0777)
+	AssertEq(nil, err)
+
+	// Create a file as one user.
+	err = runAs(owner, "touch", fileName)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectEq(owner, fi.Sys().(*syscall.Stat_t).Uid)
+
+	// Another user can neither delete it nor rename it away.
+	err = runAs(other, "rm", "-f", fileName)
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	err = runAs(other, "mv", fileName, path.Join(dirName, "bar"))
+	ExpectThat(err, Error(HasSubstr("not permitted")))
+
+	_, err = os.Stat(fileName)
+	ExpectEq(nil, err)
+
+	// The owner can.
+	err = runAs(owner, "rm", "-f", fileName)
+	AssertEq(nil, err)
+
+	_, err = os.Stat(fileName)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Killing privileges
+////////////////////////////////////////////////////////////////////////
+
+type KillPrivilegesTest struct {
+	memFSTest
+}
+
+func init() { RegisterTestSuite(&KillPrivilegesTest{}) }
+
+func (t *KillPrivilegesTest) SetUp(ti *TestInfo) {
+	// Other users need to be able to reach the file system.
+	if os.Getuid() == 0 {
+		t.MountConfig.AllowOther = true
+	}
+
+	t.MountConfig.HandleKillPrivileges = true
+	t.memFSTest.SetUp(ti)
+}
+
+func (t *KillPrivilegesTest) UnprivilegedModificationClearsBits() {
+	// Switching users requires root, and it's only unprivileged writers whose
+	// modifications clear the bits.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	const other = 1002
+
+	var err error
+
+	err = os.Chmod(t.Dir, 0755)
+	AssertEq(nil, err)
+
+	testCases := []struct {
+		name     string
+		mode     os.FileMode
+		expected os.FileMode
+		cmd      string
+	}{
+		// Set-user-ID is always cleared, and set-group-ID is cleared when it
+		// applies to execution.
+		{"write", os.ModeSetuid | os.ModeSetgid | 0777, 0777, "echo taco >> %s"},
+		{"truncate", os.ModeSetuid | os.ModeSetgid | 0777, 0777, "truncate -s 0 %s"},
+
+		// Set-group-ID without group execute means mandatory locking, and is
+		// left alone.
+		{"no group exec", os.ModeSetgid | 0766, os.ModeSetgid | 0766, "echo taco >> %s"},
+	}
+
+	for _, tc := range testCases {
+		fileName := path.Join(t.Dir, tc.name)
+
+		err = ioutil.WriteFile(fileName, []byte("burrito"), 0600)
+		AssertEq(nil, err)
+
+		err = os.Chmod(fileName, tc.mode)
+		AssertEq(nil, err)
+
+		err = runAs(other, "sh", "-c", fmt.Sprintf(tc.cmd, fileName))
+		AssertEq(nil, err, "%s", tc.name)
+
+		fi, err := os.Stat(fileName)
+		AssertEq(nil, err)
+		ExpectEq(tc.expected, fi.Mode(), "%s", tc.name)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inode limit
+////////////////////////////////////////////////////////////////////////
+
+const inodeLimit = 8
+
+type InodeLimitTest struct {
+	samples.SampleTest
+}
+
+func init() { RegisterTestSuite(&InodeLimitTest{}) }
+
+func (t *InodeLimitTest) SetUp(ti *TestInfo) {
+	t.Server = memfs.NewMemFSWithInodeLimit(
+		currentUid(),
+		currentGid(),
+		inodeLimit)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *InodeLimitTest) CreateUntilFull() {
+	var err error
+	var stat syscall.Statfs_t
+
+	// Initially only the root is in use.
+	err = syscall.Statfs(t.Dir, &stat)
+	AssertEq(nil, err)
+	ExpectEq(inodeLimit, stat.Files)
+	ExpectEq(inodeLimit-1, stat.Ffree)
+
+	// Create files until the limit is reached.
+	for i := 1; i < inodeLimit; i++ {
+		err = ioutil.WriteFile(path.Join(t.Dir, fmt.Sprint(i)), nil, 0600)
+		AssertEq(nil, err)
+	}
+
+	err = syscall.Statfs(t.Dir, &stat)
+	AssertEq(nil, err)
+	ExpectEq(inodeLimit, stat.Files)
+	ExpectEq(0, stat.Ffree)
+
+	// Further creates fail.
+	err = ioutil.WriteFile(path.Join(t.Dir, "file"), nil, 0600)
+	ExpectThat(err, Error(HasSubstr("no space left")))
+
+	err = os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	ExpectThat(err, Error(HasSubstr("no space left")))
+
+	err = os.Symlink("1", path.Join(t.Dir, "symlink"))
+	ExpectThat(err, Error(HasSubstr("no space left")))
+
+	// df agrees. Its --output flag is specific to GNU coreutils.
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	out, err := exec.Command("df", "-i", "--output=itotal,ifree", t.Dir).CombinedOutput()
+	AssertEq(nil, err, "%s", out)
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	AssertEq(2, len(lines), "%s", out)
+	ExpectThat(strings.Fields(lines[1]), ElementsAre(fmt.Sprint(inodeLimit), "0"))
+}
+
+func (t *InodeLimitTest) UnlinkingFreesInodes() {
+	var err error
+
+	// Fill the file system, with one file having a second link.
+	for i := 1; i < inodeLimit; i++ {
+		err = ioutil.WriteFile(path.Join(t.Dir, fmt.Sprint(i)), nil, 0600)
+		AssertEq(nil, err)
+	}
+
+	err = os.Link(path.Join(t.Dir, "1"), path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+
+	// Removing one of the links doesn't free the inode.
+	err = os.Remove(path.Join(t.Dir, "1"))
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.Dir, "file"), nil, 0600)
+	ExpectThat(err, Error(HasSubstr("no space left")))
+
+	// Removing the other does, once the kernel forgets the inode. It does so
+	// asynchronously, so allow it some time.
+	err = os.Remove(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = ioutil.WriteFile(path.Join(t.Dir, "file"), nil, 0600)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ExpectEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Handles supplied to getattr
+////////////////////////////////////////////////////////////////////////
+
+// A buffer that may be written by the file system while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer // GUARDED_BY(mu)
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+type GetattrHandleTest struct {
+	memFSTest
+
+	// The file system's debug log.
+	log lockedBuffer
+}
+
+func init() { RegisterTestSuite(&GetattrHandleTest{}) }
+
+func (t *GetattrHandleTest) SetUp(ti *TestInfo) {
+	t.MountConfig.DebugLogger = log.New(&t.log, "", 0)
+
+	// Otherwise the kernel keeps the size of a file being written itself, and
+	// has no need to ask.
+	t.MountConfig.DisableWritebackCaching = true
+
+	t.memFSTest.SetUp(ti)
+}
+
+func (t *GetattrHandleTest) OpenAndWrittenFile() {
+	// This relies on Linux supplying the handle when it refreshes the size of
+	// an open file for lseek(2).
+	if runtime.GOOS != "linux" {
+		return
+	}
+
+	var err error
+
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	_, err = f.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// The write invalidated the size, so seeking relative to the end makes the
+	// kernel fetch it, on behalf of the open file.
+	off, err := f.Seek(0, io.SeekEnd)
+	AssertEq(nil, err)
+	ExpectEq(4, off)
+
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+
+	// The file system should have been given the handle.
+	re := regexp.MustCompile(fmt.Sprintf(
+		`GetInodeAttributes \(inode %d, handle \d+\)`,
+		fi.Sys().(*syscall.Stat_t).Ino))
+
+	ExpectTrue(re.MatchString(t.log.String()), "Debug log:\n%s", t.log.String())
+}
+
+////////////////////////////////////////////////////////////////////////
+// Multiple mounts
+////////////////////////////////////////////////////////////////////////
+
+type MultipleMountsTest struct {
+	memFSTest
+
+	// A second mount of t.Server.
+	otherDir string
+	otherMFS *fuse.MountedFileSystem
+}
+
+func init() { RegisterTestSuite(&MultipleMountsTest{}) }
+
+func (t *MultipleMountsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.memFSTest.SetUp(ti)
+
+	t.otherDir, err = ioutil.TempDir("", "memfs_test")
+	AssertEq(nil, err)
+
+	t.otherMFS, err = fuse.Mount(t.otherDir, t.Server, &t.MountConfig)
+	AssertEq(nil, err)
+}
+
+func (t *MultipleMountsTest) TearDown() {
+	// Unmount the second mount first, so that the file system is destroyed only
+	// by the last.
+	AssertEq(nil, fuse.Unmount(t.otherDir))
+	AssertEq(nil, t.otherMFS.Join(t.Ctx))
+	AssertEq(nil, os.Remove(t.otherDir))
+
+	t.memFSTest.TearDown()
+}
+
+func (t *MultipleMountsTest) StateIsShared() {
+	var err error
+
+	// Write a file through one mount, and read it through the other.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := ioutil.ReadFile(path.Join(t.otherDir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// And the other way around.
+	err = os.Mkdir(path.Join(t.otherDir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("foo", entries[0].Name())
+	ExpectEq("dir", entries[1].Name())
+
+	// Each mount is a distinct kernel connection, and so a distinct device, but
+	// inode IDs are the file system's own and are shared.
+	fi0, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	fi1, err := os.Stat(path.Join(t.otherDir, "foo"))
+	AssertEq(nil, err)
+
+	stat0 := fi0.Sys().(*syscall.Stat_t)
+	stat1 := fi1.Sys().(*syscall.Stat_t)
+	ExpectEq(stat0.Ino, stat1.Ino)
+	ExpectNe(stat0.Dev, stat1.Dev)
+}
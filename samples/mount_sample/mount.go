@@ -26,7 +26,9 @@ import (
 	"syscall"
 
 	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
 	"github.com/sbg/fuse/samples/flushfs"
+	"github.com/sbg/fuse/samples/slowfs"
 	"golang.org/x/net/context"
 )
 
@@ -39,6 +41,9 @@ var fFsyncsFile = flag.Uint64("flushfs.fsyncs_file", 0, "")
 var fFlushError = flag.Int("flushfs.flush_error", 0, "")
 var fFsyncError = flag.Int("flushfs.fsync_error", 0, "")
 
+var fSlowManifest = flag.String("slowfs.manifest", "", "Manifest for the tree to serve; see fuseutil.ReadManifestFS.")
+var fSlowConfig = flag.String("slowfs.config", "", "JSON latency and error config; see slowfs.ParseConfig.")
+
 var fReadOnly = flag.Bool("read_only", false, "Mount in read-only mode.")
 var fDebug = flag.Bool("debug", false, "Enable debug logging.")
 
@@ -91,6 +96,49 @@ func makeFlushFS() (server fuse.Server, err error) {
 	return
 }
 
+func makeSlowFS() (server fuse.Server, err error) {
+	// Check the flags.
+	if *fSlowManifest == "" || *fSlowConfig == "" {
+		err = fmt.Errorf("You must set the slowfs flags.")
+		return
+	}
+
+	// Load the tree to serve.
+	wrapped, err := fuseutil.LoadManifestFS(
+		*fSlowManifest,
+		uint32(os.Getuid()),
+		uint32(os.Getgid()))
+
+	if err != nil {
+		err = fmt.Errorf("LoadManifestFS: %v", err)
+		return
+	}
+
+	// Load the config.
+	f, err := os.Open(*fSlowConfig)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	cfg, err := slowfs.ParseConfig(f)
+	if err != nil {
+		err = fmt.Errorf("ParseConfig: %v", err)
+		return
+	}
+
+	// Create the file system.
+	fs, err := slowfs.NewSlowFS(wrapped, cfg)
+	if err != nil {
+		err = fmt.Errorf("NewSlowFS: %v", err)
+		return
+	}
+
+	server = fuseutil.NewFileSystemServer(fs)
+	return
+}
+
 func makeFS() (server fuse.Server, err error) {
 	switch *fType {
 	default:
@@ -98,6 +146,9 @@ func makeFS() (server fuse.Server, err error) {
 
 	case "flushfs":
 		server, err = makeFlushFS()
+
+	case "slowfs":
+		server, err = makeSlowFS()
 	}
 
 	return
@@ -0,0 +1,201 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pollfs
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+const eventsID = fuseops.RootInodeID + 1
+
+// Create a file system whose root contains a single file named "events",
+// from which the events given to Post can be read, one per line. Reading
+// consumes the events pending at the time, and returns no data when there are
+// none. The file is readable as far as poll(2) is concerned exactly when
+// events are pending, and pollers waiting for it are woken up by Post.
+func NewPollFS() (fs *PollFS) {
+	impl := &pollFS{
+		waiting: make(map[uint64]struct{}),
+	}
+
+	fs = &PollFS{
+		impl:   impl,
+		server: fuseutil.NewFileSystemServer(impl),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// PollFS
+////////////////////////////////////////////////////////////////////////
+
+type PollFS struct {
+	impl   *pollFS
+	server fuse.Server
+}
+
+func (fs *PollFS) ServeOps(c *fuse.Connection) {
+	fs.impl.mu.Lock()
+	fs.impl.conn = c
+	fs.impl.mu.Unlock()
+
+	fs.server.ServeOps(c)
+}
+
+// Make an event available for reading, waking up anyone polling the events
+// file.
+func (fs *PollFS) Post(event string) (err error) {
+	fs.impl.mu.Lock()
+	defer fs.impl.mu.Unlock()
+
+	fs.impl.pending = append(fs.impl.pending, event+"\n"...)
+
+	// Waking up doesn't wait for the kernel to poll again, so it's fine to do
+	// so with the lock held. Doing so ensures that a poll can't see no
+	// pending events and then register too late to be woken.
+	for kh := range fs.impl.waiting {
+		if err = fs.impl.conn.NotifyPollWakeup(kh); err != nil {
+			return
+		}
+
+		delete(fs.impl.waiting, kh)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Implementation
+////////////////////////////////////////////////////////////////////////
+
+type pollFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// The connection on which we're serving, for waking up pollers.
+	//
+	// GUARDED_BY(mu)
+	conn *fuse.Connection
+
+	// Events posted but not yet read, each followed by a newline.
+	//
+	// GUARDED_BY(mu)
+	pending []byte
+
+	// The kernel handles of polls waiting for an event to be posted.
+	//
+	// GUARDED_BY(mu)
+	waiting map[uint64]struct{}
+}
+
+func (fs *pollFS) attributes(inode fuseops.InodeID) (
+	attrs fuseops.InodeAttributes,
+	err error) {
+	switch inode {
+	case fuseops.RootInodeID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0555 | os.ModeDir,
+		}
+
+	case eventsID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+		}
+
+	default:
+		err = fuse.ENOENT
+	}
+
+	return
+}
+
+func (fs *pollFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *pollFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "events" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = eventsID
+	op.Entry.Attributes, err = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *pollFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes, err = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *pollFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	// The file's contents change without its size doing so, so reads must
+	// reach us rather than the page cache.
+	op.UseDirectIO = true
+	op.NonSeekable = true
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *pollFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.BytesRead = copy(op.Dst, fs.pending)
+	fs.pending = fs.pending[op.BytesRead:]
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *pollFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.pending) > 0 {
+		op.Revents = fuseops.PollIn
+		return
+	}
+
+	// Nothing is ready. Remember to wake up the kernel when something is.
+	if op.ScheduleNotify {
+		fs.waiting[op.KernelHandle] = struct{}{}
+	}
+
+	return
+}
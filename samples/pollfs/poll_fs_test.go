@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pollfs_test
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/pollfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPollFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PollFSTest struct {
+	samples.SampleTest
+	fs *pollfs.PollFS
+
+	// A descriptor for the events file, opened without Go's poller so that
+	// the test controls when the file is polled.
+	fd int
+}
+
+func init() { RegisterTestSuite(&PollFSTest{}) }
+
+func (t *PollFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.fs = pollfs.NewPollFS()
+	t.Server = t.fs
+	t.SampleTest.SetUp(ti)
+
+	t.fd, err = unix.Open(path.Join(t.Dir, "events"), unix.O_RDONLY, 0)
+	AssertEq(nil, err)
+}
+
+func (t *PollFSTest) TearDown() {
+	unix.Close(t.fd)
+	t.SampleTest.TearDown()
+}
+
+// Poll the events file for readability with the supplied timeout, returning
+// the events reported.
+func (t *PollFSTest) poll(timeout time.Duration) (revents int16, err error) {
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN}}
+	_, err = unix.Poll(fds, int(timeout/time.Millisecond))
+	revents = fds[0].Revents
+	return
+}
+
+func (t *PollFSTest) read() string {
+	buf := make([]byte, 1024)
+	n, err := unix.Read(t.fd, buf)
+	AssertEq(nil, err)
+
+	return string(buf[:n])
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PollFSTest) NothingPending() {
+	revents, err := t.poll(0)
+	AssertEq(nil, err)
+	ExpectEq(0, revents)
+
+	ExpectEq("", t.read())
+}
+
+func (t *PollFSTest) EventAlreadyPending() {
+	AssertEq(nil, t.fs.Post("taco"))
+
+	revents, err := t.poll(0)
+	AssertEq(nil, err)
+	ExpectEq(unix.POLLIN, revents)
+
+	// Reading consumes the event.
+	ExpectEq("taco\n", t.read())
+
+	revents, err = t.poll(0)
+	AssertEq(nil, err)
+	ExpectEq(0, revents)
+}
+
+func (t *PollFSTest) PostWakesPoller() {
+	// Start polling in the background, with nothing pending.
+	type result struct {
+		revents int16
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		var r result
+		r.revents, r.err = t.poll(10 * time.Second)
+		done <- r
+	}()
+
+	// The poll should block.
+	select {
+	case r := <-done:
+		AddFailure("Poll returned early: %#v", r)
+		AbortTest()
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Posting an event should wake it up, and it should find the file
+	// readable.
+	AssertEq(nil, t.fs.Post("burrito"))
+
+	r := <-done
+	AssertEq(nil, r.err)
+	ExpectEq(unix.POLLIN, r.revents)
+
+	ExpectEq("burrito\n", t.read())
+}
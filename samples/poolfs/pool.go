@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poolfs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Pool stands in for a connection pool to a remote backend holding a fixed set
+// of files. Connections are a scarce resource, so it keeps count of how many
+// are open.
+//
+// Safe for concurrent use.
+type Pool struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	files map[string]string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of connections dialed and not yet closed.
+	//
+	// GUARDED_BY(mu)
+	open int
+}
+
+// NewPool creates a pool for a backend holding files with the supplied names
+// and contents.
+func NewPool(files map[string]string) (p *Pool) {
+	p = &Pool{
+		files: files,
+	}
+
+	return
+}
+
+// Names returns the names of the backend's files, in sorted order.
+func (p *Pool) Names() (names []string) {
+	for name := range p.files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// Size returns the size of the named file.
+func (p *Pool) Size(name string) uint64 {
+	return uint64(len(p.files[name]))
+}
+
+// Dial opens a connection through which the named file can be read.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Pool) Dial(name string) (c *Conn, err error) {
+	contents, ok := p.files[name]
+	if !ok {
+		err = fmt.Errorf("Unknown file: %q", name)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.open++
+	c = &Conn{
+		pool:     p,
+		contents: contents,
+	}
+
+	return
+}
+
+// Open returns the number of connections that are currently open.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *Pool) Open() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.open
+}
+
+// Conn is an open connection to a file in the backend. It is not safe for
+// concurrent use.
+type Conn struct {
+	pool     *Pool
+	contents string
+	closed   bool
+}
+
+// ReadAt reads from the file, in the manner of io.ReaderAt.
+func (c *Conn) ReadAt(p []byte, off int64) (n int, err error) {
+	if c.closed {
+		panic("ReadAt called on closed connection.")
+	}
+
+	if off >= int64(len(c.contents)) {
+		err = io.EOF
+		return
+	}
+
+	n = copy(p, c.contents[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+// Close closes the connection, returning it to the pool.
+func (c *Conn) Close() (err error) {
+	if c.closed {
+		panic("Close called twice.")
+	}
+
+	c.closed = true
+
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	c.pool.open--
+	return
+}
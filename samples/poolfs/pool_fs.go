@@ -0,0 +1,327 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poolfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// PoolFS is a read-only file system whose root contains the files of a
+// backend reached through a Pool, demonstrating how to back file handles with
+// scarce backend resources.
+//
+// The kernel alone decides how long a handle lives: it is released only once
+// the application has closed every descriptor for the file and unmapped it.
+// There is no way to ask the kernel to give a handle back early, and
+// invalidating the inode or its entry doesn't help, since that drops cached
+// data and names but never closes files. So rather than tying a connection to
+// the handle for its whole life, each handle dials one lazily on its first
+// read after being opened or going idle, and CloseIdleConns closes those that
+// haven't been used for a while. The file stays open as far as the
+// application is concerned, and the next read simply dials again.
+//
+// A real file system would call CloseIdleConns periodically, for example from
+// a goroutine driven by a time.Ticker.
+type PoolFS interface {
+	fuseutil.FileSystem
+
+	// Close the backend connections of handles that have not been read
+	// through for at least the idle timeout.
+	CloseIdleConns()
+}
+
+// Create a file system serving the files of the supplied pool, whose handles
+// give up their connections after idleTimeout without use as measured by the
+// supplied clock. Files are opened in direct I/O mode so that every read
+// reaches the file system, and with it the backend.
+func NewPoolFS(
+	pool *Pool,
+	clock timeutil.Clock,
+	idleTimeout time.Duration) PoolFS {
+	fs := &poolFS{
+		pool:        pool,
+		clock:       clock,
+		idleTimeout: idleTimeout,
+		names:       pool.Names(),
+		handles:     make(map[fuseops.HandleID]*handle),
+	}
+
+	return fs
+}
+
+type poolFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	pool        *Pool
+	clock       timeutil.Clock
+	idleTimeout time.Duration
+
+	// The names of the files in the root, in order. The file at index i has
+	// inode ID fuseops.RootInodeID + 1 + i.
+	names []string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The open file handles.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*handle
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+}
+
+// The state behind a file handle.
+type handle struct {
+	name string
+
+	mu sync.Mutex
+
+	// The backend connection, or nil if none has been dialed since the handle
+	// was opened or last went idle.
+	//
+	// GUARDED_BY(mu)
+	conn *Conn
+
+	// The time at which conn was last used.
+	//
+	// GUARDED_BY(mu)
+	lastUsed time.Time
+}
+
+// Return the name of the file with the supplied inode ID, or false if there
+// is no such file.
+func (fs *poolFS) findName(inode fuseops.InodeID) (name string, ok bool) {
+	i := int(inode) - int(fuseops.RootInodeID) - 1
+	if i < 0 || i >= len(fs.names) {
+		return
+	}
+
+	name = fs.names[i]
+	ok = true
+	return
+}
+
+func (fs *poolFS) attributes(inode fuseops.InodeID) (
+	attrs fuseops.InodeAttributes,
+	err error) {
+	if inode == fuseops.RootInodeID {
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0555 | os.ModeDir,
+		}
+
+		return
+	}
+
+	name, ok := fs.findName(inode)
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	attrs = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  fs.pool.Size(name),
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) CloseIdleConns() {
+	// Find the handles, without holding the lock while closing connections.
+	fs.mu.Lock()
+	handles := make([]*handle, 0, len(fs.handles))
+	for _, h := range fs.handles {
+		handles = append(handles, h)
+	}
+	fs.mu.Unlock()
+
+	now := fs.clock.Now()
+	for _, h := range handles {
+		h.mu.Lock()
+		if h.conn != nil && now.Sub(h.lastUsed) >= fs.idleTimeout {
+			h.conn.Close()
+			h.conn = nil
+		}
+		h.mu.Unlock()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *poolFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *poolFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID {
+		err = fuse.ENOENT
+		return
+	}
+
+	for i, name := range fs.names {
+		if name == op.Name {
+			op.Entry.Child = fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+			op.Entry.Attributes, err = fs.attributes(op.Entry.Child)
+			return
+		}
+	}
+
+	err = fuse.ENOENT
+	return
+}
+
+func (fs *poolFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes, err = fs.attributes(op.Inode)
+	return
+}
+
+func (fs *poolFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if op.Inode != fuseops.RootInodeID {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	return
+}
+
+func (fs *poolFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	if op.Offset > fuseops.DirOffset(len(fs.names)) {
+		err = fuse.EIO
+		return
+	}
+
+	for i := int(op.Offset); i < len(fs.names); i++ {
+		e := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  fuseops.RootInodeID + 1 + fuseops.InodeID(i),
+			Name:   fs.names[i],
+			Type:   fuseutil.DT_File,
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	name, ok := fs.findName(op.Inode)
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Don't dial yet; the application may never read.
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.handles[op.Handle] = &handle{name: name}
+
+	op.UseDirectIO = true
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	h := fs.handles[op.Handle]
+	fs.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Dial if the handle has no connection.
+	if h.conn == nil {
+		h.conn, err = fs.pool.Dial(h.name)
+		if err != nil {
+			return
+		}
+	}
+
+	h.lastUsed = fs.clock.Now()
+
+	op.BytesRead, err = h.conn.ReadAt(op.Dst, op.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.mu.Lock()
+	h := fs.handles[op.Handle]
+	delete(fs.handles, op.Handle)
+	fs.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn != nil {
+		h.conn.Close()
+		h.conn = nil
+	}
+
+	return
+}
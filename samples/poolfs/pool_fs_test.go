@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package poolfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/poolfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPoolFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const idleTimeout = time.Minute
+
+type PoolFSTest struct {
+	samples.SampleTest
+	pool *poolfs.Pool
+	fs   poolfs.PoolFS
+}
+
+func init() { RegisterTestSuite(&PoolFSTest{}) }
+
+func (t *PoolFSTest) SetUp(ti *TestInfo) {
+	t.pool = poolfs.NewPool(map[string]string{
+		"foo": "taco",
+		"bar": "burrito",
+	})
+
+	t.fs = poolfs.NewPoolFS(t.pool, &t.Clock, idleTimeout)
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+
+	t.SampleTest.SetUp(ti)
+}
+
+// Read the whole of the supplied file from its start.
+func (t *PoolFSTest) readAll(f *os.File) string {
+	buf := make([]byte, 1024)
+	n, err := f.ReadAt(buf, 0)
+	if n == 0 {
+		AssertEq(nil, err)
+	}
+
+	return string(buf[:n])
+}
+
+// Return the number of open connections once it reaches the expected number,
+// or after a second if it doesn't. The kernel releases a handle
+// asynchronously after the last close(2) for it returns.
+func (t *PoolFSTest) openConnsAfterRelease(expected int) (n int) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		n = t.pool.Open()
+		if n == expected || time.Now().After(deadline) {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PoolFSTest) ReadFiles() {
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	contents, err = ioutil.ReadFile(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// Closing the files released their connections.
+	ExpectEq(0, t.openConnsAfterRelease(0))
+}
+
+func (t *PoolFSTest) OpeningDoesntDial() {
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	ExpectEq(0, t.pool.Open())
+}
+
+func (t *PoolFSTest) IdleConnectionsAreClosed() {
+	f, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, f)
+	AssertEq(nil, err)
+
+	// Reading dials a connection.
+	ExpectEq("taco", t.readAll(f))
+	ExpectEq(1, t.pool.Open())
+
+	// Before the timeout, the connection is kept.
+	t.Clock.AdvanceTime(idleTimeout / 2)
+	t.fs.CloseIdleConns()
+	ExpectEq(1, t.pool.Open())
+
+	// Afterward it is closed, though the file is still open.
+	t.Clock.AdvanceTime(idleTimeout)
+	t.fs.CloseIdleConns()
+	ExpectEq(0, t.pool.Open())
+
+	// Reading again dials a new connection.
+	ExpectEq("taco", t.readAll(f))
+	ExpectEq(1, t.pool.Open())
+
+	// Closing the file releases it.
+	AssertEq(nil, f.Close())
+	t.ToClose = nil
+
+	ExpectEq(0, t.openConnsAfterRelease(0))
+}
+
+func (t *PoolFSTest) UseKeepsConnectionsOpen() {
+	foo, err := os.Open(path.Join(t.Dir, "foo"))
+	t.ToClose = append(t.ToClose, foo)
+	AssertEq(nil, err)
+
+	bar, err := os.Open(path.Join(t.Dir, "bar"))
+	t.ToClose = append(t.ToClose, bar)
+	AssertEq(nil, err)
+
+	// Read both files, then keep reading only one of them.
+	ExpectEq("taco", t.readAll(foo))
+	ExpectEq("burrito", t.readAll(bar))
+	ExpectEq(2, t.pool.Open())
+
+	t.Clock.AdvanceTime(idleTimeout / 2)
+	ExpectEq("burrito", t.readAll(bar))
+
+	t.Clock.AdvanceTime(idleTimeout / 2)
+	t.fs.CloseIdleConns()
+
+	// Only the idle one has been closed.
+	ExpectEq(1, t.pool.Open())
+}
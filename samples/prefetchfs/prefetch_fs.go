@@ -0,0 +1,282 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetchfs
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// The size of the file served by the file system.
+const FileSize = 1 << 20
+
+// The contents of the file, which repeat every 251 bytes so that misplaced
+// data is noticed.
+func FileContents() (p []byte) {
+	p = make([]byte, FileSize)
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+
+	return
+}
+
+const fooID = fuseops.RootInodeID + 1
+
+// PrefetchFS is a file system whose root contains a single read-only file
+// named "foo", with the contents given by FileContents, read from a backend
+// that takes a fixed time to answer each request. It demonstrates using
+// fuseutil.SequentialReadDetector to hide that latency from an application
+// reading the file sequentially.
+//
+// The file is opened in direct I/O mode, so that reads reach the file system
+// as the application issues them. When a read carries on from the previous
+// one on the same handle, the file system asks the backend for the same
+// amount of data following it, in the background. If the next read asks for
+// exactly that, it is served from the prefetched data, waiting for it to
+// arrive if need be. An application that does some work between reads
+// therefore waits for the backend only on its first read.
+type PrefetchFS interface {
+	fuseutil.FileSystem
+
+	// Return the number of prefetches that have been started, and the number
+	// of reads that have been served from them.
+	Stats() (prefetches int, hits int)
+}
+
+// Create a file system whose backend takes the supplied time to answer each
+// request.
+func NewPrefetchFS(latency time.Duration) PrefetchFS {
+	fs := &prefetchFS{
+		contents:   FileContents(),
+		latency:    latency,
+		reads:      fuseutil.NewSequentialReadDetector(),
+		prefetched: make(map[fuseops.HandleID]*prefetch),
+	}
+
+	return fs
+}
+
+type prefetchFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	contents []byte
+	latency  time.Duration
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	reads *fuseutil.SequentialReadDetector
+
+	mu sync.Mutex
+
+	// The most recent prefetch for each handle, if it hasn't been used yet.
+	//
+	// GUARDED_BY(mu)
+	prefetched map[fuseops.HandleID]*prefetch
+
+	// GUARDED_BY(mu)
+	nextHandle fuseops.HandleID
+
+	// GUARDED_BY(mu)
+	prefetches int
+
+	// GUARDED_BY(mu)
+	hits int
+}
+
+// Data being fetched from the backend ahead of a read.
+type prefetch struct {
+	offset int64
+	size   int
+
+	// Closed once data has been filled in.
+	done chan struct{}
+	data []byte
+}
+
+// Fetch the supplied range of the file from the backend, taking the
+// backend's latency to do so. The range is truncated at the end of the file.
+func (fs *prefetchFS) fetch(offset int64, size int) (data []byte) {
+	time.Sleep(fs.latency)
+
+	if offset >= int64(len(fs.contents)) {
+		return
+	}
+
+	end := offset + int64(size)
+	if end > int64(len(fs.contents)) {
+		end = int64(len(fs.contents))
+	}
+
+	data = fs.contents[offset:end]
+	return
+}
+
+func (fs *prefetchFS) attributes(inode fuseops.InodeID) (
+	attrs fuseops.InodeAttributes,
+	err error) {
+	switch inode {
+	case fuseops.RootInodeID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0555 | os.ModeDir,
+		}
+
+	case fooID:
+		attrs = fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0444,
+			Size:  uint64(len(fs.contents)),
+		}
+
+	default:
+		err = fuse.ENOENT
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *prefetchFS) Stats() (prefetches int, hits int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	prefetches = fs.prefetches
+	hits = fs.hits
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *prefetchFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *prefetchFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		err = fuse.ENOENT
+		return
+	}
+
+	op.Entry.Child = fooID
+	op.Entry.Attributes, err = fs.attributes(op.Entry.Child)
+	return
+}
+
+func (fs *prefetchFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	op.Attributes, err = fs.attributes(op.Inode)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *prefetchFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+
+	op.UseDirectIO = true
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *prefetchFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	sequential := fs.reads.Observe(op)
+
+	fs.mu.Lock()
+
+	// Claim the handle's prefetch, if it is for this read.
+	p := fs.prefetched[op.Handle]
+	delete(fs.prefetched, op.Handle)
+	if p != nil && (p.offset != op.Offset || p.size != len(op.Dst)) {
+		p = nil
+	}
+
+	if p != nil {
+		fs.hits++
+	}
+
+	// Start fetching what a sequential reader will want next.
+	next := op.Offset + int64(len(op.Dst))
+	if sequential && next < int64(len(fs.contents)) {
+		np := &prefetch{
+			offset: next,
+			size:   len(op.Dst),
+			done:   make(chan struct{}),
+		}
+
+		fs.prefetched[op.Handle] = np
+		fs.prefetches++
+
+		go func() {
+			np.data = fs.fetch(np.offset, np.size)
+			close(np.done)
+		}()
+	}
+
+	fs.mu.Unlock()
+
+	// Serve the read.
+	var data []byte
+	if p != nil {
+		<-p.done
+		data = p.data
+	} else {
+		data = fs.fetch(op.Offset, len(op.Dst))
+	}
+
+	op.BytesRead = copy(op.Dst, data)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *prefetchFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	fs.reads.Forget(op.Handle)
+
+	// Any prefetch in progress finishes in the background, and is discarded.
+	fs.mu.Lock()
+	delete(fs.prefetched, op.Handle)
+	fs.mu.Unlock()
+
+	return
+}
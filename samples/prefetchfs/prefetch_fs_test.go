@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prefetchfs_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/prefetchfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPrefetchFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const latency = 20 * time.Millisecond
+
+// The size of each read, which divides prefetchfs.FileSize.
+const readSize = 64 << 10
+
+const numReads = prefetchfs.FileSize / readSize
+
+type PrefetchFSTest struct {
+	samples.SampleTest
+	fs prefetchfs.PrefetchFS
+	f  *os.File
+}
+
+func init() { RegisterTestSuite(&PrefetchFSTest{}) }
+
+func (t *PrefetchFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.fs = prefetchfs.NewPrefetchFS(latency)
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+	t.SampleTest.SetUp(ti)
+
+	t.f, err = os.Open(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+}
+
+func (t *PrefetchFSTest) TearDown() {
+	t.f.Close()
+	t.SampleTest.TearDown()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefetchFSTest) SequentialReads() {
+	contents := make([]byte, prefetchfs.FileSize)
+
+	// Read the file in order, spending a while on each piece as an application
+	// processing it would, and timing how long the reads themselves take.
+	var waited time.Duration
+	for i := 0; i < numReads; i++ {
+		start := time.Now()
+		n, err := t.f.ReadAt(contents[i*readSize:(i+1)*readSize], int64(i*readSize))
+		waited += time.Since(start)
+
+		AssertEq(nil, err)
+		AssertEq(readSize, n)
+
+		time.Sleep(latency)
+	}
+
+	ExpectTrue(bytes.Equal(prefetchfs.FileContents(), contents))
+
+	// Every read but the last started a prefetch, and every read but the first
+	// was served from one.
+	prefetches, hits := t.fs.Stats()
+	ExpectEq(numReads-1, prefetches)
+	ExpectEq(numReads-1, hits)
+
+	// Without prefetching, each read would have taken at least the latency.
+	ExpectLt(waited, numReads*latency/2)
+}
+
+func (t *PrefetchFSTest) BackwardReads() {
+	buf := make([]byte, readSize)
+
+	// Read the file from its end to its start.
+	for i := numReads - 1; i >= 0; i-- {
+		n, err := t.f.ReadAt(buf, int64(i*readSize))
+		AssertEq(nil, err)
+		AssertEq(readSize, n)
+
+		ExpectTrue(bytes.Equal(prefetchfs.FileContents()[i*readSize:(i+1)*readSize], buf))
+	}
+
+	// Nothing was prefetched.
+	prefetches, hits := t.fs.Stats()
+	ExpectEq(0, prefetches)
+	ExpectEq(0, hits)
+}
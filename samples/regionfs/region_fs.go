@@ -0,0 +1,580 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regionfs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/jacobsa/syncutil"
+)
+
+// Create a file system whose root contains one directory for each of the
+// supplied names, each standing in for a separate storage backend (e.g. a
+// bucket in a different region). Each directory is a flat collection of
+// regular files kept in memory.
+//
+// Files can be renamed and hard linked within a region, but not between
+// regions, since no backend can hold a reference to another's data. Such
+// renames and links fail with EXDEV, just as they do between two different
+// file systems, and tools like mv(1) respond by copying the file and removing
+// the original.
+func NewRegionFS(
+	uid uint32,
+	gid uint32,
+	regions []string) fuse.Server {
+	fs := &regionFS{
+		uid:         uid,
+		gid:         gid,
+		regionIDs:   make(map[string]fuseops.InodeID),
+		regions:     make(map[fuseops.InodeID]*region),
+		inodes:      make(map[fuseops.InodeID]*inode),
+		nextInodeID: fuseops.RootInodeID + 1,
+	}
+
+	for _, name := range regions {
+		id := fs.nextInodeID
+		fs.nextInodeID++
+
+		fs.regionIDs[name] = id
+		fs.regions[id] = &region{
+			name:    name,
+			entries: make(map[string]fuseops.InodeID),
+		}
+	}
+
+	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
+
+	return fuseutil.NewFileSystemServer(fs)
+}
+
+type region struct {
+	name string
+
+	// The files in the region's directory.
+	entries map[string]fuseops.InodeID
+}
+
+type inode struct {
+	// The region directory in which the file lives. Every name for the file is
+	// in this region.
+	region fuseops.InodeID
+
+	attrs    fuseops.InodeAttributes
+	contents []byte
+
+	// The number of outstanding lookups by the kernel.
+	lookupCount uint64
+}
+
+type regionFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The owner of every inode.
+	uid uint32
+	gid uint32
+
+	mu syncutil.InvariantMutex
+
+	// The region directories, by name and by inode ID. These never change.
+	regionIDs map[string]fuseops.InodeID
+	regions   map[fuseops.InodeID]*region
+
+	// Every allocated file inode.
+	//
+	// INVARIANT: For each v, v.attrs.Nlink is the number of entries in
+	// regions[v.region] referring to it
+	// INVARIANT: For each k, k < nextInodeID
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inode
+
+	// GUARDED_BY(mu)
+	nextInodeID fuseops.InodeID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *regionFS) checkInvariants() {
+	links := make(map[fuseops.InodeID]uint32)
+	for regionID, r := range fs.regions {
+		for name, id := range r.entries {
+			in := fs.inodes[id]
+			if in == nil {
+				panic(fmt.Sprintf("Entry %s/%s: unknown inode %v", r.name, name, id))
+			}
+
+			if in.region != regionID {
+				panic(fmt.Sprintf("Entry %s/%s: inode %v is elsewhere", r.name, name, id))
+			}
+
+			links[id]++
+		}
+	}
+
+	for id, in := range fs.inodes {
+		// INVARIANT: For each v, v.attrs.Nlink is the number of entries in
+		// regions[v.region] referring to it
+		if in.attrs.Nlink != links[id] {
+			panic(fmt.Sprintf(
+				"Inode %v has link count %d but %d names",
+				id,
+				in.attrs.Nlink,
+				links[id]))
+		}
+
+		// INVARIANT: For each k, k < nextInodeID
+		if !(id < fs.nextInodeID) {
+			panic(fmt.Sprintf("Unexpectedly large inode ID: %v", id))
+		}
+	}
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *regionFS) getInodeOrDie(id fuseops.InodeID) (in *inode) {
+	in = fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return
+}
+
+// Return the region directory with the supplied ID, or ENOENT for anything
+// else (the root directory can't be modified).
+func (fs *regionFS) getRegion(id fuseops.InodeID) (r *region, err error) {
+	r = fs.regions[id]
+	if r == nil {
+		err = fuse.ENOENT
+		return
+	}
+
+	return
+}
+
+func (fs *regionFS) dirAttributes() fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: 2,
+		Mode:  os.ModeDir | 0777,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+	}
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *regionFS) fillEntry(
+	id fuseops.InodeID,
+	e *fuseops.ChildInodeEntry) {
+	e.Child = id
+
+	if _, ok := fs.regions[id]; ok {
+		e.Attributes = fs.dirAttributes()
+		return
+	}
+
+	in := fs.getInodeOrDie(id)
+	in.lookupCount++
+	e.Attributes = in.attrs
+}
+
+// Remove a name from the supplied region, freeing its inode if nothing else
+// refers to it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *regionFS) unlink(r *region, name string) {
+	id := r.entries[name]
+	in := fs.getInodeOrDie(id)
+
+	delete(r.entries, name)
+	in.attrs.Nlink--
+	in.attrs.Ctime = time.Now()
+
+	fs.maybeFree(id, in)
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *regionFS) maybeFree(id fuseops.InodeID, in *inode) {
+	if in.attrs.Nlink == 0 && in.lookupCount == 0 {
+		delete(fs.inodes, id)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *regionFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	return
+}
+
+func (fs *regionFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var id fuseops.InodeID
+	var ok bool
+
+	if op.Parent == fuseops.RootInodeID {
+		id, ok = fs.regionIDs[op.Name]
+	} else {
+		var r *region
+		r, err = fs.getRegion(op.Parent)
+		if err != nil {
+			return
+		}
+
+		id, ok = r.entries[op.Name]
+	}
+
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	fs.fillEntry(id, &op.Entry)
+	return
+}
+
+func (fs *regionFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.regions[op.Inode]; ok || op.Inode == fuseops.RootInodeID {
+		op.Attributes = fs.dirAttributes()
+		return
+	}
+
+	op.Attributes = fs.getInodeOrDie(op.Inode).attrs
+	return
+}
+
+func (fs *regionFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.inodes[op.Inode]
+	if in == nil {
+		err = fuse.EPERM
+		return
+	}
+
+	if op.Size != nil {
+		newSize := int(*op.Size)
+		if newSize <= len(in.contents) {
+			in.contents = in.contents[:newSize]
+		} else {
+			in.contents = append(
+				in.contents,
+				make([]byte, newSize-len(in.contents))...)
+		}
+
+		in.attrs.Size = uint64(newSize)
+		in.attrs.Mtime = time.Now()
+	}
+
+	if op.Mode != nil {
+		in.attrs.Mode = *op.Mode
+	}
+
+	if op.Atime != nil {
+		in.attrs.Atime = *op.Atime
+	}
+
+	if op.Mtime != nil {
+		in.attrs.Mtime = *op.Mtime
+	}
+
+	op.Attributes = in.attrs
+	return
+}
+
+func (fs *regionFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Directories live forever.
+	in := fs.inodes[op.Inode]
+	if in == nil {
+		return
+	}
+
+	if in.lookupCount < op.N {
+		panic(fmt.Sprintf(
+			"Overly large decrement for inode %v: %v, %v",
+			op.Inode,
+			in.lookupCount,
+			op.N))
+	}
+
+	in.lookupCount -= op.N
+	fs.maybeFree(op.Inode, in)
+
+	return
+}
+
+func (fs *regionFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	r, err := fs.getRegion(op.Parent)
+	if err != nil {
+		return
+	}
+
+	if _, ok := r.entries[op.Name]; ok {
+		err = fuse.EEXIST
+		return
+	}
+
+	now := time.Now()
+	id := fs.nextInodeID
+	fs.nextInodeID++
+
+	fs.inodes[id] = &inode{
+		region: op.Parent,
+		attrs: fuseops.InodeAttributes{
+			Nlink:  1,
+			Mode:   op.Mode,
+			Atime:  now,
+			Mtime:  now,
+			Ctime:  now,
+			Crtime: now,
+			Uid:    fs.uid,
+			Gid:    fs.gid,
+		},
+	}
+
+	r.entries[op.Name] = id
+	fs.fillEntry(id, &op.Entry)
+
+	return
+}
+
+func (fs *regionFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	r, err := fs.getRegion(op.Parent)
+	if err != nil {
+		return
+	}
+
+	in := fs.getInodeOrDie(op.Target)
+	if in.region != op.Parent {
+		err = fuse.EXDEV
+		return
+	}
+
+	if _, ok := r.entries[op.Name]; ok {
+		err = fuse.EEXIST
+		return
+	}
+
+	in.attrs.Nlink++
+	in.attrs.Ctime = time.Now()
+
+	r.entries[op.Name] = op.Target
+	fs.fillEntry(op.Target, &op.Entry)
+
+	return
+}
+
+func (fs *regionFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldRegion, err := fs.getRegion(op.OldParent)
+	if err != nil {
+		return
+	}
+
+	newRegion, err := fs.getRegion(op.NewParent)
+	if err != nil {
+		return
+	}
+
+	id, ok := oldRegion.entries[op.OldName]
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	// The data can't move between backends.
+	if oldRegion != newRegion {
+		err = fuse.EXDEV
+		return
+	}
+
+	// If the names already refer to the same inode, POSIX says to do nothing.
+	if target, ok := newRegion.entries[op.NewName]; ok {
+		if target == id {
+			return
+		}
+
+		fs.unlink(newRegion, op.NewName)
+	}
+
+	delete(oldRegion.entries, op.OldName)
+	newRegion.entries[op.NewName] = id
+	fs.getInodeOrDie(id).attrs.Ctime = time.Now()
+
+	return
+}
+
+func (fs *regionFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	r, err := fs.getRegion(op.Parent)
+	if err != nil {
+		return
+	}
+
+	if _, ok := r.entries[op.Name]; !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	fs.unlink(r, op.Name)
+	return
+}
+
+func (fs *regionFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	return
+}
+
+func (fs *regionFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Gather the directory's entries.
+	var entries map[string]fuseops.InodeID
+	dt := fuseutil.DT_File
+
+	if op.Inode == fuseops.RootInodeID {
+		entries = fs.regionIDs
+		dt = fuseutil.DT_Directory
+	} else {
+		var r *region
+		r, err = fs.getRegion(op.Inode)
+		if err != nil {
+			return
+		}
+
+		entries = r.entries
+	}
+
+	// Serve them in name order, so that offsets are stable as long as the
+	// directory isn't modified.
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for i := int(op.Offset); i < len(names); i++ {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1),
+			Inode:  entries[names[i]],
+			Name:   names[i],
+			Type:   dt,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return
+}
+
+func (fs *regionFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	return
+}
+
+func (fs *regionFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+	if op.Offset > int64(len(in.contents)) {
+		return
+	}
+
+	op.BytesRead = copy(op.Dst, in.contents[op.Offset:])
+	return
+}
+
+func (fs *regionFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in := fs.getInodeOrDie(op.Inode)
+
+	newLen := int(op.Offset) + len(op.Data)
+	if len(in.contents) < newLen {
+		in.contents = append(
+			in.contents,
+			make([]byte, newLen-len(in.contents))...)
+
+		in.attrs.Size = uint64(newLen)
+	}
+
+	copy(in.contents[op.Offset:], op.Data)
+	in.attrs.Mtime = time.Now()
+
+	return
+}
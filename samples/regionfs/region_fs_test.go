@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package regionfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/regionfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRegionFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type RegionFSTest struct {
+	samples.SampleTest
+}
+
+func init() { RegisterTestSuite(&RegionFSTest{}) }
+
+func (t *RegionFSTest) SetUp(ti *TestInfo) {
+	t.Server = regionfs.NewRegionFS(
+		uint32(os.Getuid()),
+		uint32(os.Getgid()),
+		[]string{"east", "west"})
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *RegionFSTest) nlink(p string) uint64 {
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+
+	return uint64(fi.Sys().(*syscall.Stat_t).Nlink)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RegionFSTest) ListRegions() {
+	entries, err := ioutil.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+
+	ExpectEq("east", entries[0].Name())
+	ExpectTrue(entries[0].IsDir())
+	ExpectEq("west", entries[1].Name())
+	ExpectTrue(entries[1].IsDir())
+}
+
+func (t *RegionFSTest) RenameWithinRegion() {
+	var err error
+	oldPath := path.Join(t.Dir, "east", "foo")
+	newPath := path.Join(t.Dir, "east", "bar")
+
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Rename(oldPath, newPath)
+	AssertEq(nil, err)
+
+	_, err = os.Stat(oldPath)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	contents, err := ioutil.ReadFile(newPath)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *RegionFSTest) RenameAcrossRegions() {
+	var err error
+	oldPath := path.Join(t.Dir, "east", "foo")
+	newPath := path.Join(t.Dir, "west", "foo")
+
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	// rename(2) itself refuses.
+	err = os.Rename(oldPath, newPath)
+	linkErr, ok := err.(*os.LinkError)
+	AssertTrue(ok, "Unexpected error: %v", err)
+	ExpectEq(syscall.EXDEV, linkErr.Err)
+
+	_, err = os.Stat(newPath)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	// mv falls back to copying.
+	out, err := exec.Command("mv", oldPath, newPath).CombinedOutput()
+	AssertEq(nil, err, "mv: %s", out)
+
+	_, err = os.Stat(oldPath)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	contents, err := ioutil.ReadFile(newPath)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *RegionFSTest) LinkWithinRegion() {
+	var err error
+	oldPath := path.Join(t.Dir, "east", "foo")
+	newPath := path.Join(t.Dir, "east", "bar")
+
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Link(oldPath, newPath)
+	AssertEq(nil, err)
+
+	ExpectEq(2, t.nlink(oldPath))
+	ExpectEq(2, t.nlink(newPath))
+}
+
+func (t *RegionFSTest) LinkAcrossRegions() {
+	var err error
+	oldPath := path.Join(t.Dir, "east", "foo")
+	newPath := path.Join(t.Dir, "west", "foo")
+
+	err = ioutil.WriteFile(oldPath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Link(oldPath, newPath)
+	linkErr, ok := err.(*os.LinkError)
+	AssertTrue(ok, "Unexpected error: %v", err)
+	ExpectEq(syscall.EXDEV, linkErr.Err)
+
+	ExpectEq(1, t.nlink(oldPath))
+
+	_, err = os.Stat(newPath)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
@@ -0,0 +1,619 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package slowfs contains a file system that wraps another, adding artificial
+// latency and errors to chosen op types. It is intended for seeing how an
+// application copes with a slow or flaky file system; see the slowfs type of
+// samples/mount_sample for a runnable mount.
+package slowfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+)
+
+// OpConfig describes the behaviour injected for one op type.
+type OpConfig struct {
+	// How long to wait before serving each op. If the op is interrupted while
+	// waiting, it fails with the context's error.
+	Delay time.Duration
+
+	// The probability, from 0 to 1, that an op fails with Errno after the delay
+	// instead of being passed to the wrapped file system.
+	ErrorProbability float64
+	Errno            syscall.Errno
+}
+
+// Config maps op type names, e.g. "ReadFileOp", to the behaviour to inject for
+// them. Op types that aren't listed are passed through unmodified.
+type Config map[string]OpConfig
+
+// ParseConfig reads a config in JSON form, for example:
+//
+//     {
+//       "ReadFileOp":    {"delay": "50ms"},
+//       "LookUpInodeOp": {"delay": "5ms", "error_probability": 0.1, "errno": 5}
+//     }
+//
+// Delays are in the form accepted by time.ParseDuration, and errnos are
+// numeric.
+func ParseConfig(r io.Reader) (cfg Config, err error) {
+	var raw map[string]struct {
+		Delay            string  `json:"delay"`
+		ErrorProbability float64 `json:"error_probability"`
+		Errno            int     `json:"errno"`
+	}
+
+	if err = json.NewDecoder(r).Decode(&raw); err != nil {
+		err = fmt.Errorf("Decode: %v", err)
+		return
+	}
+
+	cfg = make(Config)
+	for name, c := range raw {
+		oc := OpConfig{
+			ErrorProbability: c.ErrorProbability,
+			Errno:            syscall.Errno(c.Errno),
+		}
+
+		if c.Delay != "" {
+			oc.Delay, err = time.ParseDuration(c.Delay)
+			if err != nil {
+				err = fmt.Errorf("%s: %v", name, err)
+				return
+			}
+		}
+
+		cfg[name] = oc
+	}
+
+	return
+}
+
+// The op types that may be named in a Config, by name.
+var opTypes = make(map[string]reflect.Type)
+
+func init() {
+	for _, op := range []interface{}{
+		&fuseops.StatFSOp{},
+		&fuseops.LookUpInodeOp{},
+		&fuseops.GetInodeAttributesOp{},
+		&fuseops.SetInodeAttributesOp{},
+		&fuseops.ForgetInodeOp{},
+		&fuseops.BatchForgetOp{},
+		&fuseops.MkDirOp{},
+		&fuseops.MkNodeOp{},
+		&fuseops.CreateFileOp{},
+		&fuseops.CreateLinkOp{},
+		&fuseops.CreateSymlinkOp{},
+		&fuseops.RenameOp{},
+		&fuseops.RmDirOp{},
+		&fuseops.UnlinkOp{},
+		&fuseops.OpenDirOp{},
+		&fuseops.ReadDirOp{},
+		&fuseops.ReadDirPlusOp{},
+		&fuseops.ReleaseDirHandleOp{},
+		&fuseops.OpenFileOp{},
+		&fuseops.ReadFileOp{},
+		&fuseops.WriteFileOp{},
+		&fuseops.FallocateOp{},
+		&fuseops.CopyFileRangeOp{},
+		&fuseops.IoctlOp{},
+		&fuseops.PollOp{},
+		&fuseops.SyncFileOp{},
+		&fuseops.FlushFileOp{},
+		&fuseops.ReleaseFileHandleOp{},
+		&fuseops.ReadSymlinkOp{},
+		&fuseops.RemoveXattrOp{},
+		&fuseops.GetXattrOp{},
+		&fuseops.ListXattrOp{},
+		&fuseops.SetXattrOp{},
+		&fuseops.GetLockOp{},
+		&fuseops.SetLockOp{},
+		&fuseops.SetLockWaitOp{},
+	} {
+		t := reflect.TypeOf(op)
+		opTypes[t.Elem().Name()] = t
+	}
+}
+
+// NewSlowFS returns a file system that passes ops to the supplied one after
+// injecting the behaviour described by the config. It returns an error if the
+// config names an unknown op type.
+//
+// ForgetInodeOps and BatchForgetOps are always passed through immediately:
+// the kernel doesn't wait for them, and the server handles them
+// synchronously.
+func NewSlowFS(
+	wrapped fuseutil.FileSystem,
+	cfg Config) (fs fuseutil.FileSystem, err error) {
+	sfs := &slowFS{
+		wrapped: wrapped,
+		rules:   make(map[reflect.Type]OpConfig),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for name, oc := range cfg {
+		t, ok := opTypes[name]
+		if !ok {
+			err = fmt.Errorf("Unknown op type: %q", name)
+			return
+		}
+
+		if oc.ErrorProbability > 0 && oc.Errno == 0 {
+			err = fmt.Errorf("%s: error probability without an errno", name)
+			return
+		}
+
+		sfs.rules[t] = oc
+	}
+
+	fs = sfs
+	return
+}
+
+type slowFS struct {
+	wrapped fuseutil.FileSystem
+
+	// Immutable after construction.
+	rules map[reflect.Type]OpConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	rand *rand.Rand
+}
+
+// Wait for the delay configured for the supplied op, then return the error it
+// should fail with, or nil if it should be passed through.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *slowFS) slowDown(ctx context.Context, op interface{}) (err error) {
+	rule, ok := fs.rules[reflect.TypeOf(op)]
+	if !ok {
+		return
+	}
+
+	if rule.Delay > 0 {
+		timer := time.NewTimer(rule.Delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+	}
+
+	if rule.ErrorProbability > 0 {
+		fs.mu.Lock()
+		fire := fs.rand.Float64() < rule.ErrorProbability
+		fs.mu.Unlock()
+
+		if fire {
+			err = rule.Errno
+			return
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// File system methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *slowFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.StatFS(ctx, op)
+	return
+}
+
+func (fs *slowFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.LookUpInode(ctx, op)
+	return
+}
+
+func (fs *slowFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.GetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *slowFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.SetInodeAttributes(ctx, op)
+	return
+}
+
+func (fs *slowFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	err = fs.wrapped.ForgetInode(ctx, op)
+	return
+}
+
+func (fs *slowFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	err = fs.wrapped.BatchForget(ctx, op)
+	return
+}
+
+func (fs *slowFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.MkDir(ctx, op)
+	return
+}
+
+func (fs *slowFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.MkNode(ctx, op)
+	return
+}
+
+func (fs *slowFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.CreateFile(ctx, op)
+	return
+}
+
+func (fs *slowFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.CreateLink(ctx, op)
+	return
+}
+
+func (fs *slowFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.CreateSymlink(ctx, op)
+	return
+}
+
+func (fs *slowFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.Rename(ctx, op)
+	return
+}
+
+func (fs *slowFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.RmDir(ctx, op)
+	return
+}
+
+func (fs *slowFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.Unlink(ctx, op)
+	return
+}
+
+func (fs *slowFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.OpenDir(ctx, op)
+	return
+}
+
+func (fs *slowFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ReadDir(ctx, op)
+	return
+}
+
+func (fs *slowFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ReadDirPlus(ctx, op)
+	return
+}
+
+func (fs *slowFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ReleaseDirHandle(ctx, op)
+	return
+}
+
+func (fs *slowFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.OpenFile(ctx, op)
+	return
+}
+
+func (fs *slowFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ReadFile(ctx, op)
+	return
+}
+
+func (fs *slowFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.WriteFile(ctx, op)
+	return
+}
+
+func (fs *slowFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.Fallocate(ctx, op)
+	return
+}
+
+func (fs *slowFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.CopyFileRange(ctx, op)
+	return
+}
+
+func (fs *slowFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.Ioctl(ctx, op)
+	return
+}
+
+func (fs *slowFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.Poll(ctx, op)
+	return
+}
+
+func (fs *slowFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.SyncFile(ctx, op)
+	return
+}
+
+func (fs *slowFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.FlushFile(ctx, op)
+	return
+}
+
+func (fs *slowFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ReleaseFileHandle(ctx, op)
+	return
+}
+
+func (fs *slowFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ReadSymlink(ctx, op)
+	return
+}
+
+func (fs *slowFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.RemoveXattr(ctx, op)
+	return
+}
+
+func (fs *slowFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.GetXattr(ctx, op)
+	return
+}
+
+func (fs *slowFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.ListXattr(ctx, op)
+	return
+}
+
+func (fs *slowFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.SetXattr(ctx, op)
+	return
+}
+
+func (fs *slowFS) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.GetLock(ctx, op)
+	return
+}
+
+func (fs *slowFS) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.SetLock(ctx, op)
+	return
+}
+
+func (fs *slowFS) SetLockWait(
+	ctx context.Context,
+	op *fuseops.SetLockWaitOp) (err error) {
+	if err = fs.slowDown(ctx, op); err != nil {
+		return
+	}
+
+	err = fs.wrapped.SetLockWait(ctx, op)
+	return
+}
+
+func (fs *slowFS) Destroy() {
+	fs.wrapped.Destroy()
+}
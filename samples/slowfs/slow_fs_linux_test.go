@@ -0,0 +1,347 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slowfs_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/slowfs"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Direct I/O
+////////////////////////////////////////////////////////////////////////
+
+// The file size and the largest read the kernel is allowed to send, such that
+// it splits a read of the whole file into several ReadFileOps.
+const directIOFileSize = 1 << 15
+const directIOMaxRead = 1 << 12
+
+// A file system that wraps another, keeping track of the largest number of
+// ReadFileOps that it has seen in flight at once.
+type concurrencyFS struct {
+	fuseutil.FileSystem
+
+	mu          sync.Mutex
+	inFlight    int // GUARDED_BY(mu)
+	maxInFlight int // GUARDED_BY(mu)
+}
+
+func (fs *concurrencyFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	fs.mu.Lock()
+	fs.inFlight++
+	if fs.inFlight > fs.maxInFlight {
+		fs.maxInFlight = fs.inFlight
+	}
+	fs.mu.Unlock()
+
+	err = fs.FileSystem.ReadFile(ctx, op)
+
+	fs.mu.Lock()
+	fs.inFlight--
+	fs.mu.Unlock()
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *concurrencyFS) MaxInFlight() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.maxInFlight
+}
+
+// Create a file system containing a single large file named "foo", whose
+// reads are slow.
+func newDirectIOFS() (fs *concurrencyFS, err error) {
+	wrapped, err := fuseutil.ReadManifestFS(
+		strings.NewReader("file 0444 foo "+strings.Repeat("x", directIOFileSize)),
+		uint32(os.Getuid()),
+		uint32(os.Getgid()))
+
+	if err != nil {
+		return
+	}
+
+	slow, err := slowfs.NewSlowFS(wrapped, slowfs.Config{
+		"ReadFileOp": {Delay: 10 * time.Millisecond},
+	})
+
+	if err != nil {
+		return
+	}
+
+	fs = &concurrencyFS{FileSystem: slow}
+	return
+}
+
+// Read the whole of the supplied file with a single O_DIRECT read.
+func readDirect(name string) (err error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	buf := make([]byte, directIOFileSize)
+	_, err = f.ReadAt(buf, 0)
+	return
+}
+
+func directIOMountOptions() map[string]string {
+	return map[string]string{"max_read": strconv.Itoa(directIOMaxRead)}
+}
+
+type directIOTest struct {
+	samples.SampleTest
+	fs *concurrencyFS
+}
+
+func (t *directIOTest) setUp(ti *TestInfo, async bool) {
+	var err error
+
+	t.fs, err = newDirectIOFS()
+	AssertEq(nil, err)
+
+	t.MountConfig.EnableAsyncDirectIO = async
+	t.MountConfig.Options = directIOMountOptions()
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+	t.SampleTest.SetUp(ti)
+}
+
+type SyncDirectIOTest struct {
+	directIOTest
+}
+
+func init() { RegisterTestSuite(&SyncDirectIOTest{}) }
+
+func (t *SyncDirectIOTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, false)
+}
+
+func (t *SyncDirectIOTest) PiecesAreReadOneAtATime() {
+	AssertEq(nil, readDirect(path.Join(t.Dir, "foo")))
+	ExpectEq(1, t.fs.MaxInFlight())
+}
+
+type AsyncDirectIOTest struct {
+	directIOTest
+}
+
+func init() { RegisterTestSuite(&AsyncDirectIOTest{}) }
+
+func (t *AsyncDirectIOTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, true)
+}
+
+func (t *AsyncDirectIOTest) PiecesAreReadInParallel() {
+	AssertEq(nil, readDirect(path.Join(t.Dir, "foo")))
+	ExpectGt(t.fs.MaxInFlight(), 1)
+}
+
+// Read a large file with O_DIRECT from a slow file system, with and without
+// asynchronous direct I/O.
+func BenchmarkDirectIORead(b *testing.B) {
+	b.Run("sync", func(b *testing.B) {
+		benchmarkDirectIORead(b, &fuse.MountConfig{
+			Options: directIOMountOptions(),
+		})
+	})
+
+	b.Run("async", func(b *testing.B) {
+		benchmarkDirectIORead(b, &fuse.MountConfig{
+			Options:             directIOMountOptions(),
+			EnableAsyncDirectIO: true,
+		})
+	})
+}
+
+func benchmarkDirectIORead(b *testing.B, cfg *fuse.MountConfig) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "slow_fs_test")
+	if err != nil {
+		b.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs, err := newDirectIOFS()
+	if err != nil {
+		b.Fatalf("newDirectIOFS: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		b.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			b.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Read.
+	b.SetBytes(directIOFileSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := readDirect(path.Join(dir, "foo")); err != nil {
+			b.Fatalf("readDirect: %v", err)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Limiting ops in flight
+////////////////////////////////////////////////////////////////////////
+
+// The number of goroutines reading at once in the tests below.
+const parallelReaders = 8
+
+// Read the whole of the supplied file with O_DIRECT from parallelReaders
+// goroutines at once. Each read is split into pieces that are sent one at a
+// time, so there is one ReadFileOp in flight per goroutine.
+func readDirectInParallel(name string) (err error) {
+	errs := make(chan error, parallelReaders)
+	for i := 0; i < parallelReaders; i++ {
+		go func() { errs <- readDirect(name) }()
+	}
+
+	for i := 0; i < parallelReaders; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+type MaxOpsInFlightTest struct {
+	directIOTest
+}
+
+func init() { RegisterTestSuite(&MaxOpsInFlightTest{}) }
+
+const maxOpsInFlight = 2
+
+func (t *MaxOpsInFlightTest) SetUp(ti *TestInfo) {
+	t.MountConfig.MaxOpsInFlight = maxOpsInFlight
+	t.setUp(ti, false)
+}
+
+func (t *MaxOpsInFlightTest) ReadsRespectLimit() {
+	AssertEq(nil, readDirectInParallel(path.Join(t.Dir, "foo")))
+	ExpectEq(maxOpsInFlight, t.fs.MaxInFlight())
+}
+
+type UnlimitedOpsInFlightTest struct {
+	directIOTest
+}
+
+func init() { RegisterTestSuite(&UnlimitedOpsInFlightTest{}) }
+
+func (t *UnlimitedOpsInFlightTest) SetUp(ti *TestInfo) {
+	t.setUp(ti, false)
+}
+
+func (t *UnlimitedOpsInFlightTest) ReadsProceedInParallel() {
+	AssertEq(nil, readDirectInParallel(path.Join(t.Dir, "foo")))
+	ExpectGt(t.fs.MaxInFlight(), maxOpsInFlight)
+}
+
+// Read a large file with O_DIRECT from a slow file system from several
+// goroutines at once, with various limits on the number of ops in flight.
+func BenchmarkParallelDirectIORead(b *testing.B) {
+	for _, limit := range []int{1, 4, 0} {
+		name := fmt.Sprintf("max_ops_%d", limit)
+		if limit == 0 {
+			name = "unlimited"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			benchmarkParallelDirectIORead(b, &fuse.MountConfig{
+				Options:        directIOMountOptions(),
+				MaxOpsInFlight: limit,
+			})
+		})
+	}
+}
+
+func benchmarkParallelDirectIORead(b *testing.B, cfg *fuse.MountConfig) {
+	ctx := context.Background()
+
+	// Set up a temporary directory.
+	dir, err := ioutil.TempDir("", "slow_fs_test")
+	if err != nil {
+		b.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Mount.
+	fs, err := newDirectIOFS()
+	if err != nil {
+		b.Fatalf("newDirectIOFS: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		b.Fatalf("fuse.Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Join(ctx); err != nil {
+			b.Errorf("Joining: %v", err)
+		}
+	}()
+
+	defer fuse.Unmount(mfs.Dir())
+
+	// Read.
+	b.SetBytes(parallelReaders * directIOFileSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := readDirectInParallel(path.Join(dir, "foo")); err != nil {
+			b.Fatalf("readDirectInParallel: %v", err)
+		}
+	}
+}
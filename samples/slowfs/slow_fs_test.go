@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slowfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sbg/fuse"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/slowfs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSlowFS(t *testing.T) { RunTests(t) }
+
+const readDelay = 50 * time.Millisecond
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SlowFSTest struct {
+	samples.SampleTest
+}
+
+func init() { RegisterTestSuite(&SlowFSTest{}) }
+
+func (t *SlowFSTest) SetUp(ti *TestInfo) {
+	wrapped, err := fuseutil.ReadManifestFS(
+		strings.NewReader(`
+file 0444 foo     "taco"
+dir  0755 dir
+`),
+		uint32(os.Getuid()),
+		uint32(os.Getgid()))
+
+	AssertEq(nil, err)
+
+	fs, err := slowfs.NewSlowFS(wrapped, slowfs.Config{
+		"ReadFileOp": {Delay: readDelay},
+		"OpenDirOp":  {ErrorProbability: 1, Errno: syscall.EOWNERDEAD},
+	})
+
+	AssertEq(nil, err)
+
+	t.Server = fuseutil.NewFileSystemServer(fs)
+	t.SampleTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SlowFSTest) ReadsAreDelayed() {
+	before := time.Now()
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	elapsed := time.Since(before)
+
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+	ExpectGe(elapsed, readDelay)
+}
+
+func (t *SlowFSTest) OtherOpsAreNotDelayed() {
+	before := time.Now()
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+	elapsed := time.Since(before)
+
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+	ExpectLt(elapsed, readDelay)
+}
+
+func (t *SlowFSTest) ErrorsAreInjected() {
+	_, err := ioutil.ReadDir(path.Join(t.Dir, "dir"))
+	ExpectThat(err, Error(HasSubstr("owner died")))
+}
+
+func (t *SlowFSTest) ParseConfig() {
+	cfg, err := slowfs.ParseConfig(strings.NewReader(`{
+		"ReadFileOp":    {"delay": "50ms"},
+		"LookUpInodeOp": {"delay": "5ms", "error_probability": 0.1, "errno": 5}
+	}`))
+
+	AssertEq(nil, err)
+	ExpectEq(2, len(cfg))
+	ExpectEq(readDelay, cfg["ReadFileOp"].Delay)
+	ExpectEq(5*time.Millisecond, cfg["LookUpInodeOp"].Delay)
+	ExpectEq(0.1, cfg["LookUpInodeOp"].ErrorProbability)
+	ExpectEq(fuse.EIO, cfg["LookUpInodeOp"].Errno)
+
+	// Unknown op types are rejected.
+	_, err = slowfs.NewSlowFS(nil, slowfs.Config{"FrobnicateOp": {}})
+	ExpectThat(err, Error(HasSubstr("FrobnicateOp")))
+}
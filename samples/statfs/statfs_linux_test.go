@@ -16,11 +16,19 @@ package statfs_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
 	"regexp"
+	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/sbg/fuse/fuseops"
+	"github.com/sbg/fuse/fuseutil"
+	"github.com/sbg/fuse/samples"
+	"github.com/sbg/fuse/samples/statfs"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 )
 
@@ -86,6 +94,47 @@ func (t *StatFSTest) Syscall_NonZeroValues() {
 	ExpectEq(canned.InodesFree, stat.Ffree)
 }
 
+func (t *StatFSTest) FixedCapacity() {
+	// A realistic response: 10 GiB in 4 KiB blocks, a quarter of it used and a
+	// little more reserved for root, with a larger preferred I/O size.
+	const blockSize = 1 << 12
+	canned := fuseops.StatFSOp{
+		BlockSize: blockSize,
+		IoSize:    1 << 20,
+
+		Blocks:          10 << 30 / blockSize,
+		BlocksFree:      (10 << 30 / blockSize) * 3 / 4,
+		BlocksAvailable: (10<<30/blockSize)*3/4 - 1024,
+
+		Inodes:     1 << 20,
+		InodesFree: 1<<20 - 17,
+	}
+
+	t.fs.SetStatFSResponse(canned)
+
+	// Each field should reach statfs(2) where it belongs.
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(t.Dir, &stat)
+	AssertEq(nil, err)
+
+	ExpectEq(canned.BlockSize, stat.Frsize)
+	ExpectEq(canned.IoSize, stat.Bsize)
+	ExpectEq(canned.Blocks, stat.Blocks)
+	ExpectEq(canned.BlocksFree, stat.Bfree)
+	ExpectEq(canned.BlocksAvailable, stat.Bavail)
+	ExpectEq(canned.Inodes, stat.Files)
+	ExpectEq(canned.InodesFree, stat.Ffree)
+	ExpectEq(255, stat.Namelen)
+
+	// df should report the capacity in bytes, not scaled by the I/O size.
+	capacity, used, available, err := df(t.canonicalDir)
+	AssertEq(nil, err)
+
+	ExpectEq(10<<30, capacity)
+	ExpectEq(blockSize*(canned.Blocks-canned.BlocksFree), used)
+	ExpectEq(blockSize*canned.BlocksAvailable, available)
+}
+
 func (t *StatFSTest) BlockSizes() {
 	var err error
 
@@ -159,3 +208,57 @@ func (t *StatFSTest) IoSizes() {
 		ExpectEq(bs, stat.Bsize, "%s", desc)
 	}
 }
+
+////////////////////////////////////////////////////////////////////////
+// Read-only mounts
+////////////////////////////////////////////////////////////////////////
+
+type ReadOnlyStatFSTest struct {
+	samples.SampleTest
+	fs statfs.FS
+}
+
+var _ SetUpInterface = &ReadOnlyStatFSTest{}
+var _ TearDownInterface = &ReadOnlyStatFSTest{}
+
+func init() { RegisterTestSuite(&ReadOnlyStatFSTest{}) }
+
+func (t *ReadOnlyStatFSTest) SetUp(ti *TestInfo) {
+	t.MountConfig.ReadOnly = true
+
+	// Create the file system.
+	t.fs = statfs.New()
+	t.Server = fuseutil.NewFileSystemServer(t.fs)
+
+	// Mount it.
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *ReadOnlyStatFSTest) Syscall_ReportsReadOnly() {
+	var stat syscall.Statfs_t
+
+	// The fuse statfs reply has no flags field; the kernel fills in f_flag from
+	// the mount flags.
+	err := syscall.Statfs(t.Dir, &stat)
+	AssertEq(nil, err)
+
+	ExpectEq(unix.ST_RDONLY, stat.Flags&unix.ST_RDONLY)
+}
+
+func (t *ReadOnlyStatFSTest) MountOptionsIncludeReadOnly() {
+	contents, err := ioutil.ReadFile("/proc/self/mounts")
+	AssertEq(nil, err)
+
+	// Find the line for our mount point, whose options field is the fourth.
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != t.Dir {
+			continue
+		}
+
+		ExpectThat(strings.Split(fields[3], ","), Contains("ro"))
+		return
+	}
+
+	AddFailure("No mount found for %s in:\n%s", t.Dir, contents)
+}
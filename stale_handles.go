@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+// A staleHandleDetector watches the replies a file system sends for the
+// generation numbers it reports for each inode ID, and remembers the
+// generation that each file handle was opened against. A read or write on a
+// handle whose inode ID has since been reported with a different generation
+// indicates that the file system reallocated the ID while the handle was
+// still open. See MountConfig.DetectStaleHandles.
+type staleHandleDetector struct {
+	mu sync.Mutex
+
+	// The most recent generation reported for each inode ID. Entries are never
+	// removed, since a reallocation may follow a forget.
+	//
+	// GUARDED_BY(mu)
+	generations map[fuseops.InodeID]fuseops.GenerationNumber
+
+	// The inode and generation against which each open handle was minted.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]handleOrigin
+}
+
+type handleOrigin struct {
+	inode      fuseops.InodeID
+	generation fuseops.GenerationNumber
+}
+
+func newStaleHandleDetector() *staleHandleDetector {
+	return &staleHandleDetector{
+		generations: make(map[fuseops.InodeID]fuseops.GenerationNumber),
+		handles:     make(map[fuseops.HandleID]handleOrigin),
+	}
+}
+
+// Update state based on a successful reply to the supplied op, before the
+// reply is sent to the kernel. If the reply reveals that an inode ID has been
+// reallocated while handles are still open on the old incarnation, a
+// description of the problem is returned.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *staleHandleDetector) observeReply(op interface{}) (problem string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		problem = d.observeEntry(&typed.Entry)
+
+	case *fuseops.MkDirOp:
+		problem = d.observeEntry(&typed.Entry)
+
+	case *fuseops.MkNodeOp:
+		problem = d.observeEntry(&typed.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		problem = d.observeEntry(&typed.Entry)
+
+	case *fuseops.CreateLinkOp:
+		problem = d.observeEntry(&typed.Entry)
+
+	case *fuseops.CreateFileOp:
+		problem = d.observeEntry(&typed.Entry)
+		d.handles[typed.Handle] = handleOrigin{
+			inode:      typed.Entry.Child,
+			generation: typed.Entry.Generation,
+		}
+
+	case *fuseops.OpenFileOp:
+		d.handles[typed.Handle] = handleOrigin{
+			inode:      typed.Inode,
+			generation: d.generations[typed.Inode],
+		}
+
+	case *fuseops.ReleaseFileHandleOp:
+		delete(d.handles, typed.Handle)
+	}
+
+	return
+}
+
+// Return a description of the problem if the supplied handle was opened
+// against an earlier incarnation of the supplied inode ID.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *staleHandleDetector) check(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) (problem string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	origin, ok := d.handles[handle]
+	if !ok || origin.inode != inode {
+		return
+	}
+
+	if current := d.generations[inode]; current != origin.generation {
+		problem = fmt.Sprintf(
+			"handle %v was opened on inode %v generation %v, "+
+				"but the inode is now at generation %v",
+			handle,
+			inode,
+			origin.generation,
+			current)
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(d.mu)
+func (d *staleHandleDetector) observeEntry(
+	e *fuseops.ChildInodeEntry) (problem string) {
+	old, ok := d.generations[e.Child]
+	d.generations[e.Child] = e.Generation
+
+	if !ok || old == e.Generation {
+		return
+	}
+
+	// Are there any handles open on the old incarnation?
+	for h, origin := range d.handles {
+		if origin.inode == e.Child && origin.generation == old {
+			problem = fmt.Sprintf(
+				"inode %v reallocated as generation %v while handle %v "+
+					"on generation %v is still open",
+				e.Child,
+				e.Generation,
+				h,
+				old)
+
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"testing"
+
+	"github.com/sbg/fuse/fuseops"
+)
+
+func TestStaleHandleDetector_Reallocation(t *testing.T) {
+	c := &Connection{staleHandles: newStaleHandleDetector()}
+	d := c.staleHandles
+
+	const inode = 17
+	read := &fuseops.ReadFileOp{Inode: inode, Handle: 3}
+
+	// Look up the inode and open a handle on it.
+	lookUp := &fuseops.LookUpInodeOp{}
+	lookUp.Entry.Child = inode
+	lookUp.Entry.Generation = 1
+	if problem := d.observeReply(lookUp); problem != "" {
+		t.Fatalf("Unexpected problem on look up: %s", problem)
+	}
+
+	if problem := d.observeReply(&fuseops.OpenFileOp{Inode: inode, Handle: 3}); problem != "" {
+		t.Fatalf("Unexpected problem on open: %s", problem)
+	}
+
+	// Reads are fine.
+	if problem := c.checkStaleHandle(read); problem != "" {
+		t.Fatalf("Unexpected problem on read: %s", problem)
+	}
+
+	// The file system frees the inode and reuses its ID for a new file while the
+	// handle is still open.
+	create := &fuseops.CreateFileOp{Handle: 4}
+	create.Entry.Child = inode
+	create.Entry.Generation = 2
+	if problem := d.observeReply(create); problem == "" {
+		t.Errorf("Reallocation was not reported")
+	}
+
+	// Reads and writes on the old handle are now stale.
+	if problem := c.checkStaleHandle(read); problem == "" {
+		t.Errorf("Read on stale handle was not detected")
+	}
+
+	write := &fuseops.WriteFileOp{Inode: inode, Handle: 3}
+	if problem := c.checkStaleHandle(write); problem == "" {
+		t.Errorf("Write on stale handle was not detected")
+	}
+
+	// The new handle is fine.
+	read = &fuseops.ReadFileOp{Inode: inode, Handle: 4}
+	if problem := c.checkStaleHandle(read); problem != "" {
+		t.Errorf("Unexpected problem on new handle: %s", problem)
+	}
+}
+
+func TestStaleHandleDetector_Released(t *testing.T) {
+	c := &Connection{staleHandles: newStaleHandleDetector()}
+	d := c.staleHandles
+
+	const inode = 17
+
+	lookUp := &fuseops.LookUpInodeOp{}
+	lookUp.Entry.Child = inode
+	lookUp.Entry.Generation = 1
+	d.observeReply(lookUp)
+	d.observeReply(&fuseops.OpenFileOp{Inode: inode, Handle: 3})
+
+	// Once the handle has been released, reallocating the inode is legitimate.
+	d.observeReply(&fuseops.ReleaseFileHandleOp{Handle: 3})
+
+	lookUp.Entry.Generation = 2
+	if problem := d.observeReply(lookUp); problem != "" {
+		t.Errorf("Unexpected problem: %s", problem)
+	}
+}
+
+func TestStaleHandleDetector_Disabled(t *testing.T) {
+	c := &Connection{}
+
+	read := &fuseops.ReadFileOp{Inode: 17, Handle: 3}
+	if problem := c.checkStaleHandle(read); problem != "" {
+		t.Errorf("Unexpected problem: %s", problem)
+	}
+}
@@ -14,8 +14,33 @@
 
 package fuse
 
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
 // Unmount attempts to unmount the file system whose mount point is the
 // supplied directory.
+//
+// If the file system or a directory within it has been bind-mounted elsewhere,
+// the kernel keeps it alive until the bind mounts have been unmounted too.
+// Until then ops continue to arrive through them, and MountedFileSystem.Join
+// doesn't return.
+//
+// Unmount doesn't wait for the file system to finish serving ops; see
+// MountedFileSystem.Unmount for that.
 func Unmount(dir string) error {
 	return unmount(dir)
 }
+
+// Return true if the supplied error from unmount says that the file system is
+// in use. On Linux unmount runs fusermount, which reports this only in its
+// output, capitalized differently by different versions.
+func isBusy(err error) bool {
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EBUSY {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(err.Error()), "resource busy")
+}